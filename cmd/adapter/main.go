@@ -2,11 +2,14 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"net/http"
 	"os"
 
 	"github.com/kedacore/keda/pkg/handler"
 	kedaprovider "github.com/kedacore/keda/pkg/provider"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog"
 	"k8s.io/klog/klogr"
@@ -17,6 +20,7 @@ import (
 	"k8s.io/client-go/kubernetes/scheme"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 
 	basecmd "github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/cmd"
 	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
@@ -28,6 +32,9 @@ type Adapter struct {
 
 	// Message is printed on succesful startup
 	Message string
+
+	// MetricsPort serves the metrics of the scalers queried by the HPA on /metrics
+	MetricsPort int
 }
 
 var logger = klogr.New().WithName("keda_metrics_adapter")
@@ -70,16 +77,31 @@ func (a *Adapter) makeProviderOrDie() provider.MetricsProvider {
 	return kedaprovider.NewProvider(logger, handler, kubeclient, namespace)
 }
 
+// serveMetrics serves the controller-runtime registry the scalers register their metrics with, the adapter has no
+// manager to serve it like the operator does
+func (a *Adapter) serveMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+	address := fmt.Sprintf(":%d", a.MetricsPort)
+	go func() {
+		if err := http.ListenAndServe(address, mux); err != nil {
+			logger.Error(err, "unable to serve metrics", "address", address)
+		}
+	}()
+}
+
 func main() {
 	defer klog.Flush()
 
 	cmd := &Adapter{}
 	cmd.Flags().StringVar(&cmd.Message, "msg", "starting adapter...", "startup message")
+	cmd.Flags().IntVar(&cmd.MetricsPort, "metrics-port", 9022, "port the metrics of the scalers are served on at /metrics")
 	cmd.Flags().AddGoFlagSet(flag.CommandLine) // make sure we get the klog flags
 	cmd.Flags().Parse(os.Args)
 
 	kedaProvider := cmd.makeProviderOrDie()
 	cmd.WithExternalMetrics(kedaProvider)
+	cmd.serveMetrics()
 
 	logger.Info(cmd.Message)
 	if err := cmd.Run(wait.NeverStop); err != nil {
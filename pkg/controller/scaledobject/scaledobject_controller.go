@@ -8,6 +8,7 @@ import (
 	"github.com/go-logr/logr"
 	kedav1alpha1 "github.com/kedacore/keda/pkg/apis/keda/v1alpha1"
 	scalehandler "github.com/kedacore/keda/pkg/handler"
+	"github.com/kedacore/keda/pkg/scalers"
 	version "github.com/kedacore/keda/version"
 
 	autoscalingv2beta1 "k8s.io/api/autoscaling/v2beta1"
@@ -421,13 +422,19 @@ func (r *ReconcileScaledObject) getScaledObjectMetricSpecs(logger logr.Logger, s
 	var scaledObjectMetricSpecs []autoscalingv2beta1.MetricSpec
 	var externalMetricNames []string
 
-	scalers, _, err := scalehandler.NewScaleHandler(r.client, r.scheme).GetDeploymentScalers(scaledObject)
+	deploymentScalers, _, err := scalehandler.NewScaleHandler(r.client, r.scheme).GetDeploymentScalers(scaledObject)
 	if err != nil {
 		logger.Error(err, "Error getting scalers")
 		return nil, err
 	}
 
-	for _, scaler := range scalers {
+	// the scalers are checked on every reconcile, warn about the polling interval only once per generation
+	pollingInterval := scalehandler.GetPollingInterval(scaledObject)
+	checkPollingInterval, _ := r.scaledObjectGenerationChanged(logger, scaledObject)
+	for _, scaler := range deploymentScalers {
+		if checkPollingInterval {
+			scalers.CheckPollingInterval(logger, scaler, pollingInterval)
+		}
 		metricSpecs := scaler.GetMetricSpecForScaling()
 
 		// add the deploymentName label. This is how the MetricsAdapter will know which scaledobject a metric is for when the HPA queries it.
@@ -13,12 +13,7 @@ func (h *ScaleHandler) HandleScaleLoop(ctx context.Context, scaledObject *kedav1
 
 	h.handleScale(ctx, scaledObject)
 
-	var pollingInterval time.Duration
-	if scaledObject.Spec.PollingInterval != nil {
-		pollingInterval = time.Second * time.Duration(*scaledObject.Spec.PollingInterval)
-	} else {
-		pollingInterval = time.Second * time.Duration(defaultPollingInterval)
-	}
+	pollingInterval := GetPollingInterval(scaledObject)
 
 	h.logger.V(1).Info("Watching scaledObject with pollingInterval", "ScaledObject.PollingInterval", pollingInterval)
 
@@ -33,6 +28,14 @@ func (h *ScaleHandler) HandleScaleLoop(ctx context.Context, scaledObject *kedav1
 	}
 }
 
+// GetPollingInterval returns the interval the scaledObject's triggers are checked at
+func GetPollingInterval(scaledObject *kedav1alpha1.ScaledObject) time.Duration {
+	if scaledObject.Spec.PollingInterval != nil {
+		return time.Second * time.Duration(*scaledObject.Spec.PollingInterval)
+	}
+	return time.Second * time.Duration(defaultPollingInterval)
+}
+
 // handleScale contains the main logic for the ScaleHandler scaling logic.
 // It'll check each trigger active status then call scaleDeployment
 func (h *ScaleHandler) handleScale(ctx context.Context, scaledObject *kedav1alpha1.ScaledObject) {
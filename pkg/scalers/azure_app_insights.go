@@ -0,0 +1,366 @@
+package scalers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2018-03-01/insights"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/date"
+)
+
+const (
+	azureMonitorMetricSource = "azureMonitor"
+	appInsightsMetricSource  = "appInsights"
+)
+
+// appInsightsEndpoints are the endpoints of the App Insights metrics API per cloud, which are served from their own
+// host and not from Azure Resource Manager. The AAD token is requested for the endpoint as its resource.
+var appInsightsEndpoints = map[string]string{
+	"AzurePublicCloud":       "https://api.applicationinsights.io",
+	"AzureUSGovernmentCloud": "https://api.applicationinsights.us",
+	"AzureChinaCloud":        "https://api.applicationinsights.azure.cn",
+}
+
+// appInsightsAggregations maps the metricAggregationType to the aggregation names of the App Insights metrics API
+var appInsightsAggregations = map[insights.AggregationType]string{
+	insights.Average: "avg",
+	insights.Total:   "sum",
+	insights.Maximum: "max",
+	insights.Minimum: "min",
+	insights.Count:   "count",
+}
+
+// appInsightsClient queries the App Insights metrics API of a single application, authenticating with either
+// an API key or an AAD authorizer
+type appInsightsClient struct {
+	baseURI    string
+	appID      string
+	apiKey     string
+	userAgent  string
+	authorizer autorest.Authorizer
+	sender     autorest.Sender
+}
+
+// appInsightsMetricsResponse is the body of a metrics call without segments: the window and one aggregated value per aggregation
+type appInsightsMetricsResponse struct {
+	Value map[string]json.RawMessage `json:"value"`
+}
+
+type appInsightsErrorResponse struct {
+	Error *azure.ServiceError `json:"error"`
+}
+
+// getAppInsightsMetricValue queries an App Insights metric and returns its value after the same extraction,
+// rate and multiplier handling as Azure Monitor metrics
+func getAppInsightsMetricValue(ctx context.Context, metricMetadata *azureMonitorMetadata, sender autorest.Sender) (float64, error) {
+	client, err := createAppInsightsClient(metricMetadata, sender)
+	if err != nil {
+		return 0, err
+	}
+
+	requestPtr, err := createAppInsightsRequest(metricMetadata)
+	if err != nil {
+		return 0, err
+	}
+
+	return executeAppInsightsRequest(ctx, client, requestPtr)
+}
+
+// parseAppInsightsMetadata reads the application to query and its API key, which can come from the trigger
+// authentication or from an environment variable of the scale target
+func parseAppInsightsMetadata(meta *azureMonitorMetadata, metadata, resolvedEnv, authParams map[string]string) error {
+	if val, ok := authParams["appInsightsAppId"]; ok && val != "" {
+		meta.appInsightsAppID = val
+	} else if val, ok := metadata["appInsightsAppId"]; ok && val != "" {
+		meta.appInsightsAppID = val
+	} else {
+		return fmt.Errorf("no appInsightsAppId given")
+	}
+
+	if val, ok := authParams["appInsightsApiKey"]; ok && val != "" {
+		meta.appInsightsAPIKey = val
+	} else if val, ok := metadata["appInsightsApiKeyFromEnv"]; ok && val != "" {
+		apiKey, ok := resolvedEnv[val]
+		if !ok || apiKey == "" {
+			return fmt.Errorf("no appInsightsApiKey found in environment variable %s", val)
+		}
+		meta.appInsightsAPIKey = apiKey
+	}
+	return nil
+}
+
+// validateAppInsightsMetadata rejects the settings that only apply to Azure Monitor platform metrics
+func validateAppInsightsMetadata(meta *azureMonitorMetadata) error {
+	if _, ok := appInsightsAggregations[meta.aggregationType]; !ok {
+		return fmt.Errorf("metricAggregationType %s is not supported by app insights", meta.aggregationType)
+	}
+	if meta.dimensionGroupBy != "" {
+		return fmt.Errorf("dimensionGroupBy is not supported by app insights")
+	}
+	if meta.validateMetricDefinition {
+		return fmt.Errorf("validateMetricDefinition is not supported by app insights")
+	}
+	if meta.aggregationGranularity != "" {
+		return fmt.Errorf("aggregationGranularity is not supported by app insights")
+	}
+	return nil
+}
+
+// validateAppInsightsAccess reads the metrics metadata of the application, which checks the credentials without querying a metric
+func validateAppInsightsAccess(ctx context.Context, metricMetadata *azureMonitorMetadata, sender autorest.Sender) error {
+	client, err := createAppInsightsClient(metricMetadata, sender)
+	if err != nil {
+		return err
+	}
+
+	timeout := metricMetadata.azureMonitorRequestTimeout
+	if timeout <= 0 {
+		timeout = defaultAzureMonitorRequestTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var result json.RawMessage
+	err = client.get(ctx, fmt.Sprintf("%s/v1/apps/%s/metrics/metadata", client.baseURI, url.PathEscape(client.appID)), &result)
+	if err == nil {
+		return nil
+	}
+
+	if detailedErr, ok := err.(autorest.DetailedError); ok && (detailedErr.StatusCode == http.StatusForbidden || detailedErr.StatusCode == http.StatusUnauthorized) {
+		return fmt.Errorf("error validating app insights access to %s: %v: %w", client.appID, describeAzureMonitorError(err), ErrAzureMonitorPermissionDenied)
+	}
+	return fmt.Errorf("error validating app insights access to %s: %w", client.appID, describeAzureMonitorError(err))
+}
+
+func createAppInsightsClient(metadata *azureMonitorMetadata, sender autorest.Sender) (appInsightsClient, error) {
+	env, err := getAzureMonitorEnvironment(metadata.cloud)
+	if err != nil {
+		return appInsightsClient{}, err
+	}
+	endpoint, ok := appInsightsEndpoints[env.Name]
+	if !ok {
+		return appInsightsClient{}, fmt.Errorf("app insights is not available in azure cloud %s", env.Name)
+	}
+
+	client := appInsightsClient{
+		baseURI:   endpoint,
+		appID:     metadata.appInsightsAppID,
+		apiKey:    metadata.appInsightsAPIKey,
+		userAgent: getAzureMonitorUserAgent(metadata),
+		sender:    getAzureMonitorSender(metadata, sender),
+	}
+	if metadata.endpointOverride != "" {
+		client.baseURI = metadata.endpointOverride
+	}
+	client.baseURI = strings.TrimSuffix(client.baseURI, "/")
+
+	// an API key is sent as a header, without it the call is authorized with an AAD token for App Insights
+	if client.apiKey != "" {
+		return client, nil
+	}
+
+	if metadata.clientSecretFile != "" {
+		secret, err := azureMonitorSecretFiles.read(metadata.clientSecretFile)
+		if err != nil {
+			return client, err
+		}
+		withSecret := *metadata
+		withSecret.clientPassword = secret
+		metadata = &withSecret
+	}
+
+	authorizer, err := azureMonitorAuthorizers.get(metadata, env, endpoint)
+	if err != nil {
+		return client, fmt.Errorf("error creating app insights authorizer: %s", err)
+	}
+	client.authorizer = authorizer
+
+	return client, nil
+}
+
+func createAppInsightsRequest(metadata *azureMonitorMetadata) (*azureExternalMetricRequest, error) {
+	metricRequest := azureExternalMetricRequest{
+		MetricName:          metadata.name,
+		Aggregation:         metadata.aggregationType,
+		Filter:              metadata.filter,
+		Timeout:             metadata.azureMonitorRequestTimeout,
+		MaxRetries:          metadata.maxRetries,
+		ResultAsRate:        metadata.metricResultAsRate,
+		ValueMultiplier:     metadata.metricValueMultiplier,
+		IgnoreNullValues:    metadata.ignoreNullValues,
+		DebugLogRawResponse: metadata.debugLogRawResponse,
+	}
+
+	timespan, err := formatTimeSpanAt(metadata.aggregationInterval, metadata.aggregationDelay, metadata.maxMetricRetention, metadata.alignToMinute, metadata.queryTime())
+	if err != nil {
+		return nil, err
+	}
+	metricRequest.Timespan = timespan
+
+	window, err := getAggregationWindow(metadata.aggregationInterval)
+	if err != nil {
+		return nil, err
+	}
+	metricRequest.Window = window
+	metricRequest.RateWindow = getRateWindow(window, metadata.granularity)
+
+	return &metricRequest, nil
+}
+
+func executeAppInsightsRequest(ctx context.Context, client appInsightsClient, request *azureExternalMetricRequest) (float64, error) {
+	ctx, span := startAzureMonitorQuerySpan(ctx, "apps/"+client.appID, *request)
+	metricResult, err := listAppInsightsMetric(ctx, client, *request)
+	endAzureMonitorQuerySpan(span, err)
+	if err != nil {
+		azureMonitorLog.Error(err, "error getting app insights metric")
+		return 0, fmt.Errorf("Error getting app insights metric %s: %w", request.MetricName, describeAzureMonitorError(err))
+	}
+
+	metricResponse, err := extractMetricValue(*request, metricResult)
+	if err != nil {
+		return 0, fmt.Errorf("Error getting app insights metric %s: %w", request.MetricName, err)
+	}
+
+	return transformMetricValue(*request, metricResponse.Value), nil
+}
+
+// listAppInsightsMetric queries App Insights for the metric, retrying throttled and failed server side calls, and
+// returns the result in the shape of an Azure Monitor response so extractValue can read it
+func listAppInsightsMetric(ctx context.Context, client appInsightsClient, azMetricRequest azureExternalMetricRequest) (insights.Response, error) {
+	if azMetricRequest.MetricName == "" {
+		return insights.Response{}, fmt.Errorf("metricName is required")
+	}
+	aggregation, ok := appInsightsAggregations[azMetricRequest.Aggregation]
+	if !ok {
+		return insights.Response{}, fmt.Errorf("metricAggregationType %s is not supported by app insights", azMetricRequest.Aggregation)
+	}
+
+	azureMonitorLog.V(2).Info("querying app insights metric", "appId", client.appID, "metricName", azMetricRequest.MetricName, "aggregation", aggregation)
+
+	timeout := azMetricRequest.Timeout
+	if timeout <= 0 {
+		timeout = defaultAzureMonitorRequestTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	query := url.Values{"timespan": {azMetricRequest.Timespan}, "aggregation": {aggregation}}
+	if azMetricRequest.Filter != "" {
+		query.Set("filter", azMetricRequest.Filter)
+	}
+	requestURL := fmt.Sprintf("%s/v1/apps/%s/metrics/%s?%s", client.baseURI, url.PathEscape(client.appID), azMetricRequest.MetricName, query.Encode())
+
+	var metricResult appInsightsMetricsResponse
+	err := retryAzureMonitorCall(ctx, azMetricRequest.MaxRetries, func() error {
+		metricResult = appInsightsMetricsResponse{}
+		return client.get(ctx, requestURL, &metricResult)
+	})
+	if err != nil {
+		return insights.Response{}, err
+	}
+
+	response, err := toAzureMonitorResponse(azMetricRequest.MetricName, aggregation, metricResult)
+	if err == nil && azMetricRequest.DebugLogRawResponse {
+		logRawAzureMonitorResponse(response)
+	}
+	return response, err
+}
+
+// get sends the request and decodes the response, failures are returned as autorest.DetailedError so they are
+// retried and described like the errors of the Azure Monitor SDK
+func (c appInsightsClient) get(ctx context.Context, requestURL string, result interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, requestURL, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", c.userAgent)
+	if c.apiKey != "" {
+		req.Header.Set("x-api-key", c.apiKey)
+	} else if c.authorizer != nil {
+		req, err = autorest.Prepare(req, c.authorizer.WithAuthorization())
+		if err != nil {
+			return fmt.Errorf("error authorizing app insights request: %s", err)
+		}
+	}
+
+	resp, err := c.sender.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		errorResponse := appInsightsErrorResponse{}
+		_ = json.Unmarshal(body, &errorResponse)
+		return autorest.DetailedError{
+			Original:    &azure.RequestError{ServiceError: errorResponse.Error},
+			PackageType: "scalers.appInsightsClient",
+			Method:      "get",
+			StatusCode:  resp.StatusCode,
+			Message:     "Failure responding to request",
+			Response:    resp,
+		}
+	}
+
+	if err := json.Unmarshal(body, result); err != nil {
+		return fmt.Errorf("error decoding app insights response: %s", err)
+	}
+	return nil
+}
+
+// toAzureMonitorResponse turns the aggregated App Insights value into a single data point timestamped at the end
+// of the window. A metric without a value becomes a timeseries without data, which extractValue reports as ErrNoMetricData.
+func toAzureMonitorResponse(metricName string, aggregation string, metricResult appInsightsMetricsResponse) (insights.Response, error) {
+	aggregations := map[string]*float64{}
+	if raw, ok := metricResult.Value[metricName]; ok {
+		if err := json.Unmarshal(raw, &aggregations); err != nil {
+			return insights.Response{}, fmt.Errorf("error decoding app insights metric %s: %s", metricName, err)
+		}
+	}
+
+	var data *[]insights.MetricValue
+	if value := aggregations[aggregation]; value != nil {
+		metricValue := insights.MetricValue{}
+		switch aggregation {
+		case "avg":
+			metricValue.Average = value
+		case "sum":
+			metricValue.Total = value
+		case "max":
+			metricValue.Maximum = value
+		case "min":
+			metricValue.Minimum = value
+		case "count":
+			count := int64(math.Round(*value))
+			metricValue.Count = &count
+		}
+
+		var end string
+		if raw, ok := metricResult.Value["end"]; ok && json.Unmarshal(raw, &end) == nil {
+			if timestamp, err := time.Parse(time.RFC3339, end); err == nil {
+				metricValue.TimeStamp = &date.Time{Time: timestamp}
+			}
+		}
+		data = &[]insights.MetricValue{metricValue}
+	}
+
+	return insights.Response{Value: &[]insights.Metric{{
+		Name:       &insights.LocalizableString{Value: &metricName},
+		Timeseries: &[]insights.TimeSeriesElement{{Data: data}},
+	}}}, nil
+}
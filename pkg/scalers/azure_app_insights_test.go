@@ -0,0 +1,169 @@
+package scalers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2018-03-01/insights"
+	"go.uber.org/goleak"
+)
+
+type appInsightsMetricTestData struct {
+	name                string
+	aggregation         insights.AggregationType
+	expectedAggregation string
+	response            string
+	expectedValue       float64
+	isError             bool
+}
+
+var testAppInsightsMetrics = []appInsightsMetricTestData{
+	{"sum", insights.Total, "sum", `{"value":{"start":"2020-04-01T10:00:00Z","end":"2020-04-01T10:05:00Z","requests/count":{"sum":42}}}`, 42, false},
+	{"avg", insights.Average, "avg", `{"value":{"start":"2020-04-01T10:00:00Z","end":"2020-04-01T10:05:00Z","requests/count":{"avg":2.5}}}`, 2.5, false},
+	{"count", insights.Count, "count", `{"value":{"start":"2020-04-01T10:00:00Z","end":"2020-04-01T10:05:00Z","requests/count":{"count":7}}}`, 7, false},
+	{"missing aggregation", insights.Maximum, "max", `{"value":{"start":"2020-04-01T10:00:00Z","end":"2020-04-01T10:05:00Z","requests/count":{"sum":42}}}`, 0, true},
+	{"missing metric", insights.Total, "sum", `{"value":{"start":"2020-04-01T10:00:00Z","end":"2020-04-01T10:05:00Z"}}`, 0, true},
+}
+
+func TestAppInsightsGetMetricValue(t *testing.T) {
+	for _, testData := range testAppInsightsMetrics {
+		var request *http.Request
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			request = r
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(testData.response))
+		}))
+
+		metadata := &azureMonitorMetadata{
+			metricSource:          appInsightsMetricSource,
+			appInsightsAppID:      "app-id",
+			appInsightsAPIKey:     "API_KEY",
+			endpointOverride:      server.URL,
+			name:                  "requests/count",
+			aggregationType:       testData.aggregation,
+			metricValueMultiplier: 1,
+		}
+		value, err := getAzureMetricValue(context.Background(), metadata, server.Client())
+		server.Close()
+
+		if err != nil && !testData.isError {
+			t.Errorf("%s: expected success but got error %v", testData.name, err)
+			continue
+		}
+		if testData.isError {
+			if err == nil {
+				t.Errorf("%s: expected error but got success", testData.name)
+			}
+			continue
+		}
+		if value != testData.expectedValue {
+			t.Errorf("%s: expected %v but got %v", testData.name, testData.expectedValue, value)
+		}
+		if request.URL.Path != "/v1/apps/app-id/metrics/requests/count" {
+			t.Errorf("%s: expected the App Insights metrics path but got %s", testData.name, request.URL.Path)
+		}
+		if apiKey := request.Header.Get("x-api-key"); apiKey != "API_KEY" {
+			t.Errorf("%s: expected the API key header but got %q", testData.name, apiKey)
+		}
+		if aggregation := request.URL.Query().Get("aggregation"); aggregation != testData.expectedAggregation {
+			t.Errorf("%s: expected aggregation %s but got %s", testData.name, testData.expectedAggregation, aggregation)
+		}
+	}
+}
+
+func TestAppInsightsGetMetricValueIgnoreNullValues(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"value":{"start":"2020-04-01T10:00:00Z","end":"2020-04-01T10:05:00Z","requests/count":{"sum":null}}}`))
+	}))
+	defer server.Close()
+
+	metadata := &azureMonitorMetadata{metricSource: appInsightsMetricSource, appInsightsAppID: "app-id", appInsightsAPIKey: "API_KEY", endpointOverride: server.URL, name: "requests/count", aggregationType: insights.Total}
+	if _, err := getAzureMetricValue(context.Background(), metadata, server.Client()); !errors.Is(err, ErrNoMetricData) {
+		t.Errorf("Expected ErrNoMetricData for a metric without a value but got %v", err)
+	}
+
+	metadata.ignoreNullValues = true
+	value, err := getAzureMetricValue(context.Background(), metadata, server.Client())
+	if err != nil {
+		t.Fatal("Expected success with ignoreNullValues but got error", err)
+	}
+	if value != 0 {
+		t.Errorf("Expected 0 with ignoreNullValues but got %v", value)
+	}
+}
+
+func TestAppInsightsValidateAccessForbidden(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/apps/app-id/metrics/metadata" {
+			t.Errorf("Expected the metrics metadata path but got %s", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"error":{"code":"InsufficientAccessError","message":"The provided credentials have insufficient access"}}`))
+	}))
+	defer server.Close()
+
+	metadata := &azureMonitorMetadata{metricSource: appInsightsMetricSource, appInsightsAppID: "app-id", appInsightsAPIKey: "API_KEY", endpointOverride: server.URL}
+	err := validateAzureMonitorAccess(context.Background(), metadata, server.Client())
+	if !errors.Is(err, ErrAzureMonitorPermissionDenied) {
+		t.Errorf("Expected ErrAzureMonitorPermissionDenied but got %v", err)
+	}
+}
+
+func TestAppInsightsGetMetricValueDeadline(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+	server := newSlowAzMonitorServer()
+	httpClient := newAzureMonitorHTTPClient("")
+
+	metadata := &azureMonitorMetadata{metricSource: appInsightsMetricSource, appInsightsAppID: "app-id", appInsightsAPIKey: "API_KEY", endpointOverride: server.URL, name: "requests/count", aggregationType: insights.Total}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := getAzureMetricValue(ctx, metadata, httpClient)
+	elapsed := time.Since(start)
+
+	if err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Errorf("Expected the deadline to abort the query but got %v", err)
+	}
+	if elapsed > time.Second {
+		t.Errorf("Expected the query to return promptly after the deadline but it took %s", elapsed)
+	}
+
+	httpClient.CloseIdleConnections()
+	server.Close()
+}
+
+func TestAppInsightsClientEndpointPerCloud(t *testing.T) {
+	for cloud, endpoint := range appInsightsEndpoints {
+		metadata := &azureMonitorMetadata{metricSource: appInsightsMetricSource, appInsightsAppID: "app-id", appInsightsAPIKey: "API_KEY", cloud: cloud}
+		client, err := createAppInsightsClient(metadata, nil)
+		if err != nil {
+			t.Fatalf("%s: expected success but got error %v", cloud, err)
+		}
+		if client.baseURI != endpoint {
+			t.Errorf("%s: expected the endpoint %s but got %s", cloud, endpoint, client.baseURI)
+		}
+
+		// without an API key the token is requested for the endpoint of the cloud
+		metadata = &azureMonitorMetadata{metricSource: appInsightsMetricSource, appInsightsAppID: "app-id", cloud: cloud, tenantID: "tenant", clientID: "cloud-" + cloud, clientPassword: "password"}
+		if _, err := createAppInsightsClient(metadata, nil); err != nil {
+			t.Fatalf("%s: expected success but got error %v", cloud, err)
+		}
+		azureMonitorAuthorizers.lock.Lock()
+		_, ok := azureMonitorAuthorizers.entries[azureMonitorAuthorizerKey{tenantID: "tenant", clientID: "cloud-" + cloud, cloud: cloud, resource: endpoint}]
+		azureMonitorAuthorizers.lock.Unlock()
+		if !ok {
+			t.Errorf("%s: expected an authorizer for the resource %s", cloud, endpoint)
+		}
+	}
+
+	metadata := &azureMonitorMetadata{metricSource: appInsightsMetricSource, appInsightsAppID: "app-id", appInsightsAPIKey: "API_KEY", cloud: "AzureGermanCloud"}
+	if _, err := createAppInsightsClient(metadata, nil); err == nil {
+		t.Error("Expected an error for a cloud without app insights")
+	}
+}
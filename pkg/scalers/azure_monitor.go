@@ -1,150 +1,2241 @@
 package scalers
 
 import (
+	"bytes"
 	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
+	"unicode/utf8"
 
 	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2018-03-01/insights"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-05-01/resources"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/Azure/go-autorest/autorest/azure/auth"
-	"k8s.io/klog"
+	"github.com/kedacore/keda/version"
 )
 
 // Much of the code in this file is taken from the Azure Kubernetes Metrics Adapter
 // https://github.com/Azure/azure-k8s-metrics-adapter/tree/master/pkg/azure/externalmetrics
 
+const (
+	defaultAzureMonitorRequestTimeout = 30 * time.Second
+	defaultAzureMonitorCloud          = "AzurePublicCloud"
+	defaultAzureMonitorMaxRetries     = 3
+	// many platform metrics are only updated once a minute
+	defaultAzureMonitorMetricCacheTTL = 30 * time.Second
+	// Azure Monitor aggregates platform metrics per minute at best
+	defaultAzureMonitorGranularity = time.Minute
+	// platform metrics are kept for 93 days, older data points can't be queried
+	defaultAzureMonitorMaxRetention = 93 * 24 * time.Hour
+	// the window queried when a trigger sets neither metricAggregationInterval nor defaultAggregationWindow
+	defaultAzureMonitorAggregationWindow = 5 * time.Minute
+	// how long fallbackOnError keeps reporting the last value while Azure Monitor queries fail
+	defaultAzureMonitorFallbackMaxAge = 5 * time.Minute
+	// metric definitions only change when Azure adds metrics to a resource type
+	defaultAzureMonitorMetricDefinitionsTTL = time.Hour
+	// a percentile is computed from the per minute data points unless the trigger sets aggregationGranularity
+	defaultAzureMonitorPercentileGranularity = "PT1M"
+	// IMDS answers from the host, a slow answer means there is no IMDS
+	defaultAzureMonitorIMDSTimeout = 2 * time.Second
+)
+
+// the scopes a resource can live at, a subscription scoped resource is not part of a resource group
+const (
+	azureMonitorResourceGroupScope = "resourceGroup"
+	azureMonitorSubscriptionScope  = "subscription"
+)
+
+// azureMonitorRegions are the regions with a regional Resource Manager endpoint, per cloud. Queries for a region
+// outside of these go to the global endpoint of the cloud.
+var azureMonitorRegions = map[string]map[string]bool{
+	"AzurePublicCloud": {
+		"eastus": true, "eastus2": true, "westus": true, "westus2": true, "westus3": true, "centralus": true,
+		"northcentralus": true, "southcentralus": true, "westcentralus": true, "canadacentral": true, "canadaeast": true,
+		"brazilsouth": true, "northeurope": true, "westeurope": true, "uksouth": true, "ukwest": true,
+		"francecentral": true, "germanywestcentral": true, "switzerlandnorth": true, "norwayeast": true,
+		"swedencentral": true, "eastasia": true, "southeastasia": true, "japaneast": true, "japanwest": true,
+		"koreacentral": true, "australiaeast": true, "australiasoutheast": true, "centralindia": true,
+		"southindia": true, "southafricanorth": true, "uaenorth": true,
+	},
+	"AzureUSGovernmentCloud": {
+		"usgovvirginia": true, "usgovarizona": true, "usgovtexas": true,
+	},
+}
+
+// azureMonitorIMDSEndpoint is the instance metadata endpoint of Azure VMs, the subscription of the node is read from it
+var azureMonitorIMDSEndpoint = "http://169.254.169.254/metadata/instance"
+
+// azureMonitorIMDSSubscriptions caches the subscription IMDS returned per endpoint, it does not change for a node
+var azureMonitorIMDSSubscriptions = struct {
+	lock    sync.Mutex
+	entries map[string]string
+}{entries: map[string]string{}}
+
+// azureMonitorDefaultAggregationWindow is the window queried when a trigger does not set metricAggregationInterval.
+// Slow moving metrics are smoother over a longer window, event metrics react faster over a shorter one.
+var azureMonitorDefaultAggregationWindow = defaultAzureMonitorAggregationWindow
+
+// azureMonitorAuthorizers caches authorizers across scaler polls. The tokens they hold are refreshed by
+// go-autorest when they are close to expiry, so reusing an authorizer avoids requesting a token from AAD on every poll.
+var azureMonitorAuthorizers = azureMonitorAuthorizerCache{entries: map[azureMonitorAuthorizerKey]azureMonitorAuthorizerEntry{}}
+
+type azureMonitorAuthorizerKey struct {
+	podIdentity       string
+	tenantID          string
+	clientID          string
+	clientCertificate string
+	cloud             string
+	resource          string
+}
+
+type azureMonitorAuthorizerEntry struct {
+	authorizer autorest.Authorizer
+	credential string
+	lastUsed   time.Time
+}
+
+// maxAzureMonitorCachedClients bounds the authorizer and metrics client caches, the least recently used entry is
+// dropped to make room for a new one once a cache is full
+const maxAzureMonitorCachedClients = 256
+
+type azureMonitorAuthorizerCache struct {
+	lock    sync.Mutex
+	entries map[azureMonitorAuthorizerKey]azureMonitorAuthorizerEntry
+}
+
+// azureMonitorMetricsClients caches metrics clients across scalers. KEDA creates the scaler again for every poll and
+// every query of the HPA, so a client kept by the scaler alone would only be used once.
+var azureMonitorMetricsClients = azureMonitorMetricsClientCache{entries: map[azureMonitorMetricsClientKey]azureMonitorMetricsClientEntry{}}
+
+type azureMonitorMetricsClientKey struct {
+	podIdentity       string
+	tenantID          string
+	clientID          string
+	clientCertificate string
+	cloud             string
+	resource          string
+	baseURI           string
+	subscriptionID    string
+	userAgent         string
+	noProxy           string
+}
+
+type azureMonitorMetricsClientEntry struct {
+	client     *insights.MetricsClient
+	credential string
+	lastUsed   time.Time
+}
+
+type azureMonitorMetricsClientCache struct {
+	lock    sync.Mutex
+	entries map[azureMonitorMetricsClientKey]azureMonitorMetricsClientEntry
+}
+
+// azureMonitorHTTPClients holds the clients used when no sender is given, keyed by the noProxy setting
+var azureMonitorHTTPClients = struct {
+	lock    sync.Mutex
+	entries map[string]*http.Client
+}{entries: map[string]*http.Client{}}
+
+// azureMonitorSecretFiles caches client secrets read from files until the file changes
+var azureMonitorSecretFiles = azureMonitorSecretFileCache{entries: map[string]azureMonitorSecretFileEntry{}}
+
+type azureMonitorSecretFileEntry struct {
+	modTime time.Time
+	size    int64
+	secret  string
+}
+
+type azureMonitorSecretFileCache struct {
+	lock    sync.Mutex
+	entries map[string]azureMonitorSecretFileEntry
+}
+
+// metricsLister lists the metric values of a resource, it is satisfied by insights.MetricsClient and lets tests inject a fake
+type metricsLister interface {
+	List(ctx context.Context, resourceURI string, timespan string, interval *string, metricnames string, aggregation string, top *int32, orderby string, filter string, resultType insights.ResultType, metricnamespace string) (insights.Response, error)
+}
+
+// azureMetricDefinitionsLister is satisfied by insights.MetricDefinitionsClient
+type azureMetricDefinitionsLister interface {
+	List(ctx context.Context, resourceURI string, metricnamespace string) (insights.MetricDefinitionCollection, error)
+}
+
+// azureMonitorMetricDefinitions caches the metric definitions of each resource and metric namespace
+var azureMonitorMetricDefinitions = newAzureMonitorMetricDefinitionCache(defaultAzureMonitorMetricDefinitionsTTL)
+
+type azureMonitorMetricDefinitionCache struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	entries map[string]azureMonitorMetricDefinitionEntry
+}
+
+type azureMonitorMetricDefinitionEntry struct {
+	definitions []insights.MetricDefinition
+	expires     time.Time
+}
+
+func newAzureMonitorMetricDefinitionCache(ttl time.Duration) *azureMonitorMetricDefinitionCache {
+	return &azureMonitorMetricDefinitionCache{ttl: ttl, entries: map[string]azureMonitorMetricDefinitionEntry{}}
+}
+
+// azureTaggedResourceLister returns the IDs of the resources matching a resources API filter, within the resource group when one is given
+type azureTaggedResourceLister interface {
+	listResourceIDs(ctx context.Context, resourceGroup string, filter string) ([]string, error)
+}
+
+// azureResourcesClient lists resources through the Azure Resource Manager resources API, following every result page
+type azureResourcesClient struct {
+	client resources.Client
+}
+
+// azureMonitorFilterCondition matches a single condition of a metric filter, consuming its quoted value
+var azureMonitorFilterCondition = regexp.MustCompile(`(?i)([\w.\-/]+)\s+(?:eq|ne)\s+'(?:[^']|'')*'`)
+
+// ErrNoMetricData is returned when the metric exists but Azure Monitor has no data for it in the aggregation window
+var ErrNoMetricData = errors.New("no metric data in the aggregation window")
+
+// ErrAzureMonitorPermissionDenied is returned by ValidateAzureMonitorAccess when the credentials may not read the metrics of the resource
+var ErrAzureMonitorPermissionDenied = errors.New("not authorized to read azure monitor metrics, the credentials need the Monitoring Reader role on the resource")
+
+// ErrAzureMonitorAuthFailed is returned by CheckAzureMonitorConnectivity when Azure rejects the credentials or no token can be acquired
+var ErrAzureMonitorAuthFailed = errors.New("azure monitor rejected the credentials")
+
+// ErrAzureMonitorUnreachable is returned by CheckAzureMonitorConnectivity when Azure Monitor can't be reached in time
+var ErrAzureMonitorUnreachable = errors.New("azure monitor is unreachable")
+
+// azureMonitorConnectivityTimeout bounds CheckAzureMonitorConnectivity, so that a readiness probe gets an answer quickly
+var azureMonitorConnectivityTimeout = 5 * time.Second
+
+// azureMonitorMetricSuggestions is how many similar metric names are suggested for an unknown metricName
+const azureMonitorMetricSuggestions = 3
+
+// azureMonitorCombineModes maps the combine functions of metricNames to the aggregation that merges the values the same way
+var azureMonitorCombineModes = map[string]insights.AggregationType{
+	"max": insights.Maximum,
+	"min": insights.Minimum,
+	"sum": insights.Total,
+	"avg": insights.Average,
+}
+
+// azureMonitorRoundingModes are the roundingMode values, none keeps the precision of the value
+var azureMonitorRoundingModes = []string{"round", "ceil", "floor", "none"}
+
+// defaultAzureMonitorRoundingMode rounds to the nearest int like the scaler always did
+const defaultAzureMonitorRoundingMode = "round"
+
+// defaultAzureMonitorCombineMode scales on the busiest of the metrics when no combine function is given
+const defaultAzureMonitorCombineMode = "max"
+
+// defaultAzureMonitorResourceCombineMode scales on the load of all the resources when no combine function is given
+const defaultAzureMonitorResourceCombineMode = "sum"
+
+// azureMonitorResourceConcurrency bounds how many of the resourceNames are queried at the same time, so a trigger
+// over many instances does not burst through the Azure Monitor read quota
+var azureMonitorResourceConcurrency = 4
+
+// azureMonitorRetryBaseDelay is the first backoff delay when Azure Monitor does not send a Retry-After header
+var azureMonitorRetryBaseDelay = time.Second
+
+// azureMonitorMaxMetricPages bounds how many pages of a truncated metrics response are followed, the value read
+// from the pages that were fetched is flagged as partial
+const azureMonitorMaxMetricPages = 10
+
+// azureMonitorMetricsPage is a page of the metrics response. Azure truncates responses with many timeseries
+// and links to the rest of them, which the SDK model drops
+type azureMonitorMetricsPage struct {
+	insights.Response
+	NextLink *string `json:"nextLink,omitempty"`
+}
+
+// azureMonitorLastAggregation returns the newest data point of a metric regardless of its statistical aggregation
+const azureMonitorLastAggregation insights.AggregationType = "Last"
+
+// azureMonitorDataPointCountAggregation counts the buckets in the window that have a value, unlike Count which
+// returns Azure's number of raw samples in the newest bucket
+const azureMonitorDataPointCountAggregation insights.AggregationType = "DataPointCount"
+
+// azureMonitorAggregationTypes are the aggregation types the scaler can extract from a metric
+var azureMonitorAggregationTypes = []insights.AggregationType{insights.Average, insights.Total, insights.Maximum, insights.Minimum, insights.Count, azureMonitorLastAggregation, azureMonitorDataPointCountAggregation}
+
+// azureMonitorLastAggregationFields are the fields of a data point the Last aggregation looks at, most specific first
+var azureMonitorLastAggregationFields = []insights.AggregationType{insights.Average, insights.Total, insights.Maximum, insights.Minimum, insights.Count}
+
+// azureMonitorFilterExpression matches dimension filters such as "A eq 'a1' and B eq '*'" or "A eq 'a1' or A eq 'a2'".
+// Single quotes inside values are escaped by doubling them.
+var azureMonitorFilterExpression = regexp.MustCompile(`(?i)^\s*[\w.\-/]+\s+(eq|ne)\s+'(?:[^']|'')*'(\s+(and|or)\s+[\w.\-/]+\s+(eq|ne)\s+'(?:[^']|'')*')*\s*$`)
+
+// azureSubscriptionIDExpression matches subscription IDs, which are GUIDs
+var azureSubscriptionIDExpression = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// azureResourceGroupExpression follows Azure's resource group naming rules: up to 90 letters, digits,
+// underscores, hyphens, periods and parentheses, not ending with a period
+var azureResourceGroupExpression = regexp.MustCompile(`^[\p{L}\p{N}_\-.()]{0,89}[\p{L}\p{N}_\-()]$`)
+
+// azureMonitorResourceIDSegments matches the subscription and resource group in the resource IDs of a raw response
+var azureMonitorResourceIDSegments = regexp.MustCompile(`(?i)(/subscriptions/|/resourceGroups/)[^/"]+`)
+
+// azureMonitorISO8601Duration matches the ISO 8601 durations Azure Monitor uses for intervals, such as PT1M or P1D
+var azureMonitorISO8601Duration = regexp.MustCompile(`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// azureMonitorAuthConfig is satisfied by the go-autorest auth configs used to authenticate against Azure Monitor
+type azureMonitorAuthConfig interface {
+	Authorizer() (autorest.Authorizer, error)
+}
+
+// azureMonitorCertificateConfig authenticates a service principal with a certificate read from a PFX or PEM file
+type azureMonitorCertificateConfig struct {
+	certificatePath     string
+	certificatePassword string
+	clientID            string
+	tenantID            string
+	aadEndpoint         string
+	resource            string
+}
+
+// azureMetricValue is the value extracted from an Azure Monitor response along with the unit Azure reported for it
+// and the timestamp of the newest data point it was read from
+type azureMetricValue struct {
+	Value     float64
+	Unit      insights.Unit
+	Timestamp time.Time
+	// Partial is set when Azure truncated the response and not every page could be read
+	Partial bool
+}
+
+// azureResourceInfo is the resource a metric is read from, as parsed from the resourceURI
+type azureResourceInfo struct {
+	SubscriptionID    string
+	ResourceGroup     string
+	ProviderNamespace string
+	ResourceType      string
+	ResourceName      string
+}
+
 type azureExternalMetricRequest struct {
 	MetricName                string
+	MetricNamespace           string
 	SubscriptionID            string
+	ResourceSubscriptionID    string
 	ResourceName              string
 	ResourceProviderNamespace string
 	ResourceType              string
-	Aggregation               string
+	Aggregation               insights.AggregationType
 	Timespan                  string
 	Filter                    string
 	ResourceGroup             string
+	Scope                     string
+	Timeout                   time.Duration
+	MaxRetries                int
+	Window                    time.Duration
+	RateWindow                time.Duration
+	ResultAsRate              bool
+	ValueMultiplier           float64
+	DimensionGroupBy          string
+	Top                       int32
+	OrderBy                   string
+	Granularity               string
+	IgnoreNullValues          bool
+	DebugLogRawResponse       bool
+	TargetUnit                string
+	Percentile                *float64
+	Anchor                    time.Time
+}
+
+// GetAzureMetricValue returns the value of an Azure Monitor metric as an int, rounded with the roundingMode of the
+// trigger and then to the nearest int, which only matters with the none roundingMode
+func GetAzureMetricValue(ctx context.Context, metricMetadata *azureMonitorMetadata) (int32, error) {
+	metricValue, err := GetAzureMetricValueFloat(ctx, metricMetadata)
+	if err != nil {
+		return 0, err
+	}
+
+	// casting drops everything after decimal, so round first
+	return int32(math.Round(metricValue)), nil
+}
+
+// GetAzureMetricValueFloat returns the value of an Azure Monitor metric rounded with the roundingMode of the trigger,
+// the none roundingMode keeps its precision
+func GetAzureMetricValueFloat(ctx context.Context, metricMetadata *azureMonitorMetadata) (float64, error) {
+	value, err := getAzureMetricValue(ctx, metricMetadata, nil)
+	if err != nil {
+		return 0, err
+	}
+	return roundMetricValue(value, metricMetadata.roundingMode), nil
+}
+
+// GetAzureMetricValueAt returns the value of an Azure Monitor metric over the window ending at anchor rather than now,
+// for backtesting a trigger against historical data. The aggregationDelay still applies before anchor.
+func GetAzureMetricValueAt(ctx context.Context, metricMetadata *azureMonitorMetadata, anchor time.Time) (float64, error) {
+	return getAzureMetricValueAt(ctx, metricMetadata, anchor, nil)
+}
+
+// getAzureMetricValueAt queries the metric over the window ending at anchor, sending the HTTP calls through sender
+func getAzureMetricValueAt(ctx context.Context, metricMetadata *azureMonitorMetadata, anchor time.Time, sender autorest.Sender) (float64, error) {
+	anchoredMetadata := *metricMetadata
+	anchoredMetadata.anchor = anchor
+	value, err := getAzureMetricValue(ctx, &anchoredMetadata, sender)
+	if err != nil {
+		return 0, err
+	}
+	return roundMetricValue(value, metricMetadata.roundingMode), nil
+}
+
+// getAzureMetricValue queries the metric sending the HTTP calls through sender, or through the SDK default sender when nil
+func getAzureMetricValue(ctx context.Context, metricMetadata *azureMonitorMetadata, sender autorest.Sender) (float64, error) {
+	return getAzureMetricValueWithClient(ctx, metricMetadata, nil, sender)
+}
+
+// getAzureMetricValueWithClient queries the metric with the metrics client a scaler built once, or with a client created
+// for the metadata when it is nil
+func getAzureMetricValueWithClient(ctx context.Context, metricMetadata *azureMonitorMetadata, metricsClient *insights.MetricsClient, sender autorest.Sender) (float64, error) {
+	if metricMetadata.metricSource == appInsightsMetricSource {
+		return getAppInsightsMetricValue(ctx, metricMetadata, sender)
+	}
+	if len(metricMetadata.resourceNames) > 0 {
+		return getAzureMetricValueByName(ctx, metricMetadata, metricsClient, sender)
+	}
+
+	// an invalid request fails before the client is created, so it does not cost a token request. The requests for
+	// tagged resources are only known once the resources are listed.
+	var requestPtr *azureExternalMetricRequest
+	if metricMetadata.resourceTagFilter == "" {
+		var err error
+		if requestPtr, err = createValidMetricsRequest(metricMetadata); err != nil {
+			return 0, err
+		}
+	}
+
+	client, err := resolveMetricsClient(metricMetadata, metricsClient, sender)
+	if err != nil {
+		return 0, err
+	}
+
+	if metricMetadata.resourceTagFilter != "" {
+		resourcesClient, err := createResourcesClient(metricMetadata, sender)
+		if err != nil {
+			return 0, err
+		}
+		return getAzureMetricValueByTag(ctx, metricMetadata, client, resourcesClient)
+	}
+
+	if metricMetadata.validateMetricDefinition {
+		definitionsClient, err := createMetricDefinitionsClient(metricMetadata, sender)
+		if err != nil {
+			return 0, err
+		}
+		metricRequests := getMetricRequests(*requestPtr, metricMetadata.metricNames)
+		if metricMetadata.capacityMetricName != "" {
+			metricRequests = append(metricRequests, getMetricRequests(*requestPtr, []string{metricMetadata.capacityMetricName})...)
+		}
+		for _, metricRequest := range metricRequests {
+			if err := validateMetricDefinition(ctx, definitionsClient, metricRequest); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	var value float64
+	if len(metricMetadata.metricNames) > 0 {
+		value, err = executeCombinedRequest(ctx, client, requestPtr, metricMetadata.metricNames, metricMetadata.combine)
+	} else {
+		value, err = executeRequest(ctx, client, requestPtr)
+	}
+	if err != nil || metricMetadata.capacityMetricName == "" {
+		return value, err
+	}
+	return executeCapacityRequest(ctx, client, requestPtr, metricMetadata.capacityMetricName, value)
+}
+
+// getAzureMetricValueByName queries the metric of each of the resourceNames and combines their values with the
+// combine function, the sum of all of them by default
+func getAzureMetricValueByName(ctx context.Context, metricMetadata *azureMonitorMetadata, metricsClient *insights.MetricsClient, sender autorest.Sender) (float64, error) {
+	aggregationType, ok := azureMonitorCombineModes[metricMetadata.combine]
+	if !ok {
+		return 0, fmt.Errorf("combine %s not supported", metricMetadata.combine)
+	}
+
+	resourcesMetadata := getResourceNamesMetadata(metricMetadata)
+	requests := make([]*azureExternalMetricRequest, 0, len(resourcesMetadata))
+	for _, resourceMetadata := range resourcesMetadata {
+		requestPtr, err := createValidMetricsRequest(resourceMetadata)
+		if err != nil {
+			return 0, err
+		}
+		requests = append(requests, requestPtr)
+	}
+
+	client, err := resolveMetricsClient(metricMetadata, metricsClient, sender)
+	if err != nil {
+		return 0, err
+	}
+
+	values, err := executeResourceRequests(ctx, client, requests, azureMonitorResourceConcurrency)
+	if err != nil {
+		return 0, err
+	}
+
+	value := combineTimeseriesValues(aggregationType, values)
+	azureMonitorLog.V(2).Info("combined azure monitor metric of resources", "resourceURI", metricMetadata.resourceURI, "resourceNames", metricMetadata.resourceNames, "metricName", metricMetadata.name, "combine", metricMetadata.combine, "value", value)
+	return value, nil
+}
+
+// getResourceNamesMetadata copies the metadata once for each of the resourceNames, completing the resourceURI with the name
+func getResourceNamesMetadata(metricMetadata *azureMonitorMetadata) []*azureMonitorMetadata {
+	resourcesMetadata := make([]*azureMonitorMetadata, 0, len(metricMetadata.resourceNames))
+	for _, name := range metricMetadata.resourceNames {
+		resourceMetadata := *metricMetadata
+		resourceMetadata.resourceURI = strings.TrimSuffix(metricMetadata.resourceURI, "/") + "/" + name
+		resourceMetadata.resourceNames = nil
+		resourcesMetadata = append(resourcesMetadata, &resourceMetadata)
+	}
+	return resourcesMetadata
+}
+
+// executeResourceRequests runs the requests with at most concurrency of them in flight and returns their values in
+// the order of the requests, or the first error in that order
+func executeResourceRequests(ctx context.Context, client metricsLister, requests []*azureExternalMetricRequest, concurrency int) ([]float64, error) {
+	if concurrency <= 0 || concurrency > len(requests) {
+		concurrency = len(requests)
+	}
+
+	values := make([]float64, len(requests))
+	errs := make([]error, len(requests))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range work {
+				values[index], errs[index] = executeRequest(ctx, client, requests[index])
+			}
+		}()
+	}
+	for index := range requests {
+		work <- index
+	}
+	close(work)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// executeCapacityRequest queries the capacity metric with the settings of the request and returns the value as a percentage of it
+func executeCapacityRequest(ctx context.Context, client metricsLister, request *azureExternalMetricRequest, capacityMetricName string, value float64) (float64, error) {
+	capacityRequest := *request
+	capacityRequest.MetricName = capacityMetricName
+	capacity, err := executeRequest(ctx, client, &capacityRequest)
+	if err != nil {
+		return 0, err
+	}
+
+	percentage, err := getCapacityPercentage(value, capacity)
+	if err != nil {
+		return 0, fmt.Errorf("Error getting azure monitor metric %s as a percentage of %s: %s", request.MetricName, capacityMetricName, err)
+	}
+	azureMonitorLog.V(2).Info("got azure monitor metric as a percentage of its capacity", "resourceURI", request.metricResourceURI(), "metricName", request.MetricName, "capacityMetricName", capacityMetricName, "value", value, "capacity", capacity, "percentage", percentage)
+	return percentage, nil
+}
+
+// getCapacityPercentage returns the value as a percentage of the capacity, a capacity of zero has no meaningful utilization
+func getCapacityPercentage(value float64, capacity float64) (float64, error) {
+	if capacity == 0 {
+		return 0, fmt.Errorf("capacity is 0")
+	}
+	return value / capacity * 100, nil
+}
+
+// ValidateAzureMonitorAccess checks that the credentials of the trigger may read the metrics of its resource by listing
+// the metric definitions, which does not count against the metrics query quota. No metric value is returned.
+func ValidateAzureMonitorAccess(ctx context.Context, metricMetadata *azureMonitorMetadata) error {
+	return validateAzureMonitorAccess(ctx, metricMetadata, nil)
+}
+
+func validateAzureMonitorAccess(ctx context.Context, metricMetadata *azureMonitorMetadata, sender autorest.Sender) error {
+	if metricMetadata.metricSource == appInsightsMetricSource {
+		return validateAppInsightsAccess(ctx, metricMetadata, sender)
+	}
+	// the resources of resourceNames share the resource type and the credentials, checking the first is enough
+	if len(metricMetadata.resourceNames) > 0 {
+		metricMetadata = getResourceNamesMetadata(metricMetadata)[0]
+	}
+
+	requestPtr, err := createValidMetricsRequest(metricMetadata)
+	if err != nil {
+		return err
+	}
+
+	client, err := createMetricDefinitionsClient(metricMetadata, sender)
+	if err != nil {
+		return err
+	}
+
+	return checkMetricDefinitionsAccess(ctx, client, *requestPtr)
+}
+
+// CheckAzureMonitorConnectivity checks that Azure Monitor can be reached with the credentials of the trigger by listing the
+// metric definitions of its resource within a short timeout, for readiness probes. A rejected token or missing role is
+// reported as ErrAzureMonitorAuthFailed, a network failure or timeout as ErrAzureMonitorUnreachable.
+func CheckAzureMonitorConnectivity(ctx context.Context, metricMetadata *azureMonitorMetadata) error {
+	return checkAzureMonitorConnectivity(ctx, metricMetadata, nil)
+}
+
+func checkAzureMonitorConnectivity(ctx context.Context, metricMetadata *azureMonitorMetadata, sender autorest.Sender) error {
+	ctx, cancel := context.WithTimeout(ctx, azureMonitorConnectivityTimeout)
+	defer cancel()
+
+	withTimeout := *metricMetadata
+	if withTimeout.azureMonitorRequestTimeout <= 0 || withTimeout.azureMonitorRequestTimeout > azureMonitorConnectivityTimeout {
+		withTimeout.azureMonitorRequestTimeout = azureMonitorConnectivityTimeout
+	}
+
+	err := validateAzureMonitorAccess(ctx, &withTimeout, sender)
+	switch {
+	case err == nil:
+		return nil
+	case isAzureMonitorAuthError(err):
+		return fmt.Errorf("azure monitor connectivity check failed: %v: %w", err, ErrAzureMonitorAuthFailed)
+	case ctx.Err() != nil || isAzureMonitorNetworkError(err):
+		return fmt.Errorf("azure monitor connectivity check failed: %v: %w", err, ErrAzureMonitorUnreachable)
+	}
+	return fmt.Errorf("azure monitor connectivity check failed: %w", err)
+}
+
+// isAzureMonitorAuthError tells whether Azure answered 401 or 403, or the token for the call could not be acquired
+func isAzureMonitorAuthError(err error) bool {
+	if errors.Is(err, ErrAzureMonitorPermissionDenied) {
+		return true
+	}
+
+	var detailedErr autorest.DetailedError
+	if !errors.As(err, &detailedErr) {
+		return false
+	}
+	if detailedErr.StatusCode == http.StatusUnauthorized || detailedErr.StatusCode == http.StatusForbidden {
+		return true
+	}
+	var refreshErr adal.TokenRefreshError
+	return errors.As(detailedErr.Original, &refreshErr)
+}
+
+// isAzureMonitorNetworkError tells whether the call failed before Azure answered, e.g. on DNS, a refused connection or a timeout
+func isAzureMonitorNetworkError(err error) bool {
+	var detailedErr autorest.DetailedError
+	if errors.As(err, &detailedErr) && detailedErr.Original != nil {
+		err = detailedErr.Original
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// checkMetricDefinitionsAccess lists the metric definitions of the resource, bypassing the definitions cache so that
+// every call reaches Azure Monitor with the current credentials
+func checkMetricDefinitionsAccess(ctx context.Context, lister azureMetricDefinitionsLister, azMetricRequest azureExternalMetricRequest) error {
+	if err := azMetricRequest.validate(); err != nil {
+		return err
+	}
+
+	timeout := azMetricRequest.Timeout
+	if timeout <= 0 {
+		timeout = defaultAzureMonitorRequestTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	metricResourceURI := azMetricRequest.metricResourceURI()
+	_, err := lister.List(ctx, metricResourceURI, azMetricRequest.MetricNamespace)
+	if err == nil {
+		return nil
+	}
+
+	if detailedErr, ok := err.(autorest.DetailedError); ok && detailedErr.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("error validating azure monitor access to %s: %v: %w", metricResourceURI, describeAzureMonitorError(err), ErrAzureMonitorPermissionDenied)
+	}
+	return fmt.Errorf("error validating azure monitor access to %s: %w", metricResourceURI, describeAzureMonitorError(err))
+}
+
+// getAzureMetricValueByTag queries the metric of every resource matching the resourceTagFilter and combines
+// the values the same way Azure Monitor combines timeseries, e.g. Total sums them and Maximum takes the largest
+func getAzureMetricValueByTag(ctx context.Context, metricMetadata *azureMonitorMetadata, client metricsLister, lister azureTaggedResourceLister) (float64, error) {
+	resourceIDs, err := lister.listResourceIDs(ctx, metricMetadata.resourceGroupName, getResourceTagFilter(metricMetadata.resourceTagFilter))
+	if err != nil {
+		return 0, fmt.Errorf("error listing azure resources matching resourceTagFilter %s: %w", metricMetadata.resourceTagFilter, describeAzureMonitorError(err))
+	}
+
+	var requestPtr *azureExternalMetricRequest
+	values := make([]float64, 0, len(resourceIDs))
+	for _, resourceID := range resourceIDs {
+		if metricMetadata.resourceType != "" {
+			// the tagged resources are listed from a resource group
+			info, err := parseAzureResourceURI(resourceID, azureMonitorResourceGroupScope)
+			if err != nil || !strings.EqualFold(info.ProviderNamespace+"/"+info.ResourceType, metricMetadata.resourceType) {
+				continue
+			}
+		}
+
+		// the resource group and subscription of each resource are taken from its ID
+		resourceMetadata := *metricMetadata
+		resourceMetadata.resourceURI = resourceID
+		resourceMetadata.resourceGroupName = ""
+		requestPtr, err = createMetricsRequest(&resourceMetadata)
+		if err != nil {
+			return 0, err
+		}
+
+		metricResponse, err := getAzureMetric(ctx, client, *requestPtr)
+		if err != nil {
+			azureMonitorLog.Error(err, "error getting azure monitor metric", "resourceURI", resourceID)
+			return 0, fmt.Errorf("Error getting azure monitor metric %s: %w", metricMetadata.name, describeAzureMonitorError(err))
+		}
+		metricValue, err := convertMetricUnit(metricResponse.Value, metricResponse.Unit, requestPtr.TargetUnit, requestPtr.Window)
+		if err != nil {
+			return 0, fmt.Errorf("Error getting azure monitor metric %s for resource %s: %s", metricMetadata.name, resourceID, err)
+		}
+		values = append(values, metricValue)
+	}
+
+	if len(values) == 0 {
+		return 0, fmt.Errorf("no azure resources match resourceTagFilter %s", metricMetadata.resourceTagFilter)
+	}
+	azureMonitorLog.V(2).Info("combining azure monitor metric of tagged resources", "resourceTagFilter", metricMetadata.resourceTagFilter, "metricName", metricMetadata.name, "resources", len(values))
+
+	return transformMetricValue(*requestPtr, combineTimeseriesValues(metricMetadata.aggregationType, values)), nil
+}
+
+// getResourceTagFilter turns a resourceTagFilter of the form name=value, or just name, into a resources API filter
+func getResourceTagFilter(tagFilter string) string {
+	quote := func(value string) string {
+		return strings.ReplaceAll(strings.TrimSpace(value), "'", "''")
+	}
+
+	parts := strings.SplitN(tagFilter, "=", 2)
+	if len(parts) == 1 {
+		return fmt.Sprintf("tagName eq '%s'", quote(parts[0]))
+	}
+	return fmt.Sprintf("tagName eq '%s' and tagValue eq '%s'", quote(parts[0]), quote(parts[1]))
+}
+
+func createResourcesClient(metadata *azureMonitorMetadata, sender autorest.Sender) (azureResourcesClient, error) {
+	baseClient, err := createAzureMonitorBaseClient(metadata, sender)
+
+	// the resources live in the resource subscription when it differs from the one used to authenticate
+	subscriptionID := baseClient.SubscriptionID
+	if metadata.resourceSubscriptionID != "" {
+		subscriptionID = metadata.resourceSubscriptionID
+	}
+
+	client := resources.Client{BaseClient: resources.BaseClient{Client: baseClient.Client, BaseURI: baseClient.BaseURI, SubscriptionID: subscriptionID}}
+	return azureResourcesClient{client: client}, err
+}
+
+func (c azureResourcesClient) listResourceIDs(ctx context.Context, resourceGroup string, filter string) ([]string, error) {
+	var iterator resources.ListResultIterator
+	var err error
+	if resourceGroup != "" {
+		iterator, err = c.client.ListByResourceGroupComplete(ctx, resourceGroup, filter, "", nil)
+	} else {
+		iterator, err = c.client.ListComplete(ctx, filter, "", nil)
+	}
+
+	resourceIDs := []string{}
+	for ; err == nil && iterator.NotDone(); err = iterator.NextWithContext(ctx) {
+		if id := iterator.Value().ID; id != nil {
+			resourceIDs = append(resourceIDs, *id)
+		}
+	}
+	return resourceIDs, err
+}
+
+func createMetricsClient(metadata *azureMonitorMetadata, sender autorest.Sender) (insights.MetricsClient, error) {
+	baseClient, err := createAzureMonitorBaseClient(metadata, sender)
+	return insights.MetricsClient{BaseClient: baseClient}, err
+}
+
+// resolveMetricsClient returns the given client, or creates one for the metadata when there is none
+func resolveMetricsClient(metadata *azureMonitorMetadata, client *insights.MetricsClient, sender autorest.Sender) (insights.MetricsClient, error) {
+	if client != nil {
+		return *client, nil
+	}
+	return createMetricsClient(metadata, sender)
+}
+
+func createMetricDefinitionsClient(metadata *azureMonitorMetadata, sender autorest.Sender) (insights.MetricDefinitionsClient, error) {
+	baseClient, err := createAzureMonitorBaseClient(metadata, sender)
+	return insights.MetricDefinitionsClient{BaseClient: baseClient}, err
+}
+
+// createAzureMonitorBaseClient sets up the endpoint, retries, user agent and authorizer shared by the insights clients
+func createAzureMonitorBaseClient(metadata *azureMonitorMetadata, sender autorest.Sender) (insights.BaseClient, error) {
+	env, err := getAzureMonitorEnvironment(metadata.cloud)
+	if err != nil {
+		return insights.BaseClient{}, err
+	}
+
+	client := insights.NewWithBaseURI(getAzureMonitorBaseURI(metadata, env), metadata.subscriptionID)
+	// throttling and server errors are retried by getAzureMetric, so the SDK only makes a single attempt
+	client.RetryAttempts = 1
+	client.RetryDuration = 0
+	client.Sender = getAzureMonitorSender(metadata, sender)
+	if err := client.AddToUserAgent(getAzureMonitorUserAgent(metadata)); err != nil {
+		return client, fmt.Errorf("error setting azure monitor user agent: %s", err)
+	}
+
+	if metadata.clientSecretFile != "" {
+		secret, err := azureMonitorSecretFiles.read(metadata.clientSecretFile)
+		if err != nil {
+			return client, err
+		}
+		// a changed secret makes the authorizer cache build a new authorizer
+		withSecret := *metadata
+		withSecret.clientPassword = secret
+		metadata = &withSecret
+	}
+
+	authorizer, err := azureMonitorAuthorizers.get(metadata, env, getAzureMonitorTokenAudience(metadata, env))
+	if err != nil {
+		return client, fmt.Errorf("error creating azure monitor authorizer: %s", err)
+	}
+	client.Authorizer = authorizer
+
+	return client, nil
+}
+
+// getAzureMonitorBaseURI returns the endpointOverride of the trigger, or the Resource Manager endpoint of its region
+func getAzureMonitorBaseURI(metadata *azureMonitorMetadata, env azure.Environment) string {
+	baseURI := getAzureMonitorRegionalEndpoint(env, metadata.region)
+	if metadata.endpointOverride != "" {
+		baseURI = metadata.endpointOverride
+	}
+	return strings.TrimSuffix(baseURI, "/")
+}
+
+// getAzureMonitorRegionalEndpoint returns the Resource Manager endpoint of the region, such as
+// https://westeurope.management.azure.com/, or the global endpoint of the cloud when the region is unset or unknown
+func getAzureMonitorRegionalEndpoint(env azure.Environment, region string) string {
+	region = normalizeAzureMonitorRegion(region)
+	if region == "" || !azureMonitorRegions[env.Name][region] {
+		return env.ResourceManagerEndpoint
+	}
+
+	endpoint, err := url.Parse(env.ResourceManagerEndpoint)
+	if err != nil || endpoint.Host == "" {
+		return env.ResourceManagerEndpoint
+	}
+	endpoint.Host = region + "." + endpoint.Host
+	return endpoint.String()
+}
+
+// normalizeAzureMonitorRegion turns a region display name such as "West Europe" into its name, westeurope
+func normalizeAzureMonitorRegion(region string) string {
+	return strings.ToLower(strings.Join(strings.Fields(region), ""))
+}
+
+// getAzureMonitorTokenAudience returns the resource the AAD token is requested for, the management endpoint of the cloud
+// unless the trigger sets tokenAudience for an endpoint that expects a different audience
+func getAzureMonitorTokenAudience(metadata *azureMonitorMetadata, env azure.Environment) string {
+	if metadata.tokenAudience != "" {
+		return metadata.tokenAudience
+	}
+	return env.ResourceManagerEndpoint
+}
+
+// getAzureMonitorSender returns the sender, or without one a client shared by the triggers with the same noProxy setting,
+// so the calls honor the proxy of the environment without opening a connection pool per poll
+func getAzureMonitorSender(metadata *azureMonitorMetadata, sender autorest.Sender) autorest.Sender {
+	if sender != nil {
+		return sender
+	}
+
+	return getAzureMonitorHTTPClient(metadata.noProxy)
+}
+
+// isAzureMonitorSharedHTTPClient reports whether the client is one of the clients shared by the triggers
+func isAzureMonitorSharedHTTPClient(client *http.Client) bool {
+	azureMonitorHTTPClients.lock.Lock()
+	defer azureMonitorHTTPClients.lock.Unlock()
+	for _, shared := range azureMonitorHTTPClients.entries {
+		if shared == client {
+			return true
+		}
+	}
+	return false
+}
+
+// getAzureMonitorHTTPClient returns the client shared by the triggers with the noProxy setting
+func getAzureMonitorHTTPClient(noProxy string) *http.Client {
+	azureMonitorHTTPClients.lock.Lock()
+	defer azureMonitorHTTPClients.lock.Unlock()
+	client, ok := azureMonitorHTTPClients.entries[noProxy]
+	if !ok {
+		client = newAzureMonitorHTTPClient(noProxy)
+		azureMonitorHTTPClients.entries[noProxy] = client
+	}
+	return client
+}
+
+// getAzureMonitorUserAgent identifies KEDA in Azure's request logs, optionally followed by the userAgentSuffix
+func getAzureMonitorUserAgent(metadata *azureMonitorMetadata) string {
+	userAgent := fmt.Sprintf("keda/%s azure-monitor-scaler", version.Version)
+	if metadata.userAgentSuffix != "" {
+		userAgent = fmt.Sprintf("%s %s", userAgent, metadata.userAgentSuffix)
+	}
+	return userAgent
+}
+
+// read returns the secret stored in the file, reading it again only when its modification time or size changed
+func (c *azureMonitorSecretFileCache) read(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading clientSecretFromFile %s: %s", path, err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if entry, ok := c.entries[path]; ok && entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+		return entry.secret, nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading clientSecretFromFile %s: %s", path, err)
+	}
+	secret := strings.TrimSpace(string(content))
+	if secret == "" {
+		return "", fmt.Errorf("clientSecretFromFile %s is empty", path)
+	}
+
+	c.entries[path] = azureMonitorSecretFileEntry{modTime: info.ModTime(), size: info.Size(), secret: secret}
+	return secret, nil
+}
+
+// get returns the cached authorizer for the credentials and the resource the token is requested for,
+// creating it when missing or when the client secret changed
+func (c *azureMonitorAuthorizerCache) get(metadata *azureMonitorMetadata, env azure.Environment, resource string) (autorest.Authorizer, error) {
+	key := azureMonitorAuthorizerKey{
+		podIdentity:       metadata.podIdentity,
+		tenantID:          metadata.tenantID,
+		clientID:          metadata.clientID,
+		clientCertificate: metadata.clientCertificate,
+		cloud:             env.Name,
+		resource:          resource,
+	}
+
+	credential := getAzureMonitorCredentialFingerprint(metadata)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if entry, ok := c.entries[key]; ok && entry.credential == credential {
+		entry.lastUsed = time.Now()
+		c.entries[key] = entry
+		return entry.authorizer, nil
+	}
+
+	authorizer, err := getAuthConfig(metadata, env, resource).Authorizer()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxAzureMonitorCachedClients {
+		var oldest azureMonitorAuthorizerKey
+		for entryKey, entry := range c.entries {
+			if _, ok := c.entries[oldest]; !ok || entry.lastUsed.Before(c.entries[oldest].lastUsed) {
+				oldest = entryKey
+			}
+		}
+		delete(c.entries, oldest)
+	}
+	c.entries[key] = azureMonitorAuthorizerEntry{authorizer: authorizer, credential: credential, lastUsed: time.Now()}
+
+	return authorizer, nil
+}
+
+// getAzureMonitorCredentialFingerprint hashes the secrets the authorizer is built from, and the modification time and
+// size of the certificate file, so that a rotated secret, certificate or certificate password builds a new authorizer
+func getAzureMonitorCredentialFingerprint(metadata *azureMonitorMetadata) string {
+	hash := sha256.New()
+	for _, value := range []string{metadata.clientPassword, metadata.clientCertificatePassword} {
+		_, _ = fmt.Fprintf(hash, "%d:%s|", len(value), value)
+	}
+	if metadata.clientCertificate != "" {
+		// a certificate that can't be read fails when the authorizer is built
+		if info, err := os.Stat(metadata.clientCertificate); err == nil {
+			_, _ = fmt.Fprintf(hash, "%d|%d", info.ModTime().UnixNano(), info.Size())
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// get returns the metrics client of the credentials and endpoint of the trigger, sending through the client shared by
+// the triggers with its noProxy setting. Like an authorizer, the client is built again when the credentials changed.
+func (c *azureMonitorMetricsClientCache) get(metadata *azureMonitorMetadata) (*insights.MetricsClient, error) {
+	env, err := getAzureMonitorEnvironment(metadata.cloud)
+	if err != nil {
+		return nil, err
+	}
+	key := azureMonitorMetricsClientKey{
+		podIdentity:       metadata.podIdentity,
+		tenantID:          metadata.tenantID,
+		clientID:          metadata.clientID,
+		clientCertificate: metadata.clientCertificate,
+		cloud:             env.Name,
+		resource:          getAzureMonitorTokenAudience(metadata, env),
+		baseURI:           getAzureMonitorBaseURI(metadata, env),
+		subscriptionID:    metadata.subscriptionID,
+		userAgent:         getAzureMonitorUserAgent(metadata),
+		noProxy:           metadata.noProxy,
+	}
+
+	credential := getAzureMonitorCredentialFingerprint(metadata)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if entry, ok := c.entries[key]; ok && entry.credential == credential {
+		entry.lastUsed = time.Now()
+		c.entries[key] = entry
+		return entry.client, nil
+	}
+
+	client, err := createMetricsClient(metadata, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxAzureMonitorCachedClients {
+		var oldest azureMonitorMetricsClientKey
+		for entryKey, entry := range c.entries {
+			if _, ok := c.entries[oldest]; !ok || entry.lastUsed.Before(c.entries[oldest].lastUsed) {
+				oldest = entryKey
+			}
+		}
+		delete(c.entries, oldest)
+	}
+	c.entries[key] = azureMonitorMetricsClientEntry{client: &client, credential: credential, lastUsed: time.Now()}
+
+	return &client, nil
+}
+
+// getAuthConfig uses the managed identity of the pod when pod identity is enabled and falls back to the service principal
+// otherwise, authenticating with its certificate when one is given and with its client secret if not
+func getAuthConfig(metadata *azureMonitorMetadata, env azure.Environment, resource string) azureMonitorAuthConfig {
+	if metadata.podIdentity == "azure" {
+		config := auth.NewMSIConfig()
+		config.Resource = resource
+		return config
+	}
+
+	if metadata.clientCertificate != "" {
+		return azureMonitorCertificateConfig{
+			certificatePath:     metadata.clientCertificate,
+			certificatePassword: metadata.clientCertificatePassword,
+			clientID:            metadata.clientID,
+			tenantID:            metadata.tenantID,
+			aadEndpoint:         env.ActiveDirectoryEndpoint,
+			resource:            resource,
+		}
+	}
+
+	config := auth.NewClientCredentialsConfig(metadata.clientID, metadata.clientPassword, metadata.tenantID)
+	config.AADEndpoint = env.ActiveDirectoryEndpoint
+	config.Resource = resource
+	return config
+}
+
+// Authorizer reads the service principal certificate. PFX files are handled by go-autorest, PEM files holding
+// the certificate and its RSA private key, optionally encrypted with the certificate password, are parsed here.
+func (c azureMonitorCertificateConfig) Authorizer() (autorest.Authorizer, error) {
+	content, err := ioutil.ReadFile(c.certificatePath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading clientCertificate %s: %s", c.certificatePath, err)
+	}
+
+	if !bytes.Contains(content, []byte("-----BEGIN")) {
+		config := auth.NewClientCertificateConfig(c.certificatePath, c.certificatePassword, c.clientID, c.tenantID)
+		config.AADEndpoint = c.aadEndpoint
+		config.Resource = c.resource
+		return config.Authorizer()
+	}
+
+	certificate, privateKey, err := parsePEMCertificate(content, c.certificatePassword)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing clientCertificate %s: %s", c.certificatePath, err)
+	}
+
+	oauthConfig, err := adal.NewOAuthConfig(c.aadEndpoint, c.tenantID)
+	if err != nil {
+		return nil, err
+	}
+	token, err := adal.NewServicePrincipalTokenFromCertificate(*oauthConfig, c.clientID, certificate, privateKey, c.resource)
+	if err != nil {
+		return nil, err
+	}
+	return autorest.NewBearerAuthorizer(token), nil
+}
+
+// parsePEMCertificate returns the first certificate and the RSA private key in the PEM data
+func parsePEMCertificate(content []byte, password string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	var certificate *x509.Certificate
+	var privateKey *rsa.PrivateKey
+
+	for block, rest := pem.Decode(content); block != nil; block, rest = pem.Decode(rest) {
+		der := block.Bytes
+		if x509.IsEncryptedPEMBlock(block) {
+			var err error
+			if der, err = x509.DecryptPEMBlock(block, []byte(password)); err != nil {
+				return nil, nil, fmt.Errorf("unable to decrypt %s: %s", block.Type, err)
+			}
+		}
+
+		switch {
+		case block.Type == "CERTIFICATE" && certificate == nil:
+			parsed, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, nil, err
+			}
+			certificate = parsed
+		case block.Type == "RSA PRIVATE KEY":
+			parsed, err := x509.ParsePKCS1PrivateKey(der)
+			if err != nil {
+				return nil, nil, err
+			}
+			privateKey = parsed
+		case block.Type == "PRIVATE KEY":
+			parsed, err := x509.ParsePKCS8PrivateKey(der)
+			if err != nil {
+				return nil, nil, err
+			}
+			rsaKey, ok := parsed.(*rsa.PrivateKey)
+			if !ok {
+				return nil, nil, fmt.Errorf("private key is not an RSA key")
+			}
+			privateKey = rsaKey
+		}
+	}
+
+	if certificate == nil {
+		return nil, nil, fmt.Errorf("no certificate found")
+	}
+	if privateKey == nil {
+		return nil, nil, fmt.Errorf("no RSA private key found")
+	}
+	return certificate, privateKey, nil
+}
+
+// getIMDSSubscriptionID returns the subscription of the VM the pod runs on from the instance metadata service. IMDS
+// is link local, so it is called without the proxy of the environment.
+func getIMDSSubscriptionID(ctx context.Context) (string, error) {
+	endpoint := azureMonitorIMDSEndpoint
+	azureMonitorIMDSSubscriptions.lock.Lock()
+	subscriptionID, ok := azureMonitorIMDSSubscriptions.entries[endpoint]
+	azureMonitorIMDSSubscriptions.lock.Unlock()
+	if ok {
+		return subscriptionID, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultAzureMonitorIMDSTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, endpoint+"?api-version=2021-02-01&format=json", nil)
+	if err != nil {
+		return "", fmt.Errorf("error creating IMDS request: %s", err)
+	}
+	req.Header.Set("Metadata", "true")
+
+	client := &http.Client{Transport: &http.Transport{Proxy: nil}}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("error reading the subscription from IMDS: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error reading the subscription from IMDS: status code %d", resp.StatusCode)
+	}
+
+	var instance struct {
+		Compute struct {
+			SubscriptionID string `json:"subscriptionId"`
+		} `json:"compute"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&instance); err != nil {
+		return "", fmt.Errorf("error decoding the IMDS instance metadata: %s", err)
+	}
+	if instance.Compute.SubscriptionID == "" {
+		return "", fmt.Errorf("IMDS instance metadata has no subscriptionId")
+	}
+
+	azureMonitorIMDSSubscriptions.lock.Lock()
+	azureMonitorIMDSSubscriptions.entries[endpoint] = instance.Compute.SubscriptionID
+	azureMonitorIMDSSubscriptions.lock.Unlock()
+	return instance.Compute.SubscriptionID, nil
+}
+
+// getAzureMonitorEnvironment resolves the Azure cloud environment, defaulting to the public cloud
+func getAzureMonitorEnvironment(cloud string) (azure.Environment, error) {
+	if cloud == "" {
+		cloud = defaultAzureMonitorCloud
+	}
+
+	env, err := azure.EnvironmentFromName(cloud)
+	if err != nil {
+		return env, fmt.Errorf("unknown azure cloud %s: %s", cloud, err)
+	}
+	return env, nil
+}
+
+func createMetricsRequest(metadata *azureMonitorMetadata) (*azureExternalMetricRequest, error) {
+	metricRequest := azureExternalMetricRequest{
+		MetricName:             metadata.name,
+		MetricNamespace:        metadata.metricNamespace,
+		SubscriptionID:         metadata.subscriptionID,
+		ResourceSubscriptionID: metadata.resourceSubscriptionID,
+		Aggregation:            metadata.aggregationType,
+		Filter:                 metadata.filter,
+		ResourceGroup:          metadata.resourceGroupName,
+		Scope:                  metadata.scope,
+		Timeout:                metadata.azureMonitorRequestTimeout,
+		MaxRetries:             metadata.maxRetries,
+		ResultAsRate:           metadata.metricResultAsRate,
+		ValueMultiplier:        metadata.metricValueMultiplier,
+		DimensionGroupBy:       metadata.dimensionGroupBy,
+		Top:                    metadata.top,
+		OrderBy:                metadata.orderBy,
+		Granularity:            metadata.aggregationGranularity,
+		IgnoreNullValues:       metadata.ignoreNullValues,
+		DebugLogRawResponse:    metadata.debugLogRawResponse,
+		TargetUnit:             metadata.targetUnit,
+		Percentile:             metadata.percentile,
+		Anchor:                 metadata.anchor,
+	}
+
+	resourceInfo, err := parseAzureResourceURI(metadata.resourceURI, metadata.scope)
+	if err != nil {
+		return nil, err
+	}
+	metricRequest.ResourceProviderNamespace = resourceInfo.ProviderNamespace
+	metricRequest.ResourceType = resourceInfo.ResourceType
+	metricRequest.ResourceName = resourceInfo.ResourceName
+	if metricRequest.SubscriptionID == "" {
+		metricRequest.SubscriptionID = resourceInfo.SubscriptionID
+	}
+	if metricRequest.ResourceSubscriptionID == "" && resourceInfo.SubscriptionID != "" && !strings.EqualFold(resourceInfo.SubscriptionID, metricRequest.SubscriptionID) {
+		metricRequest.ResourceSubscriptionID = resourceInfo.SubscriptionID
+	}
+	if metricRequest.ResourceGroup == "" {
+		metricRequest.ResourceGroup = resourceInfo.ResourceGroup
+	}
+
+	// if no timespan is provided, defaults to azureMonitorDefaultAggregationWindow
+	timespan, err := formatTimeSpanAt(metadata.aggregationInterval, metadata.aggregationDelay, metadata.maxMetricRetention, metadata.alignToMinute, metadata.queryTime())
+	if err != nil {
+		return nil, err
+	}
+
+	metricRequest.Timespan = timespan
+
+	window, err := getAggregationWindow(metadata.aggregationInterval)
+	if err != nil {
+		return nil, err
+	}
+	metricRequest.Window = window
+	metricRequest.RateWindow = getRateWindow(window, metadata.granularity)
+
+	return &metricRequest, nil
+}
+
+// createValidMetricsRequest creates the request for the metadata and validates it
+func createValidMetricsRequest(metadata *azureMonitorMetadata) (*azureExternalMetricRequest, error) {
+	requestPtr, err := createMetricsRequest(metadata)
+	if err != nil {
+		return nil, err
+	}
+	if err := requestPtr.validate(); err != nil {
+		return nil, err
+	}
+	return requestPtr, nil
+}
+
+func executeRequest(ctx context.Context, client metricsLister, request *azureExternalMetricRequest) (float64, error) {
+	metricResponse, err := getAzureMetric(ctx, client, *request)
+	if err != nil {
+		azureMonitorLog.Error(err, "error getting azure monitor metric")
+		return 0, fmt.Errorf("Error getting azure monitor metric %s: %w", request.MetricName, describeAzureMonitorError(err))
+	}
+
+	metricValue, err := convertMetricUnit(metricResponse.Value, metricResponse.Unit, request.TargetUnit, request.Window)
+	if err != nil {
+		return 0, fmt.Errorf("Error getting azure monitor metric %s: %s", request.MetricName, err)
+	}
+	return transformMetricValue(*request, metricValue), nil
+}
+
+// executeCombinedRequest queries each of the metrics with the settings of the request and merges their values with the combine function
+func executeCombinedRequest(ctx context.Context, client metricsLister, request *azureExternalMetricRequest, metricNames []string, combine string) (float64, error) {
+	aggregationType, ok := azureMonitorCombineModes[combine]
+	if !ok {
+		return 0, fmt.Errorf("combine %s not supported", combine)
+	}
+
+	metricRequests := getMetricRequests(*request, metricNames)
+	values := make([]float64, 0, len(metricRequests))
+	for i := range metricRequests {
+		value, err := executeRequest(ctx, client, &metricRequests[i])
+		if err != nil {
+			return 0, err
+		}
+		values = append(values, value)
+	}
+
+	value := combineTimeseriesValues(aggregationType, values)
+	azureMonitorLog.V(2).Info("combined azure monitor metrics", "resourceURI", request.metricResourceURI(), "metricNames", metricNames, "combine", combine, "value", value)
+	return value, nil
+}
+
+// getMetricRequests copies the request once for each metric name, or returns the request itself without metric names
+func getMetricRequests(request azureExternalMetricRequest, metricNames []string) []azureExternalMetricRequest {
+	if len(metricNames) == 0 {
+		return []azureExternalMetricRequest{request}
+	}
+	requests := make([]azureExternalMetricRequest, 0, len(metricNames))
+	for _, name := range metricNames {
+		metricRequest := request
+		metricRequest.MetricName = name
+		requests = append(requests, metricRequest)
+	}
+	return requests
+}
+
+// transformMetricValue applies the rate and multiplier settings of the request to the value read from the response.
+// The value is only rounded once it is combined with the other resources and metrics of the trigger.
+func transformMetricValue(request azureExternalMetricRequest, metricValue float64) float64 {
+	if request.ResultAsRate {
+		rateWindow := request.RateWindow
+		if rateWindow <= 0 {
+			rateWindow = request.Window
+		}
+		metricValue = getMetricRate(metricValue, rateWindow)
+	}
+	// an unset multiplier leaves the value as Azure Monitor reported it
+	if request.ValueMultiplier != 0 {
+		metricValue *= request.ValueMultiplier
+	}
+	return metricValue
+}
+
+// roundMetricValue rounds the final value of the trigger with the rounding mode, none keeps its precision. Metadata
+// that was not parsed has no mode and is left alone as well.
+func roundMetricValue(metricValue float64, roundingMode string) float64 {
+	switch roundingMode {
+	case "round":
+		return math.Round(metricValue)
+	case "ceil":
+		return math.Ceil(metricValue)
+	case "floor":
+		return math.Floor(metricValue)
+	}
+	return metricValue
+}
+
+// getUnitScale returns the kind of quantity the unit measures and its size in the base unit of the kind, a count
+// per second is worth the number of seconds in the window in counts. MB and GB are 1024 based like in the Azure portal.
+func getUnitScale(unit string, window time.Duration) (string, float64, bool) {
+	switch strings.ToLower(unit) {
+	case "bytes":
+		return "bytes", 1, true
+	case "mb":
+		return "bytes", 1 << 20, true
+	case "gb":
+		return "bytes", 1 << 30, true
+	case "seconds":
+		return "time", 1, true
+	case "milliseconds":
+		return "time", 0.001, true
+	case "count":
+		return "count", 1, true
+	case "countpersecond":
+		return "count", window.Seconds(), window > 0
+	}
+	return "", 0, false
+}
+
+// convertMetricUnit converts the value from the unit Azure Monitor reported to the target unit, without a target unit
+// the value is returned as is
+func convertMetricUnit(value float64, unit insights.Unit, targetUnit string, window time.Duration) (float64, error) {
+	if targetUnit == "" {
+		return value, nil
+	}
+
+	kind, scale, ok := getUnitScale(string(unit), window)
+	targetKind, targetScale, targetOk := getUnitScale(targetUnit, window)
+	if !ok || !targetOk || kind != targetKind {
+		return 0, fmt.Errorf("can't convert the %s unit of the metric to %s", unit, targetUnit)
+	}
+	return value * scale / targetScale, nil
+}
+
+// getRateWindow returns how long the Total or Count of a window covers. Azure Monitor returns whole data points, so a
+// window shorter than the granularity still gets the events of a full data point and the rate is taken over that.
+func getRateWindow(window time.Duration, granularity time.Duration) time.Duration {
+	if granularity <= 0 {
+		granularity = defaultAzureMonitorGranularity
+	}
+	if window < granularity {
+		return granularity
+	}
+	return window
+}
+
+// getMetricRate turns the total or count over the aggregation window into a per second rate, e.g. events per second
+func getMetricRate(total float64, window time.Duration) float64 {
+	if window <= 0 {
+		return total
+	}
+	return total / window.Seconds()
+}
+
+// getAzureMetric queries the metric and reads its value, failures are reported with the resource ID that was queried
+func getAzureMetric(ctx context.Context, client metricsLister, azMetricRequest azureExternalMetricRequest) (azureMetricValue, error) {
+	resourceURI := azMetricRequest.metricResourceURI()
+	ctx, span := startAzureMonitorQuerySpan(ctx, resourceURI, azMetricRequest)
+	start := time.Now()
+
+	var value azureMetricValue
+	metricResult, partial, err := listAzureMetric(ctx, client, azMetricRequest, azMetricRequest.Filter, "")
+	if err == nil {
+		value, err = extractMetricValue(azMetricRequest, metricResult)
+		value.Partial = partial
+	}
+	duration := time.Since(start)
+	recordAzureMonitorQuery(azMetricRequest.MetricName, azMetricRequest.ResourceName, duration, value.Value, err)
+	endAzureMonitorQuerySpan(span, err)
+	if err != nil {
+		// a wrong resourceURI is a common misconfiguration, the resource ID holds no secrets so it is safe to report
+		return azureMetricValue{}, fmt.Errorf("resource %s: %w", resourceURI, err)
+	}
+	return value, nil
+}
+
+// extractMetricValue reads the value from the response, reporting 0 instead of ErrNoMetricData when IgnoreNullValues is set
+func extractMetricValue(azMetricRequest azureExternalMetricRequest, metricResult insights.Response) (azureMetricValue, error) {
+	value, err := extractValue(azMetricRequest, metricResult)
+	// for event driven workloads no data in the window means nothing happened, report 0 so the target can scale to zero
+	if errors.Is(err, ErrNoMetricData) && azMetricRequest.IgnoreNullValues {
+		azureMonitorLog.V(1).Info("no azure monitor metric data in the aggregation window, reporting 0", "metricName", azMetricRequest.MetricName)
+		return azureMetricValue{}, nil
+	}
+
+	return value, err
+}
+
+// getAzureMetricByDimension splits the metric on DimensionGroupBy and returns one value per dimension value
+func getAzureMetricByDimension(ctx context.Context, client metricsLister, azMetricRequest azureExternalMetricRequest) (map[string]float64, error) {
+	if azMetricRequest.DimensionGroupBy == "" {
+		return nil, fmt.Errorf("dimensionGroupBy is required to split a metric by dimension")
+	}
+
+	metricResult, _, err := listAzureMetric(ctx, client, azMetricRequest, azMetricRequest.dimensionFilter(), insights.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return extractValuesByDimension(azMetricRequest, metricResult)
+}
+
+// azureMonitorDimensionDiscoveryTop is how many dimension value combinations ListAzureMetricDimensionValues asks for when
+// the trigger sets no top, rather than the 10 Azure Monitor returns by default
+const azureMonitorDimensionDiscoveryTop int32 = 1000
+
+// ListAzureMetricDimensionValues returns the values currently present in the aggregation window for each of the
+// dimensions of the metric of the trigger, which helps to build a metricFilter. The metricFilter of the trigger
+// still applies, so it narrows down the values that are returned.
+func ListAzureMetricDimensionValues(ctx context.Context, metricMetadata *azureMonitorMetadata, dimensions []string) (map[string][]string, error) {
+	requestPtr, err := createValidMetricsRequest(metricMetadata)
+	if err != nil {
+		return nil, err
+	}
+	client, err := createMetricsClient(metricMetadata, nil)
+	if err != nil {
+		return nil, err
+	}
+	return listMetricDimensionValues(ctx, client, *requestPtr, dimensions)
+}
+
+// listMetricDimensionValues queries the metric with resultType metadata, which returns the dimension values of every
+// timeseries without their data points
+func listMetricDimensionValues(ctx context.Context, client metricsLister, azMetricRequest azureExternalMetricRequest, dimensions []string) (map[string][]string, error) {
+	if len(dimensions) == 0 {
+		return nil, fmt.Errorf("at least one dimension is required to list its values")
+	}
+	if azMetricRequest.Top <= 0 {
+		azMetricRequest.Top = azureMonitorDimensionDiscoveryTop
+	}
+
+	metricResult, _, err := listAzureMetric(ctx, client, azMetricRequest, azMetricRequest.dimensionsFilter(dimensions), insights.Metadata)
+	if err != nil {
+		return nil, fmt.Errorf("resource %s: %w", azMetricRequest.metricResourceURI(), err)
+	}
+	return getMetricDimensionValues(metricResult, dimensions), nil
+}
+
+// getMetricDimensionValues collects the distinct values of each dimension across the timeseries of a metadata response,
+// sorted so that they are listed the same way on every call. A dimension without values maps to an empty list.
+func getMetricDimensionValues(metricResult insights.Response, dimensions []string) map[string][]string {
+	seen := make(map[string]map[string]bool, len(dimensions))
+	values := make(map[string][]string, len(dimensions))
+	for _, dimension := range dimensions {
+		seen[dimension] = map[string]bool{}
+		values[dimension] = []string{}
+	}
+	if metricResult.Value == nil {
+		return values
+	}
+
+	for _, metric := range *metricResult.Value {
+		if metric.Timeseries == nil {
+			continue
+		}
+		for _, series := range *metric.Timeseries {
+			for _, dimension := range dimensions {
+				value := getDimensionValue(dimension, series.Metadatavalues)
+				if value == "" || seen[dimension][value] {
+					continue
+				}
+				seen[dimension][value] = true
+				values[dimension] = append(values[dimension], value)
+			}
+		}
+	}
+
+	for _, dimensionValues := range values {
+		sort.Strings(dimensionValues)
+	}
+	return values
+}
+
+// listAzureMetric validates the request and queries Azure Monitor for it, retrying throttled and failed server side calls.
+// The response is partial when Azure truncated it and not every page could be read
+func listAzureMetric(ctx context.Context, client metricsLister, azMetricRequest azureExternalMetricRequest, filter string, resultType insights.ResultType) (insights.Response, bool, error) {
+	err := azMetricRequest.validate()
+	if err != nil {
+		return insights.Response{}, false, err
+	}
+
+	metricResourceURI := azMetricRequest.metricResourceURI()
+	azureMonitorLog.V(2).Info("querying azure monitor metric", "resourceURI", metricResourceURI, "metricName", azMetricRequest.MetricName, "aggregation", azMetricRequest.Aggregation)
+
+	timeout := azMetricRequest.Timeout
+	if timeout <= 0 {
+		timeout = defaultAzureMonitorRequestTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	aggregation := string(azMetricRequest.Aggregation)
+	if azMetricRequest.Aggregation == azureMonitorLastAggregation || azMetricRequest.Aggregation == azureMonitorDataPointCountAggregation {
+		// Last and DataPointCount are not Azure Monitor aggregations, ask for every field and work them out from the data points
+		fields := make([]string, 0, len(azureMonitorLastAggregationFields))
+		for _, field := range azureMonitorLastAggregationFields {
+			fields = append(fields, string(field))
+		}
+		aggregation = strings.Join(fields, ",")
+	}
+
+	// without an interval Azure Monitor picks the granularity from the length of the timespan
+	var interval *string
+	if azMetricRequest.Granularity != "" {
+		interval = &azMetricRequest.Granularity
+	}
+	// without top Azure Monitor returns its default of 10 timeseries for a split metric
+	var top *int32
+	if azMetricRequest.Top > 0 {
+		top = &azMetricRequest.Top
+	}
+
+	var metricResult insights.Response
+	var partial bool
+	err = retryAzureMonitorCall(ctx, azMetricRequest.MaxRetries, func() error {
+		// the SDK client reads the next links of a truncated response, other listers return a single page
+		metricsClient, ok := client.(insights.MetricsClient)
+		if !ok {
+			var listErr error
+			metricResult, listErr = client.List(ctx, metricResourceURI,
+				azMetricRequest.Timespan, interval,
+				azMetricRequest.MetricName, aggregation, top,
+				azMetricRequest.OrderBy, filter, resultType, azMetricRequest.MetricNamespace)
+			return listErr
+		}
+
+		req, listErr := metricsClient.ListPreparer(ctx, metricResourceURI,
+			azMetricRequest.Timespan, interval,
+			azMetricRequest.MetricName, aggregation, top,
+			azMetricRequest.OrderBy, filter, resultType, azMetricRequest.MetricNamespace)
+		if listErr != nil {
+			return autorest.NewErrorWithError(listErr, "insights.MetricsClient", "List", nil, "Failure preparing request")
+		}
+		metricResult, partial, listErr = listAzureMetricPages(ctx, metricsClient, req)
+		return listErr
+	})
+	if err != nil {
+		return metricResult, false, err
+	}
+	if partial {
+		azureMonitorLog.Info("azure monitor truncated the metric response, the value is computed from part of the timeseries", "resourceURI", metricResourceURI, "metricName", azMetricRequest.MetricName, "maxPages", azureMonitorMaxMetricPages)
+	}
+	if azMetricRequest.DebugLogRawResponse {
+		logRawAzureMonitorResponse(metricResult)
+	}
+
+	return metricResult, partial, nil
+}
+
+// listAzureMetricPages sends the metrics request and follows the next links of a truncated response, merging the
+// timeseries of every page. Only links to the host of the first request are followed, the authorizer adds the
+// token to each of them.
+func listAzureMetricPages(ctx context.Context, client insights.MetricsClient, req *http.Request) (insights.Response, bool, error) {
+	page, err := sendAzureMonitorMetricsPage(client, req)
+	if err != nil {
+		return insights.Response{}, false, err
+	}
+	metricResult := page.Response
+
+	for pages := 1; page.NextLink != nil && *page.NextLink != ""; pages++ {
+		nextURL, err := url.Parse(*page.NextLink)
+		if err != nil || pages >= azureMonitorMaxMetricPages || !strings.EqualFold(nextURL.Host, req.URL.Host) {
+			return metricResult, true, nil
+		}
+
+		nextReq, err := autorest.Prepare((&http.Request{}).WithContext(ctx),
+			autorest.AsGet(),
+			autorest.WithBaseURL(*page.NextLink))
+		if err != nil {
+			return insights.Response{}, false, autorest.NewErrorWithError(err, "insights.MetricsClient", "List", nil, "Failure preparing next page request")
+		}
+		page, err = sendAzureMonitorMetricsPage(client, nextReq)
+		if err != nil {
+			return insights.Response{}, false, err
+		}
+		mergeAzureMonitorMetrics(&metricResult, page.Response)
+	}
+
+	return metricResult, false, nil
+}
+
+// sendAzureMonitorMetricsPage sends the request and reads the page like the SDK responder does, keeping the next link
+func sendAzureMonitorMetricsPage(client insights.MetricsClient, req *http.Request) (azureMonitorMetricsPage, error) {
+	var page azureMonitorMetricsPage
+	resp, err := client.ListSender(req)
+	if err != nil {
+		page.Response.Response = autorest.Response{Response: resp}
+		return page, autorest.NewErrorWithError(err, "insights.MetricsClient", "List", resp, "Failure sending request")
+	}
+
+	err = autorest.Respond(resp,
+		client.ByInspecting(),
+		azure.WithErrorUnlessStatusCode(http.StatusOK),
+		autorest.ByUnmarshallingJSON(&page),
+		autorest.ByClosing())
+	page.Response.Response = autorest.Response{Response: resp}
+	if err != nil {
+		return page, autorest.NewErrorWithError(err, "insights.MetricsClient", "List", resp, "Failure responding to request")
+	}
+	return page, nil
+}
+
+// mergeAzureMonitorMetrics appends the timeseries of the page to the metric of the same name in the result
+func mergeAzureMonitorMetrics(metricResult *insights.Response, page insights.Response) {
+	if page.Value == nil {
+		return
+	}
+	if metricResult.Value == nil {
+		metricResult.Value = &[]insights.Metric{}
+	}
+
+	metrics := *metricResult.Value
+	for _, pageMetric := range *page.Value {
+		merged := false
+		for i := range metrics {
+			if getResponseMetricName(metrics[i]) != getResponseMetricName(pageMetric) {
+				continue
+			}
+			if pageMetric.Timeseries != nil {
+				timeseries := []insights.TimeSeriesElement{}
+				if metrics[i].Timeseries != nil {
+					timeseries = append(timeseries, *metrics[i].Timeseries...)
+				}
+				timeseries = append(timeseries, *pageMetric.Timeseries...)
+				metrics[i].Timeseries = &timeseries
+			}
+			merged = true
+			break
+		}
+		if !merged {
+			metrics = append(metrics, pageMetric)
+		}
+	}
+	metricResult.Value = &metrics
+}
+
+// getResponseMetricName returns the name of the metric in the response, or its ID when the name is missing
+func getResponseMetricName(metric insights.Metric) string {
+	if metric.Name != nil && metric.Name.Value != nil {
+		return *metric.Name.Value
+	}
+	if metric.ID != nil {
+		return *metric.ID
+	}
+	return ""
+}
+
+// logRawAzureMonitorResponse logs the response as Azure Monitor returned it at V(4), with the subscription
+// and resource group IDs redacted
+func logRawAzureMonitorResponse(metricResult insights.Response) {
+	raw, err := json.Marshal(metricResult)
+	if err != nil {
+		azureMonitorLog.V(4).Info("unable to marshal raw azure monitor response", "error", err.Error())
+		return
+	}
+	redacted := azureMonitorResourceIDSegments.ReplaceAllString(string(raw), "${1}<redacted>")
+	azureMonitorLog.V(4).Info("raw azure monitor response", "response", redacted)
+}
+
+// retryAzureMonitorCall retries throttled and failed server side calls with exponential backoff, honoring Retry-After when Azure sends it
+func retryAzureMonitorCall(ctx context.Context, maxRetries int, call func() error) error {
+	retries := 0
+	defer func() { addAzureMonitorRetriesAttribute(ctx, retries) }()
+
+	for attempt := 0; ; attempt++ {
+		retries = attempt
+		err := call()
+		if err == nil || attempt >= maxRetries {
+			return err
+		}
+
+		retryable, delay := isRetryableAzureMonitorError(err)
+		if !retryable {
+			return err
+		}
+		if delay <= 0 {
+			delay = azureMonitorRetryBaseDelay * time.Duration(1<<uint(attempt))
+		}
+
+		azureMonitorLog.V(2).Info("retrying azure monitor call", "delay", delay.String(), "attempt", attempt+1, "error", err.Error())
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// isRetryableAzureMonitorError reports whether the call failed with 429 or 5xx and how long Azure asked us to wait
+func isRetryableAzureMonitorError(err error) (bool, time.Duration) {
+	detailedErr, ok := err.(autorest.DetailedError)
+	if !ok {
+		return false, 0
+	}
+
+	statusCode, ok := detailedErr.StatusCode.(int)
+	if !ok || (statusCode != http.StatusTooManyRequests && statusCode < http.StatusInternalServerError) {
+		return false, 0
+	}
+
+	if detailedErr.Response == nil {
+		return true, 0
+	}
+	return true, parseRetryAfter(detailedErr.Response.Header.Get("Retry-After"))
 }
 
-// GetAzureMetricValue returns the value of an Azure Monitor metric, rounded to the nearest int
-func GetAzureMetricValue(ctx context.Context, metricMetadata *azureMonitorMetadata) (int32, error) {
-	client := createMetricsClient(metricMetadata)
+// describeAzureMonitorError prefixes errors returned by the SDK with the HTTP status and the Azure error code
+// so that e.g. MetricNotFound can be told apart from InvalidAuthenticationToken
+func describeAzureMonitorError(err error) error {
+	var detailedErr autorest.DetailedError
+	if !errors.As(err, &detailedErr) || detailedErr.StatusCode == nil {
+		return err
+	}
 
-	requestPtr, err := createMetricsRequest(metricMetadata)
-	if err != nil {
-		return -1, err
+	var serviceErr *azure.ServiceError
+	switch original := detailedErr.Original.(type) {
+	case *azure.RequestError:
+		serviceErr = original.ServiceError
+	case azure.RequestError:
+		serviceErr = original.ServiceError
+	}
+	if serviceErr == nil || serviceErr.Code == "" {
+		return fmt.Errorf("status code %v: %w", detailedErr.StatusCode, err)
 	}
 
-	return executeRequest(client, requestPtr)
+	return fmt.Errorf("status code %v, error code %s: %w", detailedErr.StatusCode, serviceErr.Code, err)
 }
 
-func createMetricsClient(metadata *azureMonitorMetadata) insights.MetricsClient {
-	client := insights.NewMetricsClient(metadata.subscriptionID)
-	config := auth.NewClientCredentialsConfig(metadata.clientID, metadata.clientPassword, metadata.tenantID)
+// parseRetryAfter returns the delay in a Retry-After header given in seconds or as an HTTP date, or zero when it is
+// missing, invalid or in the past
+func parseRetryAfter(retryAfter string) time.Duration {
+	return parseRetryAfterAt(retryAfter, time.Now())
+}
 
-	authorizer, _ := config.Authorizer()
-	client.Authorizer = authorizer
+func parseRetryAfterAt(retryAfter string, now time.Time) time.Duration {
+	retryAfter = strings.TrimSpace(retryAfter)
+	if seconds, err := strconv.Atoi(retryAfter); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
 
-	return client
+	// http.ParseTime accepts the RFC 1123 date of HTTP/1.1 and the obsolete RFC 850 and ANSI C forms
+	retryAt, err := http.ParseTime(retryAfter)
+	if err != nil || !retryAt.After(now) {
+		return 0
+	}
+	return retryAt.Sub(now)
 }
 
-func createMetricsRequest(metadata *azureMonitorMetadata) (*azureExternalMetricRequest, error) {
-	metricRequest := azureExternalMetricRequest{
-		MetricName:     metadata.name,
-		SubscriptionID: metadata.subscriptionID,
-		Aggregation:    metadata.aggregationType,
-		Filter:         metadata.filter,
-		ResourceGroup:  metadata.resourceGroupName,
+func extractValue(azMetricRequest azureExternalMetricRequest, metricResult insights.Response) (azureMetricValue, error) {
+	if metricResult.Value == nil {
+		err := fmt.Errorf("Got a response without a metric list for metric %s/%s and aggregate type %s", azMetricRequest.ResourceProviderNamespace, azMetricRequest.MetricName, azMetricRequest.Aggregation)
+		return azureMetricValue{}, err
+	}
+	metricVals := *metricResult.Value
+
+	if len(metricVals) == 0 {
+		err := fmt.Errorf("Got an empty response for metric %s/%s and aggregate type %s", azMetricRequest.ResourceProviderNamespace, azMetricRequest.MetricName, azMetricRequest.Aggregation)
+		return azureMetricValue{}, err
 	}
 
-	resourceInfo := strings.Split(metadata.resourceURI, "/")
-	metricRequest.ResourceProviderNamespace = resourceInfo[0]
-	metricRequest.ResourceType = resourceInfo[1]
-	metricRequest.ResourceName = resourceInfo[2]
+	// a nil pointer means Azure Monitor left the field out, a nil or empty slice that there is no data
+	if metricVals[0].Timeseries == nil {
+		err := fmt.Errorf("Got metric result for %s/%s and aggregate type %s without a timeseries list: %w", azMetricRequest.ResourceProviderNamespace, azMetricRequest.MetricName, azMetricRequest.Aggregation, ErrNoMetricData)
+		return azureMetricValue{}, err
+	}
+	timeseries := getTopTimeseries(*metricVals[0].Timeseries, azMetricRequest.Top)
+	if len(timeseries) == 0 {
+		err := fmt.Errorf("Got metric result for %s/%s and aggregate type %s without timeseries: %w", azMetricRequest.ResourceProviderNamespace, azMetricRequest.MetricName, azMetricRequest.Aggregation, ErrNoMetricData)
+		return azureMetricValue{}, err
+	}
 
-	// if no timespan is provided, defaults to 5 minutes
-	timespan, err := formatTimeSpan(metadata.aggregationInterval)
-	if err != nil {
-		return nil, err
+	if len(timeseries) > 1 {
+		azureMonitorLog.Info("combining multiple timeseries", "resourceURI", azMetricRequest.metricResourceURI(), "metricName", azMetricRequest.MetricName, "aggregation", azMetricRequest.Aggregation, "timeseries", len(timeseries))
 	}
 
-	metricRequest.Timespan = timespan
+	hasData := false
+	values := make([]float64, 0, len(timeseries))
+	var timestamp time.Time
+	// Last is the newest data point of all timeseries, of the series that have it the first one wins
+	var newest float64
+	for _, series := range timeseries {
+		if series.Data == nil || *series.Data == nil {
+			continue
+		}
+		data := *series.Data
+		hasData = true
 
-	return &metricRequest, nil
-}
+		if azMetricRequest.Percentile != nil {
+			dataPointValues, valueTimestamp := getDataPointValues(azMetricRequest.Aggregation, data)
+			values = append(values, dataPointValues...)
+			if valueTimestamp.After(timestamp) {
+				timestamp = valueTimestamp
+			}
+			continue
+		}
 
-func executeRequest(client insights.MetricsClient, request *azureExternalMetricRequest) (int32, error) {
-	metricResponse, err := getAzureMetric(client, *request)
-	if err != nil {
-		azureMonitorLog.Error(err, "error getting azure monitor metric")
-		return -1, fmt.Errorf("Error getting azure monitor metric %s: %s", request.MetricName, err.Error())
+		valuePtr, valueTimestamp, err := verifyAggregationTypeIsSupported(azMetricRequest.Aggregation, data)
+		if err != nil {
+			continue
+		}
+		if len(values) == 0 || valueTimestamp.After(timestamp) {
+			newest = *valuePtr
+		}
+		values = append(values, *valuePtr)
+		if valueTimestamp.After(timestamp) {
+			timestamp = valueTimestamp
+		}
 	}
 
-	// casting drops everything after decimal, so round first
-	metricValue := int32(math.Round(metricResponse))
+	if !hasData {
+		err := fmt.Errorf("Got metric result for %s/%s and aggregate type %s without any metric values: %w", azMetricRequest.ResourceProviderNamespace, azMetricRequest.MetricName, azMetricRequest.Aggregation, ErrNoMetricData)
+		return azureMetricValue{}, err
+	}
+
+	if len(values) == 0 {
+		// the aggregation type is often not one the metric supports, list the ones Azure Monitor did return
+		present := getPresentAggregationFields(timeseries)
+		if len(present) == 0 {
+			return azureMetricValue{}, fmt.Errorf("Unable to get value for metric %s/%s with aggregation %s. No value returned by Azure Monitor for any aggregation", azMetricRequest.ResourceProviderNamespace, azMetricRequest.MetricName, azMetricRequest.Aggregation)
+		}
+		return azureMetricValue{}, fmt.Errorf("Unable to get value for metric %s/%s with aggregation %s. No value returned by Azure Monitor, the returned data has values for %s", azMetricRequest.ResourceProviderNamespace, azMetricRequest.MetricName, azMetricRequest.Aggregation, strings.Join(present, ", "))
+	}
+
+	value := combineTimeseriesValues(azMetricRequest.Aggregation, values)
+	if azMetricRequest.Percentile != nil {
+		value = getPercentile(values, *azMetricRequest.Percentile)
+	} else if azMetricRequest.Aggregation == azureMonitorLastAggregation {
+		value = newest
+	}
+	unit := metricVals[0].Unit
+
+	azureMonitorLog.V(2).Info("got azure monitor metric value", "resourceURI", azMetricRequest.metricResourceURI(), "metricName", azMetricRequest.MetricName, "aggregation", azMetricRequest.Aggregation, "value", value, "unit", string(unit))
+
+	metricValue := azureMetricValue{Value: value, Unit: unit, Timestamp: timestamp}
+	now := time.Now()
+	if !azMetricRequest.Anchor.IsZero() {
+		now = azMetricRequest.Anchor
+	}
+	if isStaleMetricValue(metricValue, azMetricRequest.Window, now) {
+		azureMonitorLog.Info("scaling on a stale azure monitor data point", "resourceURI", azMetricRequest.metricResourceURI(), "metricName", azMetricRequest.MetricName, "timestamp", timestamp.Format(time.RFC3339), "window", azMetricRequest.Window.String())
+	}
 
 	return metricValue, nil
 }
 
-func getAzureMetric(client insights.MetricsClient, azMetricRequest azureExternalMetricRequest) (float64, error) {
-	err := azMetricRequest.validate()
-	if err != nil {
-		return -1, err
+// isStaleMetricValue reports whether the data point the value was read from is older than the aggregation window
+func isStaleMetricValue(value azureMetricValue, window time.Duration, now time.Time) bool {
+	if value.Timestamp.IsZero() || window <= 0 {
+		return false
+	}
+	return now.Sub(value.Timestamp) > window
+}
+
+// getDataPointValues returns the aggregation value of every data point that has one, and the timestamp of the newest
+func getDataPointValues(aggregationType insights.AggregationType, data []insights.MetricValue) ([]float64, time.Time) {
+	values := make([]float64, 0, len(data))
+	var timestamp time.Time
+	for _, dataPoint := range data {
+		valuePtr, err := getAggregationValue(aggregationType, dataPoint)
+		if err != nil || valuePtr == nil {
+			continue
+		}
+		values = append(values, *valuePtr)
+		if dataPoint.TimeStamp != nil && dataPoint.TimeStamp.ToTime().After(timestamp) {
+			timestamp = dataPoint.TimeStamp.ToTime()
+		}
+	}
+	return values, timestamp
+}
+
+// getPercentile returns the percentile of the values, interpolating linearly between the two closest ranks
+func getPercentile(values []float64, percentile float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	rank := percentile / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+// combineTimeseriesValues merges the values of a metric split across dimensions the same way Azure Monitor aggregates them.
+// Last is not combined, extractValue takes the newest data point of the timeseries instead.
+func combineTimeseriesValues(aggregationType insights.AggregationType, values []float64) float64 {
+	result := values[0]
+	switch {
+	case aggregationType == insights.Maximum:
+		for _, value := range values[1:] {
+			result = math.Max(result, value)
+		}
+	case aggregationType == insights.Minimum:
+		for _, value := range values[1:] {
+			result = math.Min(result, value)
+		}
+	default:
+		for _, value := range values[1:] {
+			result += value
+		}
+		if aggregationType == insights.Average {
+			result /= float64(len(values))
+		}
+	}
+	return result
+}
+
+// extractValuesByDimension returns the value of every timeseries keyed by its value for the DimensionGroupBy dimension
+func extractValuesByDimension(azMetricRequest azureExternalMetricRequest, metricResult insights.Response) (map[string]float64, error) {
+	if metricResult.Value == nil || len(*metricResult.Value) == 0 {
+		return nil, fmt.Errorf("Got an empty response for metric %s/%s and aggregate type %s", azMetricRequest.ResourceProviderNamespace, azMetricRequest.MetricName, azMetricRequest.Aggregation)
+	}
+
+	timeseries := (*metricResult.Value)[0].Timeseries
+	if timeseries == nil || len(*timeseries) == 0 {
+		return nil, fmt.Errorf("Got metric result for %s/%s and aggregate type %s without timeseries: %w", azMetricRequest.ResourceProviderNamespace, azMetricRequest.MetricName, azMetricRequest.Aggregation, ErrNoMetricData)
+	}
+
+	dimensionValues := map[string][]float64{}
+	for _, series := range getTopTimeseries(*timeseries, azMetricRequest.Top) {
+		if series.Data == nil {
+			continue
+		}
+		valuePtr, _, err := verifyAggregationTypeIsSupported(azMetricRequest.Aggregation, *series.Data)
+		if err != nil {
+			continue
+		}
+
+		dimension := getDimensionValue(azMetricRequest.DimensionGroupBy, series.Metadatavalues)
+		dimensionValues[dimension] = append(dimensionValues[dimension], *valuePtr)
+	}
+
+	if len(dimensionValues) == 0 {
+		return nil, fmt.Errorf("Got metric result for %s/%s and aggregate type %s without any metric values: %w", azMetricRequest.ResourceProviderNamespace, azMetricRequest.MetricName, azMetricRequest.Aggregation, ErrNoMetricData)
+	}
+
+	values := make(map[string]float64, len(dimensionValues))
+	for dimension, dimensionValue := range dimensionValues {
+		values[dimension] = combineTimeseriesValues(azMetricRequest.Aggregation, dimensionValue)
+	}
+	return values, nil
+}
+
+// getTopTimeseries returns the first top timeseries, which Azure Monitor sorts by orderBy. The merged pages of a
+// response can hold more timeseries than were asked for.
+func getTopTimeseries(timeseries []insights.TimeSeriesElement, top int32) []insights.TimeSeriesElement {
+	if top <= 0 || len(timeseries) <= int(top) {
+		return timeseries
+	}
+	return timeseries[:top]
+}
+
+// getDimensionValue returns the value of the named dimension in the timeseries metadata, or an empty string when it is missing
+func getDimensionValue(dimension string, metadataValues *[]insights.MetadataValue) string {
+	if metadataValues == nil {
+		return ""
 	}
+	for _, metadataValue := range *metadataValues {
+		if metadataValue.Name == nil || metadataValue.Name.Value == nil || metadataValue.Value == nil {
+			continue
+		}
+		if strings.EqualFold(*metadataValue.Name.Value, dimension) {
+			return *metadataValue.Value
+		}
+	}
+	return ""
+}
 
+// validateMetricDefinition checks that the metric exists on the resource and supports the dimensions used in the filter,
+// since Azure Monitor answers a filter on an unknown dimension with an empty result instead of an error
+func validateMetricDefinition(ctx context.Context, lister azureMetricDefinitionsLister, azMetricRequest azureExternalMetricRequest) error {
 	metricResourceURI := azMetricRequest.metricResourceURI()
-	klog.V(2).Infof("resource uri: %s", metricResourceURI)
+	definitions, err := azureMonitorMetricDefinitions.get(ctx, lister, metricResourceURI, azMetricRequest.MetricNamespace)
+	if err != nil {
+		return fmt.Errorf("error getting azure monitor metric definitions for %s: %w", metricResourceURI, describeAzureMonitorError(err))
+	}
+
+	var definition *insights.MetricDefinition
+	names := make([]string, 0, len(definitions))
+	for i := range definitions {
+		if definitions[i].Name == nil || definitions[i].Name.Value == nil {
+			continue
+		}
+		if strings.EqualFold(*definitions[i].Name.Value, azMetricRequest.MetricName) {
+			definition = &definitions[i]
+			break
+		}
+		names = append(names, *definitions[i].Name.Value)
+	}
+	if definition == nil {
+		return fmt.Errorf("metric %s not found for resource %s. Did you mean: %s", azMetricRequest.MetricName, metricResourceURI, strings.Join(suggestMetricNames(azMetricRequest.MetricName, names, azureMonitorMetricSuggestions), ", "))
+	}
+
+	if err := validateMetricAggregation(*definition, azMetricRequest); err != nil {
+		return err
+	}
+
+	dimensions := []string{}
+	if definition.Dimensions != nil {
+		for _, dimension := range *definition.Dimensions {
+			if dimension.Value != nil {
+				dimensions = append(dimensions, *dimension.Value)
+			}
+		}
+	}
 
-	metricResult, err := client.List(context.Background(), metricResourceURI,
-		azMetricRequest.Timespan, nil,
-		azMetricRequest.MetricName, azMetricRequest.Aggregation, nil,
-		"", azMetricRequest.Filter, "", "")
+	for _, used := range getFilterDimensions(azMetricRequest) {
+		supported := false
+		for _, dimension := range dimensions {
+			supported = supported || strings.EqualFold(dimension, used)
+		}
+		if !supported {
+			return fmt.Errorf("dimension %s not supported by metric %s. Supported dimensions: %s", used, azMetricRequest.MetricName, strings.Join(dimensions, ", "))
+		}
+	}
+	return nil
+}
+
+// validateMetricAggregation checks that the metric supports the aggregation of the request. Last and DataPointCount are
+// worked out from whichever fields the metric has, and definitions without supported aggregations are not checked.
+func validateMetricAggregation(definition insights.MetricDefinition, azMetricRequest azureExternalMetricRequest) error {
+	if azMetricRequest.Aggregation == azureMonitorLastAggregation || azMetricRequest.Aggregation == azureMonitorDataPointCountAggregation {
+		return nil
+	}
+	if definition.SupportedAggregationTypes == nil || len(*definition.SupportedAggregationTypes) == 0 {
+		return nil
+	}
+
+	supported := make([]string, 0, len(*definition.SupportedAggregationTypes))
+	for _, aggregation := range *definition.SupportedAggregationTypes {
+		if strings.EqualFold(string(aggregation), string(azMetricRequest.Aggregation)) {
+			return nil
+		}
+		supported = append(supported, string(aggregation))
+	}
+	return fmt.Errorf("aggregation %s not supported by metric %s. Supported aggregations: %s", azMetricRequest.Aggregation, azMetricRequest.MetricName, strings.Join(supported, ", "))
+}
+
+// listAvailableMetrics returns the sorted names of the metrics the resource of the request supports
+func listAvailableMetrics(ctx context.Context, lister azureMetricDefinitionsLister, azMetricRequest azureExternalMetricRequest) ([]string, error) {
+	metricResourceURI := azMetricRequest.metricResourceURI()
+	definitions, err := azureMonitorMetricDefinitions.get(ctx, lister, metricResourceURI, azMetricRequest.MetricNamespace)
 	if err != nil {
-		return -1, err
+		return nil, fmt.Errorf("error getting azure monitor metric definitions for %s: %w", metricResourceURI, describeAzureMonitorError(err))
 	}
 
-	value, err := extractValue(azMetricRequest, metricResult)
+	names := make([]string, 0, len(definitions))
+	for _, definition := range definitions {
+		if definition.Name != nil && definition.Name.Value != nil {
+			names = append(names, *definition.Name.Value)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
 
-	return value, err
+// suggestMetricNames returns up to max of the available metric names closest to the unknown name, so a typo
+// in metricName can be fixed without listing every metric of the resource
+func suggestMetricNames(name string, available []string, max int) []string {
+	suggestions := append([]string{}, available...)
+	distances := make(map[string]int, len(suggestions))
+	for _, suggestion := range suggestions {
+		distances[suggestion] = getEditDistance(strings.ToLower(name), strings.ToLower(suggestion))
+	}
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		if distances[suggestions[i]] != distances[suggestions[j]] {
+			return distances[suggestions[i]] < distances[suggestions[j]]
+		}
+		return suggestions[i] < suggestions[j]
+	})
+
+	if len(suggestions) > max {
+		suggestions = suggestions[:max]
+	}
+	return suggestions
 }
 
-func extractValue(azMetricRequest azureExternalMetricRequest, metricResult insights.Response) (float64, error) {
-	metricVals := *metricResult.Value
+// getEditDistance is the Levenshtein distance between a and b
+func getEditDistance(a string, b string) int {
+	source, target := []rune(a), []rune(b)
+	previous := make([]int, len(target)+1)
+	for j := range previous {
+		previous[j] = j
+	}
 
-	if len(metricVals) == 0 {
-		err := fmt.Errorf("Got an empty response for metric %s/%s and aggregate type %s", azMetricRequest.ResourceProviderNamespace, azMetricRequest.MetricName, insights.AggregationType(strings.ToTitle(azMetricRequest.Aggregation)))
-		return -1, err
+	for i := 1; i <= len(source); i++ {
+		current := make([]int, len(target)+1)
+		current[0] = i
+		for j := 1; j <= len(target); j++ {
+			cost := 1
+			if source[i-1] == target[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(minInt(previous[j]+1, current[j-1]+1), previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(target)]
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
 	}
+	return b
+}
 
-	timeseries := *metricVals[0].Timeseries
-	if timeseries == nil {
-		err := fmt.Errorf("Got metric result for %s/%s and aggregate type %s without timeseries", azMetricRequest.ResourceProviderNamespace, azMetricRequest.MetricName, insights.AggregationType(strings.ToTitle(azMetricRequest.Aggregation)))
-		return -1, err
+// getFilterDimensions returns the dimensions the request filters or splits on
+func getFilterDimensions(azMetricRequest azureExternalMetricRequest) []string {
+	dimensions := []string{}
+	for _, condition := range azureMonitorFilterCondition.FindAllStringSubmatch(azMetricRequest.Filter, -1) {
+		dimensions = append(dimensions, condition[1])
+	}
+	if azMetricRequest.DimensionGroupBy != "" {
+		dimensions = append(dimensions, azMetricRequest.DimensionGroupBy)
 	}
+	return dimensions
+}
+
+// get returns the cached metric definitions of the resource, listing them on the first call and again once they are
+// older than the ttl. Errors are not cached. The lock is not held while listing, so concurrent misses for the same
+// key may each list the definitions once.
+func (c *azureMonitorMetricDefinitionCache) get(ctx context.Context, lister azureMetricDefinitionsLister, resourceURI string, metricNamespace string) ([]insights.MetricDefinition, error) {
+	key := strings.ToLower(resourceURI + "|" + metricNamespace)
 
-	data := *timeseries[0].Data
-	if data == nil {
-		err := fmt.Errorf("Got metric result for %s/%s and aggregate type %s without any metric values", azMetricRequest.ResourceProviderNamespace, azMetricRequest.MetricName, insights.AggregationType(strings.ToTitle(azMetricRequest.Aggregation)))
-		return -1, err
+	c.lock.Lock()
+	entry, ok := c.entries[key]
+	c.lock.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.definitions, nil
 	}
 
-	valuePtr, err := verifyAggregationTypeIsSupported(azMetricRequest.Aggregation, data)
+	result, err := lister.List(ctx, resourceURI, metricNamespace)
 	if err != nil {
-		return -1, fmt.Errorf("Unable to get value for metric %s/%s with aggregation %s. No value returned by Azure Monitor", azMetricRequest.ResourceProviderNamespace, azMetricRequest.MetricName, azMetricRequest.Aggregation)
+		return nil, err
+	}
+	var definitions []insights.MetricDefinition
+	if result.Value != nil {
+		definitions = *result.Value
 	}
 
-	klog.V(2).Infof("metric type: %s %f", azMetricRequest.Aggregation, *valuePtr)
+	c.lock.Lock()
+	c.entries[key] = azureMonitorMetricDefinitionEntry{definitions: definitions, expires: time.Now().Add(c.ttl)}
+	c.lock.Unlock()
+	return definitions, nil
+}
+
+// dimensionFilter adds a wildcard for DimensionGroupBy to the filter so Azure Monitor returns one timeseries per dimension value
+func (amr azureExternalMetricRequest) dimensionFilter() string {
+	return amr.dimensionsFilter([]string{amr.DimensionGroupBy})
+}
 
-	return *valuePtr, nil
+// dimensionsFilter adds a <dimension> eq '*' clause for each of the dimensions to the filter, which makes Azure Monitor
+// return a timeseries per combination of their values
+func (amr azureExternalMetricRequest) dimensionsFilter(dimensions []string) string {
+	clauses := make([]string, 0, len(dimensions)+1)
+	if amr.Filter != "" {
+		clauses = append(clauses, amr.Filter)
+	}
+	for _, dimension := range dimensions {
+		clauses = append(clauses, fmt.Sprintf("%s eq '*'", dimension))
+	}
+	return strings.Join(clauses, " and ")
 }
 
 func (amr azureExternalMetricRequest) validate() error {
 	if amr.MetricName == "" {
 		return fmt.Errorf("metricName is required")
 	}
-	if amr.ResourceGroup == "" {
+	if amr.ResourceGroup == "" && amr.Scope != azureMonitorSubscriptionScope {
 		return fmt.Errorf("resourceGroup is required")
 	}
 	if amr.SubscriptionID == "" {
@@ -153,50 +2244,406 @@ func (amr azureExternalMetricRequest) validate() error {
 	return nil
 }
 
+// String prints the query the request sends to Azure Monitor
+func (amr azureExternalMetricRequest) String() string {
+	return fmt.Sprintf("metricName=%s resourceURI=%s metricNamespace=%s aggregation=%s timespan=%s interval=%s filter=%s",
+		amr.MetricName, amr.metricResourceURI(), amr.MetricNamespace, amr.Aggregation, amr.Timespan, amr.Granularity, amr.Filter)
+}
+
+// metricResourceURI uses the resource subscription when set, and the subscription used to authenticate otherwise.
+// Resources at subscription scope have no resource group in their ID.
 func (amr azureExternalMetricRequest) metricResourceURI() string {
+	subscriptionID := amr.ResourceSubscriptionID
+	if subscriptionID == "" {
+		subscriptionID = amr.SubscriptionID
+	}
+
+	if amr.Scope == azureMonitorSubscriptionScope {
+		return fmt.Sprintf("/subscriptions/%s/providers/%s/%s/%s",
+			subscriptionID,
+			amr.ResourceProviderNamespace,
+			amr.ResourceType,
+			amr.ResourceName)
+	}
+
 	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/%s/%s/%s",
-		amr.SubscriptionID,
+		subscriptionID,
 		amr.ResourceGroup,
 		amr.ResourceProviderNamespace,
 		amr.ResourceType,
 		amr.ResourceName)
 }
 
-// formatTimeSpan defaults to a 5 minute timespan if the user does not provide one
-func formatTimeSpan(timeSpan string) (string, error) {
-	endtime := time.Now().UTC().Format(time.RFC3339)
-	starttime := time.Now().Add(-(5 * time.Minute)).UTC().Format(time.RFC3339)
-	if timeSpan != "" {
-		aggregationInterval := strings.Split(timeSpan, ":")
-		hours, herr := strconv.Atoi(aggregationInterval[0])
-		minutes, merr := strconv.Atoi(aggregationInterval[1])
-		seconds, serr := strconv.Atoi(aggregationInterval[2])
+// parseAzureResourceURI accepts namespace/resource_type/resource_name, nested child resources such as
+// Microsoft.Web/sites/mysite/slots/staging, and full /subscriptions/.../resourceGroups/.../providers/... resource IDs.
+// In the subscription scope it also accepts /subscriptions/.../providers/... resource IDs without a resource group.
+func parseAzureResourceURI(resourceURI string, scope string) (azureResourceInfo, error) {
+	info := azureResourceInfo{}
+	segments := strings.Split(strings.Trim(resourceURI, "/"), "/")
+
+	if strings.EqualFold(segments[0], "subscriptions") && scope == azureMonitorSubscriptionScope && len(segments) >= 3 && strings.EqualFold(segments[2], "providers") {
+		info.SubscriptionID = segments[1]
+		segments = segments[3:]
+	} else if strings.EqualFold(segments[0], "subscriptions") {
+		if len(segments) < 6 || !strings.EqualFold(segments[2], "resourceGroups") || !strings.EqualFold(segments[4], "providers") {
+			return info, fmt.Errorf("resourceURI %s is not a valid resource ID. Should be /subscriptions/<subscription>/resourceGroups/<group>/providers/<namespace>/<resource_type>/<resource_name>", resourceURI)
+		}
+		info.SubscriptionID = segments[1]
+		info.ResourceGroup = segments[3]
+		segments = segments[5:]
+	}
+
+	// the provider namespace is followed by one or more resource_type/resource_name pairs, checked before any
+	// segment is indexed so that a short resourceURI fails with a clear message
+	if len(segments) < 3 || len(segments)%2 == 0 {
+		return info, fmt.Errorf("resourceURI must be in the form <provider>/<type>/<name>, got %q", resourceURI)
+	}
+	for _, segment := range segments {
+		if segment == "" {
+			return info, fmt.Errorf("resourceURI %s contains an empty segment", resourceURI)
+		}
+	}
+
+	info.ProviderNamespace = segments[0]
+	info.ResourceType = segments[1]
+	info.ResourceName = strings.Join(segments[2:], "/")
+	return info, nil
+}
+
+// formatTimeSpan defaults to a 5 minute timespan if the user does not provide one.
+// The window ends aggregationDelay before now so that it only covers data Azure Monitor has settled. With alignToMinute
+// it ends at the start of that minute and starts on a minute boundary, so that it only covers complete minutes.
+func formatTimeSpan(timeSpan string, aggregationDelay string, maxRetention time.Duration, alignToMinute bool) (string, error) {
+	return formatTimeSpanAt(timeSpan, aggregationDelay, maxRetention, alignToMinute, time.Now())
+}
 
-		if herr != nil || merr != nil || serr != nil {
-			return "", fmt.Errorf("Errors parsing metricAggregationInterval: %v, %v, %v", herr, merr, serr)
+// formatTimeSpanAt formats the timespan of the window ending aggregationDelay before now
+func formatTimeSpanAt(timeSpan string, aggregationDelay string, maxRetention time.Duration, alignToMinute bool, now time.Time) (string, error) {
+	delay := time.Duration(0)
+	if aggregationDelay != "" {
+		var err error
+		delay, err = parseTimeSpanDuration("metricAggregationDelay", aggregationDelay)
+		if err != nil {
+			return "", err
 		}
+	}
+
+	duration, err := getAggregationWindow(timeSpan)
+	if err != nil {
+		return "", err
+	}
+
+	if maxRetention <= 0 {
+		maxRetention = defaultAzureMonitorMaxRetention
+	}
+	if duration+delay > maxRetention {
+		return "", fmt.Errorf("metricAggregationInterval %s with metricAggregationDelay %s reaches back further than the %s Azure Monitor retains metrics for", duration, delay, maxRetention)
+	}
 
-		starttime = time.Now().Add(-(time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute + time.Duration(seconds)*time.Second)).UTC().Format(time.RFC3339)
+	end := now.Add(-delay)
+	start := end.Add(-duration)
+	if alignToMinute {
+		end = end.Truncate(time.Minute)
+		start = end.Add(-duration).Truncate(time.Minute)
 	}
+	endtime := end.UTC().Format(time.RFC3339)
+	starttime := start.UTC().Format(time.RFC3339)
 	return fmt.Sprintf("%s/%s", starttime, endtime), nil
 }
 
-func verifyAggregationTypeIsSupported(aggregationType string, data []insights.MetricValue) (*float64, error) {
-	var valuePtr *float64
-	if strings.EqualFold(string(insights.Average), aggregationType) && data[len(data)-1].Average != nil {
-		valuePtr = data[len(data)-1].Average
-	} else if strings.EqualFold(string(insights.Total), aggregationType) && data[len(data)-1].Total != nil {
-		valuePtr = data[len(data)-1].Total
-	} else if strings.EqualFold(string(insights.Maximum), aggregationType) && data[len(data)-1].Maximum != nil {
-		valuePtr = data[len(data)-1].Maximum
-	} else if strings.EqualFold(string(insights.Minimum), aggregationType) && data[len(data)-1].Minimum != nil {
-		valuePtr = data[len(data)-1].Minimum
-	} else if strings.EqualFold(string(insights.Count), aggregationType) && data[len(data)-1].Count != nil {
-		fValue := float64(*data[len(data)-1].Count)
-		valuePtr = &fValue
-	} else {
-		err := fmt.Errorf("Unsupported aggregation type %s", insights.AggregationType(strings.ToTitle(aggregationType)))
+// queryTime is the time the queried window ends at before the aggregationDelay, the anchor when set and now otherwise
+func (m *azureMonitorMetadata) queryTime() time.Time {
+	if m.anchor.IsZero() {
+		return time.Now()
+	}
+	return m.anchor
+}
+
+// getAggregationWindow returns the length of the queried window, defaulting to azureMonitorDefaultAggregationWindow
+func getAggregationWindow(timeSpan string) (time.Duration, error) {
+	if timeSpan == "" {
+		return azureMonitorDefaultAggregationWindow, nil
+	}
+	return parseAggregationInterval("metricAggregationInterval", timeSpan)
+}
+
+// parseAggregationInterval accepts the hh:mm:ss form as well as ISO 8601 durations such as PT5M used by other Azure
+// tooling, told apart by the leading P. Values mixing both forms are rejected rather than guessed.
+func parseAggregationInterval(name string, value string) (time.Duration, error) {
+	if !strings.HasPrefix(strings.ToUpper(value), "P") {
+		return parseTimeSpanDuration(name, value)
+	}
+	if strings.Contains(value, ":") {
+		return 0, fmt.Errorf("%s %q mixes the ISO 8601 and hh:mm:ss forms. Should be e.g. PT5M or 00:05:00", name, value)
+	}
+	return parseISO8601Duration(name, value)
+}
+
+// parseTimeSpanDuration converts a hh:mm:ss metadata value into a duration
+func parseTimeSpanDuration(name string, timeSpan string) (time.Duration, error) {
+	aggregationInterval := strings.Split(timeSpan, ":")
+	if len(aggregationInterval) != 3 {
+		return 0, fmt.Errorf("%s must be HH:MM:SS, got %q", name, timeSpan)
+	}
+
+	hours, herr := strconv.Atoi(aggregationInterval[0])
+	minutes, merr := strconv.Atoi(aggregationInterval[1])
+	seconds, serr := strconv.Atoi(aggregationInterval[2])
+
+	if herr != nil || merr != nil || serr != nil {
+		return 0, fmt.Errorf("Errors parsing %s: %v, %v, %v", name, herr, merr, serr)
+	}
+	if hours < 0 || minutes < 0 || seconds < 0 {
+		return 0, fmt.Errorf("%s must not contain negative values, got %q", name, timeSpan)
+	}
+
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute + time.Duration(seconds)*time.Second, nil
+}
+
+// expandMetricFilterTemplate substitutes the variables of the ScaledObject into a metricFilter template. A variable
+// that is not known for the trigger fails the expansion, quotes in the values are escaped for the filter.
+func expandMetricFilterTemplate(filter string, vars azureMonitorTemplateVars) (string, error) {
+	if !strings.Contains(filter, "{{") {
+		return filter, nil
+	}
+
+	values := map[string]string{}
+	for name, value := range map[string]string{"Name": vars.Name, "Namespace": vars.Namespace} {
+		if value != "" {
+			values[name] = strings.Replace(value, "'", "''", -1)
+		}
+	}
+
+	tmpl, err := template.New("metricFilter").Option("missingkey=error").Parse(filter)
+	if err != nil {
+		return "", fmt.Errorf("metricFilter %q is not a valid template: %s", filter, err)
+	}
+	var expanded strings.Builder
+	if err := tmpl.Execute(&expanded, values); err != nil {
+		return "", fmt.Errorf("metricFilter %q references a variable that is not known for the trigger, the variables are .Name and .Namespace of the ScaledObject: %s", filter, err)
+	}
+	return expanded.String(), nil
+}
+
+// validateStrictTimeSpan checks that the minutes and seconds of a hh:mm:ss metadata value are below 60, so that
+// "00:00:90" is rejected instead of being read as 90 seconds. ISO 8601 durations are left to their own parser.
+func validateStrictTimeSpan(name string, timeSpan string) error {
+	parts := strings.Split(timeSpan, ":")
+	if len(parts) != 3 {
+		return nil
+	}
+	for i, unit := range []string{"minutes", "seconds"} {
+		value, err := strconv.Atoi(parts[i+1])
+		if err == nil && value >= 60 {
+			return fmt.Errorf("%s %q has %d %s, strictInterval requires 0-59", name, timeSpan, value, unit)
+		}
+	}
+	return nil
+}
+
+// formatTimeSpanDuration formats a window as the HH:MM:SS used by metricAggregationInterval
+func formatTimeSpanDuration(duration time.Duration) string {
+	return fmt.Sprintf("%02d:%02d:%02d", int(duration.Hours()), int(duration.Minutes())%60, int(duration.Seconds())%60)
+}
+
+// validateSubscriptionID checks that the named subscription metadata value is a GUID
+func validateSubscriptionID(name string, subscriptionID string) error {
+	if !azureSubscriptionIDExpression.MatchString(subscriptionID) {
+		return fmt.Errorf("%s %q is not a valid subscription ID. Should be a GUID", name, subscriptionID)
+	}
+	return nil
+}
+
+// validateResourceGroupName checks the resource group against Azure's naming rules
+func validateResourceGroupName(resourceGroup string) error {
+	if utf8.RuneCountInString(resourceGroup) > 90 {
+		return fmt.Errorf("resourceGroupName %q is longer than 90 characters", resourceGroup)
+	}
+	if !azureResourceGroupExpression.MatchString(resourceGroup) {
+		return fmt.Errorf("resourceGroupName %q is not valid. Should only contain letters, digits, underscores, hyphens, periods and parentheses and not end with a period", resourceGroup)
+	}
+	return nil
+}
+
+// parseISO8601Duration converts an ISO 8601 duration made of days, hours, minutes and seconds into a duration
+func parseISO8601Duration(name string, value string) (time.Duration, error) {
+	parts := azureMonitorISO8601Duration.FindStringSubmatch(strings.ToUpper(value))
+	if parts == nil || strings.HasSuffix(value, "T") {
+		return 0, fmt.Errorf("%s must be an ISO 8601 duration such as PT1M, got %q", name, value)
+	}
+
+	duration := time.Duration(0)
+	for i, unit := range []time.Duration{24 * time.Hour, time.Hour, time.Minute, time.Second} {
+		if parts[i+1] == "" {
+			continue
+		}
+		amount, err := strconv.Atoi(parts[i+1])
+		if err != nil {
+			return 0, fmt.Errorf("Error parsing %s: %s", name, err)
+		}
+		duration += time.Duration(amount) * unit
+	}
+
+	if duration <= 0 {
+		return 0, fmt.Errorf("%s must be greater than zero, got %q", name, value)
+	}
+	return duration, nil
+}
+
+// validateMetricFilter does a light check of the filter grammar so a malformed filter fails at parse time
+// instead of coming back as a 400 from Azure Monitor
+func validateMetricFilter(filter string) error {
+	if filter == "" || azureMonitorFilterExpression.MatchString(filter) {
+		return nil
+	}
+	return fmt.Errorf("metricFilter %q not in the correct format. Should be dimension eq 'value' optionally combined with and/or", filter)
+}
+
+// buildMetricFilter compiles a filter matching any of the values of the dimension with "or", or all of them with "and".
+// Single quotes in the values are escaped the OData way by doubling them.
+func buildMetricFilter(dimension string, values []string, op string) string {
+	conditions := make([]string, 0, len(values))
+	for _, value := range values {
+		conditions = append(conditions, fmt.Sprintf("%s eq '%s'", dimension, strings.Replace(value, "'", "''", -1)))
+	}
+	return strings.Join(conditions, " "+op+" ")
+}
+
+// parseMetricOrderBy checks that orderBy is an Azure Monitor aggregation followed by asc or desc, such as "Total desc",
+// and returns it with their canonical spelling
+func parseMetricOrderBy(orderBy string) (string, error) {
+	fields := strings.Fields(orderBy)
+	if len(fields) != 2 {
+		return "", fmt.Errorf("orderBy %q must be an aggregation and a direction, such as \"Total desc\"", orderBy)
+	}
+
+	direction := strings.ToLower(fields[1])
+	if direction != "asc" && direction != "desc" {
+		return "", fmt.Errorf("orderBy direction %s not supported. Should be asc or desc", fields[1])
+	}
+
+	names := make([]string, 0, len(azureMonitorLastAggregationFields))
+	for _, aggregation := range azureMonitorLastAggregationFields {
+		if strings.EqualFold(string(aggregation), fields[0]) {
+			return string(aggregation) + " " + direction, nil
+		}
+		names = append(names, string(aggregation))
+	}
+	return "", fmt.Errorf("orderBy aggregation %s not supported. Should be one of %s", fields[0], strings.Join(names, ", "))
+}
+
+// normalizeAggregationType matches the aggregation type case-insensitively against the supported aggregation types
+// and returns its canonical spelling, so the rest of the scaler can compare aggregation types directly
+func normalizeAggregationType(aggregationType string) (insights.AggregationType, error) {
+	names := make([]string, 0, len(azureMonitorAggregationTypes))
+	for _, supported := range azureMonitorAggregationTypes {
+		if strings.EqualFold(string(supported), aggregationType) {
+			return supported, nil
+		}
+		names = append(names, string(supported))
+	}
+
+	return "", fmt.Errorf("metricAggregationType %s not supported. Should be one of %s", aggregationType, strings.Join(names, ", "))
+}
+
+// verifyAggregationTypeIsSupported returns the most recent value for the aggregation type and the timestamp of its data point,
+// skipping buckets Azure Monitor has not finalized yet
+func verifyAggregationTypeIsSupported(aggregationType insights.AggregationType, data []insights.MetricValue) (*float64, time.Time, error) {
+	if aggregationType == azureMonitorDataPointCountAggregation {
+		return countDataPoints(data)
+	}
+
+	for i := len(data) - 1; i >= 0; i-- {
+		valuePtr, err := getAggregationValue(aggregationType, data[i])
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		if valuePtr != nil {
+			var timestamp time.Time
+			if data[i].TimeStamp != nil {
+				timestamp = data[i].TimeStamp.ToTime()
+			}
+			return valuePtr, timestamp, nil
+		}
+	}
+
+	return nil, time.Time{}, fmt.Errorf("No value for aggregation type %s in any of the %d data points", aggregationType, len(data))
+}
+
+// getPresentAggregationFields returns the aggregation fields that have a value in any data point of the timeseries
+func getPresentAggregationFields(timeseries []insights.TimeSeriesElement) []string {
+	present := []string{}
+	for _, field := range azureMonitorLastAggregationFields {
+		found := false
+		for _, series := range timeseries {
+			if series.Data == nil {
+				continue
+			}
+			for _, value := range *series.Data {
+				if valuePtr, err := getAggregationValue(field, value); err == nil && valuePtr != nil {
+					found = true
+					break
+				}
+			}
+			if found {
+				break
+			}
+		}
+		if found {
+			present = append(present, string(field))
+		}
+	}
+	return present
+}
+
+// countDataPoints returns the number of buckets with a value and the timestamp of the newest of them
+func countDataPoints(data []insights.MetricValue) (*float64, time.Time, error) {
+	count := float64(0)
+	var timestamp time.Time
+	for _, value := range data {
+		valuePtr, err := getAggregationValue(azureMonitorLastAggregation, value)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		if valuePtr == nil {
+			continue
+		}
+		count++
+		if value.TimeStamp != nil && value.TimeStamp.ToTime().After(timestamp) {
+			timestamp = value.TimeStamp.ToTime()
+		}
+	}
+	return &count, timestamp, nil
+}
+
+// getAggregationValue returns the field of the data point matching the aggregation type, or nil when it has no value
+func getAggregationValue(aggregationType insights.AggregationType, value insights.MetricValue) (*float64, error) {
+	switch {
+	case aggregationType == insights.Average:
+		return value.Average, nil
+	case aggregationType == insights.Total:
+		return value.Total, nil
+	case aggregationType == insights.Maximum:
+		return value.Maximum, nil
+	case aggregationType == insights.Minimum:
+		return value.Minimum, nil
+	case aggregationType == insights.Count:
+		// Count is the number of raw samples Azure Monitor aggregated into the bucket
+		if value.Count == nil {
+			return nil, nil
+		}
+		fValue := float64(*value.Count)
+		return &fValue, nil
+	case aggregationType == azureMonitorLastAggregation:
+		for _, field := range azureMonitorLastAggregationFields {
+			valuePtr, err := getAggregationValue(field, value)
+			if err != nil || valuePtr != nil {
+				return valuePtr, err
+			}
+		}
+		return nil, nil
+	default:
+		err := fmt.Errorf("Unsupported aggregation type %s", aggregationType)
 		return nil, err
 	}
-	return valuePtr, nil
 }
@@ -0,0 +1,70 @@
+package scalers
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// the labels of the azure monitor query metrics, the resource is the name of the resource rather than its ID so that
+// the subscription and resource group do not multiply the series. The duration histogram has a series per bucket and
+// is only labelled with the metric.
+var azureMonitorQueryLabels = []string{"metric", "resource"}
+
+var (
+	azureMonitorQueryTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "keda",
+			Subsystem: "azure_monitor",
+			Name:      "query_total",
+			Help:      "Number of Azure Monitor metric queries made by the azure monitor scaler",
+		},
+		azureMonitorQueryLabels,
+	)
+	azureMonitorQueryErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "keda",
+			Subsystem: "azure_monitor",
+			Name:      "query_errors_total",
+			Help:      "Number of Azure Monitor metric queries that failed or returned no value",
+		},
+		azureMonitorQueryLabels,
+	)
+	azureMonitorQueryDurationSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "keda",
+			Subsystem: "azure_monitor",
+			Name:      "query_duration_seconds",
+			Help:      "Duration of Azure Monitor metric queries, including retries",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"metric"},
+	)
+	azureMonitorQueryLastValue = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "keda",
+			Subsystem: "azure_monitor",
+			Name:      "query_last_value",
+			Help:      "Last value read from Azure Monitor, before the rate and multiplier settings are applied",
+		},
+		azureMonitorQueryLabels,
+	)
+)
+
+// the metrics are registered with the controller-runtime registry, the operator serves it on its metrics port and the
+// metrics adapter, which queries the scalers of the HPA, on the /metrics endpoint of its --metrics-port
+func init() {
+	metrics.Registry.MustRegister(azureMonitorQueryTotal, azureMonitorQueryErrorsTotal, azureMonitorQueryDurationSeconds, azureMonitorQueryLastValue)
+}
+
+// recordAzureMonitorQuery counts the query and its duration, and either the error or the value it returned
+func recordAzureMonitorQuery(metricName string, resourceName string, duration time.Duration, value float64, err error) {
+	azureMonitorQueryTotal.WithLabelValues(metricName, resourceName).Inc()
+	azureMonitorQueryDurationSeconds.WithLabelValues(metricName).Observe(duration.Seconds())
+	if err != nil {
+		azureMonitorQueryErrorsTotal.WithLabelValues(metricName, resourceName).Inc()
+		return
+	}
+	azureMonitorQueryLastValue.WithLabelValues(metricName, resourceName).Set(value)
+}
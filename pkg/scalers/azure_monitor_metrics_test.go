@@ -0,0 +1,50 @@
+package scalers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2018-03-01/insights"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAzMonitorQueryMetrics(t *testing.T) {
+	request := newTestAzMonitorRequest()
+	total := azureMonitorQueryTotal.WithLabelValues(request.MetricName, request.ResourceName)
+	errorsTotal := azureMonitorQueryErrorsTotal.WithLabelValues(request.MetricName, request.ResourceName)
+	lastValue := azureMonitorQueryLastValue.WithLabelValues(request.MetricName, request.ResourceName)
+	startTotal, startErrors := testutil.ToFloat64(total), testutil.ToFloat64(errorsTotal)
+
+	sender := &testAzMonitorSender{responses: []testAzMonitorSenderResponse{
+		{statusCode: http.StatusOK, body: newTestAzMonitorResponse([]insights.MetricValue{{Average: float64Ptr(7)}})},
+	}}
+	if _, err := getAzureMetric(context.Background(), newTestAzMonitorClient(sender), request); err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if value := testutil.ToFloat64(total); value != startTotal+1 {
+		t.Errorf("Expected the query to be counted but got %v queries", value-startTotal)
+	}
+	if value := testutil.ToFloat64(errorsTotal); value != startErrors {
+		t.Errorf("Expected no error to be counted but got %v errors", value-startErrors)
+	}
+	if value := testutil.ToFloat64(lastValue); value != 7 {
+		t.Errorf("Expected the last value 7 but got %v", value)
+	}
+
+	sender = &testAzMonitorSender{responses: []testAzMonitorSenderResponse{
+		{statusCode: http.StatusNotFound, body: map[string]interface{}{"error": map[string]string{"code": "ResourceNotFound", "message": "failed"}}},
+	}}
+	if _, err := getAzureMetric(context.Background(), newTestAzMonitorClient(sender), request); err == nil {
+		t.Fatal("Expected error for a missing resource but got success")
+	}
+	if value := testutil.ToFloat64(total); value != startTotal+2 {
+		t.Errorf("Expected both queries to be counted but got %v queries", value-startTotal)
+	}
+	if value := testutil.ToFloat64(errorsTotal); value != startErrors+1 {
+		t.Errorf("Expected the failed query to be counted as an error but got %v errors", value-startErrors)
+	}
+	if value := testutil.ToFloat64(lastValue); value != 7 {
+		t.Errorf("Expected a failed query to keep the last value but got %v", value)
+	}
+}
@@ -3,9 +3,21 @@ package scalers
 import (
 	"context"
 	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2018-03-01/insights"
+	"github.com/Azure/go-autorest/autorest"
 	v2beta1 "k8s.io/api/autoscaling/v2beta1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -15,170 +27,1863 @@ import (
 )
 
 const (
-	azureMonitorMetricName       = "metricName"
-	targetValueName              = "targetValue"
-	defaultClientIDSetting       = ""
-	defaultClientPasswordSetting = ""
+	azureMonitorMetricName = "metricName"
+	targetValueName        = "targetValue"
+)
+
+// the targetType values, the HPA divides the metric by the number of replicas for an AverageValue target only
+const (
+	azureMonitorAverageValueTargetType = "AverageValue"
+	azureMonitorValueTargetType        = "Value"
 )
 
 type azureMonitorScaler struct {
-	metadata *azureMonitorMetadata
+	metadata      *azureMonitorMetadata
+	httpClient    *http.Client
+	metricsClient *insights.MetricsClient
+	activation    *azureMonitorActivationState
+	jitter        *azureMonitorJitterState
+	derivative    *azureMonitorDerivativeState
+	lastGood      *azureMonitorLastGoodState
+	smoothing     *azureMonitorSmoothingState
+	valueCache    *azureMonitorValueCache
+}
+
+// azureMonitorValueCache keeps metric values for a short time so frequent polls don't each query Azure Monitor,
+// expired values are dropped when a new one is stored
+type azureMonitorValueCache struct {
+	lock    sync.Mutex
+	entries map[string]azureMonitorCachedValue
+}
+
+type azureMonitorCachedValue struct {
+	value   float64
+	expires time.Time
+}
+
+// azureMonitorValues is shared by all scalers, since the scale loop and the metrics adapter build new scalers for every poll
+var azureMonitorValues = &azureMonitorValueCache{entries: map[string]azureMonitorCachedValue{}}
+
+// azureMonitorTriggerStateTTL is how long the state of a trigger is kept without being used. The scalers of a trigger
+// use it on every poll, so an unused state belongs to a ScaledObject that was deleted or changed.
+var azureMonitorTriggerStateTTL = time.Hour
+
+// azureMonitorTriggerStates keeps state of the triggers across polls, keyed by the request signature
+type azureMonitorTriggerStates struct {
+	lock      sync.Mutex
+	entries   map[string]*azureMonitorTriggerStateEntry
+	lastSweep time.Time
+}
+
+type azureMonitorTriggerStateEntry struct {
+	state    interface{}
+	lastUsed time.Time
+}
+
+func newAzureMonitorTriggerStates() *azureMonitorTriggerStates {
+	return &azureMonitorTriggerStates{entries: map[string]*azureMonitorTriggerStateEntry{}, lastSweep: time.Now()}
+}
+
+// azureMonitorActivationState counts the consecutive polls a metric stayed at or below the activation target value
+type azureMonitorActivationState struct {
+	lock       sync.Mutex
+	active     bool
+	belowPolls int
+}
+
+// azureMonitorActivationStates keeps the activation state of each trigger across polls,
+// since the scale loop builds new scalers every time it polls
+var azureMonitorActivationStates = newAzureMonitorTriggerStates()
+
+// azureMonitorJitterState picks the random delay before each query of a trigger, so triggers polling on the same
+// interval don't all call Azure Monitor at the same moment
+type azureMonitorJitterState struct {
+	lock    sync.Mutex
+	random  *rand.Rand
+	started bool
+}
+
+// azureMonitorJitterStates keeps the jitter of each trigger across polls, each seeded from the request signature
+var azureMonitorJitterStates = newAzureMonitorTriggerStates()
+
+// azureMonitorDerivativeState keeps the last value of a trigger scaling on the rate of change of its metric, so
+// each poll only queries the current window
+type azureMonitorDerivativeState struct {
+	lock      sync.Mutex
+	value     float64
+	sampledAt time.Time
+}
+
+// azureMonitorDerivativeStates keeps the last sample of each trigger across polls, keyed by the request signature
+var azureMonitorDerivativeStates = newAzureMonitorTriggerStates()
+
+// azureMonitorLastGoodState keeps the last value a trigger read successfully, reported with fallbackOnError while
+// queries fail
+type azureMonitorLastGoodState struct {
+	lock       sync.Mutex
+	value      float64
+	observedAt time.Time
+}
+
+// azureMonitorLastGoodStates keeps the last good value of each trigger across polls, keyed by the request signature
+var azureMonitorLastGoodStates = newAzureMonitorTriggerStates()
+
+// azureMonitorSmoothingState keeps the exponential moving average of a trigger's metric, blended with every new value
+type azureMonitorSmoothingState struct {
+	lock        sync.Mutex
+	value       float64
+	initialized bool
+}
+
+// azureMonitorSmoothingStates keeps the moving average of each trigger across polls, keyed by the request signature
+var azureMonitorSmoothingStates = newAzureMonitorTriggerStates()
+
+type azureMonitorMetadata struct {
+	metricSource               string
+	appInsightsAppID           string
+	appInsightsAPIKey          string
+	resourceURI                string
+	resourceTagFilter          string
+	resourceNames              []string
+	resourceType               string
+	tenantID                   string
+	subscriptionID             string
+	resourceSubscriptionID     string
+	resourceGroupName          string
+	scope                      string
+	name                       string
+	metricNames                []string
+	combine                    string
+	capacityMetricName         string
+	metricNameOverride         string
+	metricNamespace            string
+	filter                     string
+	dimensionGroupBy           string
+	top                        int32
+	orderBy                    string
+	validateMetricDefinition   bool
+	ignoreNullValues           bool
+	debugLogRawResponse        bool
+	aggregationInterval        string
+	aggregationGranularity     string
+	granularity                time.Duration
+	aggregationDelay           string
+	alignToMinute              bool
+	anchor                     time.Time
+	aggregationType            insights.AggregationType
+	metricResultAsRate         bool
+	metricDerivative           bool
+	metricValueMultiplier      float64
+	maxMetricValue             *float64
+	unhealthyBelow             *float64
+	unhealthyMetricValue       float64
+	emaAlpha                   float64
+	targetUnit                 string
+	roundingMode               string
+	percentile                 *float64
+	clientID                   string
+	clientPassword             string
+	clientSecretFile           string
+	backupClientID             string
+	backupClientPassword       string
+	clientCertificate          string
+	clientCertificatePassword  string
+	podIdentity                string
+	cloud                      string
+	endpointOverride           string
+	region                     string
+	tokenAudience              string
+	userAgentSuffix            string
+	noProxy                    string
+	maxRetries                 int
+	targetValue                int
+	targetType                 string
+	activationTargetValue      float64
+	activationGracePolls       int
+	azureMonitorRequestTimeout time.Duration
+	metricCacheTTL             time.Duration
+	maxMetricRetention         time.Duration
+	startupJitter              time.Duration
+	pollJitter                 time.Duration
+	fallbackOnError            bool
+	fallbackMaxAge             time.Duration
+}
+
+var azureMonitorLog = logf.Log.WithName("azure_monitor_scaler")
+
+// azureMonitorInvalidMetricNameChars matches everything that is not allowed in the advertised external metric name
+var azureMonitorInvalidMetricNameChars = regexp.MustCompile("[^a-z0-9-]+")
+
+// azureMonitorMetricNameOverridePattern matches the lowercase DNS subdomain names a metricNameOverride can advertise,
+// which covers the names the Azure metrics adapter used
+var azureMonitorMetricNameOverridePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+
+// maxAzureMonitorMetricNameLength is the longest metric name Kubernetes accepts
+const maxAzureMonitorMetricNameLength = 253
+
+// azureMonitorRedacted replaces the secrets of a trigger when it is printed
+const azureMonitorRedacted = "<redacted>"
+
+// String prints the resolved query of the trigger and the identity it authenticates with, the secrets are redacted
+func (m *azureMonitorMetadata) String() string {
+	fields := []string{
+		"metricSource=" + m.metricSource,
+		"metricName=" + m.name,
+	}
+	if m.metricSource == appInsightsMetricSource {
+		fields = append(fields, "appInsightsAppId="+m.appInsightsAppID)
+	} else {
+		fields = append(fields,
+			"resourceURI="+m.resourceURI,
+			"resourceNames="+strings.Join(m.resourceNames, ","),
+			"resourceTagFilter="+m.resourceTagFilter,
+			"subscriptionId="+m.subscriptionID,
+			"resourceGroupName="+m.resourceGroupName,
+			"metricNamespace="+m.metricNamespace)
+	}
+	fields = append(fields,
+		"aggregation="+string(m.aggregationType),
+		"aggregationInterval="+m.aggregationInterval,
+		"aggregationDelay="+m.aggregationDelay,
+		"aggregationGranularity="+m.aggregationGranularity,
+		"filter="+m.filter,
+		"cloud="+m.cloud,
+		"tenantId="+m.tenantID,
+		"podIdentity="+m.podIdentity,
+		"clientId="+m.clientID,
+		"clientPassword="+redactAzureMonitorSecret(m.clientPassword),
+		"backupClientId="+m.backupClientID,
+		"backupClientPassword="+redactAzureMonitorSecret(m.backupClientPassword),
+		"clientCertificatePassword="+redactAzureMonitorSecret(m.clientCertificatePassword),
+		"appInsightsApiKey="+redactAzureMonitorSecret(m.appInsightsAPIKey))
+	return strings.Join(fields, " ")
+}
+
+// redactAzureMonitorSecret hides a secret, an unset secret stays empty so that it shows as missing
+func redactAzureMonitorSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return azureMonitorRedacted
+}
+
+// azureMonitorTemplateVars are the variables a metricFilter can reference, such as Environment eq '{{.Namespace}}',
+// so that one trigger template can be reused across ScaledObjects
+type azureMonitorTemplateVars struct {
+	// Name is the name of the ScaledObject
+	Name      string
+	Namespace string
+}
+
+// NewAzureMonitorScaler creates a new AzureMonitorScaler for the trigger of the named ScaledObject
+func NewAzureMonitorScaler(name, namespace string, resolvedEnv, metadata, authParams map[string]string, podIdentity string) (Scaler, error) {
+	meta, err := parseAzureMonitorTriggerMetadata(metadata, resolvedEnv, authParams, podIdentity, azureMonitorTemplateVars{Name: name, Namespace: namespace})
+	if err != nil {
+		return nil, fmt.Errorf("error parsing azure monitor metadata: %s", err)
+	}
+
+	scaler := &azureMonitorScaler{
+		metadata:   meta,
+		httpClient: getAzureMonitorHTTPClient(meta.noProxy),
+		activation: getAzureMonitorActivationState(meta),
+		jitter:     getAzureMonitorJitterState(meta),
+		derivative: getAzureMonitorDerivativeState(meta),
+		lastGood:   getAzureMonitorLastGoodState(meta),
+		smoothing:  getAzureMonitorSmoothingState(meta),
+		valueCache: azureMonitorValues,
+	}
+	scaler.metricsClient = newAzureMonitorScalerMetricsClient(meta)
+	azureMonitorLog.V(1).Info("created azure monitor scaler", "resourceURI", meta.resourceURI, "metricName", meta.name, "minRecommendedInterval", scaler.MinRecommendedInterval().String())
+	azureMonitorLog.V(3).Info("resolved azure monitor trigger", "metadata", meta.String())
+
+	return scaler, nil
+}
+
+// newAzureMonitorScalerMetricsClient returns the metrics client the scalers of the trigger share across polls. It returns
+// nil, so that every poll creates its own client, for app insights triggers, for a clientSecretFile that can be rotated
+// between polls and when the client can't be built yet, in which case the poll reports the error.
+func newAzureMonitorScalerMetricsClient(meta *azureMonitorMetadata) *insights.MetricsClient {
+	if meta.metricSource == appInsightsMetricSource || meta.clientSecretFile != "" {
+		return nil
+	}
+	client, err := azureMonitorMetricsClients.get(meta)
+	if err != nil {
+		azureMonitorLog.V(1).Info("azure monitor metrics client will be created on every poll", "resourceURI", meta.resourceURI, "metricName", meta.name, "error", err.Error())
+		return nil
+	}
+	return client
 }
 
-type azureMonitorMetadata struct {
-	resourceURI         string
-	tenantID            string
-	subscriptionID      string
-	resourceGroupName   string
-	name                string
-	filter              string
-	aggregationInterval string
-	aggregationType     string
-	clientID            string
-	clientPassword      string
-	targetValue         int
-}
+// NewAzureMonitorMetadata parses the trigger metadata, fills in the defaults the queries would otherwise apply and
+// checks every query the trigger makes, reporting all invalid queries in one error. Credentials are read from authParams
+// and the metadata, the pod identity from its podIdentity key.
+func NewAzureMonitorMetadata(metadata, authParams map[string]string) (*azureMonitorMetadata, error) {
+	meta, err := parseAzureMonitorMetadata(metadata, map[string]string{}, authParams, metadata["podIdentity"])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing azure monitor metadata: %s", err)
+	}
+
+	applyAzureMonitorDefaults(meta)
+	if err := validateAzureMonitorQueries(meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// applyAzureMonitorDefaults sets the aggregation window and metric retention the queries fall back to when unset
+func applyAzureMonitorDefaults(meta *azureMonitorMetadata) {
+	if meta.aggregationInterval == "" {
+		meta.aggregationInterval = formatTimeSpanDuration(azureMonitorDefaultAggregationWindow)
+	}
+	if meta.maxMetricRetention <= 0 {
+		meta.maxMetricRetention = defaultAzureMonitorMaxRetention
+	}
+}
+
+// validateAzureMonitorQueries builds the request of every metric and resource the trigger queries and validates them,
+// joining the distinct errors. The resources of a resourceTagFilter are only known at query time, only their timespan is checked.
+func validateAzureMonitorQueries(meta *azureMonitorMetadata) error {
+	var messages []string
+	seen := map[string]bool{}
+	addError := func(err error) {
+		if err != nil && !seen[err.Error()] {
+			seen[err.Error()] = true
+			messages = append(messages, err.Error())
+		}
+	}
+
+	switch {
+	case meta.metricSource == appInsightsMetricSource:
+		_, err := createAppInsightsRequest(meta)
+		addError(err)
+	case meta.resourceTagFilter != "":
+		_, err := formatTimeSpan(meta.aggregationInterval, meta.aggregationDelay, meta.maxMetricRetention, meta.alignToMinute)
+		addError(err)
+	default:
+		resourcesMetadata := []*azureMonitorMetadata{meta}
+		if len(meta.resourceNames) > 0 {
+			resourcesMetadata = getResourceNamesMetadata(meta)
+		}
+		for _, resourceMetadata := range resourcesMetadata {
+			requestPtr, err := createMetricsRequest(resourceMetadata)
+			if err != nil {
+				addError(err)
+				continue
+			}
+			metricRequests := getMetricRequests(*requestPtr, meta.metricNames)
+			if meta.capacityMetricName != "" {
+				metricRequests = append(metricRequests, getMetricRequests(*requestPtr, []string{meta.capacityMetricName})...)
+			}
+			for _, metricRequest := range metricRequests {
+				if err := metricRequest.validate(); err != nil {
+					addError(fmt.Errorf("metric %s of %s: %s", metricRequest.MetricName, metricRequest.metricResourceURI(), err))
+				}
+			}
+		}
+	}
+
+	if len(messages) > 0 {
+		return fmt.Errorf("invalid azure monitor metadata: %s", strings.Join(messages, "; "))
+	}
+	return nil
+}
+
+// MinRecommendedInterval is half the granularity Azure Monitor aggregates the metric at. A new data point can show up
+// at any time within its grain, polling twice per grain picks it up within half a grain and polling more often returns
+// the same value. With the default granularity of a minute this is the default pollingInterval of 30 seconds.
+func (s *azureMonitorScaler) MinRecommendedInterval() time.Duration {
+	granularity := s.metadata.granularity
+	if granularity <= 0 {
+		granularity = defaultAzureMonitorGranularity
+	}
+	return granularity / 2
+}
+
+// TestAzureMonitorTrigger parses the trigger metadata the way the scaler does and queries the metric once, so a trigger
+// can be checked before it is used in a ScaledObject. Credentials are read from the metadata itself, the pod identity
+// from its podIdentity key. Nothing is read from or written to Kubernetes.
+func TestAzureMonitorTrigger(ctx context.Context, metadata map[string]string) (float64, error) {
+	meta, err := NewAzureMonitorMetadata(metadata, metadata)
+	if err != nil {
+		return 0, err
+	}
+
+	return GetAzureMetricValueFloat(ctx, meta)
+}
+
+// Validate checks that the scaler's credentials may read the metrics of the resource without querying a metric value,
+// a missing Monitoring Reader role is reported as ErrAzureMonitorPermissionDenied
+func (s *azureMonitorScaler) Validate(ctx context.Context) error {
+	if s.httpClient == nil {
+		return ValidateAzureMonitorAccess(ctx, s.metadata)
+	}
+	return validateAzureMonitorAccess(ctx, s.metadata, s.httpClient)
+}
+
+// ListAvailableMetrics returns the names of the metrics the configured resource supports, to help fix a misconfigured metricName
+func (s *azureMonitorScaler) ListAvailableMetrics(ctx context.Context) ([]string, error) {
+	if s.metadata.metricSource == appInsightsMetricSource || s.metadata.resourceTagFilter != "" {
+		return nil, fmt.Errorf("listing the available metrics requires a resourceURI")
+	}
+
+	var sender autorest.Sender
+	if s.httpClient != nil {
+		sender = s.httpClient
+	}
+	client, err := createMetricDefinitionsClient(s.metadata, sender)
+	if err != nil {
+		return nil, err
+	}
+
+	// the resources of resourceNames share the resource type, so they support the same metrics
+	metadata := s.metadata
+	if len(metadata.resourceNames) > 0 {
+		metadata = getResourceNamesMetadata(metadata)[0]
+	}
+	requestPtr, err := createMetricsRequest(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	return listAvailableMetrics(ctx, client, *requestPtr)
+}
+
+// get returns the state of the trigger, creating it with create the first time, and drops the states that were not
+// used for azureMonitorTriggerStateTTL
+func (s *azureMonitorTriggerStates) get(key string, create func() interface{}) interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) >= azureMonitorTriggerStateTTL {
+		for entryKey, entry := range s.entries {
+			if now.Sub(entry.lastUsed) >= azureMonitorTriggerStateTTL {
+				delete(s.entries, entryKey)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	entry, ok := s.entries[key]
+	if !ok {
+		entry = &azureMonitorTriggerStateEntry{state: create()}
+		s.entries[key] = entry
+	}
+	entry.lastUsed = now
+	return entry.state
+}
+
+// getAzureMonitorActivationState returns the shared activation state for the trigger, or nil when no grace polls are configured
+func getAzureMonitorActivationState(meta *azureMonitorMetadata) *azureMonitorActivationState {
+	if meta.activationGracePolls <= 0 {
+		return nil
+	}
+
+	// the signature leaves out the activation settings, which don't change the value that is read
+	key := fmt.Sprintf("%s|%v|%d", getAzureMonitorRequestSignature(meta), meta.activationTargetValue, meta.activationGracePolls)
+	return azureMonitorActivationStates.get(key, func() interface{} {
+		return &azureMonitorActivationState{}
+	}).(*azureMonitorActivationState)
+}
+
+// getAzureMonitorJitterState returns the jitter state of the trigger, or nil when neither startupJitter nor pollJitter is set
+func getAzureMonitorJitterState(meta *azureMonitorMetadata) *azureMonitorJitterState {
+	if meta.startupJitter <= 0 && meta.pollJitter <= 0 {
+		return nil
+	}
+
+	key := getAzureMonitorRequestSignature(meta)
+	return azureMonitorJitterStates.get(key, func() interface{} {
+		hash := fnv.New64a()
+		_, _ = hash.Write([]byte(key))
+		return newAzureMonitorJitterState(int64(hash.Sum64()))
+	}).(*azureMonitorJitterState)
+}
+
+// getAzureMonitorDerivativeState returns the last sample of the trigger, or nil when metricDerivative is not set
+func getAzureMonitorDerivativeState(meta *azureMonitorMetadata) *azureMonitorDerivativeState {
+	if !meta.metricDerivative {
+		return nil
+	}
+
+	return azureMonitorDerivativeStates.get(getAzureMonitorRequestSignature(meta), func() interface{} {
+		return &azureMonitorDerivativeState{}
+	}).(*azureMonitorDerivativeState)
+}
+
+// last returns the previous sample of the trigger and when it was taken, the time is zero before the first sample
+func (d *azureMonitorDerivativeState) last() (float64, time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.value, d.sampledAt
+}
+
+func (d *azureMonitorDerivativeState) store(value float64, sampledAt time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.value = value
+	d.sampledAt = sampledAt
+}
+
+// getAzureMonitorSmoothingState returns the moving average of the trigger, or nil when emaAlpha is not set
+func getAzureMonitorSmoothingState(meta *azureMonitorMetadata) *azureMonitorSmoothingState {
+	if meta.emaAlpha <= 0 {
+		return nil
+	}
+
+	return azureMonitorSmoothingStates.get(getAzureMonitorRequestSignature(meta), func() interface{} {
+		return &azureMonitorSmoothingState{}
+	}).(*azureMonitorSmoothingState)
+}
+
+// smooth blends the value into the moving average as alpha*value + (1-alpha)*average and returns the new average,
+// the first value starts the average
+func (m *azureMonitorSmoothingState) smooth(value float64, alpha float64) float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.initialized {
+		value = alpha*value + (1-alpha)*m.value
+	}
+	m.value = value
+	m.initialized = true
+	return value
+}
+
+// getAzureMonitorLastGoodState returns the last good value of the trigger, or nil when fallbackOnError is not set
+func getAzureMonitorLastGoodState(meta *azureMonitorMetadata) *azureMonitorLastGoodState {
+	if !meta.fallbackOnError {
+		return nil
+	}
+
+	return azureMonitorLastGoodStates.get(getAzureMonitorRequestSignature(meta), func() interface{} {
+		return &azureMonitorLastGoodState{}
+	}).(*azureMonitorLastGoodState)
+}
+
+// fallback stores the value of a successful query. When the query failed it returns the last good value instead,
+// as long as it was observed no longer than maxAge ago, and the error otherwise
+func (l *azureMonitorLastGoodState) fallback(value float64, err error, maxAge time.Duration, now time.Time) (float64, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if err == nil {
+		l.value = value
+		l.observedAt = now
+		return value, nil
+	}
+	if l.observedAt.IsZero() || now.Sub(l.observedAt) > maxAge {
+		return value, err
+	}
+
+	azureMonitorLog.Info("azure monitor query failed, reporting the last good value", "value", l.value, "observedAt", l.observedAt.Format(time.RFC3339), "error", err.Error())
+	return l.value, nil
+}
+
+func newAzureMonitorJitterState(seed int64) *azureMonitorJitterState {
+	return &azureMonitorJitterState{random: rand.New(rand.NewSource(seed))}
+}
+
+// next returns a random delay of up to startupJitter before the first query of the trigger and up to pollJitter after it
+func (j *azureMonitorJitterState) next(startupJitter time.Duration, pollJitter time.Duration) time.Duration {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	max := pollJitter
+	if !j.started {
+		max = startupJitter
+		j.started = true
+	}
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(j.random.Int63n(int64(max) + 1))
+}
+
+// waitAzureMonitorJitter sleeps for the delay, returning early with the error of the context when it is done
+func waitAzureMonitorJitter(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// newAzureMonitorHTTPClient creates an HTTP client with its own connection pool. Requests go through the proxy of the
+// environment unless NO_PROXY or noProxy exclude the host, and are traced as children of the query span.
+func newAzureMonitorHTTPClient(noProxy string) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = getAzureMonitorProxy(noProxy)
+	return &http.Client{Transport: newAzureMonitorTransport(transport)}
+}
+
+// getAzureMonitorProxy reads HTTPS_PROXY, HTTP_PROXY and NO_PROXY when the client is created, the hosts in noProxy are
+// excluded in addition to the ones in NO_PROXY. Like http.ProxyFromEnvironment, requests to localhost are never proxied.
+func getAzureMonitorProxy(noProxy string) func(*http.Request) (*url.URL, error) {
+	httpsProxy := getProxyEnv("HTTPS_PROXY")
+	httpProxy := getProxyEnv("HTTP_PROXY")
+	exclusions := append(splitNoProxy(getProxyEnv("NO_PROXY")), splitNoProxy(noProxy)...)
+
+	return func(req *http.Request) (*url.URL, error) {
+		proxy := httpProxy
+		if req.URL.Scheme == "https" {
+			proxy = httpsProxy
+		}
+		if proxy == "" || isNoProxyHost(req.URL.Hostname(), exclusions) {
+			return nil, nil
+		}
+
+		// a proxy without a scheme is an http proxy, as curl and net/http treat it
+		if !strings.Contains(proxy, "://") {
+			proxy = "http://" + proxy
+		}
+		proxyURL, err := url.Parse(proxy)
+		if err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid proxy address %q", proxy)
+		}
+		return proxyURL, nil
+	}
+}
+
+// getProxyEnv returns the proxy environment variable, falling back to its lowercase spelling
+func getProxyEnv(name string) string {
+	if val := os.Getenv(name); val != "" {
+		return val
+	}
+	return os.Getenv(strings.ToLower(name))
+}
+
+// splitNoProxy splits a comma separated NO_PROXY list into lowercase hosts, domains and CIDR ranges without ports
+func splitNoProxy(noProxy string) []string {
+	exclusions := []string{}
+	for _, exclusion := range strings.Split(noProxy, ",") {
+		exclusion = strings.ToLower(strings.TrimSpace(exclusion))
+		if host, _, err := net.SplitHostPort(exclusion); err == nil {
+			exclusion = host
+		}
+		if exclusion != "" {
+			exclusions = append(exclusions, exclusion)
+		}
+	}
+	return exclusions
+}
+
+// isNoProxyHost checks whether the host is localhost or matches an exclusion. A domain also matches its subdomains,
+// "*" matches every host.
+func isNoProxyHost(host string, exclusions []string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	if host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return true
+	}
+
+	for _, exclusion := range exclusions {
+		if exclusion == "*" || host == exclusion || strings.HasSuffix(host, "."+strings.TrimPrefix(exclusion, ".")) {
+			return true
+		}
+		if _, network, err := net.ParseCIDR(exclusion); err == nil && ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAzureMonitorMetadata parses a trigger that is not part of a ScaledObject, its metricFilter can't reference any variable
+func parseAzureMonitorMetadata(metadata, resolvedEnv, authParams map[string]string, podIdentity string) (*azureMonitorMetadata, error) {
+	return parseAzureMonitorTriggerMetadata(metadata, resolvedEnv, authParams, podIdentity, azureMonitorTemplateVars{})
+}
+
+func parseAzureMonitorTriggerMetadata(metadata, resolvedEnv, authParams map[string]string, podIdentity string, vars azureMonitorTemplateVars) (*azureMonitorMetadata, error) {
+	meta := azureMonitorMetadata{}
+
+	if val, ok := metadata[targetValueName]; ok && val != "" {
+		targetValue, err := strconv.Atoi(val)
+		if err != nil {
+			azureMonitorLog.Error(err, "Error parsing azure monitor metadata", "targetValue", targetValueName)
+			return nil, fmt.Errorf("Error parsing azure monitor metadata %s: %s", targetValueName, err.Error())
+		}
+		meta.targetValue = targetValue
+	} else {
+		return nil, fmt.Errorf("no targetValue given")
+	}
+
+	meta.targetType = azureMonitorAverageValueTargetType
+	if val, ok := metadata["targetType"]; ok && val != "" {
+		switch {
+		case strings.EqualFold(val, azureMonitorAverageValueTargetType):
+			meta.targetType = azureMonitorAverageValueTargetType
+		case strings.EqualFold(val, azureMonitorValueTargetType):
+			meta.targetType = azureMonitorValueTargetType
+		default:
+			return nil, fmt.Errorf("targetType %s not supported. Should be %s or %s", val, azureMonitorAverageValueTargetType, azureMonitorValueTargetType)
+		}
+	}
+
+	if val, ok := metadata["activationTargetValue"]; ok && val != "" {
+		activationTargetValue, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			azureMonitorLog.Error(err, "Error parsing azure monitor metadata", "activationTargetValue", val)
+			return nil, fmt.Errorf("Error parsing azure monitor metadata activationTargetValue: %s", err.Error())
+		}
+		meta.activationTargetValue = activationTargetValue
+	}
+
+	if val, ok := metadata["activationGracePolls"]; ok && val != "" {
+		activationGracePolls, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing azure monitor metadata activationGracePolls: %s", err.Error())
+		}
+		if activationGracePolls < 0 {
+			return nil, fmt.Errorf("activationGracePolls must not be negative")
+		}
+		meta.activationGracePolls = activationGracePolls
+	}
+
+	meta.metricSource = azureMonitorMetricSource
+	if val, ok := metadata["metricSource"]; ok && val != "" {
+		switch {
+		case strings.EqualFold(val, azureMonitorMetricSource):
+		case strings.EqualFold(val, appInsightsMetricSource):
+			meta.metricSource = appInsightsMetricSource
+		default:
+			return nil, fmt.Errorf("metricSource %s is not supported, use %s or %s", val, azureMonitorMetricSource, appInsightsMetricSource)
+		}
+	}
+
+	meta.scope = azureMonitorResourceGroupScope
+	if val, ok := metadata["scope"]; ok && val != "" {
+		switch {
+		case strings.EqualFold(val, azureMonitorResourceGroupScope):
+		case strings.EqualFold(val, azureMonitorSubscriptionScope):
+			meta.scope = azureMonitorSubscriptionScope
+		default:
+			return nil, fmt.Errorf("scope %s is not supported, use %s or %s", val, azureMonitorResourceGroupScope, azureMonitorSubscriptionScope)
+		}
+		if meta.scope == azureMonitorSubscriptionScope && (meta.metricSource == appInsightsMetricSource || metadata["resourceTagFilter"] != "") {
+			return nil, fmt.Errorf("the %s scope is not supported with app insights or resourceTagFilter", azureMonitorSubscriptionScope)
+		}
+	}
+
+	// App Insights metrics belong to an application instead of an Azure resource
+	var resourceInfo azureResourceInfo
+	if meta.metricSource == appInsightsMetricSource {
+		if err := parseAppInsightsMetadata(&meta, metadata, resolvedEnv, authParams); err != nil {
+			return nil, err
+		}
+	} else if val, ok := metadata["resourceTagFilter"]; ok && val != "" {
+		// tagged resources are resolved on every poll, so resources can come and go without changing the trigger
+		if _, ok := metadata["resourceURI"]; ok {
+			return nil, fmt.Errorf("resourceURI and resourceTagFilter can't be used together")
+		}
+		if name := strings.SplitN(val, "=", 2)[0]; strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("resourceTagFilter %s not in the correct format. Should be tag_name=tag_value or tag_name", val)
+		}
+		meta.resourceTagFilter = val
+
+		if val, ok := metadata["resourceType"]; ok && val != "" {
+			if parts := strings.Split(val, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				return nil, fmt.Errorf("resourceType %s not in the correct format. Should be namespace/resource_type", val)
+			}
+			meta.resourceType = val
+		}
+
+		if val, ok := metadata["resourceGroupName"]; ok && val != "" {
+			if err := validateResourceGroupName(val); err != nil {
+				return nil, err
+			}
+			meta.resourceGroupName = val
+		}
+	} else {
+		if val, ok := metadata["resourceURI"]; ok && val != "" {
+			resourceURI := val
+			// with resourceNames the resourceURI stops at the resource type, each of the names completes it
+			if names, ok := metadata["resourceNames"]; ok && names != "" {
+				for _, name := range strings.Split(names, ",") {
+					name = strings.TrimSpace(name)
+					if name == "" {
+						return nil, fmt.Errorf("resourceNames %q contains an empty resource name", names)
+					}
+					meta.resourceNames = append(meta.resourceNames, name)
+				}
+				resourceURI = strings.TrimSuffix(val, "/") + "/" + meta.resourceNames[0]
+			}
+			info, err := parseAzureResourceURI(resourceURI, meta.scope)
+			if err != nil {
+				if len(meta.resourceNames) > 0 {
+					return nil, fmt.Errorf("with resourceNames the resourceURI must be in the form <provider>/<type>: %s", err)
+				}
+				return nil, err
+			}
+			resourceInfo = info
+			meta.resourceURI = val
+		} else {
+			return nil, fmt.Errorf("no resourceURI given")
+		}
+
+		// a full resource ID already names the resource group and subscription
+		if meta.scope == azureMonitorSubscriptionScope {
+			if resourceInfo.ResourceGroup != "" || metadata["resourceGroupName"] != "" {
+				return nil, fmt.Errorf("resourceGroupName can't be used with the %s scope", azureMonitorSubscriptionScope)
+			}
+		} else {
+			if val, ok := metadata["resourceGroupName"]; ok && val != "" {
+				if resourceInfo.ResourceGroup != "" && !strings.EqualFold(resourceInfo.ResourceGroup, val) {
+					return nil, fmt.Errorf("resourceGroupName %s does not match resource group %s in resourceURI", val, resourceInfo.ResourceGroup)
+				}
+				meta.resourceGroupName = val
+			} else if resourceInfo.ResourceGroup != "" {
+				meta.resourceGroupName = resourceInfo.ResourceGroup
+			} else {
+				return nil, fmt.Errorf("no resourceGroupName given")
+			}
+			if err := validateResourceGroupName(meta.resourceGroupName); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if val, ok := metadata["metricNames"]; ok && val != "" {
+		if metadata[azureMonitorMetricName] != "" {
+			return nil, fmt.Errorf("metricName and metricNames are mutually exclusive")
+		}
+		for _, name := range strings.Split(val, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				return nil, fmt.Errorf("metricNames %q contains an empty metric name", val)
+			}
+			meta.metricNames = append(meta.metricNames, name)
+		}
+		// the joined names identify the trigger in the metric name, the activation state and the request signature
+		meta.name = strings.Join(meta.metricNames, ",")
+		meta.combine = defaultAzureMonitorCombineMode
+	} else if val, ok := metadata[azureMonitorMetricName]; ok && val != "" {
+		meta.name = val
+	} else {
+		return nil, fmt.Errorf("no metricName given")
+	}
+	if len(meta.resourceNames) > 0 {
+		meta.combine = defaultAzureMonitorResourceCombineMode
+	}
+
+	if val, ok := metadata["capacityMetricName"]; ok && val != "" {
+		meta.capacityMetricName = strings.TrimSpace(val)
+	}
+
+	if val, ok := metadata["metricNameOverride"]; ok && val != "" {
+		if len(val) > maxAzureMonitorMetricNameLength || !azureMonitorMetricNameOverridePattern.MatchString(val) {
+			return nil, fmt.Errorf("metricNameOverride %q is not a valid metric name. Should be lowercase alphanumerics, '-' or '.' and start and end with an alphanumeric", val)
+		}
+		meta.metricNameOverride = val
+	}
+
+	if val, ok := metadata["combine"]; ok && val != "" {
+		if len(meta.metricNames) == 0 && len(meta.resourceNames) == 0 {
+			return nil, fmt.Errorf("combine requires metricNames or resourceNames")
+		}
+		combine := strings.ToLower(val)
+		if _, ok := azureMonitorCombineModes[combine]; !ok {
+			return nil, fmt.Errorf("combine %s not supported. Should be one of max, min, sum, avg", val)
+		}
+		meta.combine = combine
+	}
+
+	if val, ok := metadata["metricNamespace"]; ok && val != "" {
+		meta.metricNamespace = val
+	}
+
+	if val, ok := metadata["metricAggregationType"]; ok && val != "" {
+		aggregationType, err := normalizeAggregationType(val)
+		if err != nil {
+			return nil, err
+		}
+		meta.aggregationType = aggregationType
+	} else {
+		return nil, fmt.Errorf("no metricAggregationType given")
+	}
+
+	meta.azureMonitorRequestTimeout = defaultAzureMonitorRequestTimeout
+	if val, ok := metadata["requestTimeout"]; ok && val != "" {
+		requestTimeout, err := time.ParseDuration(val)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing azure monitor metadata requestTimeout: %s", err.Error())
+		}
+		if requestTimeout <= 0 {
+			return nil, fmt.Errorf("requestTimeout must be greater than zero")
+		}
+		meta.azureMonitorRequestTimeout = requestTimeout
+	}
+
+	if val, ok := metadata["maxMetricRetention"]; ok && val != "" {
+		maxMetricRetention, err := time.ParseDuration(val)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing azure monitor metadata maxMetricRetention: %s", err.Error())
+		}
+		if maxMetricRetention <= 0 {
+			return nil, fmt.Errorf("maxMetricRetention must be greater than zero")
+		}
+		meta.maxMetricRetention = maxMetricRetention
+	}
+
+	meta.metricCacheTTL = defaultAzureMonitorMetricCacheTTL
+	if val, ok := metadata["metricCacheTTL"]; ok && val != "" {
+		metricCacheTTL, err := time.ParseDuration(val)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing azure monitor metadata metricCacheTTL: %s", err.Error())
+		}
+		if metricCacheTTL < 0 {
+			return nil, fmt.Errorf("metricCacheTTL must not be negative")
+		}
+		meta.metricCacheTTL = metricCacheTTL
+	}
+
+	if val, ok := metadata["startupJitter"]; ok && val != "" {
+		startupJitter, err := time.ParseDuration(val)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing azure monitor metadata startupJitter: %s", err.Error())
+		}
+		if startupJitter < 0 {
+			return nil, fmt.Errorf("startupJitter must not be negative")
+		}
+		meta.startupJitter = startupJitter
+	}
+
+	if val, ok := metadata["pollJitter"]; ok && val != "" {
+		pollJitter, err := time.ParseDuration(val)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing azure monitor metadata pollJitter: %s", err.Error())
+		}
+		if pollJitter < 0 {
+			return nil, fmt.Errorf("pollJitter must not be negative")
+		}
+		meta.pollJitter = pollJitter
+	}
+
+	if val, ok := metadata["fallbackOnError"]; ok && val != "" {
+		fallbackOnError, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing azure monitor metadata fallbackOnError: %s", err.Error())
+		}
+		meta.fallbackOnError = fallbackOnError
+	}
+
+	meta.fallbackMaxAge = defaultAzureMonitorFallbackMaxAge
+	if val, ok := metadata["fallbackMaxAge"]; ok && val != "" {
+		if !meta.fallbackOnError {
+			return nil, fmt.Errorf("fallbackMaxAge requires fallbackOnError")
+		}
+		fallbackMaxAge, err := time.ParseDuration(val)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing azure monitor metadata fallbackMaxAge: %s", err.Error())
+		}
+		if fallbackMaxAge <= 0 {
+			return nil, fmt.Errorf("fallbackMaxAge must be positive")
+		}
+		meta.fallbackMaxAge = fallbackMaxAge
+	}
+
+	meta.maxRetries = defaultAzureMonitorMaxRetries
+	if val, ok := metadata["maxRetries"]; ok && val != "" {
+		maxRetries, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing azure monitor metadata maxRetries: %s", err.Error())
+		}
+		if maxRetries < 0 {
+			return nil, fmt.Errorf("maxRetries must not be negative")
+		}
+		meta.maxRetries = maxRetries
+	}
+
+	if val, ok := metadata["metricDerivative"]; ok && val != "" {
+		metricDerivative, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing azure monitor metadata metricDerivative: %s", err.Error())
+		}
+		meta.metricDerivative = metricDerivative
+	}
+
+	if val, ok := metadata["metricResultAsRate"]; ok && val != "" {
+		metricResultAsRate, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing azure monitor metadata metricResultAsRate: %s", err.Error())
+		}
+		if metricResultAsRate && meta.aggregationType != insights.Total && meta.aggregationType != insights.Count {
+			return nil, fmt.Errorf("metricResultAsRate requires the Total or Count metricAggregationType")
+		}
+		meta.metricResultAsRate = metricResultAsRate
+	}
+
+	if val, ok := metadata["targetUnit"]; ok && val != "" {
+		if _, _, ok := getUnitScale(val, time.Minute); !ok {
+			return nil, fmt.Errorf("targetUnit %s not supported. Should be one of Bytes, MB, GB, Count, CountPerSecond, Seconds, MilliSeconds", val)
+		}
+		if meta.metricResultAsRate {
+			return nil, fmt.Errorf("targetUnit can't be used with metricResultAsRate, use the CountPerSecond targetUnit instead")
+		}
+		if meta.metricSource == appInsightsMetricSource {
+			return nil, fmt.Errorf("targetUnit is not supported by app insights")
+		}
+		meta.targetUnit = val
+	}
+
+	// values are rounded to the nearest int by default, the none roundingMode keeps the precision so that e.g. an
+	// average CPU of 0.3 can still scale the target
+	meta.roundingMode = defaultAzureMonitorRoundingMode
+	if val, ok := metadata["roundingMode"]; ok && val != "" {
+		roundingMode := strings.ToLower(val)
+		supported := false
+		for _, mode := range azureMonitorRoundingModes {
+			if roundingMode == mode {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return nil, fmt.Errorf("roundingMode %s not supported. Should be one of %s", val, strings.Join(azureMonitorRoundingModes, ", "))
+		}
+		meta.roundingMode = roundingMode
+	}
+
+	meta.metricValueMultiplier = 1
+	if val, ok := metadata["metricValueMultiplier"]; ok && val != "" {
+		metricValueMultiplier, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing azure monitor metadata metricValueMultiplier: %s", err.Error())
+		}
+		if math.IsNaN(metricValueMultiplier) || math.IsInf(metricValueMultiplier, 0) || metricValueMultiplier <= 0 {
+			return nil, fmt.Errorf("metricValueMultiplier must be a positive number")
+		}
+		meta.metricValueMultiplier = metricValueMultiplier
+	}
+
+	// smooths the metric with an exponential moving average, a lower alpha dampens noise more but reacts slower
+	if val, ok := metadata["emaAlpha"]; ok && val != "" {
+		emaAlpha, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing azure monitor metadata emaAlpha: %s", err.Error())
+		}
+		if math.IsNaN(emaAlpha) || emaAlpha <= 0 || emaAlpha > 1 {
+			return nil, fmt.Errorf("emaAlpha must be greater than 0 and at most 1, got %s", val)
+		}
+		meta.emaAlpha = emaAlpha
+	}
+
+	// caps the value reported to the HPA, so that a spike or a bad data point can't scale the workload out of bounds
+	if val, ok := metadata["maxMetricValue"]; ok && val != "" {
+		maxMetricValue, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing azure monitor metadata maxMetricValue: %s", err.Error())
+		}
+		if math.IsNaN(maxMetricValue) || math.IsInf(maxMetricValue, 0) {
+			return nil, fmt.Errorf("maxMetricValue must be a finite number")
+		}
+		meta.maxMetricValue = &maxMetricValue
+	}
 
-var azureMonitorLog = logf.Log.WithName("azure_monitor_scaler")
+	if val, ok := metadata["unhealthyBelow"]; ok && val != "" {
+		unhealthyBelow, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing azure monitor metadata unhealthyBelow: %s", err.Error())
+		}
+		if math.IsNaN(unhealthyBelow) || math.IsInf(unhealthyBelow, 0) {
+			return nil, fmt.Errorf("unhealthyBelow must be a finite number")
+		}
+		meta.unhealthyBelow = &unhealthyBelow
 
-// NewAzureMonitorScaler creates a new AzureMonitorScaler
-func NewAzureMonitorScaler(resolvedEnv, metadata, authParams map[string]string) (Scaler, error) {
-	meta, err := parseAzureMonitorMetadata(metadata, resolvedEnv, authParams)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing azure monitor metadata: %s", err)
+		val, ok := metadata["unhealthyMetricValue"]
+		if !ok || val == "" {
+			return nil, fmt.Errorf("unhealthyMetricValue is required with unhealthyBelow")
+		}
+		unhealthyMetricValue, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing azure monitor metadata unhealthyMetricValue: %s", err.Error())
+		}
+		if unhealthyMetricValue < 0 || math.IsNaN(unhealthyMetricValue) || math.IsInf(unhealthyMetricValue, 0) {
+			return nil, fmt.Errorf("unhealthyMetricValue must be a finite number not lower than zero")
+		}
+		meta.unhealthyMetricValue = unhealthyMetricValue
+	} else if val, ok := metadata["unhealthyMetricValue"]; ok && val != "" {
+		return nil, fmt.Errorf("unhealthyMetricValue is only supported with unhealthyBelow")
 	}
 
-	return &azureMonitorScaler{
-		metadata: meta,
-	}, nil
-}
+	if val, ok := metadata["metricFilter"]; ok && val != "" {
+		filter, err := expandMetricFilterTemplate(val, vars)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateMetricFilter(filter); err != nil {
+			return nil, err
+		}
+		meta.filter = filter
+	}
 
-func parseAzureMonitorMetadata(metadata, resolvedEnv, authParams map[string]string) (*azureMonitorMetadata, error) {
-	meta := azureMonitorMetadata{}
+	// filterDimension and filterValues are compiled into the filter, so the values don't need to be quoted by hand
+	if val, ok := metadata["filterDimension"]; ok && val != "" {
+		if meta.filter != "" {
+			return nil, fmt.Errorf("metricFilter and filterDimension can't be used together")
+		}
+		if err := validateMetricFilter(fmt.Sprintf("%s eq '*'", val)); err != nil {
+			return nil, fmt.Errorf("filterDimension %q is not a valid dimension name", val)
+		}
+		values := []string{}
+		for _, value := range strings.Split(metadata["filterValues"], ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+		if len(values) == 0 {
+			return nil, fmt.Errorf("filterDimension requires filterValues")
+		}
+		op := "or"
+		if val, ok := metadata["filterOperator"]; ok && val != "" {
+			op = strings.ToLower(val)
+			if op != "or" && op != "and" {
+				return nil, fmt.Errorf("filterOperator %s not supported. Should be or or and", val)
+			}
+		}
+		meta.filter = buildMetricFilter(val, values, op)
+	} else if _, ok := metadata["filterValues"]; ok {
+		return nil, fmt.Errorf("filterValues requires filterDimension")
+	}
 
-	if val, ok := metadata[targetValueName]; ok && val != "" {
-		targetValue, err := strconv.Atoi(val)
+	if val, ok := metadata["validateMetricDefinition"]; ok && val != "" {
+		validateMetricDefinition, err := strconv.ParseBool(val)
 		if err != nil {
-			azureMonitorLog.Error(err, "Error parsing azure monitor metadata", "targetValue", targetValueName)
-			return nil, fmt.Errorf("Error parsing azure monitor metadata %s: %s", targetValueName, err.Error())
+			return nil, fmt.Errorf("Error parsing azure monitor metadata validateMetricDefinition: %s", err.Error())
 		}
-		meta.targetValue = targetValue
-	} else {
-		return nil, fmt.Errorf("no targetValue given")
+		meta.validateMetricDefinition = validateMetricDefinition
 	}
 
-	if val, ok := metadata["resourceURI"]; ok && val != "" {
-		resourceURI := strings.Split(val, "/")
-		if len(resourceURI) != 3 {
-			return nil, fmt.Errorf("resourceURI not in the correct format. Should be namespace/resource_type/resource_name")
+	if val, ok := metadata["alignToMinute"]; ok && val != "" {
+		alignToMinute, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing azure monitor metadata alignToMinute: %s", err.Error())
 		}
-		meta.resourceURI = val
-	} else {
-		return nil, fmt.Errorf("no resourceURI given")
+		meta.alignToMinute = alignToMinute
 	}
 
-	if val, ok := metadata["resourceGroupName"]; ok && val != "" {
-		meta.resourceGroupName = val
-	} else {
-		return nil, fmt.Errorf("no resourceGroupName given")
+	if val, ok := metadata["ignoreNullValues"]; ok && val != "" {
+		ignoreNullValues, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing azure monitor metadata ignoreNullValues: %s", err.Error())
+		}
+		meta.ignoreNullValues = ignoreNullValues
 	}
 
-	if val, ok := metadata[azureMonitorMetricName]; ok && val != "" {
-		meta.name = val
-	} else {
-		return nil, fmt.Errorf("no metricName given")
+	if val, ok := metadata["debugLogRawResponse"]; ok && val != "" {
+		debugLogRawResponse, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing azure monitor metadata debugLogRawResponse: %s", err.Error())
+		}
+		meta.debugLogRawResponse = debugLogRawResponse
 	}
 
-	if val, ok := metadata["metricAggregationType"]; ok && val != "" {
-		meta.aggregationType = val
-	} else {
-		return nil, fmt.Errorf("no metricAggregationType given")
+	if val, ok := metadata["dimensionGroupBy"]; ok && val != "" {
+		if err := validateMetricFilter(fmt.Sprintf("%s eq '*'", val)); err != nil {
+			return nil, fmt.Errorf("dimensionGroupBy %q is not a valid dimension name", val)
+		}
+		meta.dimensionGroupBy = val
 	}
 
-	if val, ok := metadata["metricFilter"]; ok && val != "" {
-		meta.filter = val
+	// top limits a metric split on a dimension to the first timeseries, sorted by orderBy
+	if val, ok := metadata["top"]; ok && val != "" {
+		top, err := strconv.ParseInt(val, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing azure monitor metadata top: %s", err.Error())
+		}
+		if top <= 0 {
+			return nil, fmt.Errorf("top must be positive")
+		}
+		meta.top = int32(top)
+	}
+
+	if val, ok := metadata["orderBy"]; ok && val != "" {
+		if meta.top == 0 {
+			return nil, fmt.Errorf("orderBy requires top")
+		}
+		orderBy, err := parseMetricOrderBy(val)
+		if err != nil {
+			return nil, err
+		}
+		meta.orderBy = orderBy
+	}
+
+	if val, ok := metadata["aggregationGranularity"]; ok && val != "" {
+		granularity, err := parseISO8601Duration("aggregationGranularity", val)
+		if err != nil {
+			return nil, err
+		}
+		meta.aggregationGranularity = strings.ToUpper(val)
+		meta.granularity = granularity
+	}
+
+	// Azure Monitor has no percentile aggregation, the percentile is computed from the data points of the window
+	if val, ok := metadata["percentile"]; ok && val != "" {
+		percentile, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing azure monitor metadata percentile: %s", err.Error())
+		}
+		if math.IsNaN(percentile) || percentile < 0 || percentile > 100 {
+			return nil, fmt.Errorf("percentile must be between 0 and 100, got %s", val)
+		}
+		if meta.metricSource == appInsightsMetricSource {
+			return nil, fmt.Errorf("percentile is not supported by app insights")
+		}
+		if meta.aggregationType == azureMonitorLastAggregation || meta.aggregationType == azureMonitorDataPointCountAggregation {
+			return nil, fmt.Errorf("percentile is not supported with metricAggregationType %s", meta.aggregationType)
+		}
+		meta.percentile = &percentile
+		if meta.aggregationGranularity == "" {
+			meta.aggregationGranularity = defaultAzureMonitorPercentileGranularity
+			meta.granularity = time.Minute
+		}
+	}
+
+	// the hh:mm:ss components are added up by default, strictInterval rejects minutes or seconds of 60 and more
+	strictInterval := false
+	if val, ok := metadata["strictInterval"]; ok && val != "" {
+		strict, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing azure monitor metadata strictInterval: %s", err.Error())
+		}
+		strictInterval = strict
 	}
 
 	if val, ok := metadata["metricAggregationInterval"]; ok && val != "" {
-		aggregationInterval := strings.Split(val, ":")
-		if len(aggregationInterval) != 3 {
-			return nil, fmt.Errorf("metricAggregationInterval not in the correct format. Should be hh:mm:ss")
+		if _, err := parseAggregationInterval("metricAggregationInterval", val); err != nil {
+			return nil, err
+		}
+		if strictInterval {
+			if err := validateStrictTimeSpan("metricAggregationInterval", val); err != nil {
+				return nil, err
+			}
 		}
 		meta.aggregationInterval = val
+	} else if val, ok := metadata["defaultAggregationWindow"]; ok && val != "" {
+		// replaces the package default for this trigger, metricAggregationInterval still takes precedence
+		window, err := parseTimeSpanDuration("defaultAggregationWindow", val)
+		if err != nil {
+			return nil, err
+		}
+		if strictInterval {
+			if err := validateStrictTimeSpan("defaultAggregationWindow", val); err != nil {
+				return nil, err
+			}
+		}
+		if window <= 0 {
+			return nil, fmt.Errorf("defaultAggregationWindow must be greater than zero")
+		}
+		meta.aggregationInterval = formatTimeSpanDuration(window)
 	}
 
-	// Required authentication parameters below
+	if meta.granularity > 0 {
+		window, err := getAggregationWindow(meta.aggregationInterval)
+		if err != nil {
+			return nil, err
+		}
+		if meta.granularity > window {
+			return nil, fmt.Errorf("aggregationGranularity %s is longer than the aggregation window %s", meta.aggregationGranularity, window)
+		}
+	}
 
-	if val, ok := metadata["subscriptionId"]; ok && val != "" {
-		meta.subscriptionID = val
-	} else {
-		return nil, fmt.Errorf("no subscriptionId given")
+	if val, ok := metadata["metricAggregationDelay"]; ok && val != "" {
+		aggregationDelay := strings.Split(val, ":")
+		if len(aggregationDelay) != 3 {
+			return nil, fmt.Errorf("metricAggregationDelay not in the correct format. Should be hh:mm:ss")
+		}
+		if strictInterval {
+			if err := validateStrictTimeSpan("metricAggregationDelay", val); err != nil {
+				return nil, err
+			}
+		}
+		meta.aggregationDelay = val
 	}
 
-	if val, ok := metadata["tenantId"]; ok && val != "" {
-		meta.tenantID = val
-	} else {
-		return nil, fmt.Errorf("no tenantId given")
+	meta.cloud = defaultAzureMonitorCloud
+	if val, ok := metadata["cloud"]; ok && val != "" {
+		if _, err := getAzureMonitorEnvironment(val); err != nil {
+			return nil, err
+		}
+		meta.cloud = val
 	}
 
-	if val, ok := authParams["activeDirectoryClientId"]; ok && val != "" {
-		meta.clientID = val
-	} else {
-		clientIDSetting := defaultClientIDSetting
-		if val, ok := metadata["activeDirectoryClientId"]; ok && val != "" {
-			clientIDSetting = val
+	// lets the scaler talk to a mock server or go through a forward proxy instead of the cloud's endpoint
+	if val, ok := metadata["endpointOverride"]; ok && val != "" {
+		endpoint, err := url.Parse(val)
+		if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+			return nil, fmt.Errorf("endpointOverride %s is not an absolute URL", val)
+		}
+		meta.endpointOverride = val
+	}
+
+	// queries go to the regional endpoint of the cloud for a known region, the global endpoint otherwise
+	if val, ok := metadata["region"]; ok && val != "" {
+		if meta.metricSource == appInsightsMetricSource {
+			return nil, fmt.Errorf("region is not supported by app insights")
+		}
+		meta.region = normalizeAzureMonitorRegion(val)
+	}
+
+	if val, ok := metadata["tokenAudience"]; ok && val != "" {
+		if meta.metricSource == appInsightsMetricSource {
+			return nil, fmt.Errorf("tokenAudience is not supported by app insights")
+		}
+		audience, err := url.Parse(val)
+		if err != nil || audience.Scheme == "" || audience.Host == "" {
+			return nil, fmt.Errorf("tokenAudience %s is not an absolute URL", val)
+		}
+		meta.tokenAudience = val
+	}
+
+	if val, ok := metadata["userAgentSuffix"]; ok {
+		meta.userAgentSuffix = strings.TrimSpace(val)
+	}
+
+	if val, ok := metadata["noProxy"]; ok {
+		meta.noProxy = strings.TrimSpace(val)
+	}
+
+	if meta.metricSource == appInsightsMetricSource {
+		if err := validateAppInsightsMetadata(&meta); err != nil {
+			return nil, err
+		}
+	}
+	if len(meta.metricNames) > 0 && (meta.metricSource == appInsightsMetricSource || meta.resourceTagFilter != "" || meta.dimensionGroupBy != "") {
+		return nil, fmt.Errorf("metricNames is not supported with app insights, resourceTagFilter or dimensionGroupBy")
+	}
+	if meta.capacityMetricName != "" && (meta.metricSource == appInsightsMetricSource || meta.resourceTagFilter != "" || meta.dimensionGroupBy != "") {
+		return nil, fmt.Errorf("capacityMetricName is not supported with app insights, resourceTagFilter or dimensionGroupBy")
+	}
+	if metadata["resourceNames"] != "" && (meta.metricSource == appInsightsMetricSource || meta.resourceTagFilter != "") {
+		return nil, fmt.Errorf("resourceNames is not supported with app insights or resourceTagFilter")
+	}
+	if len(meta.resourceNames) > 0 && (len(meta.metricNames) > 0 || meta.capacityMetricName != "" || meta.dimensionGroupBy != "" || meta.validateMetricDefinition) {
+		return nil, fmt.Errorf("resourceNames is not supported with metricNames, capacityMetricName, dimensionGroupBy or validateMetricDefinition")
+	}
+	if meta.top > 0 && meta.metricSource == appInsightsMetricSource {
+		return nil, fmt.Errorf("top is not supported by app insights")
+	}
+	if meta.top > 0 && meta.filter == "" && meta.dimensionGroupBy == "" {
+		return nil, fmt.Errorf("top requires metricFilter, filterDimension or dimensionGroupBy to split the metric")
+	}
+	if meta.resourceTagFilter != "" && meta.validateMetricDefinition {
+		return nil, fmt.Errorf("validateMetricDefinition is not supported with resourceTagFilter")
+	}
+
+	// Required authentication parameters below
+
+	if meta.metricSource == appInsightsMetricSource {
+		// the App Insights API is not scoped to a subscription, an API key replaces the AAD credentials
+		if meta.appInsightsAPIKey != "" {
+			return &meta, nil
 		}
+	}
+
+	auth, err := resolveAzureMonitorAuth(resolvedEnv, authParams, metadata)
+	if err != nil {
+		return nil, err
+	}
 
-		if val, ok := resolvedEnv[clientIDSetting]; ok {
-			meta.clientID = val
+	if meta.metricSource != appInsightsMetricSource {
+		if auth.subscriptionID != "" {
+			meta.subscriptionID = auth.subscriptionID
+		} else if resourceInfo.SubscriptionID != "" {
+			meta.subscriptionID = resourceInfo.SubscriptionID
+		} else if podIdentity == "azure" {
+			// with a managed identity the pod runs on an Azure VM, which knows its subscription
+			subscriptionID, err := getIMDSSubscriptionID(context.Background())
+			if err != nil {
+				return nil, fmt.Errorf("no subscriptionId given and %s", err)
+			}
+			meta.subscriptionID = subscriptionID
 		} else {
-			return nil, fmt.Errorf("no activeDirectoryClientId given")
+			return nil, fmt.Errorf("no subscriptionId given")
+		}
+		if err := validateSubscriptionID("subscriptionId", meta.subscriptionID); err != nil {
+			return nil, err
+		}
+
+		// the resource can live in another subscription than the one used to authenticate, e.g. in hub-and-spoke setups
+		if val, ok := metadata["resourceSubscriptionId"]; ok && val != "" {
+			if resourceInfo.SubscriptionID != "" && !strings.EqualFold(resourceInfo.SubscriptionID, val) {
+				return nil, fmt.Errorf("resourceSubscriptionId %s does not match subscription %s in resourceURI", val, resourceInfo.SubscriptionID)
+			}
+			if err := validateSubscriptionID("resourceSubscriptionId", val); err != nil {
+				return nil, err
+			}
+			meta.resourceSubscriptionID = val
+		} else if resourceInfo.SubscriptionID != "" && !strings.EqualFold(resourceInfo.SubscriptionID, meta.subscriptionID) {
+			if err := validateSubscriptionID("resourceURI subscription", resourceInfo.SubscriptionID); err != nil {
+				return nil, err
+			}
+			meta.resourceSubscriptionID = resourceInfo.SubscriptionID
 		}
 	}
 
-	if val, ok := authParams["activeDirectoryClientPassword"]; ok && val != "" {
-		meta.clientPassword = val
+	if auth.tenantID != "" {
+		meta.tenantID = auth.tenantID
 	} else {
-		clientPasswordSetting := defaultClientPasswordSetting
-		if val, ok := metadata["activeDirectoryClientPassword"]; ok && val != "" {
-			clientPasswordSetting = val
+		return nil, fmt.Errorf("no tenantId given")
+	}
+
+	// pod identity does not need a service principal, so the client credentials are only required otherwise
+	meta.podIdentity = podIdentity
+	if podIdentity == "" || podIdentity == "none" {
+		if auth.clientID != "" {
+			meta.clientID = auth.clientID
+		} else {
+			return nil, fmt.Errorf("no activeDirectoryClientId given")
+		}
+
+		// a certificate takes precedence over the client secret, for tenants that forbid password credentials
+		if val, ok := authParams["clientCertificate"]; ok && val != "" {
+			meta.clientCertificate = val
+		} else if val, ok := metadata["clientCertificate"]; ok && val != "" {
+			meta.clientCertificate = val
 		}
 
-		if val, ok := resolvedEnv[clientPasswordSetting]; ok {
-			meta.clientPassword = val
+		if meta.clientCertificate != "" {
+			if val, ok := authParams["clientCertificatePassword"]; ok && val != "" {
+				meta.clientCertificatePassword = val
+			} else if val, ok := metadata["clientCertificatePassword"]; ok && val != "" {
+				if password, ok := resolvedEnv[val]; ok {
+					meta.clientCertificatePassword = password
+				} else {
+					return nil, fmt.Errorf("no clientCertificatePassword found in environment variable %s", val)
+				}
+			}
+		} else if val, ok := metadata["clientSecretFromFile"]; ok && val != "" {
+			// the file is read again when it changes, so a rotated secret in a mounted volume is used without a restart
+			meta.clientSecretFile = val
+		} else if auth.clientPassword != "" {
+			meta.clientPassword = auth.clientPassword
 		} else {
 			return nil, fmt.Errorf("no activeDirectoryClientPassword given")
 		}
+	} else if podIdentity != "azure" {
+		return nil, fmt.Errorf("pod identity %s not supported for azure monitor", podIdentity)
+	}
+
+	// a second service principal the queries fail over to when the primary credentials are rejected
+	if auth.backupClientID != "" || auth.backupClientPassword != "" {
+		if podIdentity == "azure" {
+			return nil, fmt.Errorf("backupActiveDirectoryClientId is not supported with pod identity")
+		}
+		if auth.backupClientID == "" || auth.backupClientPassword == "" {
+			return nil, fmt.Errorf("backupActiveDirectoryClientId and backupActiveDirectoryClientPassword must be given together")
+		}
+		meta.backupClientID = auth.backupClientID
+		meta.backupClientPassword = auth.backupClientPassword
 	}
 
 	return &meta, nil
 }
 
-// Returns true if the Azure Monitor metric value is greater than zero
+// azureMonitorAuth holds the identifiers and the secret used to authenticate against Azure Monitor
+type azureMonitorAuth struct {
+	tenantID       string
+	subscriptionID string
+	clientID       string
+	clientPassword string
+
+	backupClientID       string
+	backupClientPassword string
+}
+
+// resolveAzureMonitorAuth resolves every auth field the same way, the first of these that is set wins:
+//   - the parameter of the TriggerAuthentication
+//   - the environment variable of the container named by <field>FromEnv
+//   - the inline metadata value, or the environment variable it names when the container has one by that name.
+//     The inline client IDs and passwords always name an environment variable, which is how
+//     activeDirectoryClientId and activeDirectoryClientPassword have always been set, and a missing one is an error.
+func resolveAzureMonitorAuth(resolvedEnv, authParams, metadata map[string]string) (azureMonitorAuth, error) {
+	var auth azureMonitorAuth
+	fields := []struct {
+		key      string
+		namesEnv bool
+		value    *string
+	}{
+		{"tenantId", false, &auth.tenantID},
+		{"subscriptionId", false, &auth.subscriptionID},
+		{"activeDirectoryClientId", true, &auth.clientID},
+		{"activeDirectoryClientPassword", true, &auth.clientPassword},
+		{"backupActiveDirectoryClientId", true, &auth.backupClientID},
+		{"backupActiveDirectoryClientPassword", true, &auth.backupClientPassword},
+	}
+
+	for _, field := range fields {
+		value, err := resolveAzureMonitorAuthValue(field.key, field.namesEnv, resolvedEnv, authParams, metadata)
+		if err != nil {
+			return azureMonitorAuth{}, err
+		}
+		*field.value = value
+	}
+	return auth, nil
+}
+
+// resolveAzureMonitorAuthValue returns the value of a single auth field, or an empty string when it is not set. When
+// namesEnv is set the inline value must name an environment variable of the container.
+func resolveAzureMonitorAuthValue(key string, namesEnv bool, resolvedEnv, authParams, metadata map[string]string) (string, error) {
+	if val, ok := authParams[key]; ok && val != "" {
+		return val, nil
+	}
+	if val, ok := metadata[key+"FromEnv"]; ok && val != "" {
+		if envVal, ok := resolvedEnv[val]; ok && envVal != "" {
+			return envVal, nil
+		}
+		return "", fmt.Errorf("no %s found in environment variable %s", key, val)
+	}
+	if val, ok := metadata[key]; ok && val != "" {
+		if envVal, ok := resolvedEnv[val]; ok {
+			return envVal, nil
+		}
+		if namesEnv {
+			return "", fmt.Errorf("no %s given, environment variable %s not found", key, val)
+		}
+		return val, nil
+	}
+	return "", nil
+}
+
+// Returns true if the Azure Monitor metric value is greater than the activation target value, which defaults to zero
 func (s *azureMonitorScaler) IsActive(ctx context.Context) (bool, error) {
-	val, err := GetAzureMetricValue(ctx, s.metadata)
+	val, err := s.getMetricValue(ctx)
 	if err != nil {
 		azureMonitorLog.Error(err, "error getting azure monitor metric")
 		return false, err
 	}
 
-	return val > 0, nil
+	return s.isActiveValue(val), nil
+}
+
+// isActiveValue reports whether the metric is above the activation target value. With activationGracePolls set,
+// an active trigger only becomes inactive once the metric stayed at or below it for that many consecutive polls.
+func (s *azureMonitorScaler) isActiveValue(val float64) bool {
+	if s.activation == nil {
+		return val > s.metadata.activationTargetValue
+	}
+
+	s.activation.lock.Lock()
+	defer s.activation.lock.Unlock()
+
+	if val > s.metadata.activationTargetValue {
+		s.activation.active = true
+		s.activation.belowPolls = 0
+		return true
+	}
+	if !s.activation.active {
+		return false
+	}
+
+	s.activation.belowPolls++
+	if s.activation.belowPolls >= s.metadata.activationGracePolls {
+		s.activation.active = false
+		s.activation.belowPolls = 0
+	}
+	return s.activation.active
+}
+
+// getMetricValue returns the cached or queried value, falling back to the last good value with fallbackOnError
+func (s *azureMonitorScaler) getMetricValue(ctx context.Context) (float64, error) {
+	value, err := s.getCachedMetricValue(ctx)
+	if s.lastGood == nil {
+		return value, err
+	}
+	return s.lastGood.fallback(value, err, s.metadata.fallbackMaxAge, time.Now())
+}
+
+func (s *azureMonitorScaler) getCachedMetricValue(ctx context.Context) (float64, error) {
+	if s.valueCache == nil || s.metadata.metricCacheTTL <= 0 {
+		return s.queryMetricValue(ctx)
+	}
+	return s.valueCache.get(getAzureMonitorRequestSignature(s.metadata), s.metadata.metricCacheTTL, func() (float64, error) {
+		return s.queryMetricValue(ctx)
+	})
+}
+
+func (s *azureMonitorScaler) queryMetricValue(ctx context.Context) (float64, error) {
+	if s.jitter != nil {
+		if err := waitAzureMonitorJitter(ctx, s.jitter.next(s.metadata.startupJitter, s.metadata.pollJitter)); err != nil {
+			return 0, err
+		}
+	}
+
+	value, err := s.queryWindowValue(ctx, s.metadata)
+	if err == nil && s.derivative != nil {
+		value, err = s.getDerivativeValue(ctx, value)
+	}
+	if err != nil {
+		return value, err
+	}
+	if s.smoothing != nil {
+		value = s.smoothing.smooth(value, s.metadata.emaAlpha)
+	}
+	value = getHealthMetricValue(s.metadata, clampMetricValue(s.metadata, value))
+	// rounding comes last so that the combined, smoothed and clamped value is what gets rounded
+	return roundMetricValue(value, s.metadata.roundingMode), nil
+}
+
+// getHealthMetricValue reports the fixed unhealthyMetricValue while the metric, e.g. the availability of an endpoint,
+// is below unhealthyBelow, so that the target scales to the remediation replicas it is sized for
+func getHealthMetricValue(meta *azureMonitorMetadata, value float64) float64 {
+	if meta.unhealthyBelow == nil || value >= *meta.unhealthyBelow {
+		return value
+	}
+	azureMonitorLog.Info("azure monitor metric value is below unhealthyBelow, reporting unhealthyMetricValue instead", "resourceURI", meta.resourceURI, "metricName", meta.name, "value", value, "unhealthyBelow", *meta.unhealthyBelow, "unhealthyMetricValue", meta.unhealthyMetricValue)
+	return meta.unhealthyMetricValue
+}
+
+// clampMetricValue caps the value at the maxMetricValue of the trigger, warning when it does
+func clampMetricValue(meta *azureMonitorMetadata, value float64) float64 {
+	if meta.maxMetricValue == nil || value <= *meta.maxMetricValue {
+		return value
+	}
+	azureMonitorLog.Info("azure monitor metric value is above maxMetricValue, reporting maxMetricValue instead", "resourceURI", meta.resourceURI, "metricName", meta.name, "value", value, "maxMetricValue", *meta.maxMetricValue)
+	return *meta.maxMetricValue
+}
+
+// queryWindowValue queries the metric with the primary credentials, and once more with the backup credentials of the
+// trigger when Azure rejects the primary ones
+func (s *azureMonitorScaler) queryWindowValue(ctx context.Context, meta *azureMonitorMetadata) (float64, error) {
+	var value float64
+	var err error
+	if s.httpClient == nil {
+		value, err = getAzureMetricValue(ctx, meta, nil)
+	} else {
+		value, err = getAzureMetricValueWithClient(ctx, meta, s.metricsClient, s.httpClient)
+	}
+	if err == nil || meta.backupClientID == "" || !isAzureMonitorAuthError(err) {
+		return value, err
+	}
+
+	backupMeta := getBackupCredentialsMetadata(meta)
+	if s.httpClient == nil {
+		value, err = getAzureMetricValue(ctx, backupMeta, nil)
+	} else {
+		value, err = getAzureMetricValue(ctx, backupMeta, s.httpClient)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("backup credentials of the azure monitor trigger failed after the primary credentials were rejected: %w", err)
+	}
+	azureMonitorLog.Info("primary azure monitor credentials were rejected, queried with the backup credentials", "resourceURI", meta.resourceURI, "metricName", meta.name, "clientId", meta.clientID, "backupClientId", backupMeta.clientID)
+	return value, nil
+}
+
+// getBackupCredentialsMetadata returns the metadata authenticating with the backup service principal in place of the primary one
+func getBackupCredentialsMetadata(meta *azureMonitorMetadata) *azureMonitorMetadata {
+	backupMeta := *meta
+	backupMeta.clientID = meta.backupClientID
+	backupMeta.clientPassword = meta.backupClientPassword
+	backupMeta.clientSecretFile = ""
+	backupMeta.clientCertificate = ""
+	backupMeta.clientCertificatePassword = ""
+	backupMeta.backupClientID = ""
+	backupMeta.backupClientPassword = ""
+	return &backupMeta
+}
+
+// getDerivativeValue returns how fast the metric changed per second since the previous sample of the trigger.
+// Without a recent sample, e.g. after a restart or when polls were missed, the window before the current one is queried
+func (s *azureMonitorScaler) getDerivativeValue(ctx context.Context, value float64) (float64, error) {
+	window, err := getAggregationWindow(s.metadata.aggregationInterval)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	previous, sampledAt := s.derivative.last()
+	interval := now.Sub(sampledAt)
+	if sampledAt.IsZero() || interval <= 0 || interval > 2*window {
+		previousMeta, err := getPreviousWindowMetadata(s.metadata, window)
+		if err != nil {
+			return 0, err
+		}
+		previous, err = s.queryWindowValue(ctx, previousMeta)
+		if err != nil {
+			return 0, err
+		}
+		interval = window
+	}
+	s.derivative.store(value, now)
+
+	return getMetricDerivative(value, previous, interval), nil
+}
+
+// getPreviousWindowMetadata copies the metadata with the delay pushed back by one window, so that it queries the
+// window that ends where the current one starts
+func getPreviousWindowMetadata(meta *azureMonitorMetadata, window time.Duration) (*azureMonitorMetadata, error) {
+	delay := time.Duration(0)
+	if meta.aggregationDelay != "" {
+		var err error
+		delay, err = parseTimeSpanDuration("metricAggregationDelay", meta.aggregationDelay)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	previousMeta := *meta
+	previousMeta.aggregationDelay = formatTimeSpanDuration(delay + window)
+	return &previousMeta, nil
+}
+
+// getMetricDerivative returns the change between the two values per second of the interval between them
+func getMetricDerivative(value float64, previous float64, interval time.Duration) float64 {
+	if interval <= 0 {
+		return 0
+	}
+	return (value - previous) / interval.Seconds()
+}
+
+// get returns the cached value for the key, calling query when it is missing or older than the ttl. Errors are not cached.
+// The lock is not held while querying, so concurrent misses for the same key may each query Azure Monitor once.
+func (c *azureMonitorValueCache) get(key string, ttl time.Duration, query func() (float64, error)) (float64, error) {
+	c.lock.Lock()
+	entry, ok := c.entries[key]
+	c.lock.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.value, nil
+	}
+
+	value, err := query()
+	if err != nil {
+		return value, err
+	}
+
+	c.lock.Lock()
+	now := time.Now()
+	for entryKey, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, entryKey)
+		}
+	}
+	c.entries[key] = azureMonitorCachedValue{value: value, expires: now.Add(ttl)}
+	c.lock.Unlock()
+	return value, nil
+}
+
+// formatAzureMonitorOptionalFloat formats an optional setting of a trigger for its signature, without one it is empty
+func formatAzureMonitorOptionalFloat(value *float64) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*value, 'g', -1, 64)
+}
+
+// getAzureMonitorRequestSignature identifies the query a scaler makes and the identity it makes it with, scalers with
+// the same signature get the same value
+func getAzureMonitorRequestSignature(meta *azureMonitorMetadata) string {
+	return strings.Join([]string{
+		getAzureMonitorIdentity(meta),
+		meta.metricSource, meta.appInsightsAppID, meta.cloud, meta.endpointOverride, meta.region, meta.subscriptionID, meta.resourceSubscriptionID, meta.resourceGroupName, meta.scope, meta.resourceURI, strings.Join(meta.resourceNames, ","), meta.resourceTagFilter, meta.resourceType,
+		meta.metricNamespace, meta.name, meta.combine, meta.capacityMetricName, string(meta.aggregationType), meta.filter, meta.dimensionGroupBy, strconv.Itoa(int(meta.top)), meta.orderBy, meta.aggregationInterval, meta.aggregationDelay, strconv.FormatBool(meta.alignToMinute), meta.aggregationGranularity,
+		strconv.FormatBool(meta.metricResultAsRate), strconv.FormatBool(meta.metricDerivative), strconv.FormatBool(meta.ignoreNullValues), meta.targetUnit, meta.roundingMode, formatAzureMonitorOptionalFloat(meta.percentile), strconv.FormatFloat(meta.metricValueMultiplier, 'g', -1, 64), formatAzureMonitorOptionalFloat(meta.maxMetricValue), strconv.FormatFloat(meta.emaAlpha, 'g', -1, 64),
+		formatAzureMonitorOptionalFloat(meta.unhealthyBelow), strconv.FormatFloat(meta.unhealthyMetricValue, 'g', -1, 64),
+	}, "|")
+}
+
+// getAzureMonitorIdentity identifies the credentials the trigger queries with without holding its secrets, so a
+// trigger whose identity may not read the metric does not get the value read by another identity
+func getAzureMonitorIdentity(meta *azureMonitorMetadata) string {
+	switch {
+	case meta.metricSource == appInsightsMetricSource:
+		// the API key is the only credential of app insights
+		hash := fnv.New64a()
+		_, _ = hash.Write([]byte(meta.appInsightsAPIKey))
+		return fmt.Sprintf("apiKey=%x", hash.Sum64())
+	case meta.podIdentity == "azure":
+		return "podIdentity=" + meta.podIdentity + "|" + meta.tokenAudience
+	case meta.clientCertificate != "":
+		return strings.Join([]string{"clientCertificate=" + meta.clientCertificate, meta.tenantID, meta.clientID, meta.tokenAudience}, "|")
+	case meta.clientSecretFile != "":
+		return strings.Join([]string{"clientSecretFile=" + meta.clientSecretFile, meta.tenantID, meta.clientID, meta.tokenAudience}, "|")
+	}
+	return strings.Join([]string{"clientSecret", meta.tenantID, meta.clientID, meta.tokenAudience}, "|")
 }
 
+// Close releases the idle connections of the scaler's HTTP client, it is safe to call more than once. The client
+// shared by the triggers with the same noProxy setting is left open, the scaler is closed after every poll and
+// closing it would drop the connections of every other trigger.
 func (s *azureMonitorScaler) Close() error {
+	if s.httpClient != nil && !isAzureMonitorSharedHTTPClient(s.httpClient) {
+		s.httpClient.CloseIdleConnections()
+	}
 	return nil
 }
 
 func (s *azureMonitorScaler) GetMetricSpecForScaling() []v2beta1.MetricSpec {
 	targetMetricVal := resource.NewQuantity(int64(s.metadata.targetValue), resource.DecimalSI)
-	externalMetric := &v2beta1.ExternalMetricSource{MetricName: azureMonitorMetricName, TargetAverageValue: targetMetricVal}
+	externalMetric := &v2beta1.ExternalMetricSource{MetricName: getAzureMonitorMetricName(s.metadata)}
+	if s.metadata.targetType == azureMonitorValueTargetType {
+		externalMetric.TargetValue = targetMetricVal
+	} else {
+		externalMetric.TargetAverageValue = targetMetricVal
+	}
 	metricSpec := v2beta1.MetricSpec{External: externalMetric, Type: externalMetricType}
 	return []v2beta1.MetricSpec{metricSpec}
 }
 
+// getAzureMonitorMetricName builds a valid Kubernetes metric name that is unique per resource and Azure metric, e.g.
+// azure-monitor-<subscription>-<resource group>-<provider>-<resource type>-<resource name>-<metric name>, unless the
+// trigger sets a metricNameOverride
+func getAzureMonitorMetricName(metadata *azureMonitorMetadata) string {
+	if metadata.metricNameOverride != "" {
+		return metadata.metricNameOverride
+	}
+	subscriptionID := metadata.subscriptionID
+	if metadata.resourceSubscriptionID != "" {
+		subscriptionID = metadata.resourceSubscriptionID
+	}
+	parts := []string{"azure-monitor", subscriptionID, metadata.resourceGroupName}
+	if metadata.metricSource == appInsightsMetricSource {
+		parts = []string{"azure-app-insights", metadata.appInsightsAppID}
+	} else if metadata.resourceTagFilter != "" {
+		parts = append(parts, metadata.resourceType, metadata.resourceTagFilter)
+	} else if len(metadata.resourceNames) > 0 {
+		// the resourceURI holds the provider and resource type of the resources
+		parts = append(parts, metadata.resourceURI)
+		parts = append(parts, metadata.resourceNames...)
+	} else if info, err := parseAzureResourceURI(metadata.resourceURI, metadata.scope); err == nil {
+		parts = append(parts, info.ProviderNamespace, info.ResourceType, info.ResourceName)
+	}
+	parts = append(parts, metadata.name)
+	if metadata.capacityMetricName != "" {
+		parts = append(parts, "per", metadata.capacityMetricName)
+	}
+
+	sanitized := make([]string, 0, len(parts))
+	for _, part := range parts {
+		part = strings.Trim(azureMonitorInvalidMetricNameChars.ReplaceAllString(strings.ToLower(part), "-"), "-")
+		if part != "" {
+			sanitized = append(sanitized, part)
+		}
+	}
+	return truncateAzureMonitorMetricName(strings.Join(sanitized, "-"))
+}
+
+// truncateAzureMonitorMetricName cuts a metric name that is too long for Kubernetes and ends it with a hash of the
+// full name, so that names which only differ after the cut stay unique
+func truncateAzureMonitorMetricName(name string) string {
+	if len(name) <= maxAzureMonitorMetricNameLength {
+		return name
+	}
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(name))
+	suffix := fmt.Sprintf("%08x", hash.Sum32())
+	return strings.TrimRight(name[:maxAzureMonitorMetricNameLength-len(suffix)-1], "-") + "-" + suffix
+}
+
 // GetMetrics returns value for a supported metric and an error if there is a problem getting the metric
 func (s *azureMonitorScaler) GetMetrics(ctx context.Context, metricName string, metricSelector labels.Selector) ([]external_metrics.ExternalMetricValue, error) {
-	val, err := GetAzureMetricValue(ctx, s.metadata)
+	// the metrics adapter asks every scaler of the ScaledObject, the metric names are lower case so the case is ignored
+	if expected := getAzureMonitorMetricName(s.metadata); !strings.EqualFold(metricName, expected) {
+		return []external_metrics.ExternalMetricValue{}, fmt.Errorf("metric %s is not served by this azure monitor trigger, its metric is %s", metricName, expected)
+	}
+
+	val, err := s.getMetricValue(ctx)
 	if err != nil {
 		azureMonitorLog.Error(err, "error getting azure monitor metric")
 		return []external_metrics.ExternalMetricValue{}, err
@@ -186,9 +1891,24 @@ func (s *azureMonitorScaler) GetMetrics(ctx context.Context, metricName string,
 
 	metric := external_metrics.ExternalMetricValue{
 		MetricName: metricName,
-		Value:      *resource.NewQuantity(int64(val), resource.DecimalSI),
+		Value:      newAzureMonitorQuantity(val),
 		Timestamp:  metav1.Now(),
 	}
 
 	return append([]external_metrics.ExternalMetricValue{}, metric), nil
 }
+
+// newAzureMonitorQuantity returns the value with a precision of a thousandth, values that don't fit a quantity at that
+// precision are capped instead of overflowing
+func newAzureMonitorQuantity(val float64) resource.Quantity {
+	milli := val * 1000
+	switch {
+	case math.IsNaN(milli):
+		milli = 0
+	case milli >= math.MaxInt64:
+		return *resource.NewMilliQuantity(math.MaxInt64, resource.DecimalSI)
+	case milli <= math.MinInt64:
+		return *resource.NewMilliQuantity(math.MinInt64, resource.DecimalSI)
+	}
+	return *resource.NewMilliQuantity(int64(milli), resource.DecimalSI)
+}
@@ -1,7 +1,41 @@
 package scalers
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2018-03-01/insights"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/azure/auth"
+	"github.com/Azure/go-autorest/autorest/date"
+	"github.com/go-logr/logr"
+	"github.com/kedacore/keda/version"
+	"go.uber.org/goleak"
 )
 
 type parseAzMonitorMetadataTestData struct {
@@ -9,51 +43,362 @@ type parseAzMonitorMetadataTestData struct {
 	isError     bool
 	resolvedEnv map[string]string
 	authParams  map[string]string
+	podIdentity string
 }
 
 var testAzMonitorResolvedEnv = map[string]string{
 	"CLIENT_ID":       "xxx",
 	"CLIENT_PASSWORD": "yyy",
+	"BACKUP_ID":       "backup-xxx",
+	"BACKUP_PASSWORD": "backup-yyy",
 }
 
 var testParseAzMonitorMetadata = []parseAzMonitorMetadataTestData{
 	// nothing passed
-	{map[string]string{}, true, map[string]string{}, map[string]string{}},
+	{map[string]string{}, true, map[string]string{}, map[string]string{}, ""},
 	// properly formed
-	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}},
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// Last aggregation type
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Last", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// dimensionGroupBy
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Total", "dimensionGroupBy": "EntityName", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// invalid dimensionGroupBy
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Total", "dimensionGroupBy": "Entity'Name", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// maxMetricRetention
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "maxMetricRetention": "720h", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// invalid maxMetricRetention
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "maxMetricRetention": "0s", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// activationGracePolls
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "activationGracePolls": "3", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// negative activationGracePolls
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "activationGracePolls": "-1", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// subscriptionId is not a GUID
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// resourceSubscriptionId is not a GUID
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceSubscriptionId": "789", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// resourceGroupName with illegal characters
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test group", "metricName": "metric", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// clientSecretFromFile instead of a client password
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "clientSecretFromFile": "/var/run/secrets/azure/client-secret", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// metricValueMultiplier
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "metricValueMultiplier": "0.001", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// non positive metricValueMultiplier
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "metricValueMultiplier": "0", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// metricValueMultiplier is not a number
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "metricValueMultiplier": "NaN", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// metricCacheTTL disabled
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "metricCacheTTL": "0s", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// negative metricCacheTTL
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "metricCacheTTL": "-1s", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// validateMetricDefinition
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "validateMetricDefinition": "true", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// invalid validateMetricDefinition
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "validateMetricDefinition": "sometimes", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// aggregationGranularity
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "aggregationGranularity": "PT1M", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// invalid aggregationGranularity
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "aggregationGranularity": "1m", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// aggregationGranularity longer than the aggregation window
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "aggregationGranularity": "PT1H", "metricAggregationInterval": "0:15:0", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// ignoreNullValues
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "ignoreNullValues": "true", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// invalid ignoreNullValues
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "ignoreNullValues": "yes please", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// app insights metric with an API key
+	{map[string]string{"metricSource": "appInsights", "appInsightsAppId": "app-id", "metricName": "requests/count", "metricAggregationType": "Count", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{"appInsightsApiKey": "API_KEY"}, ""},
+	// app insights metric with an API key from the environment
+	{map[string]string{"metricSource": "appInsights", "appInsightsAppId": "app-id", "appInsightsApiKeyFromEnv": "CLIENT_PASSWORD", "metricName": "requests/count", "metricAggregationType": "Count", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// app insights metric with AAD credentials
+	{map[string]string{"metricSource": "appInsights", "appInsightsAppId": "app-id", "metricName": "requests/count", "metricAggregationType": "Count", "tenantId": "123", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// app insights metric without appInsightsAppId
+	{map[string]string{"metricSource": "appInsights", "metricName": "requests/count", "metricAggregationType": "Count", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{"appInsightsApiKey": "API_KEY"}, ""},
+	// app insights metric without credentials
+	{map[string]string{"metricSource": "appInsights", "appInsightsAppId": "app-id", "metricName": "requests/count", "metricAggregationType": "Count", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// app insights metric with an aggregation it does not support
+	{map[string]string{"metricSource": "appInsights", "appInsightsAppId": "app-id", "metricName": "requests/count", "metricAggregationType": "Last", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{"appInsightsApiKey": "API_KEY"}, ""},
+	// unknown metricSource
+	{map[string]string{"metricSource": "logAnalytics", "resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// resourceTagFilter instead of resourceURI
+	{map[string]string{"resourceTagFilter": "role=worker", "resourceType": "Microsoft.Compute/virtualMachines", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "metricName": "metric", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// resourceTagFilter together with resourceURI
+	{map[string]string{"resourceTagFilter": "role=worker", "resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// resourceTagFilter without a tag name
+	{map[string]string{"resourceTagFilter": "=worker", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "metricName": "metric", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// resourceTagFilter with an invalid resourceType
+	{map[string]string{"resourceTagFilter": "role=worker", "resourceType": "virtualMachines", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "metricName": "metric", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// resourceTagFilter without subscriptionId
+	{map[string]string{"resourceTagFilter": "role=worker", "tenantId": "123", "metricName": "metric", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// client certificate instead of client secret
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "clientCertificate": "/certs/sp.pem", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// client certificate with its password from the environment
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "clientCertificate": "/certs/sp.pfx", "clientCertificatePassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// client certificate with a password environment variable that is not set
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "clientCertificate": "/certs/sp.pfx", "clientCertificatePassword": "MISSING", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// client certificate and its password from the trigger authentication
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "targetValue": "5"}, false, map[string]string{}, map[string]string{"activeDirectoryClientId": "zzz", "clientCertificate": "/certs/sp.pfx", "clientCertificatePassword": "password"}, ""},
+	// multiple metrics combined
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricNames": "cpu_percent, memory_percent", "combine": "AVG", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// multiple metrics with the default combine
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricNames": "cpu_percent,memory_percent", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// unsupported combine
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricNames": "cpu_percent,memory_percent", "combine": "median", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// metricNames with an empty metric name
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricNames": "cpu_percent,,memory_percent", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// both metricName and metricNames
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricNames": "cpu_percent,memory_percent", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// combine without metricNames
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "combine": "max", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// metricNames with dimensionGroupBy
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricNames": "cpu_percent,memory_percent", "dimensionGroupBy": "Instance", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// noProxy
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "noProxy": "management.azure.com", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// startup and poll jitter
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "startupJitter": "30s", "pollJitter": "5s", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// improperly formatted pollJitter
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "pollJitter": "5", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// negative startupJitter
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "startupJitter": "-1s", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// capacityMetricName
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "active_connections", "capacityMetricName": "max_connections", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// capacityMetricName with dimensionGroupBy
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "active_connections", "capacityMetricName": "max_connections", "dimensionGroupBy": "Instance", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// subscription scope without a resource group
+	{map[string]string{"resourceURI": "Microsoft.Capacity/resourceProviders/Microsoft.Compute", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "scope": "Subscription", "metricName": "metric", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// explicit resource group scope
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "scope": "resourceGroup", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// subscription scope with a resource group
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "scope": "subscription", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// subscription scope with a subscription scoped resource ID
+	{map[string]string{"resourceURI": "/subscriptions/00000000-0000-0000-0000-000000000456/providers/Microsoft.Capacity/resourceProviders/Microsoft.Compute", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "scope": "subscription", "metricName": "metric", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// subscription scope with a resource group scoped resource ID
+	{map[string]string{"resourceURI": "/subscriptions/00000000-0000-0000-0000-000000000456/resourceGroups/test/providers/test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "scope": "subscription", "metricName": "metric", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// unsupported scope
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "scope": "managementGroup", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// tokenAudience
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "cloud": "AzureUSGovernmentCloud", "tokenAudience": "https://management.usgovcloudapi.net/", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// tokenAudience that is not a URL
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "tokenAudience": "management", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// targetUnit
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "targetUnit": "GB", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// unsupported targetUnit
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "targetUnit": "Percent", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// targetUnit with metricResultAsRate
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Total", "metricResultAsRate": "true", "targetUnit": "CountPerSecond", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// filterDimension and filterValues
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "filterDimension": "EntityName", "filterValues": "orders, o'brien", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// filterDimension without filterValues
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "filterDimension": "EntityName", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// filterValues without filterDimension
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "filterValues": "orders", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// filterDimension with metricFilter
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "filterDimension": "EntityName", "filterValues": "orders", "metricFilter": "EntityName eq 'orders'", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// unsupported filterOperator
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "filterDimension": "EntityName", "filterValues": "orders", "filterOperator": "xor", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// metricDerivative
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "metricDerivative": "true", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// invalid metricDerivative
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "metricDerivative": "yes please", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// tenantId and subscriptionId from the environment of the container
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantIdFromEnv": "TENANT_ID", "subscriptionIdFromEnv": "SUBSCRIPTION_ID", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, map[string]string{"TENANT_ID": "123", "SUBSCRIPTION_ID": "00000000-0000-0000-0000-000000000456", "CLIENT_ID": "xxx", "CLIENT_PASSWORD": "yyy"}, map[string]string{}, ""},
+	// tenantIdFromEnv names a missing environment variable
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantIdFromEnv": "TENANT_ID", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// tenantId and subscriptionId from the TriggerAuthentication
+	{map[string]string{"resourceURI": "test/resource/uri", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "targetValue": "5"}, false, map[string]string{}, map[string]string{"tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "activeDirectoryClientId": "zzz", "activeDirectoryClientPassword": "password"}, ""},
+	// fallbackOnError with fallbackMaxAge
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "fallbackOnError": "true", "fallbackMaxAge": "10m", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// fallbackMaxAge without fallbackOnError
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "fallbackMaxAge": "10m", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// invalid fallbackMaxAge
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "fallbackOnError": "true", "fallbackMaxAge": "0s", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// invalid fallbackOnError
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "fallbackOnError": "maybe", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// ISO 8601 metricAggregationInterval
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "metricAggregationInterval": "PT15M", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// metricAggregationInterval mixing ISO 8601 and hh:mm:ss
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "metricAggregationInterval": "PT00:15:00", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// ISO 8601 metricAggregationInterval in months
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "metricAggregationInterval": "P1M", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// roundingMode
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "roundingMode": "Ceil", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// unsupported roundingMode
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "roundingMode": "truncate", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// resourceNames
+	{map[string]string{"resourceURI": "Microsoft.Compute/virtualMachines", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricAggregationType": "Average", "metricName": "metric", "resourceNames": "vm-0, vm-1, vm-2", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// resourceNames with combine
+	{map[string]string{"resourceURI": "Microsoft.Compute/virtualMachines", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricAggregationType": "Average", "metricName": "metric", "resourceNames": "vm-0,vm-1", "combine": "max", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// resourceNames with a resourceURI naming a resource
+	{map[string]string{"resourceURI": "Microsoft.Compute/virtualMachines/vm-0", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricAggregationType": "Average", "metricName": "metric", "resourceNames": "vm-1", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// resourceNames with an empty name
+	{map[string]string{"resourceURI": "Microsoft.Compute/virtualMachines", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricAggregationType": "Average", "metricName": "metric", "resourceNames": "vm-0,,vm-2", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// resourceNames with metricNames
+	{map[string]string{"resourceURI": "Microsoft.Compute/virtualMachines", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricAggregationType": "Average", "metricNames": "a,b", "resourceNames": "vm-0,vm-1", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// align the window to minutes
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "alignToMinute": "true", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// invalid alignToMinute
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "alignToMinute": "sometimes", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// region
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "region": "West Europe", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// top with a dimension split
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Total", "dimensionGroupBy": "Partition", "top": "5", "orderBy": "Total desc", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// top without a dimension split
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Total", "top": "5", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// top not a number
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Total", "dimensionGroupBy": "Partition", "top": "five", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// top not positive
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Total", "dimensionGroupBy": "Partition", "top": "0", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// invalid orderBy
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Total", "dimensionGroupBy": "Partition", "top": "5", "orderBy": "Busiest first", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// orderBy without top
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Total", "dimensionGroupBy": "Partition", "orderBy": "Total desc", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// 90 seconds interval read as 00:01:30 by default
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "metricAggregationInterval": "00:00:90", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// 90 seconds interval with strictInterval
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "metricAggregationInterval": "00:00:90", "strictInterval": "true", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// normalized interval with strictInterval
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "metricAggregationInterval": "00:01:30", "strictInterval": "true", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// 90 minutes delay with strictInterval
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "metricAggregationDelay": "00:90:00", "strictInterval": "true", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// invalid strictInterval
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "strictInterval": "yes please", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// percentile
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "percentile": "95", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// percentile above 100
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "percentile": "100.5", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// negative percentile
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "percentile": "-1", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// percentile not a number
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "percentile": "p95", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// maxMetricValue
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "maxMetricValue": "250.5", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// maxMetricValue not a number
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "maxMetricValue": "lots", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// infinite maxMetricValue
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "maxMetricValue": "+Inf", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// invalid targetType
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "targetType": "Utilization", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// emaAlpha
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "emaAlpha": "0.3", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// emaAlpha of 1
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "emaAlpha": "1", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// emaAlpha of 0
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "emaAlpha": "0", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// emaAlpha above 1
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "emaAlpha": "1.5", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// unhealthyBelow with the value reported while unhealthy
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "availabilityResults/availabilityPercentage", "metricAggregationType": "Average", "unhealthyBelow": "99.5", "unhealthyMetricValue": "50", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// unhealthyBelow without unhealthyMetricValue
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "availabilityResults/availabilityPercentage", "metricAggregationType": "Average", "unhealthyBelow": "99.5", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// unhealthyBelow not a number
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "availabilityResults/availabilityPercentage", "metricAggregationType": "Average", "unhealthyBelow": "healthy", "unhealthyMetricValue": "50", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// negative unhealthyMetricValue
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "availabilityResults/availabilityPercentage", "metricAggregationType": "Average", "unhealthyBelow": "1", "unhealthyMetricValue": "-1", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// unhealthyMetricValue without unhealthyBelow
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "availabilityResults/availabilityPercentage", "metricAggregationType": "Average", "unhealthyMetricValue": "50", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// backup credentials
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "backupActiveDirectoryClientId": "BACKUP_ID", "backupActiveDirectoryClientPassword": "BACKUP_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// backup client id without its password
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "backupActiveDirectoryClientId": "BACKUP_ID", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// backup credentials with pod identity
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "backupActiveDirectoryClientId": "BACKUP_ID", "backupActiveDirectoryClientPassword": "BACKUP_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, "azure"},
+	// metricNameOverride
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "metricNameOverride": "queuemessages.orders", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// metricNameOverride with uppercase
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "metricNameOverride": "QueueMessages", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// metricNameOverride with a slash
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "metricNameOverride": "queue/messages", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// metricNameOverride ending with a dash
+	{map[string]string{"resourceURI": "Microsoft.Insights/components/component", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "metricNameOverride": "queuemessages-", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// activeDirectoryClientPassword naming an environment variable the container does not have
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "MISSING_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
 	// no optional parameters
-	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}},
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
 	// incorrectly formatted resourceURI
-	{map[string]string{"resourceURI": "bad/format", "tenantId": "123", "subscriptionId": "456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}},
+	{map[string]string{"resourceURI": "bad/format", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// nested resourceURI
+	{map[string]string{"resourceURI": "Microsoft.Web/sites/mysite/slots/staging", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// full resource ID without subscriptionId and resourceGroupName
+	{map[string]string{"resourceURI": "/subscriptions/00000000-0000-0000-0000-000000000456/resourceGroups/test/providers/Microsoft.Web/sites/mysite", "tenantId": "123", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// resource in another subscription
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceSubscriptionId": "00000000-0000-0000-0000-000000000789", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// full resource ID conflicting with resourceSubscriptionId
+	{map[string]string{"resourceURI": "/subscriptions/00000000-0000-0000-0000-000000000456/resourceGroups/test/providers/Microsoft.Web/sites/mysite", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceSubscriptionId": "00000000-0000-0000-0000-000000000789", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// full resource ID conflicting with resourceGroupName
+	{map[string]string{"resourceURI": "/subscriptions/00000000-0000-0000-0000-000000000456/resourceGroups/test/providers/Microsoft.Web/sites/mysite", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "other", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
 	// improperly formatted aggregationInterval
-	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:1", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}},
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:1", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
 	// missing resourceURI
-	{map[string]string{"tenantId": "123", "subscriptionId": "456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}},
+	{map[string]string{"tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
 	// missing tenantId
-	{map[string]string{"resourceURI": "test/resource/uri", "subscriptionId": "456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}},
+	{map[string]string{"resourceURI": "test/resource/uri", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
 	// missing subscriptionId
-	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}},
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
 	// missing resourceGroupName
-	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "456", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}},
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
 	// missing metricName
-	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "456", "resourceGroupName": "test", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}},
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
 	// missing metricAggregationType
-	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}},
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// abbreviated metricAggregationType
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "avg", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// percentile metricAggregationType
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "p95", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// lowercase metricAggregationType
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "total", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
 	// filter included
-	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "456", "resourceGroupName": "test", "metricName": "metric", "metricFilter": "namespace eq 'default'", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}},
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricFilter": "namespace eq 'default'", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// malformed filter
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricFilter": "namespace = default", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
 	// missing activeDirectoryClientId
-	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}},
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
 	// missing activeDirectoryClientPassword
-	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}},
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// custom request timeout
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5", "requestTimeout": "45s"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// malformed request timeout
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5", "requestTimeout": "soon"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// sovereign cloud
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5", "cloud": "AzureUSGovernmentCloud"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// unknown cloud
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5", "cloud": "AzureMoonCloud"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// metric namespace included
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricNamespace": "azure.applicationinsights", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// custom maxRetries
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5", "maxRetries": "0"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// negative maxRetries
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5", "maxRetries": "-1"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// aggregation delay included
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationDelay": "00:02:00", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// improperly formatted aggregation delay
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationDelay": "2m", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// activation target value included
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5", "activationTargetValue": "2.5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// malformed activation target value
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5", "activationTargetValue": "five"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// rate of a total
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:1:0", "metricAggregationType": "Total", "metricResultAsRate": "true", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// rate of an average
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:1:0", "metricAggregationType": "Average", "metricResultAsRate": "true", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// metricResultAsRate with Count aggregation
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:5:0", "metricAggregationType": "Count", "metricResultAsRate": "true", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// endpoint override
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5", "endpointOverride": "http://localhost:8080"}, false, testAzMonitorResolvedEnv, map[string]string{}, ""},
+	// relative endpoint override
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5", "endpointOverride": "localhost"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
 	// missing targetValue
-	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD"}, true, testAzMonitorResolvedEnv, map[string]string{}},
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD"}, true, testAzMonitorResolvedEnv, map[string]string{}, ""},
 	// connection from authParams
-	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "targetValue": "5"}, false, map[string]string{}, map[string]string{"activeDirectoryClientId": "zzz", "activeDirectoryClientPassword": "password"}},
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "targetValue": "5"}, false, map[string]string{}, map[string]string{"activeDirectoryClientId": "zzz", "activeDirectoryClientPassword": "password"}, ""},
+	// pod identity without client credentials
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "targetValue": "5"}, false, map[string]string{}, map[string]string{}, "azure"},
+	// pod identity none requires client credentials
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "targetValue": "5"}, true, map[string]string{}, map[string]string{}, "none"},
+	// unsupported pod identity
+	{map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationInterval": "0:15:0", "metricAggregationType": "Average", "targetValue": "5"}, true, map[string]string{}, map[string]string{}, "gcp"},
 }
 
 func TestAzMonitorParseMetadata(t *testing.T) {
 	for _, testData := range testParseAzMonitorMetadata {
-		_, err := parseAzureMonitorMetadata(testData.metadata, testData.resolvedEnv, testData.authParams)
+		_, err := parseAzureMonitorMetadata(testData.metadata, testData.resolvedEnv, testData.authParams, testData.podIdentity)
 		if err != nil && !testData.isError {
 			t.Error("Expected success but got error", err)
 		}
@@ -62,3 +407,4221 @@ func TestAzMonitorParseMetadata(t *testing.T) {
 		}
 	}
 }
+
+type azMonitorValidateValueTestData struct {
+	value   string
+	isError bool
+}
+
+var testAzMonitorSubscriptionIDs = []azMonitorValidateValueTestData{
+	{"00000000-0000-0000-0000-000000000456", false},
+	{"9D2A83F1-5C3B-4E7A-A1B2-0C9D8E7F6A5B", false},
+	{"", true},
+	{"456", true},
+	{"00000000-0000-0000-0000-00000000045", true},
+	{"00000000000000000000000000000456", true},
+	{"0000000g-0000-0000-0000-000000000456", true},
+	{" 00000000-0000-0000-0000-000000000456", true},
+}
+
+var testAzMonitorResourceGroupNames = []azMonitorValidateValueTestData{
+	{"test", false},
+	{"my-rg_1.prod", false},
+	{"rg(legacy)", false},
+	{"grüße", false},
+	{strings.Repeat("a", 90), false},
+	{"", true},
+	{strings.Repeat("a", 91), true},
+	{"ends.with.period.", true},
+	{"has space", true},
+	{"has/slash", true},
+	{"has'quote", true},
+}
+
+func TestAzMonitorValidateSubscriptionID(t *testing.T) {
+	for _, testData := range testAzMonitorSubscriptionIDs {
+		err := validateSubscriptionID("subscriptionId", testData.value)
+		if err != nil && !testData.isError {
+			t.Errorf("%q: expected success but got error %v", testData.value, err)
+		}
+		if testData.isError && err == nil {
+			t.Errorf("%q: expected error but got success", testData.value)
+		}
+	}
+}
+
+func TestAzMonitorValidateResourceGroupName(t *testing.T) {
+	for _, testData := range testAzMonitorResourceGroupNames {
+		err := validateResourceGroupName(testData.value)
+		if err != nil && !testData.isError {
+			t.Errorf("%q: expected success but got error %v", testData.value, err)
+		}
+		if testData.isError && err == nil {
+			t.Errorf("%q: expected error but got success", testData.value)
+		}
+	}
+}
+
+type azMonitorExtractValueTestData struct {
+	name          string
+	aggregation   insights.AggregationType
+	data          [][]insights.MetricValue
+	expectedValue float64
+	isError       bool
+}
+
+func float64Ptr(val float64) *float64 {
+	return &val
+}
+
+func int64Ptr(val int64) *int64 {
+	return &val
+}
+
+// testAzMonitorTimeStamp returns the time of a data point relative to a fixed point in time
+func testAzMonitorTimeStamp(offset time.Duration) *date.Time {
+	return &date.Time{Time: time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC).Add(offset)}
+}
+
+func newTestAzMonitorResponse(data ...[]insights.MetricValue) insights.Response {
+	timeseries := make([]insights.TimeSeriesElement, 0, len(data))
+	for i := range data {
+		timeseries = append(timeseries, insights.TimeSeriesElement{Data: &data[i]})
+	}
+	metrics := []insights.Metric{{Timeseries: &timeseries}}
+	return insights.Response{Value: &metrics}
+}
+
+var testAzMonitorExtractValueData = []azMonitorExtractValueTestData{
+	{"fractional average below one", "Average", [][]insights.MetricValue{{{Average: float64Ptr(0.3)}}}, 0.3, false},
+	{"fractional average above one", "Average", [][]insights.MetricValue{{{Average: float64Ptr(1.5)}}}, 1.5, false},
+	{"fractional total", "Total", [][]insights.MetricValue{{{Total: float64Ptr(0.3)}}}, 0.3, false},
+	{"two timeseries total", "Total", [][]insights.MetricValue{{{Total: float64Ptr(3)}}, {{Total: float64Ptr(4)}}}, 7, false},
+	{"two timeseries average", "Average", [][]insights.MetricValue{{{Average: float64Ptr(2)}}, {{Average: float64Ptr(4)}}}, 3, false},
+	{"two timeseries maximum", "Maximum", [][]insights.MetricValue{{{Maximum: float64Ptr(2)}}, {{Maximum: float64Ptr(9)}}}, 9, false},
+	{"two timeseries minimum", "Minimum", [][]insights.MetricValue{{{Minimum: float64Ptr(2)}}, {{Minimum: float64Ptr(9)}}}, 2, false},
+	{"two timeseries count", "Count", [][]insights.MetricValue{{{Count: int64Ptr(5)}}, {{Count: int64Ptr(6)}}}, 11, false},
+	{"count skips nil final bucket", "Count", [][]insights.MetricValue{{{Count: int64Ptr(7)}, {Count: int64Ptr(42)}, {Average: float64Ptr(1)}}}, 42, false},
+	{"last picks newest data point", "Last", [][]insights.MetricValue{{{Average: float64Ptr(3)}, {Maximum: float64Ptr(9)}, {Count: int64Ptr(4), Total: float64Ptr(7)}, {}}}, 7, false},
+	{"last prefers average", "Last", [][]insights.MetricValue{{{Average: float64Ptr(2), Total: float64Ptr(8), Maximum: float64Ptr(5)}}}, 2, false},
+	{"last without values", "Last", [][]insights.MetricValue{{{}, {}}}, 0, true},
+	{"two timeseries last takes the newest data point", "Last", [][]insights.MetricValue{{{TimeStamp: testAzMonitorTimeStamp(-2 * time.Minute), Average: float64Ptr(3)}}, {{TimeStamp: testAzMonitorTimeStamp(-time.Minute), Average: float64Ptr(4)}}}, 4, false},
+	{"two timeseries last newest in the first series", "Last", [][]insights.MetricValue{{{TimeStamp: testAzMonitorTimeStamp(0), Average: float64Ptr(3)}}, {{TimeStamp: testAzMonitorTimeStamp(-time.Minute), Average: float64Ptr(4)}}}, 3, false},
+	{"two timeseries last at the same time", "Last", [][]insights.MetricValue{{{TimeStamp: testAzMonitorTimeStamp(0), Average: float64Ptr(3)}}, {{TimeStamp: testAzMonitorTimeStamp(0), Average: float64Ptr(4)}}}, 3, false},
+	{"count is the samples in the newest bucket", "Count", [][]insights.MetricValue{{{Count: int64Ptr(5)}, {Count: int64Ptr(3)}, {}}}, 3, false},
+	{"data point count is the buckets with a value", "DataPointCount", [][]insights.MetricValue{{{Count: int64Ptr(5)}, {Count: int64Ptr(3)}, {}}}, 2, false},
+	{"data point count across fields", "DataPointCount", [][]insights.MetricValue{{{Average: float64Ptr(1)}, {}, {Maximum: float64Ptr(2)}, {Total: float64Ptr(0)}}}, 3, false},
+	{"data point count without values", "DataPointCount", [][]insights.MetricValue{{{}, {}}}, 0, false},
+	{"two timeseries data point count", "DataPointCount", [][]insights.MetricValue{{{Count: int64Ptr(5)}}, {{Count: int64Ptr(1)}, {Count: int64Ptr(1)}}}, 3, false},
+	{"two timeseries with one missing the aggregation", "Total", [][]insights.MetricValue{{{Total: float64Ptr(3)}}, {{Average: float64Ptr(4)}}}, 3, false},
+	{"latest bucket not finalized", "Average", [][]insights.MetricValue{{{Average: float64Ptr(2)}, {Average: float64Ptr(3)}, {}}}, 3, false},
+	{"no bucket with a value", "Average", [][]insights.MetricValue{{{}, {}}}, 0, true},
+	{"unsupported aggregation", "p95", [][]insights.MetricValue{{{Average: float64Ptr(2)}}}, 0, true},
+	{"no timeseries with the aggregation", "Total", [][]insights.MetricValue{{{Average: float64Ptr(3)}}, {{Average: float64Ptr(4)}}}, 0, true},
+}
+
+func TestAzMonitorExtractValue(t *testing.T) {
+	for _, testData := range testAzMonitorExtractValueData {
+		request := azureExternalMetricRequest{MetricName: "metric", Aggregation: testData.aggregation}
+		value, err := extractValue(request, newTestAzMonitorResponse(testData.data...))
+		if err != nil && !testData.isError {
+			t.Errorf("%s: expected success but got error %v", testData.name, err)
+		}
+		if testData.isError && err == nil {
+			t.Errorf("%s: expected error but got success", testData.name)
+		}
+		if !testData.isError && value.Value != testData.expectedValue {
+			t.Errorf("%s: expected %v but got %v", testData.name, testData.expectedValue, value.Value)
+		}
+	}
+}
+
+func TestAzMonitorGetAuthConfig(t *testing.T) {
+	config := getAuthConfig(&azureMonitorMetadata{podIdentity: "azure"}, azure.PublicCloud, azure.PublicCloud.ResourceManagerEndpoint)
+	if _, ok := config.(auth.MSIConfig); !ok {
+		t.Errorf("Expected MSI config for azure pod identity but got %T", config)
+	}
+
+	for _, podIdentity := range []string{"", "none"} {
+		config = getAuthConfig(&azureMonitorMetadata{podIdentity: podIdentity, clientID: "id", clientPassword: "password", tenantID: "tenant"}, azure.PublicCloud, azure.PublicCloud.ResourceManagerEndpoint)
+		if _, ok := config.(auth.ClientCredentialsConfig); !ok {
+			t.Errorf("Expected client credentials config for pod identity %q but got %T", podIdentity, config)
+		}
+	}
+}
+
+func TestAzMonitorGetAuthConfigTokenAudience(t *testing.T) {
+	metadata := &azureMonitorMetadata{clientID: "id", clientPassword: "password", tenantID: "tenant"}
+	if audience := getAzureMonitorTokenAudience(metadata, azure.USGovernmentCloud); audience != azure.USGovernmentCloud.ResourceManagerEndpoint {
+		t.Errorf("Expected the management endpoint of the cloud as default audience but got %s", audience)
+	}
+
+	metadata.tokenAudience = "https://monitor.example.net/"
+	audience := getAzureMonitorTokenAudience(metadata, azure.USGovernmentCloud)
+	if audience != "https://monitor.example.net/" {
+		t.Errorf("Expected the tokenAudience but got %s", audience)
+	}
+	config, ok := getAuthConfig(metadata, azure.USGovernmentCloud, audience).(auth.ClientCredentialsConfig)
+	if !ok {
+		t.Fatalf("Expected client credentials config but got %T", config)
+	}
+	if config.Resource != "https://monitor.example.net/" {
+		t.Errorf("Expected the tokenAudience as resource of the auth config but got %s", config.Resource)
+	}
+}
+
+func TestAzMonitorGetAuthConfigCertificate(t *testing.T) {
+	metadata := &azureMonitorMetadata{clientID: "id", clientPassword: "password", tenantID: "tenant", clientCertificate: "/certs/sp.pfx", clientCertificatePassword: "certificate-password"}
+	config, ok := getAuthConfig(metadata, azure.PublicCloud, azure.PublicCloud.ResourceManagerEndpoint).(azureMonitorCertificateConfig)
+	if !ok {
+		t.Fatalf("Expected certificate config when a client certificate is given but got %T", config)
+	}
+	if config.certificatePath != "/certs/sp.pfx" || config.certificatePassword != "certificate-password" || config.clientID != "id" || config.tenantID != "tenant" {
+		t.Errorf("Expected the certificate and service principal to be passed on but got %+v", config)
+	}
+	if config.aadEndpoint != azure.PublicCloud.ActiveDirectoryEndpoint || config.resource != azure.PublicCloud.ResourceManagerEndpoint {
+		t.Errorf("Expected the cloud endpoints to be passed on but got %+v", config)
+	}
+}
+
+func TestAzMonitorCertificateConfigPEM(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "keda"}, NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificatePEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	dir, err := ioutil.TempDir("", "azure-monitor-certificate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sp.pem")
+	if err := ioutil.WriteFile(path, append(certificatePEM, keyPEM...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := azureMonitorCertificateConfig{certificatePath: path, clientID: "id", tenantID: "tenant", aadEndpoint: azure.PublicCloud.ActiveDirectoryEndpoint, resource: azure.PublicCloud.ResourceManagerEndpoint}
+	if _, err := config.Authorizer(); err != nil {
+		t.Errorf("Expected a PEM certificate with its key to be accepted but got %v", err)
+	}
+
+	if _, _, err := parsePEMCertificate(certificatePEM, ""); err == nil {
+		t.Error("Expected a PEM file without a private key to be rejected")
+	}
+	if _, _, err := parsePEMCertificate(keyPEM, ""); err == nil {
+		t.Error("Expected a PEM file without a certificate to be rejected")
+	}
+
+	config.certificatePath = filepath.Join(dir, "missing.pem")
+	if _, err := config.Authorizer(); err == nil {
+		t.Error("Expected a missing certificate file to be rejected")
+	}
+}
+
+func TestAzMonitorCredentialFingerprint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "azure-monitor-fingerprint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sp.pfx")
+	if err := ioutil.WriteFile(path, []byte("certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := &azureMonitorMetadata{tenantID: "tenant", clientID: "id", clientCertificate: path, clientCertificatePassword: "password"}
+	fingerprint := getAzureMonitorCredentialFingerprint(metadata)
+	if getAzureMonitorCredentialFingerprint(metadata) != fingerprint {
+		t.Error("Expected the fingerprint of unchanged credentials to be stable")
+	}
+	if strings.Contains(fingerprint, "password") {
+		t.Errorf("Expected the fingerprint to hold no secret but got %s", fingerprint)
+	}
+
+	changedPassword := *metadata
+	changedPassword.clientCertificatePassword = "rotated"
+	if getAzureMonitorCredentialFingerprint(&changedPassword) == fingerprint {
+		t.Error("Expected a changed certificate password to change the fingerprint")
+	}
+
+	// a certificate rotated at the same path
+	if err := ioutil.WriteFile(path, []byte("rotated certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rotated := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, rotated, rotated); err != nil {
+		t.Fatal(err)
+	}
+	if getAzureMonitorCredentialFingerprint(metadata) == fingerprint {
+		t.Error("Expected a rotated certificate file to change the fingerprint")
+	}
+}
+
+func TestAzMonitorAuthorizerCacheRebuildsChangedCredentials(t *testing.T) {
+	cache := azureMonitorAuthorizerCache{entries: map[azureMonitorAuthorizerKey]azureMonitorAuthorizerEntry{}}
+	metadata := &azureMonitorMetadata{tenantID: "tenant", clientID: "id", clientPassword: "password"}
+	key := azureMonitorAuthorizerKey{tenantID: "tenant", clientID: "id", cloud: azure.PublicCloud.Name, resource: azure.PublicCloud.ResourceManagerEndpoint}
+	cache.entries[key] = azureMonitorAuthorizerEntry{authorizer: autorest.NullAuthorizer{}, credential: getAzureMonitorCredentialFingerprint(metadata), lastUsed: time.Now()}
+
+	authorizer, err := cache.get(metadata, azure.PublicCloud, azure.PublicCloud.ResourceManagerEndpoint)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if _, ok := authorizer.(autorest.NullAuthorizer); !ok {
+		t.Errorf("Expected the cached authorizer for unchanged credentials but got %T", authorizer)
+	}
+
+	rotated := *metadata
+	rotated.clientPassword = "rotated"
+	authorizer, err = cache.get(&rotated, azure.PublicCloud, azure.PublicCloud.ResourceManagerEndpoint)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if _, ok := authorizer.(autorest.NullAuthorizer); ok {
+		t.Error("Expected a new authorizer for the rotated secret")
+	}
+}
+
+func TestAzMonitorAuthorizerCacheBounded(t *testing.T) {
+	cache := azureMonitorAuthorizerCache{entries: map[azureMonitorAuthorizerKey]azureMonitorAuthorizerEntry{}}
+	first := &azureMonitorMetadata{tenantID: "tenant", clientID: "client-first", clientPassword: "password"}
+	if _, err := cache.get(first, azure.PublicCloud, azure.PublicCloud.ResourceManagerEndpoint); err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	firstKey := azureMonitorAuthorizerKey{tenantID: "tenant", clientID: "client-first", cloud: azure.PublicCloud.Name, resource: azure.PublicCloud.ResourceManagerEndpoint}
+	entry := cache.entries[firstKey]
+	entry.lastUsed = time.Now().Add(-time.Hour)
+	cache.entries[firstKey] = entry
+
+	for i := 0; i < maxAzureMonitorCachedClients; i++ {
+		metadata := &azureMonitorMetadata{tenantID: "tenant", clientID: fmt.Sprintf("client-%d", i), clientPassword: "password"}
+		if _, err := cache.get(metadata, azure.PublicCloud, azure.PublicCloud.ResourceManagerEndpoint); err != nil {
+			t.Fatal("Expected success but got error", err)
+		}
+	}
+	if len(cache.entries) != maxAzureMonitorCachedClients {
+		t.Errorf("Expected the cache to hold at most %d authorizers but got %d", maxAzureMonitorCachedClients, len(cache.entries))
+	}
+	if _, ok := cache.entries[firstKey]; ok {
+		t.Error("Expected the least recently used authorizer to be dropped")
+	}
+}
+
+func TestAzMonitorCreateMetricsClientInvalidTenant(t *testing.T) {
+	metadata := &azureMonitorMetadata{subscriptionID: "456", clientID: "id", clientPassword: "password", tenantID: "%invalid"}
+	_, err := createMetricsClient(metadata, nil)
+	if err == nil {
+		t.Fatal("Expected error for invalid tenantId but got success")
+	}
+	if !strings.Contains(err.Error(), "authorizer") {
+		t.Errorf("Expected authorizer error but got %v", err)
+	}
+}
+
+func TestAzMonitorGetAzureMetricCanceledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := getAzureMetric(ctx, insights.NewMetricsClient("456"), newTestAzMonitorRequest())
+	if err == nil {
+		t.Fatal("Expected error for canceled context but got success")
+	}
+	if !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Errorf("Expected the canceled context to reach the metrics client but got %v", err)
+	}
+}
+
+func TestAzMonitorCreateMetricsClientCloud(t *testing.T) {
+	metadata := &azureMonitorMetadata{subscriptionID: "456", clientID: "id", clientPassword: "password", tenantID: "tenant"}
+	publicClient, err := createMetricsClient(metadata, nil)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+
+	metadata.cloud = "AzureUSGovernmentCloud"
+	govClient, err := createMetricsClient(metadata, nil)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+
+	if publicClient.BaseURI == govClient.BaseURI {
+		t.Errorf("Expected different BaseURI for public and government clouds but both were %s", publicClient.BaseURI)
+	}
+	if !strings.Contains(govClient.BaseURI, "usgovcloudapi.net") {
+		t.Errorf("Expected government cloud BaseURI but got %s", govClient.BaseURI)
+	}
+}
+
+func TestAzMonitorCreateMetricsClientRegion(t *testing.T) {
+	metadata := &azureMonitorMetadata{subscriptionID: "456", clientID: "id", clientPassword: "password", tenantID: "tenant", region: "westeurope"}
+	client, err := createMetricsClient(metadata, nil)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if client.BaseURI != "https://westeurope.management.azure.com" {
+		t.Errorf("Expected the west europe BaseURI but got %s", client.BaseURI)
+	}
+
+	metadata.cloud = "AzureUSGovernmentCloud"
+	metadata.region = "usgovvirginia"
+	govClient, err := createMetricsClient(metadata, nil)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if govClient.BaseURI != "https://usgovvirginia.management.usgovcloudapi.net" {
+		t.Errorf("Expected the us gov virginia BaseURI but got %s", govClient.BaseURI)
+	}
+
+	// a region the cloud does not have falls back to its global endpoint
+	metadata.region = "westeurope"
+	fallbackClient, err := createMetricsClient(metadata, nil)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if fallbackClient.BaseURI != "https://management.usgovcloudapi.net" {
+		t.Errorf("Expected the global us gov BaseURI but got %s", fallbackClient.BaseURI)
+	}
+}
+
+// testAzMonitorSender records the requests sent by the metrics client and replies with canned responses
+type testAzMonitorSender struct {
+	requests  []*http.Request
+	responses []testAzMonitorSenderResponse
+}
+
+type testAzMonitorSenderResponse struct {
+	statusCode int
+	header     http.Header
+	body       interface{}
+}
+
+func (s *testAzMonitorSender) Do(r *http.Request) (*http.Response, error) {
+	s.requests = append(s.requests, r)
+
+	response := testAzMonitorSenderResponse{statusCode: http.StatusOK, body: insights.Response{}}
+	if len(s.responses) > 0 {
+		response = s.responses[0]
+		if len(s.responses) > 1 {
+			s.responses = s.responses[1:]
+		}
+	}
+
+	body, err := json.Marshal(response.body)
+	if err != nil {
+		return nil, err
+	}
+	header := response.header
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Content-Type", "application/json")
+
+	return &http.Response{
+		StatusCode: response.statusCode,
+		Header:     header,
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		Request:    r,
+	}, nil
+}
+
+func newTestAzMonitorClient(sender *testAzMonitorSender) insights.MetricsClient {
+	client := insights.NewMetricsClient("456")
+	client.Sender = sender
+	client.RetryAttempts = 1
+	client.RetryDuration = 0
+	return client
+}
+
+func newTestAzMonitorRequest() azureExternalMetricRequest {
+	return azureExternalMetricRequest{
+		MetricName:                "metric",
+		SubscriptionID:            "456",
+		ResourceGroup:             "test",
+		ResourceProviderNamespace: "test",
+		ResourceType:              "resource",
+		ResourceName:              "uri",
+		Aggregation:               "Average",
+	}
+}
+
+// fakeMetricsLister returns its results in order and records the calls made to it
+type fakeMetricsLister struct {
+	results []fakeMetricsListerResult
+	calls   []fakeMetricsListerCall
+}
+
+type fakeMetricsListerResult struct {
+	response insights.Response
+	err      error
+}
+
+type fakeMetricsListerCall struct {
+	resourceURI string
+	timespan    string
+	metricNames string
+	aggregation string
+	filter      string
+}
+
+func (f *fakeMetricsLister) List(ctx context.Context, resourceURI string, timespan string, interval *string, metricnames string, aggregation string, top *int32, orderby string, filter string, resultType insights.ResultType, metricnamespace string) (insights.Response, error) {
+	f.calls = append(f.calls, fakeMetricsListerCall{resourceURI: resourceURI, timespan: timespan, metricNames: metricnames, aggregation: aggregation, filter: filter})
+	if len(f.results) == 0 {
+		return insights.Response{}, fmt.Errorf("unexpected call to List")
+	}
+	result := f.results[0]
+	f.results = f.results[1:]
+	return result.response, result.err
+}
+
+func TestAzMonitorGetAzureMetricFakeLister(t *testing.T) {
+	lister := &fakeMetricsLister{results: []fakeMetricsListerResult{
+		{response: newTestAzMonitorResponse([]insights.MetricValue{{Average: float64Ptr(5)}})},
+	}}
+	request := newTestAzMonitorRequest()
+	request.Timespan = "2020-01-02T10:00:00Z/2020-01-02T10:05:00Z"
+	request.Filter = "Instance eq 'a'"
+
+	value, err := getAzureMetric(context.TODO(), lister, request)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if value.Value != 5 {
+		t.Errorf("Expected value 5 but got %v", value.Value)
+	}
+	expected := fakeMetricsListerCall{resourceURI: "/subscriptions/456/resourceGroups/test/providers/test/resource/uri", timespan: request.Timespan, metricNames: "metric", aggregation: "Average", filter: "Instance eq 'a'"}
+	if len(lister.calls) != 1 || lister.calls[0] != expected {
+		t.Errorf("Expected a single call %+v but got %+v", expected, lister.calls)
+	}
+}
+
+func TestAzMonitorGetAzureMetricFakeListerErrors(t *testing.T) {
+	azureMonitorRetryBaseDelay = time.Millisecond
+	defer func() { azureMonitorRetryBaseDelay = time.Second }()
+
+	listErr := fmt.Errorf("connection reset")
+	throttled := autorest.DetailedError{StatusCode: http.StatusTooManyRequests, Original: fmt.Errorf("throttled")}
+	for _, data := range []struct {
+		name          string
+		request       func(*azureExternalMetricRequest)
+		results       []fakeMetricsListerResult
+		expectedCalls int
+		expectedErr   string
+		expectedIs    error
+	}{
+		{name: "invalid request", request: func(r *azureExternalMetricRequest) { r.MetricName = "" }, expectedCalls: 0, expectedErr: "metricName is required"},
+		{name: "list error", results: []fakeMetricsListerResult{{err: listErr}}, expectedCalls: 1, expectedErr: "resource /subscriptions/456/resourceGroups/test/providers/test/resource/uri", expectedIs: listErr},
+		{name: "throttled until the retries run out", request: func(r *azureExternalMetricRequest) { r.MaxRetries = 1 }, results: []fakeMetricsListerResult{{err: throttled}, {err: throttled}}, expectedCalls: 2, expectedErr: "throttled"},
+		{name: "no metric list", results: []fakeMetricsListerResult{{response: insights.Response{}}}, expectedCalls: 1, expectedErr: "without a metric list"},
+		{name: "no metric", results: []fakeMetricsListerResult{{response: insights.Response{Value: &[]insights.Metric{}}}}, expectedCalls: 1, expectedErr: "Got an empty response"},
+		{name: "no timeseries list", results: []fakeMetricsListerResult{{response: insights.Response{Value: &[]insights.Metric{{}}}}}, expectedCalls: 1, expectedIs: ErrNoMetricData},
+		{name: "no timeseries", results: []fakeMetricsListerResult{{response: newTestAzMonitorResponse()}}, expectedCalls: 1, expectedIs: ErrNoMetricData},
+		{name: "no data", results: []fakeMetricsListerResult{{response: insights.Response{Value: &[]insights.Metric{{Timeseries: &[]insights.TimeSeriesElement{{}}}}}}}, expectedCalls: 1, expectedIs: ErrNoMetricData},
+		{name: "no value for the aggregation", results: []fakeMetricsListerResult{{response: newTestAzMonitorResponse([]insights.MetricValue{{Total: float64Ptr(5)}})}}, expectedCalls: 1, expectedErr: "the returned data has values for Total"},
+		{name: "no value for any aggregation", results: []fakeMetricsListerResult{{response: newTestAzMonitorResponse([]insights.MetricValue{{}})}}, expectedCalls: 1, expectedErr: "No value returned by Azure Monitor for any aggregation"},
+	} {
+		lister := &fakeMetricsLister{results: data.results}
+		request := newTestAzMonitorRequest()
+		if data.request != nil {
+			data.request(&request)
+		}
+
+		_, err := getAzureMetric(context.TODO(), lister, request)
+		if err == nil {
+			t.Errorf("%s: expected an error", data.name)
+			continue
+		}
+		if data.expectedErr != "" && !strings.Contains(err.Error(), data.expectedErr) {
+			t.Errorf("%s: expected an error containing %q but got %v", data.name, data.expectedErr, err)
+		}
+		if data.expectedIs != nil && !errors.Is(err, data.expectedIs) {
+			t.Errorf("%s: expected an error wrapping %v but got %v", data.name, data.expectedIs, err)
+		}
+		if len(lister.calls) != data.expectedCalls {
+			t.Errorf("%s: expected %d calls but got %d", data.name, data.expectedCalls, len(lister.calls))
+		}
+	}
+}
+
+func TestAzMonitorGetAzureMetricFakeListerRetry(t *testing.T) {
+	azureMonitorRetryBaseDelay = time.Millisecond
+	defer func() { azureMonitorRetryBaseDelay = time.Second }()
+
+	lister := &fakeMetricsLister{results: []fakeMetricsListerResult{
+		{err: autorest.DetailedError{StatusCode: http.StatusServiceUnavailable, Original: fmt.Errorf("unavailable")}},
+		{response: newTestAzMonitorResponse([]insights.MetricValue{{Average: float64Ptr(3)}})},
+	}}
+	request := newTestAzMonitorRequest()
+	request.MaxRetries = 2
+
+	value, err := getAzureMetric(context.TODO(), lister, request)
+	if err != nil {
+		t.Fatal("Expected the retry to succeed but got error", err)
+	}
+	if value.Value != 3 || len(lister.calls) != 2 {
+		t.Errorf("Expected value 3 after 2 calls but got %v after %d", value.Value, len(lister.calls))
+	}
+}
+
+func TestAzMonitorGetAzureMetricNamespace(t *testing.T) {
+	for _, namespace := range []string{"", "azure.applicationinsights"} {
+		sender := &testAzMonitorSender{responses: []testAzMonitorSenderResponse{
+			{statusCode: http.StatusOK, body: newTestAzMonitorResponse([]insights.MetricValue{{Average: float64Ptr(1)}})},
+		}}
+		request := newTestAzMonitorRequest()
+		request.MetricNamespace = namespace
+
+		_, err := getAzureMetric(context.Background(), newTestAzMonitorClient(sender), request)
+		if err != nil {
+			t.Fatal("Expected success but got error", err)
+		}
+		if len(sender.requests) != 1 {
+			t.Fatalf("Expected one request but got %d", len(sender.requests))
+		}
+		if got := sender.requests[0].URL.Query().Get("metricnamespace"); got != namespace {
+			t.Errorf("Expected metricnamespace %q to be forwarded but got %q", namespace, got)
+		}
+	}
+}
+
+func TestAzMonitorExtractValueUnit(t *testing.T) {
+	response := newTestAzMonitorResponse([]insights.MetricValue{{Average: float64Ptr(42)}})
+	(*response.Value)[0].Unit = insights.UnitPercent
+
+	value, err := extractValue(newTestAzMonitorRequest(), response)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if value.Unit != insights.UnitPercent {
+		t.Errorf("Expected unit %s but got %s", insights.UnitPercent, value.Unit)
+	}
+}
+
+type azMonitorRetryTestData struct {
+	name          string
+	statusCodes   []int
+	maxRetries    int
+	expectedCalls int
+	isError       bool
+}
+
+var testAzMonitorRetryData = []azMonitorRetryTestData{
+	{"throttled twice then success", []int{http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusOK}, 3, 3, false},
+	{"server error then success", []int{http.StatusServiceUnavailable, http.StatusOK}, 3, 2, false},
+	{"retries exhausted", []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError}, 2, 3, true},
+	{"auth error is not retried", []int{http.StatusUnauthorized, http.StatusOK}, 3, 1, true},
+	{"retries disabled", []int{http.StatusTooManyRequests, http.StatusOK}, 0, 1, true},
+}
+
+func TestAzMonitorRetryAzureMonitorCall(t *testing.T) {
+	azureMonitorRetryBaseDelay = time.Millisecond
+	defer func() { azureMonitorRetryBaseDelay = time.Second }()
+
+	for _, testData := range testAzMonitorRetryData {
+		calls := 0
+		err := retryAzureMonitorCall(context.Background(), testData.maxRetries, func() error {
+			statusCode := testData.statusCodes[calls]
+			calls++
+			if statusCode == http.StatusOK {
+				return nil
+			}
+			return autorest.DetailedError{StatusCode: statusCode, Response: &http.Response{StatusCode: statusCode, Header: http.Header{}}}
+		})
+		if err != nil && !testData.isError {
+			t.Errorf("%s: expected success but got error %v", testData.name, err)
+		}
+		if testData.isError && err == nil {
+			t.Errorf("%s: expected error but got success", testData.name)
+		}
+		if calls != testData.expectedCalls {
+			t.Errorf("%s: expected %d calls but got %d", testData.name, testData.expectedCalls, calls)
+		}
+	}
+}
+
+func TestAzMonitorGetAzureMetricRetriesThrottling(t *testing.T) {
+	azureMonitorRetryBaseDelay = time.Millisecond
+	defer func() { azureMonitorRetryBaseDelay = time.Second }()
+
+	sender := &testAzMonitorSender{responses: []testAzMonitorSenderResponse{
+		{statusCode: http.StatusTooManyRequests},
+		{statusCode: http.StatusTooManyRequests},
+		{statusCode: http.StatusOK, body: newTestAzMonitorResponse([]insights.MetricValue{{Average: float64Ptr(7)}})},
+	}}
+	request := newTestAzMonitorRequest()
+	request.MaxRetries = 3
+
+	value, err := getAzureMetric(context.Background(), newTestAzMonitorClient(sender), request)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if value.Value != 7 {
+		t.Errorf("Expected 7 but got %v", value.Value)
+	}
+	if len(sender.requests) != 3 {
+		t.Errorf("Expected 3 requests but got %d", len(sender.requests))
+	}
+}
+
+func TestAzMonitorParseRetryAfter(t *testing.T) {
+	if delay := parseRetryAfter("120"); delay != 120*time.Second {
+		t.Errorf("Expected 120s but got %s", delay)
+	}
+	if delay := parseRetryAfter(""); delay != 0 {
+		t.Errorf("Expected no delay for a missing header but got %s", delay)
+	}
+}
+
+func TestAzMonitorParseRetryAfterDate(t *testing.T) {
+	now := time.Date(2020, time.January, 15, 10, 0, 0, 0, time.UTC)
+	testData := []struct {
+		retryAfter string
+		expected   time.Duration
+	}{
+		{"120", 120 * time.Second},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second},
+		{"Wed, 15 Jan 2020 10:02:00 GMT", 2 * time.Minute},
+		{"Wed, 15 Jan 2020 09:59:00 GMT", 0},
+		{"-5", 0},
+		{"soon", 0},
+	}
+
+	for _, data := range testData {
+		if delay := parseRetryAfterAt(data.retryAfter, now); delay != data.expected {
+			t.Errorf("%q: expected %s but got %s", data.retryAfter, data.expected, delay)
+		}
+	}
+}
+
+func parseTestAzMonitorTimeSpan(t *testing.T, timespan string) (time.Time, time.Time) {
+	endpoints := strings.Split(timespan, "/")
+	if len(endpoints) != 2 {
+		t.Fatalf("Expected start/end timespan but got %s", timespan)
+	}
+	start, err := time.Parse(time.RFC3339, endpoints[0])
+	if err != nil {
+		t.Fatal("Expected RFC3339 start time but got error", err)
+	}
+	end, err := time.Parse(time.RFC3339, endpoints[1])
+	if err != nil {
+		t.Fatal("Expected RFC3339 end time but got error", err)
+	}
+	return start, end
+}
+
+func TestAzMonitorFormatTimeSpanAggregationDelay(t *testing.T) {
+	now := time.Now()
+	timespan, err := formatTimeSpan("00:15:00", "00:02:00", 0, false)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+
+	start, end := parseTestAzMonitorTimeSpan(t, timespan)
+	expectedEnd := now.Add(-2 * time.Minute)
+	if diff := end.Sub(expectedEnd); diff < -time.Second || diff > time.Second {
+		t.Errorf("Expected end time %s but got %s", expectedEnd, end)
+	}
+	expectedStart := now.Add(-17 * time.Minute)
+	if diff := start.Sub(expectedStart); diff < -time.Second || diff > time.Second {
+		t.Errorf("Expected start time %s but got %s", expectedStart, start)
+	}
+}
+
+func TestAzMonitorFormatTimeSpanAt(t *testing.T) {
+	anchor := time.Date(2020, time.January, 2, 10, 30, 45, 0, time.UTC)
+	timespan, err := formatTimeSpanAt("00:15:00", "00:02:00", 0, false, anchor)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if expected := "2020-01-02T10:13:45Z/2020-01-02T10:28:45Z"; timespan != expected {
+		t.Errorf("Expected timespan %s but got %s", expected, timespan)
+	}
+
+	timespan, err = formatTimeSpanAt("00:05:00", "", 0, true, anchor)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if expected := "2020-01-02T10:25:00Z/2020-01-02T10:30:00Z"; timespan != expected {
+		t.Errorf("Expected timespan %s but got %s", expected, timespan)
+	}
+}
+
+func TestAzMonitorGetAzureMetricValueAt(t *testing.T) {
+	sender := &testAzMonitorSender{responses: []testAzMonitorSenderResponse{
+		{statusCode: http.StatusOK, body: newTestAzMonitorResponse([]insights.MetricValue{{Average: float64Ptr(7)}})},
+	}}
+	metadata := newTestAzMonitorSeededMetadata("anchor", "")
+	metadata.aggregationInterval = "00:10:00"
+
+	anchor := time.Date(2020, time.January, 2, 10, 30, 0, 0, time.UTC)
+	value, err := getAzureMetricValueAt(context.TODO(), metadata, anchor, sender)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if value != 7 {
+		t.Errorf("Expected value 7 but got %v", value)
+	}
+	if len(sender.requests) != 1 {
+		t.Fatalf("Expected a single request but got %d", len(sender.requests))
+	}
+	if timespan, expected := sender.requests[0].URL.Query().Get("timespan"), "2020-01-02T10:20:00Z/2020-01-02T10:30:00Z"; timespan != expected {
+		t.Errorf("Expected timespan %s but got %s", expected, timespan)
+	}
+	if !metadata.anchor.IsZero() {
+		t.Error("Expected the anchor not to be set on the metadata of the trigger")
+	}
+}
+
+func TestAzMonitorFormatTimeSpanAlignToMinute(t *testing.T) {
+	timespan, err := formatTimeSpan("00:05:00", "00:01:30", 0, true)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+
+	start, end := parseTestAzMonitorTimeSpan(t, timespan)
+	if end.Second() != 0 || start.Second() != 0 {
+		t.Errorf("Expected the window to be aligned to minutes but got %s", timespan)
+	}
+	if end.Sub(start) != 5*time.Minute {
+		t.Errorf("Expected a 5 minute window but got %s", timespan)
+	}
+	if latest := time.Now().Add(-90 * time.Second); end.After(latest) {
+		t.Errorf("Expected the window to end before %s but got %s", latest, end)
+	}
+}
+
+type azMonitorResourceURITestData struct {
+	resourceURI string
+	scope       string
+	expectedURI string
+	isError     bool
+}
+
+var testAzMonitorResourceURIData = []azMonitorResourceURITestData{
+	{"Microsoft.Web/sites/mysite", "", "/subscriptions/456/resourceGroups/test/providers/Microsoft.Web/sites/mysite", false},
+	{"/Microsoft.Web/sites/mysite", "", "/subscriptions/456/resourceGroups/test/providers/Microsoft.Web/sites/mysite", false},
+	{"Microsoft.Web/sites/mysite/slots/staging", "", "/subscriptions/456/resourceGroups/test/providers/Microsoft.Web/sites/mysite/slots/staging", false},
+	{"/subscriptions/789/resourceGroups/other/providers/Microsoft.Web/sites/mysite", "", "/subscriptions/789/resourceGroups/other/providers/Microsoft.Web/sites/mysite", false},
+	{"Microsoft.Web/sites", "", "", true},
+	{"Microsoft.Web/sites/mysite/slots", "", "", true},
+	{"/subscriptions/789/providers/Microsoft.Web/sites/mysite", "", "", true},
+	{"Microsoft.Web//mysite", "", "", true},
+	{"/subscriptions/789/providers/Microsoft.Capacity/resourceProviders/Microsoft.Compute", "subscription", "/subscriptions/789/providers/Microsoft.Capacity/resourceProviders/Microsoft.Compute", false},
+	{"Microsoft.Capacity/resourceProviders/Microsoft.Compute", "subscription", "/subscriptions/456/providers/Microsoft.Capacity/resourceProviders/Microsoft.Compute", false},
+	{"/subscriptions/789/providers/Microsoft.Capacity", "subscription", "", true},
+}
+
+func TestAzMonitorParseResourceURI(t *testing.T) {
+	for _, testData := range testAzMonitorResourceURIData {
+		info, err := parseAzureResourceURI(testData.resourceURI, testData.scope)
+		if err != nil && !testData.isError {
+			t.Errorf("%s: expected success but got error %v", testData.resourceURI, err)
+		}
+		if testData.isError {
+			if err == nil {
+				t.Errorf("%s: expected error but got success", testData.resourceURI)
+			} else if !strings.Contains(err.Error(), testData.resourceURI) {
+				t.Errorf("%s: expected the error to name the resourceURI but got %v", testData.resourceURI, err)
+			}
+			continue
+		}
+
+		request := azureExternalMetricRequest{
+			SubscriptionID:            "456",
+			ResourceGroup:             "test",
+			ResourceProviderNamespace: info.ProviderNamespace,
+			ResourceType:              info.ResourceType,
+			ResourceName:              info.ResourceName,
+			Scope:                     testData.scope,
+		}
+		if info.SubscriptionID != "" {
+			request.SubscriptionID = info.SubscriptionID
+			request.ResourceGroup = info.ResourceGroup
+		}
+		if uri := request.metricResourceURI(); uri != testData.expectedURI {
+			t.Errorf("%s: expected %s but got %s", testData.resourceURI, testData.expectedURI, uri)
+		}
+	}
+}
+
+func TestAzMonitorIsActiveValue(t *testing.T) {
+	scaler := azureMonitorScaler{metadata: &azureMonitorMetadata{activationTargetValue: 5}}
+	if scaler.isActiveValue(4) {
+		t.Error("Expected a value below the activation target value to be inactive")
+	}
+	if scaler.isActiveValue(5) {
+		t.Error("Expected a value equal to the activation target value to be inactive")
+	}
+	if !scaler.isActiveValue(6) {
+		t.Error("Expected a value above the activation target value to be active")
+	}
+}
+
+func TestAzMonitorIsActiveValueGracePolls(t *testing.T) {
+	metadata := &azureMonitorMetadata{resourceURI: "test/resource/uri", name: "grace", activationTargetValue: 5, activationGracePolls: 3}
+	scaler := azureMonitorScaler{metadata: metadata, activation: getAzureMonitorActivationState(metadata)}
+
+	reads := []struct {
+		value    float64
+		expected bool
+	}{
+		{1, false}, // never active, no grace
+		{6, true},
+		{4, true},
+		{3, true},
+		{7, true}, // rising above resets the counter
+		{4, true},
+		{4, true},
+		{4, false}, // third consecutive read below
+		{4, false},
+		{9, true},
+	}
+	for i, read := range reads {
+		if active := scaler.isActiveValue(read.value); active != read.expected {
+			t.Errorf("read %d (%v): expected active %v but got %v", i, read.value, read.expected, active)
+		}
+	}
+
+	// the scale loop builds a new scaler for every poll, the state has to carry over
+	next := azureMonitorScaler{metadata: metadata, activation: getAzureMonitorActivationState(metadata)}
+	if !next.isActiveValue(1) {
+		t.Error("Expected the grace window to carry over to a new scaler for the same trigger")
+	}
+
+	// the key covers the whole request, triggers that differ only in a setting of the query keep separate states
+	filtered := *metadata
+	filtered.filter = "Region eq 'west'"
+	if getAzureMonitorActivationState(&filtered) == scaler.activation {
+		t.Error("Expected triggers with a different filter to keep separate activation states")
+	}
+	graced := *metadata
+	graced.activationGracePolls = 5
+	if getAzureMonitorActivationState(&graced) == scaler.activation {
+		t.Error("Expected triggers with a different grace window to keep separate activation states")
+	}
+}
+
+func TestAzMonitorTriggerStatesEviction(t *testing.T) {
+	defer func(ttl time.Duration) { azureMonitorTriggerStateTTL = ttl }(azureMonitorTriggerStateTTL)
+	azureMonitorTriggerStateTTL = 10 * time.Millisecond
+
+	states := newAzureMonitorTriggerStates()
+	create := func() interface{} { return &azureMonitorDerivativeState{} }
+	removed := states.get("removed", create)
+	kept := states.get("kept", create)
+
+	time.Sleep(6 * time.Millisecond)
+	if states.get("kept", create) != kept {
+		t.Error("Expected the state of a trigger to be kept while it is used")
+	}
+	time.Sleep(6 * time.Millisecond)
+	if states.get("kept", create) != kept {
+		t.Error("Expected the state of a used trigger to survive the sweep")
+	}
+	if _, ok := states.entries["removed"]; ok {
+		t.Error("Expected the state of an unused trigger to be dropped")
+	}
+	if states.get("removed", create) == removed {
+		t.Error("Expected a dropped state to be created again")
+	}
+}
+
+func TestAzMonitorCreateMetricsClientReusesAuthorizer(t *testing.T) {
+	metadata := &azureMonitorMetadata{subscriptionID: "456", clientID: "cached-id", clientPassword: "password", tenantID: "tenant"}
+	first, err := createMetricsClient(metadata, nil)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+
+	var wg sync.WaitGroup
+	clients := make([]insights.MetricsClient, 10)
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			clients[i], _ = createMetricsClient(metadata, nil)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, client := range clients {
+		if client.Authorizer != first.Authorizer {
+			t.Fatal("Expected clients with the same credentials to share one authorizer")
+		}
+	}
+
+	metadata.clientPassword = "rotated"
+	rotated, err := createMetricsClient(metadata, nil)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if rotated.Authorizer == first.Authorizer {
+		t.Error("Expected a new authorizer after the client secret changed")
+	}
+}
+
+func TestAzMonitorCreateMetricsClientSecretFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "azure-monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secretFile := filepath.Join(dir, "client-secret")
+	if err := ioutil.WriteFile(secretFile, []byte("first-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := &azureMonitorMetadata{subscriptionID: "456", clientID: "file-id", clientSecretFile: secretFile, tenantID: "tenant"}
+	first, err := createMetricsClient(metadata, nil)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	unchanged, err := createMetricsClient(metadata, nil)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if unchanged.Authorizer != first.Authorizer {
+		t.Error("Expected the authorizer to be reused while the secret file is unchanged")
+	}
+
+	if err := ioutil.WriteFile(secretFile, []byte("second-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(secretFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := createMetricsClient(metadata, nil)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if rotated.Authorizer == first.Authorizer {
+		t.Error("Expected a new authorizer after the secret file changed")
+	}
+	if metadata.clientPassword != "" {
+		t.Error("Expected the secret not to be stored on the scaler metadata")
+	}
+
+	metadata.clientSecretFile = filepath.Join(dir, "missing")
+	if _, err := createMetricsClient(metadata, nil); err == nil {
+		t.Error("Expected error for a missing secret file but got success")
+	}
+}
+
+func TestAzMonitorExecuteRequestErrorCodes(t *testing.T) {
+	messages := map[int]string{}
+	for statusCode, errorCode := range map[int]string{http.StatusNotFound: "ResourceNotFound", http.StatusUnauthorized: "InvalidAuthenticationToken"} {
+		sender := &testAzMonitorSender{responses: []testAzMonitorSenderResponse{
+			{statusCode: statusCode, body: map[string]interface{}{"error": map[string]string{"code": errorCode, "message": "failed"}}},
+		}}
+		request := newTestAzMonitorRequest()
+
+		_, err := executeRequest(context.Background(), newTestAzMonitorClient(sender), &request)
+		if err == nil {
+			t.Fatalf("Expected error for status code %d but got success", statusCode)
+		}
+		if !strings.Contains(err.Error(), strconv.Itoa(statusCode)) || !strings.Contains(err.Error(), errorCode) {
+			t.Errorf("Expected status code %d and error code %s in error but got %v", statusCode, errorCode, err)
+		}
+		messages[statusCode] = err.Error()
+	}
+
+	if messages[http.StatusNotFound] == messages[http.StatusUnauthorized] {
+		t.Error("Expected distinguishable errors for 404 and 401")
+	}
+}
+
+func TestAzMonitorGetAzureMetricErrorResourceURI(t *testing.T) {
+	sender := &testAzMonitorSender{responses: []testAzMonitorSenderResponse{
+		{statusCode: http.StatusNotFound, body: map[string]interface{}{"error": map[string]string{"code": "ResourceNotFound", "message": "failed"}}},
+	}}
+	request := newTestAzMonitorRequest()
+
+	_, err := getAzureMetric(context.Background(), newTestAzMonitorClient(sender), request)
+	if err == nil {
+		t.Fatal("Expected error for a missing resource but got success")
+	}
+	if !strings.Contains(err.Error(), "/subscriptions/456/resourceGroups/test/providers/test/resource/uri") {
+		t.Errorf("Expected the resource ID in the error but got %v", err)
+	}
+
+	if err := describeAzureMonitorError(err); !strings.Contains(err.Error(), "ResourceNotFound") {
+		t.Errorf("Expected the wrapped error to still be described with its error code but got %v", err)
+	}
+}
+
+type azMonitorFormatTimeSpanTestData struct {
+	timeSpan         string
+	expectedDuration time.Duration
+	isError          bool
+}
+
+var testAzMonitorFormatTimeSpanData = []azMonitorFormatTimeSpanTestData{
+	{"", 5 * time.Minute, false},
+	{"00:15:00", 15 * time.Minute, false},
+	{"1:30:15", time.Hour + 30*time.Minute + 15*time.Second, false},
+	{"5", 0, true},
+	{"00:05", 0, true},
+	{"00:05:00:00", 0, true},
+	{"aa:05:00", 0, true},
+	{"00:five:00", 0, true},
+	{"-1:00:00", 0, true},
+	{"00:00:-30", 0, true},
+	{"2232:00:00", 93 * 24 * time.Hour, false},
+	{"2233:00:00", 0, true},
+}
+
+func TestAzMonitorFormatTimeSpan(t *testing.T) {
+	for _, testData := range testAzMonitorFormatTimeSpanData {
+		timespan, err := formatTimeSpan(testData.timeSpan, "", 0, false)
+		if err != nil && !testData.isError {
+			t.Errorf("%q: expected success but got error %v", testData.timeSpan, err)
+		}
+		if testData.isError {
+			if err == nil {
+				t.Errorf("%q: expected error but got success", testData.timeSpan)
+			}
+			continue
+		}
+
+		start, end := parseTestAzMonitorTimeSpan(t, timespan)
+		if duration := end.Sub(start); duration != testData.expectedDuration {
+			t.Errorf("%q: expected a window of %s but got %s", testData.timeSpan, testData.expectedDuration, duration)
+		}
+	}
+}
+
+func TestAzMonitorFormatTimeSpanDefaultWindow(t *testing.T) {
+	previousWindow := azureMonitorDefaultAggregationWindow
+	defer func() { azureMonitorDefaultAggregationWindow = previousWindow }()
+
+	for _, window := range []time.Duration{time.Minute, 15 * time.Minute} {
+		azureMonitorDefaultAggregationWindow = window
+		timespan, err := formatTimeSpan("", "", 0, false)
+		if err != nil {
+			t.Fatal("Expected success but got error", err)
+		}
+		start, end := parseTestAzMonitorTimeSpan(t, timespan)
+		if duration := end.Sub(start); duration != window {
+			t.Errorf("Expected the configured default window of %s but got %s", window, duration)
+		}
+	}
+}
+
+func TestAzMonitorParseSubscriptionFromIMDS(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.Header.Get("Metadata") != "true" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"compute": {"location": "westeurope", "subscriptionId": "00000000-0000-0000-0000-000000000789"}}`))
+	}))
+	defer server.Close()
+
+	previousEndpoint := azureMonitorIMDSEndpoint
+	azureMonitorIMDSEndpoint = server.URL + "/metadata/instance"
+	defer func() { azureMonitorIMDSEndpoint = previousEndpoint }()
+
+	metadata := map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "targetValue": "5"}
+	for i := 0; i < 2; i++ {
+		meta, err := parseAzureMonitorMetadata(metadata, map[string]string{}, map[string]string{}, "azure")
+		if err != nil {
+			t.Fatal("Expected success but got error", err)
+		}
+		if meta.subscriptionID != "00000000-0000-0000-0000-000000000789" {
+			t.Errorf("Expected the subscription of the node but got %q", meta.subscriptionID)
+		}
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 1 {
+		t.Errorf("Expected IMDS to be called once for both parses but got %d calls", calls)
+	}
+
+	// an explicit subscriptionId takes precedence
+	metadata["subscriptionId"] = "00000000-0000-0000-0000-000000000456"
+	meta, err := parseAzureMonitorMetadata(metadata, map[string]string{}, map[string]string{}, "azure")
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if meta.subscriptionID != "00000000-0000-0000-0000-000000000456" {
+		t.Errorf("Expected the explicit subscriptionId but got %q", meta.subscriptionID)
+	}
+
+	// service principals are not tied to the node
+	delete(metadata, "subscriptionId")
+	metadata["activeDirectoryClientId"] = "CLIENT_ID"
+	metadata["activeDirectoryClientPassword"] = "CLIENT_PASSWORD"
+	if _, err := parseAzureMonitorMetadata(metadata, testAzMonitorResolvedEnv, map[string]string{}, ""); err == nil {
+		t.Error("Expected a missing subscriptionId to be reported without pod identity")
+	}
+}
+
+func TestAzMonitorGetIMDSSubscriptionIDError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"compute": {}}`))
+	}))
+	defer server.Close()
+
+	previousEndpoint := azureMonitorIMDSEndpoint
+	azureMonitorIMDSEndpoint = server.URL
+	defer func() { azureMonitorIMDSEndpoint = previousEndpoint }()
+
+	if _, err := getIMDSSubscriptionID(context.Background()); err == nil {
+		t.Error("Expected instance metadata without a subscription to be rejected")
+	}
+}
+
+func TestAzMonitorParseDefaultAggregationWindow(t *testing.T) {
+	metadata := map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5", "defaultAggregationWindow": "00:15:00"}
+	meta, err := parseAzureMonitorMetadata(metadata, testAzMonitorResolvedEnv, map[string]string{}, "")
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if window, _ := getAggregationWindow(meta.aggregationInterval); window != 15*time.Minute {
+		t.Errorf("Expected the defaultAggregationWindow of 15m but got %s", window)
+	}
+
+	metadata["metricAggregationInterval"] = "0:1:0"
+	meta, err = parseAzureMonitorMetadata(metadata, testAzMonitorResolvedEnv, map[string]string{}, "")
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if window, _ := getAggregationWindow(meta.aggregationInterval); window != time.Minute {
+		t.Errorf("Expected metricAggregationInterval to take precedence over defaultAggregationWindow but got %s", window)
+	}
+
+	for _, invalid := range []string{"15m", "00:00:00"} {
+		delete(metadata, "metricAggregationInterval")
+		metadata["defaultAggregationWindow"] = invalid
+		if _, err := parseAzureMonitorMetadata(metadata, testAzMonitorResolvedEnv, map[string]string{}, ""); err == nil {
+			t.Errorf("Expected defaultAggregationWindow %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestAzMonitorFormatTimeSpanMaxRetention(t *testing.T) {
+	if _, err := formatTimeSpan("24:00:00", "", 12*time.Hour, false); err == nil {
+		t.Error("Expected a window longer than the configured retention to be rejected")
+	}
+	if _, err := formatTimeSpan("2232:00:00", "01:00:00", 0, false); err == nil {
+		t.Error("Expected a delay pushing the window past the default retention to be rejected")
+	}
+	if _, err := formatTimeSpan("2233:00:00", "", 100*24*time.Hour, false); err != nil {
+		t.Errorf("Expected a window within the configured retention to succeed but got %v", err)
+	}
+}
+
+func TestAzMonitorMetricResourceURIResourceSubscription(t *testing.T) {
+	metadata := &azureMonitorMetadata{
+		resourceURI:            "test/resource/uri",
+		subscriptionID:         "456",
+		resourceSubscriptionID: "789",
+		resourceGroupName:      "test",
+		name:                   "metric",
+		aggregationType:        "Average",
+	}
+	request, err := createMetricsRequest(metadata)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+
+	if request.SubscriptionID != "456" {
+		t.Errorf("Expected subscription 456 to authenticate but got %s", request.SubscriptionID)
+	}
+	if uri := request.metricResourceURI(); uri != "/subscriptions/789/resourceGroups/test/providers/test/resource/uri" {
+		t.Errorf("Expected the resource subscription in the resource URI but got %s", uri)
+	}
+
+	metadata.resourceSubscriptionID = ""
+	request, err = createMetricsRequest(metadata)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if uri := request.metricResourceURI(); uri != "/subscriptions/456/resourceGroups/test/providers/test/resource/uri" {
+		t.Errorf("Expected the subscription in the resource URI but got %s", uri)
+	}
+}
+
+type azMonitorMetricNameTestData struct {
+	resourceURI  string
+	metricName   string
+	expectedName string
+}
+
+var testAzMonitorMetricNameData = []azMonitorMetricNameTestData{
+	{"Microsoft.Web/sites/mysite", "Requests", "azure-monitor-456-test-microsoft-web-sites-mysite-requests"},
+	{"Microsoft.Web/sites/mysite/slots/staging", "Http Server Errors", "azure-monitor-456-test-microsoft-web-sites-mysite-slots-staging-http-server-errors"},
+	{"Microsoft.Storage/storageAccounts/account", "Ingress/Egress", "azure-monitor-456-test-microsoft-storage-storageaccounts-account-ingress-egress"},
+	{"Microsoft.Sql/servers/account", "Ingress/Egress", "azure-monitor-456-test-microsoft-sql-servers-account-ingress-egress"},
+}
+
+func TestAzMonitorGetMetricSpecForScaling(t *testing.T) {
+	names := map[string]bool{}
+	for _, testData := range testAzMonitorMetricNameData {
+		scaler := azureMonitorScaler{metadata: &azureMonitorMetadata{resourceURI: testData.resourceURI, subscriptionID: "456", resourceGroupName: "Test", name: testData.metricName, targetValue: 5}}
+		metricSpec := scaler.GetMetricSpecForScaling()
+		if len(metricSpec) != 1 || metricSpec[0].External == nil {
+			t.Fatalf("Expected one external metric spec but got %v", metricSpec)
+		}
+
+		name := metricSpec[0].External.MetricName
+		if name != testData.expectedName {
+			t.Errorf("Expected metric name %s but got %s", testData.expectedName, name)
+		}
+		if names[name] {
+			t.Errorf("Expected metric name %s to be unique per resource", name)
+		}
+		names[name] = true
+	}
+}
+
+func TestAzMonitorGetMetricNameUnique(t *testing.T) {
+	// the same resource group and resource in two subscriptions
+	resourceURI := "/subscriptions/%s/resourceGroups/test/providers/Microsoft.Web/sites/mysite"
+	first := &azureMonitorMetadata{subscriptionID: "00000000-0000-0000-0000-000000000456", resourceURI: fmt.Sprintf(resourceURI, "00000000-0000-0000-0000-000000000456"), resourceGroupName: "test", name: "Requests"}
+	second := &azureMonitorMetadata{subscriptionID: "00000000-0000-0000-0000-000000000456", resourceSubscriptionID: "00000000-0000-0000-0000-000000000789", resourceURI: fmt.Sprintf(resourceURI, "00000000-0000-0000-0000-000000000789"), resourceGroupName: "test", name: "Requests"}
+	if firstName, secondName := getAzureMonitorMetricName(first), getAzureMonitorMetricName(second); firstName == secondName {
+		t.Errorf("Expected the resources of two subscriptions to have different metric names but both got %s", firstName)
+	}
+
+	// resourceNames that are too long for a Kubernetes name and only differ in the last resource
+	resourceNames := []string{}
+	for i := 0; i < 30; i++ {
+		resourceNames = append(resourceNames, fmt.Sprintf("virtual-machine-%d", i))
+	}
+	long := &azureMonitorMetadata{subscriptionID: "456", resourceGroupName: "test", resourceURI: "Microsoft.Compute/virtualMachines", resourceNames: resourceNames, name: "Percentage CPU"}
+	other := *long
+	other.resourceNames = append(append([]string{}, resourceNames[:29]...), "virtual-machine-last")
+
+	longName, otherName := getAzureMonitorMetricName(long), getAzureMonitorMetricName(&other)
+	for _, name := range []string{longName, otherName} {
+		if len(name) > maxAzureMonitorMetricNameLength || !azureMonitorMetricNameOverridePattern.MatchString(name) {
+			t.Errorf("Expected a valid Kubernetes name of at most %d characters but got %d: %s", maxAzureMonitorMetricNameLength, len(name), name)
+		}
+		if !strings.HasPrefix(name, "azure-monitor-456-test-microsoft-compute-virtualmachines-virtual-machine-0-") {
+			t.Errorf("Expected the name to start with the resource but got %s", name)
+		}
+	}
+	if longName == otherName {
+		t.Errorf("Expected truncated names that differ after the cut to stay unique but both got %s", longName)
+	}
+	if getAzureMonitorMetricName(long) != longName {
+		t.Error("Expected the truncated name to be stable")
+	}
+}
+
+func TestAzMonitorGetMetricSpecForScalingTargetType(t *testing.T) {
+	for _, targetType := range []string{"", "averagevalue", "Value"} {
+		metadata := map[string]string{"resourceURI": "Microsoft.Web/sites/mysite", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "Requests", "metricAggregationType": "Total", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "7", "targetType": targetType}
+		meta, err := parseAzureMonitorMetadata(metadata, testAzMonitorResolvedEnv, map[string]string{}, "")
+		if err != nil {
+			t.Fatalf("%q: expected success but got error %v", targetType, err)
+		}
+
+		scaler := azureMonitorScaler{metadata: meta}
+		external := scaler.GetMetricSpecForScaling()[0].External
+		target, unset := external.TargetAverageValue, external.TargetValue
+		if targetType == "Value" {
+			target, unset = external.TargetValue, external.TargetAverageValue
+		}
+		if target == nil || target.Value() != 7 {
+			t.Errorf("%q: expected a target of 7 but got %v", targetType, target)
+		}
+		if unset != nil {
+			t.Errorf("%q: expected a single target but got %v as well", targetType, unset)
+		}
+	}
+}
+
+func TestAzMonitorGetMetricSpecForScalingMetricNameOverride(t *testing.T) {
+	metadata := map[string]string{"resourceURI": "Microsoft.Web/sites/mysite", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "Requests", "metricAggregationType": "Total", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "7", "metricNameOverride": "site-requests"}
+	meta, err := parseAzureMonitorMetadata(metadata, testAzMonitorResolvedEnv, map[string]string{}, "")
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+
+	scaler := azureMonitorScaler{metadata: meta}
+	if name := scaler.GetMetricSpecForScaling()[0].External.MetricName; name != "site-requests" {
+		t.Errorf("Expected the metricNameOverride site-requests to be advertised but got %s", name)
+	}
+
+	metadata["metricNameOverride"] = strings.Repeat("a", maxAzureMonitorMetricNameLength+1)
+	if _, err := parseAzureMonitorMetadata(metadata, testAzMonitorResolvedEnv, map[string]string{}, ""); err == nil {
+		t.Error("Expected a metricNameOverride longer than a Kubernetes name to be rejected")
+	}
+}
+
+func newTestAzMonitorMetadataSeries(dimensions map[string]string) insights.TimeSeriesElement {
+	metadataValues := []insights.MetadataValue{}
+	for name, value := range dimensions {
+		name, value := name, value
+		metadataValues = append(metadataValues, insights.MetadataValue{Name: &insights.LocalizableString{Value: &name}, Value: &value})
+	}
+	return insights.TimeSeriesElement{Metadatavalues: &metadataValues}
+}
+
+func TestAzMonitorListMetricDimensionValues(t *testing.T) {
+	timeseries := []insights.TimeSeriesElement{
+		newTestAzMonitorMetadataSeries(map[string]string{"EntityName": "orders", "OperationResult": "Success"}),
+		newTestAzMonitorMetadataSeries(map[string]string{"entityname": "invoices", "OperationResult": "Success"}),
+		newTestAzMonitorMetadataSeries(map[string]string{"EntityName": "orders", "OperationResult": "ServerError"}),
+	}
+	sender := &testAzMonitorSender{responses: []testAzMonitorSenderResponse{
+		{statusCode: http.StatusOK, body: insights.Response{Value: &[]insights.Metric{{Timeseries: &timeseries}}}},
+	}}
+	request := newTestAzMonitorRequest()
+	request.Filter = "OperationResult ne 'ClientError'"
+
+	values, err := listMetricDimensionValues(context.TODO(), newTestAzMonitorClient(sender), request, []string{"EntityName", "OperationResult", "Region"})
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	expected := map[string][]string{
+		"EntityName":      {"invoices", "orders"},
+		"OperationResult": {"ServerError", "Success"},
+		"Region":          {},
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("Expected dimension values %v but got %v", expected, values)
+	}
+
+	query := sender.requests[0].URL.Query()
+	if resultType := query.Get("resultType"); resultType != string(insights.Metadata) {
+		t.Errorf("Expected resultType %s but got %s", insights.Metadata, resultType)
+	}
+	if filter, expectedFilter := query.Get("$filter"), "OperationResult ne 'ClientError' and EntityName eq '*' and OperationResult eq '*' and Region eq '*'"; filter != expectedFilter {
+		t.Errorf("Expected filter %s but got %s", expectedFilter, filter)
+	}
+	if top := query.Get("top"); top != "1000" {
+		t.Errorf("Expected top 1000 without a top on the trigger but got %s", top)
+	}
+
+	if _, err := listMetricDimensionValues(context.TODO(), newTestAzMonitorClient(sender), request, nil); err == nil {
+		t.Error("Expected an error without dimensions")
+	}
+}
+
+func TestAzMonitorExecuteRequestResultAsRate(t *testing.T) {
+	sender := &testAzMonitorSender{responses: []testAzMonitorSenderResponse{
+		{statusCode: http.StatusOK, body: newTestAzMonitorResponse([]insights.MetricValue{{Total: float64Ptr(120)}})},
+	}}
+	request := newTestAzMonitorRequest()
+	request.Aggregation = "Total"
+	request.Window = time.Minute
+	request.ResultAsRate = true
+
+	value, err := executeRequest(context.Background(), newTestAzMonitorClient(sender), &request)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if value != 2 {
+		t.Errorf("Expected a rate of 2 but got %v", value)
+	}
+}
+
+func TestAzMonitorExecuteRequestCountPerSecond(t *testing.T) {
+	metadata := map[string]string{"resourceURI": "Microsoft.EventHub/namespaces/events", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "IncomingMessages", "metricAggregationType": "Count", "metricAggregationInterval": "00:05:00", "metricResultAsRate": "true", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}
+	meta, err := parseAzureMonitorMetadata(metadata, testAzMonitorResolvedEnv, map[string]string{}, "")
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	request, err := createMetricsRequest(meta)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+
+	lister := &fakeMetricsLister{results: []fakeMetricsListerResult{
+		{response: newTestAzMonitorResponse([]insights.MetricValue{{Count: int64Ptr(600)}})},
+	}}
+	value, err := executeRequest(context.Background(), lister, request)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if value != 2 {
+		t.Errorf("Expected a count of 600 over 300s to be 2 events per second but got %v", value)
+	}
+}
+
+func TestAzMonitorGetRateWindow(t *testing.T) {
+	for _, data := range []struct {
+		window      time.Duration
+		granularity time.Duration
+		expected    time.Duration
+	}{
+		{5 * time.Minute, 0, 5 * time.Minute},
+		{5 * time.Minute, time.Minute, 5 * time.Minute},
+		// a window shorter than the granularity gets the events of a whole data point
+		{30 * time.Second, 0, time.Minute},
+		{10 * time.Minute, 15 * time.Minute, 15 * time.Minute},
+	} {
+		if rateWindow := getRateWindow(data.window, data.granularity); rateWindow != data.expected {
+			t.Errorf("window %s with granularity %s: expected %s but got %s", data.window, data.granularity, data.expected, rateWindow)
+		}
+	}
+}
+
+func TestAzMonitorExecuteRequestValueMultiplier(t *testing.T) {
+	sender := &testAzMonitorSender{responses: []testAzMonitorSenderResponse{
+		{statusCode: http.StatusOK, body: newTestAzMonitorResponse([]insights.MetricValue{{Average: float64Ptr(5000)}})},
+	}}
+	request := newTestAzMonitorRequest()
+	request.ValueMultiplier = 0.001
+
+	value, err := executeRequest(context.Background(), newTestAzMonitorClient(sender), &request)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if value != 5 {
+		t.Errorf("Expected 5000 * 0.001 to be 5 but got %v", value)
+	}
+}
+
+type azMonitorFilterTestData struct {
+	filter  string
+	isError bool
+}
+
+var testAzMonitorFilterData = []azMonitorFilterTestData{
+	{"", false},
+	{"namespace eq 'default'", false},
+	{"ApiName eq 'GetBlob' and ResponseType eq 'Success'", false},
+	{"EntityName eq 'orders' or EntityName eq 'invoices'", false},
+	{"EntityName eq '*'", false},
+	{"EntityName EQ 'orders' AND Region ne 'west'", false},
+	{"Name eq 'it''s'", false},
+	{"namespace eq default", true},
+	{"namespace = 'default'", true},
+	{"namespace eq 'default' and", true},
+	{"eq 'default'", true},
+	{"namespace eq 'default", true},
+}
+
+func TestAzMonitorValidateMetricFilter(t *testing.T) {
+	for _, testData := range testAzMonitorFilterData {
+		err := validateMetricFilter(testData.filter)
+		if err != nil && !testData.isError {
+			t.Errorf("%q: expected success but got error %v", testData.filter, err)
+		}
+		if testData.isError && err == nil {
+			t.Errorf("%q: expected error but got success", testData.filter)
+		}
+	}
+}
+
+func TestAzMonitorCloseIsIdempotent(t *testing.T) {
+	scaler := azureMonitorScaler{metadata: &azureMonitorMetadata{}, httpClient: newAzureMonitorHTTPClient("")}
+	for i := 0; i < 3; i++ {
+		if err := scaler.Close(); err != nil {
+			t.Errorf("Expected Close to succeed but got %v", err)
+		}
+	}
+
+	scaler = azureMonitorScaler{metadata: &azureMonitorMetadata{}}
+	if err := scaler.Close(); err != nil {
+		t.Errorf("Expected Close without an HTTP client to succeed but got %v", err)
+	}
+}
+
+func TestAzMonitorCloseKeepsSharedConnections(t *testing.T) {
+	var connections int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	get := func(client *http.Client) {
+		response, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal("Expected success but got error", err)
+		}
+		_, _ = io.Copy(ioutil.Discard, response.Body)
+		response.Body.Close()
+	}
+
+	// the scalers of every poll share the client, closing one keeps the connection of the others
+	shared := getAzureMonitorHTTPClient("")
+	get(shared)
+	scaler := azureMonitorScaler{metadata: &azureMonitorMetadata{}, httpClient: shared}
+	if err := scaler.Close(); err != nil {
+		t.Fatal("Expected Close to succeed but got", err)
+	}
+	get(shared)
+	if count := atomic.LoadInt32(&connections); count != 1 {
+		t.Errorf("Expected the shared client to reuse its connection after Close but it opened %d", count)
+	}
+
+	// a client of the scaler alone is released
+	own := newAzureMonitorHTTPClient("")
+	get(own)
+	scaler = azureMonitorScaler{metadata: &azureMonitorMetadata{}, httpClient: own}
+	if err := scaler.Close(); err != nil {
+		t.Fatal("Expected Close to succeed but got", err)
+	}
+	get(own)
+	if count := atomic.LoadInt32(&connections); count != 3 {
+		t.Errorf("Expected Close to release the connection of the scaler's own client but got %d connections", count)
+	}
+}
+
+func TestAzMonitorEndpointOverride(t *testing.T) {
+	var requestedPath string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestedPath = r.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(newTestAzMonitorResponse([]insights.MetricValue{{Average: float64Ptr(3)}}))
+	}))
+	defer server.Close()
+
+	metadata := &azureMonitorMetadata{subscriptionID: "456", clientID: "override-id", clientPassword: "password", tenantID: "tenant", endpointOverride: server.URL}
+	client, err := createMetricsClient(metadata, nil)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if client.BaseURI != server.URL {
+		t.Errorf("Expected BaseURI %s but got %s", server.URL, client.BaseURI)
+	}
+
+	// the test server does not need a token
+	client.Authorizer = autorest.NullAuthorizer{}
+	value, err := getAzureMetric(context.Background(), client, newTestAzMonitorRequest())
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if value.Value != 3 {
+		t.Errorf("Expected 3 but got %v", value.Value)
+	}
+	if !strings.HasPrefix(requestedPath, "/subscriptions/456/resourceGroups/test/providers/test/resource/uri") {
+		t.Errorf("Expected the metrics request on the test server but got path %s", requestedPath)
+	}
+}
+
+func TestAzMonitorUserAgent(t *testing.T) {
+	var userAgent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(newTestAzMonitorResponse([]insights.MetricValue{{Average: float64Ptr(3)}}))
+	}))
+	defer server.Close()
+
+	metadata := &azureMonitorMetadata{subscriptionID: "456", clientID: "agent-id", clientPassword: "password", tenantID: "tenant", endpointOverride: server.URL, userAgentSuffix: "cluster/prod"}
+	client, err := createMetricsClient(metadata, nil)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+
+	client.Authorizer = autorest.NullAuthorizer{}
+	if _, err := getAzureMetric(context.Background(), client, newTestAzMonitorRequest()); err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	expected := "keda/" + version.Version + " azure-monitor-scaler cluster/prod"
+	if !strings.Contains(userAgent, expected) {
+		t.Errorf("Expected User-Agent to contain %q but got %q", expected, userAgent)
+	}
+}
+
+func TestAzMonitorExtractValueNoMetricData(t *testing.T) {
+	var nilData []insights.MetricValue
+	response := newTestAzMonitorResponse(nilData)
+	_, err := extractValue(newTestAzMonitorRequest(), response)
+	if !errors.Is(err, ErrNoMetricData) {
+		t.Errorf("Expected ErrNoMetricData for a timeseries without data but got %v", err)
+	}
+
+	sender := &testAzMonitorSender{responses: []testAzMonitorSenderResponse{
+		{statusCode: http.StatusOK, body: response},
+	}}
+	request := newTestAzMonitorRequest()
+	_, err = executeRequest(context.Background(), newTestAzMonitorClient(sender), &request)
+	if !errors.Is(err, ErrNoMetricData) {
+		t.Errorf("Expected ErrNoMetricData to be preserved by executeRequest but got %v", err)
+	}
+
+	_, err = extractValue(newTestAzMonitorRequest(), newTestAzMonitorResponse([]insights.MetricValue{{Total: float64Ptr(1)}}))
+	if errors.Is(err, ErrNoMetricData) {
+		t.Errorf("Expected a missing aggregation not to be reported as ErrNoMetricData but got %v", err)
+	}
+}
+
+type testAzMonitorLogEntry struct {
+	level         int
+	msg           string
+	keysAndValues []interface{}
+}
+
+// testAzMonitorLogger records every Info call regardless of verbosity, along with the V level it was logged at
+type testAzMonitorLogger struct {
+	entries *[]testAzMonitorLogEntry
+	level   int
+}
+
+func (l testAzMonitorLogger) Info(msg string, keysAndValues ...interface{}) {
+	*l.entries = append(*l.entries, testAzMonitorLogEntry{level: l.level, msg: msg, keysAndValues: keysAndValues})
+}
+func (l testAzMonitorLogger) Enabled() bool                                             { return true }
+func (l testAzMonitorLogger) Error(err error, msg string, keysAndValues ...interface{}) {}
+func (l testAzMonitorLogger) V(level int) logr.InfoLogger {
+	return testAzMonitorLogger{entries: l.entries, level: l.level + level}
+}
+func (l testAzMonitorLogger) WithValues(keysAndValues ...interface{}) logr.Logger { return l }
+func (l testAzMonitorLogger) WithName(name string) logr.Logger                    { return l }
+
+func TestAzMonitorExtractValueStructuredLogging(t *testing.T) {
+	entries := []testAzMonitorLogEntry{}
+	previousLog := azureMonitorLog
+	azureMonitorLog = testAzMonitorLogger{entries: &entries}
+	defer func() { azureMonitorLog = previousLog }()
+
+	_, err := extractValue(newTestAzMonitorRequest(), newTestAzMonitorResponse([]insights.MetricValue{{Average: float64Ptr(3)}}))
+	if err != nil {
+		t.Fatalf("Expected success but got %v", err)
+	}
+	if len(entries) == 0 {
+		t.Fatal("Expected the metric value to be logged")
+	}
+
+	entry := entries[len(entries)-1]
+	keys := map[string]interface{}{}
+	for i := 0; i+1 < len(entry.keysAndValues); i += 2 {
+		keys[entry.keysAndValues[i].(string)] = entry.keysAndValues[i+1]
+	}
+	for _, key := range []string{"resourceURI", "aggregation", "value"} {
+		if _, ok := keys[key]; !ok {
+			t.Errorf("Expected log entry %q to carry key %s but got %v", entry.msg, key, entry.keysAndValues)
+		}
+	}
+	if keys["value"] != float64(3) {
+		t.Errorf("Expected logged value 3 but got %v", keys["value"])
+	}
+}
+
+func newTestAzMonitorDimensionSeries(dimension, value string, data ...insights.MetricValue) insights.TimeSeriesElement {
+	metadataValues := []insights.MetadataValue{{Name: &insights.LocalizableString{Value: &dimension}, Value: &value}}
+	return insights.TimeSeriesElement{Metadatavalues: &metadataValues, Data: &data}
+}
+
+func TestAzMonitorExtractValuesByDimension(t *testing.T) {
+	timeseries := []insights.TimeSeriesElement{
+		newTestAzMonitorDimensionSeries("EntityName", "orders", insights.MetricValue{Total: float64Ptr(3)}, insights.MetricValue{Total: float64Ptr(5)}),
+		newTestAzMonitorDimensionSeries("entityname", "invoices", insights.MetricValue{Total: float64Ptr(2)}, insights.MetricValue{}),
+		newTestAzMonitorDimensionSeries("EntityName", "empty", insights.MetricValue{}),
+	}
+	metrics := []insights.Metric{{Timeseries: &timeseries}}
+
+	request := newTestAzMonitorRequest()
+	request.Aggregation = "Total"
+	request.DimensionGroupBy = "EntityName"
+	values, err := extractValuesByDimension(request, insights.Response{Value: &metrics})
+	if err != nil {
+		t.Fatalf("Expected success but got %v", err)
+	}
+
+	expected := map[string]float64{"orders": 5, "invoices": 2}
+	if len(values) != len(expected) {
+		t.Errorf("Expected %v but got %v", expected, values)
+	}
+	for dimension, value := range expected {
+		if values[dimension] != value {
+			t.Errorf("Expected %v for dimension %s but got %v", value, dimension, values[dimension])
+		}
+	}
+
+	emptyTimeseries := []insights.TimeSeriesElement{newTestAzMonitorDimensionSeries("EntityName", "orders", insights.MetricValue{})}
+	emptyMetrics := []insights.Metric{{Timeseries: &emptyTimeseries}}
+	if _, err := extractValuesByDimension(request, insights.Response{Value: &emptyMetrics}); !errors.Is(err, ErrNoMetricData) {
+		t.Errorf("Expected ErrNoMetricData but got %v", err)
+	}
+}
+
+func TestAzMonitorDimensionFilter(t *testing.T) {
+	request := newTestAzMonitorRequest()
+	request.DimensionGroupBy = "EntityName"
+	if filter := request.dimensionFilter(); filter != "EntityName eq '*'" {
+		t.Errorf("Expected wildcard filter but got %s", filter)
+	}
+
+	request.Filter = "Status eq 'Active'"
+	if filter := request.dimensionFilter(); filter != "Status eq 'Active' and EntityName eq '*'" {
+		t.Errorf("Expected the wildcard to be added to the filter but got %s", filter)
+	}
+}
+
+func TestAzMonitorValueCache(t *testing.T) {
+	cache := &azureMonitorValueCache{entries: map[string]azureMonitorCachedValue{}}
+	calls := 0
+	query := func() (float64, error) {
+		calls++
+		return float64(calls), nil
+	}
+
+	for i := 0; i < 3; i++ {
+		value, err := cache.get("metric", time.Minute, query)
+		if err != nil {
+			t.Fatal("Expected success but got error", err)
+		}
+		if value != 1 {
+			t.Errorf("Expected the cached value 1 but got %v", value)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected a single query within the ttl but got %d", calls)
+	}
+
+	if value, _ := cache.get("other", time.Minute, query); value != 2 {
+		t.Errorf("Expected a different key to be queried but got %v", value)
+	}
+
+	if _, err := cache.get("expiring", time.Millisecond, query); err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if value, _ := cache.get("expiring", time.Millisecond, query); value != 4 {
+		t.Errorf("Expected an expired entry to be queried again but got %v", value)
+	}
+
+	failing := func() (float64, error) {
+		calls++
+		return 0, errors.New("throttled")
+	}
+	if _, err := cache.get("failing", time.Minute, failing); err == nil {
+		t.Error("Expected the query error to be returned")
+	}
+	if value, err := cache.get("failing", time.Minute, query); err != nil || value != 6 {
+		t.Errorf("Expected errors not to be cached but got %v, %v", value, err)
+	}
+}
+
+func TestAzMonitorValueCacheConcurrent(t *testing.T) {
+	cache := &azureMonitorValueCache{entries: map[string]azureMonitorCachedValue{}}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := strconv.Itoa(i % 4)
+			if _, err := cache.get(key, time.Minute, func() (float64, error) { return 1, nil }); err != nil {
+				t.Error("Expected success but got error", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(cache.entries) != 4 {
+		t.Errorf("Expected 4 cached keys but got %d", len(cache.entries))
+	}
+}
+
+func TestAzMonitorValueCacheDropsExpired(t *testing.T) {
+	cache := &azureMonitorValueCache{entries: map[string]azureMonitorCachedValue{}}
+	query := func() (float64, error) { return 1, nil }
+	if _, err := cache.get("removed", time.Millisecond, query); err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err := cache.get("other", time.Minute, query); err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if _, ok := cache.entries["removed"]; ok {
+		t.Error("Expected an expired value to be dropped when a new one is stored")
+	}
+}
+
+func TestAzMonitorScalerUsesValueCache(t *testing.T) {
+	metadata := &azureMonitorMetadata{resourceURI: "test/resource/uri", name: "cached", metricCacheTTL: time.Minute}
+	cache := &azureMonitorValueCache{entries: map[string]azureMonitorCachedValue{}}
+	cache.entries[getAzureMonitorRequestSignature(metadata)] = azureMonitorCachedValue{value: 42, expires: time.Now().Add(time.Minute)}
+
+	// without credentials a query would fail, so getting the value shows the client was not called
+	scaler := azureMonitorScaler{metadata: metadata, valueCache: cache}
+	value, err := scaler.getMetricValue(context.Background())
+	if err != nil {
+		t.Fatal("Expected the cached value but got error", err)
+	}
+	if value != 42 {
+		t.Errorf("Expected 42 but got %v", value)
+	}
+
+	other := *metadata
+	other.filter = "EntityName eq 'orders'"
+	if getAzureMonitorRequestSignature(&other) == getAzureMonitorRequestSignature(metadata) {
+		t.Error("Expected a different filter to change the request signature")
+	}
+}
+
+func TestAzMonitorRequestSignatureIdentity(t *testing.T) {
+	metadata := &azureMonitorMetadata{resourceURI: "test/resource/uri", name: "metric", tenantID: "tenant", clientID: "client", clientPassword: "password"}
+	signature := getAzureMonitorRequestSignature(metadata)
+
+	rotated := *metadata
+	rotated.clientPassword = "rotated"
+	if getAzureMonitorRequestSignature(&rotated) != signature {
+		t.Error("Expected a rotated client secret to keep the identity and the request signature")
+	}
+
+	for name, identity := range map[string]func(*azureMonitorMetadata){
+		"tenant":           func(m *azureMonitorMetadata) { m.tenantID = "other-tenant" },
+		"client":           func(m *azureMonitorMetadata) { m.clientID = "other-client" },
+		"pod identity":     func(m *azureMonitorMetadata) { m.podIdentity = "azure" },
+		"certificate":      func(m *azureMonitorMetadata) { m.clientCertificate = "/certs/client.pem" },
+		"secret file":      func(m *azureMonitorMetadata) { m.clientSecretFile = "/secrets/client" },
+		"token audience":   func(m *azureMonitorMetadata) { m.tokenAudience = "https://management.core.windows.net/" },
+		"app insights key": func(m *azureMonitorMetadata) { m.metricSource = appInsightsMetricSource; m.appInsightsAPIKey = "key" },
+	} {
+		other := *metadata
+		identity(&other)
+		otherSignature := getAzureMonitorRequestSignature(&other)
+		if otherSignature == signature {
+			t.Errorf("%s: expected a different identity to change the request signature", name)
+		}
+		if strings.Contains(otherSignature, "password") || strings.Contains(otherSignature, "|key|") {
+			t.Errorf("%s: expected no secret in the request signature but got %s", name, otherSignature)
+		}
+	}
+
+	keyed := *metadata
+	keyed.metricSource, keyed.appInsightsAPIKey = appInsightsMetricSource, "key"
+	otherKey := keyed
+	otherKey.appInsightsAPIKey = "other-key"
+	if getAzureMonitorRequestSignature(&keyed) == getAzureMonitorRequestSignature(&otherKey) {
+		t.Error("Expected app insights triggers with different API keys to have different request signatures")
+	}
+}
+
+func TestAzMonitorExtractValueTimestamp(t *testing.T) {
+	entries := []testAzMonitorLogEntry{}
+	previousLog := azureMonitorLog
+	azureMonitorLog = testAzMonitorLogger{entries: &entries}
+	defer func() { azureMonitorLog = previousLog }()
+
+	now := time.Now().UTC().Truncate(time.Minute)
+	older := date.Time{Time: now.Add(-2 * time.Minute)}
+	newer := date.Time{Time: now.Add(-time.Minute)}
+	latest := date.Time{Time: now}
+
+	request := newTestAzMonitorRequest()
+	request.Window = 5 * time.Minute
+	value, err := extractValue(request, newTestAzMonitorResponse(
+		[]insights.MetricValue{{TimeStamp: &older, Average: float64Ptr(1)}, {TimeStamp: &newer, Average: float64Ptr(2)}, {TimeStamp: &latest}},
+	))
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if !value.Timestamp.Equal(newer.Time) {
+		t.Errorf("Expected the timestamp of the newest data point with a value %s but got %s", newer, value.Timestamp)
+	}
+	for _, entry := range entries {
+		if strings.Contains(entry.msg, "stale") {
+			t.Errorf("Expected a fresh data point not to be flagged but got %q", entry.msg)
+		}
+	}
+
+	stale := date.Time{Time: time.Now().Add(-10 * time.Minute)}
+	value, err = extractValue(request, newTestAzMonitorResponse([]insights.MetricValue{{TimeStamp: &stale, Average: float64Ptr(1)}}))
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if !isStaleMetricValue(value, request.Window, time.Now()) {
+		t.Error("Expected a data point older than the window to be stale")
+	}
+	flagged := false
+	for _, entry := range entries {
+		flagged = flagged || strings.Contains(entry.msg, "stale")
+	}
+	if !flagged {
+		t.Error("Expected a stale data point to be logged")
+	}
+
+	if isStaleMetricValue(azureMetricValue{Value: 1}, request.Window, time.Now()) {
+		t.Error("Expected a data point without timestamp not to be stale")
+	}
+}
+
+func TestAzMonitorGetAzureMetricDataPointCountAggregation(t *testing.T) {
+	sender := &testAzMonitorSender{responses: []testAzMonitorSenderResponse{
+		{statusCode: http.StatusOK, body: newTestAzMonitorResponse([]insights.MetricValue{{Count: int64Ptr(5)}, {Count: int64Ptr(3)}, {}})},
+	}}
+	request := newTestAzMonitorRequest()
+	request.Aggregation = "DataPointCount"
+
+	value, err := getAzureMetric(context.Background(), newTestAzMonitorClient(sender), request)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if value.Value != 2 {
+		t.Errorf("Expected 2 data points but got %v", value.Value)
+	}
+	if aggregation := sender.requests[0].URL.Query().Get("aggregation"); aggregation != "Average,Total,Maximum,Minimum,Count" {
+		t.Errorf("Expected every aggregation to be requested but got %s", aggregation)
+	}
+}
+
+type testAzMonitorDefinitionsLister struct {
+	calls       int
+	definitions []insights.MetricDefinition
+	err         error
+}
+
+func (l *testAzMonitorDefinitionsLister) List(ctx context.Context, resourceURI string, metricnamespace string) (insights.MetricDefinitionCollection, error) {
+	l.calls++
+	return insights.MetricDefinitionCollection{Value: &l.definitions}, l.err
+}
+
+func newTestAzMonitorDefinition(name string, dimensions ...string) insights.MetricDefinition {
+	localizedDimensions := make([]insights.LocalizableString, 0, len(dimensions))
+	for i := range dimensions {
+		localizedDimensions = append(localizedDimensions, insights.LocalizableString{Value: &dimensions[i]})
+	}
+	return insights.MetricDefinition{Name: &insights.LocalizableString{Value: &name}, Dimensions: &localizedDimensions}
+}
+
+func TestAzMonitorValidateMetricDefinition(t *testing.T) {
+	azureMonitorMetricDefinitions = newAzureMonitorMetricDefinitionCache(defaultAzureMonitorMetricDefinitionsTTL)
+	lister := &testAzMonitorDefinitionsLister{definitions: []insights.MetricDefinition{
+		newTestAzMonitorDefinition("ActiveMessages", "EntityName"),
+		newTestAzMonitorDefinition("metric", "EntityName", "Status"),
+	}}
+
+	request := newTestAzMonitorRequest()
+	request.Filter = "EntityName eq 'orders' and status eq 'a eq ''b'''"
+	if err := validateMetricDefinition(context.Background(), lister, request); err != nil {
+		t.Errorf("Expected supported dimensions to be valid but got %v", err)
+	}
+
+	request.Filter = "Region eq 'west'"
+	err := validateMetricDefinition(context.Background(), lister, request)
+	if err == nil || !strings.Contains(err.Error(), "dimension Region not supported") {
+		t.Errorf("Expected an unknown dimension error but got %v", err)
+	}
+
+	request.Filter = ""
+	request.DimensionGroupBy = "Region"
+	if err := validateMetricDefinition(context.Background(), lister, request); err == nil {
+		t.Error("Expected an unknown dimensionGroupBy to be rejected")
+	}
+
+	request.DimensionGroupBy = ""
+	request.MetricName = "missing"
+	err = validateMetricDefinition(context.Background(), lister, request)
+	if err == nil || !strings.Contains(err.Error(), "ActiveMessages") {
+		t.Errorf("Expected an unknown metric error listing the available metrics but got %v", err)
+	}
+
+	if lister.calls != 1 {
+		t.Errorf("Expected the definitions to be listed once per resource but got %d calls", lister.calls)
+	}
+}
+
+func TestAzMonitorValidateMetricDefinitionAggregation(t *testing.T) {
+	azureMonitorMetricDefinitions = newAzureMonitorMetricDefinitionCache(defaultAzureMonitorMetricDefinitionsTTL)
+	definition := newTestAzMonitorDefinition("metric")
+	definition.SupportedAggregationTypes = &[]insights.AggregationType{insights.Total, insights.Maximum}
+	lister := &testAzMonitorDefinitionsLister{definitions: []insights.MetricDefinition{definition, newTestAzMonitorDefinition("undocumented")}}
+
+	request := newTestAzMonitorRequest()
+	for _, aggregation := range []insights.AggregationType{insights.Total, "maximum", azureMonitorLastAggregation, azureMonitorDataPointCountAggregation} {
+		request.Aggregation = aggregation
+		if err := validateMetricDefinition(context.Background(), lister, request); err != nil {
+			t.Errorf("%s: expected a supported aggregation to be valid but got %v", aggregation, err)
+		}
+	}
+
+	request.Aggregation = insights.Average
+	err := validateMetricDefinition(context.Background(), lister, request)
+	if err == nil || !strings.Contains(err.Error(), "aggregation Average not supported by metric metric. Supported aggregations: Total, Maximum") {
+		t.Errorf("Expected an unsupported aggregation error listing the supported ones but got %v", err)
+	}
+
+	// a definition without supported aggregations is not checked
+	request.MetricName = "undocumented"
+	if err := validateMetricDefinition(context.Background(), lister, request); err != nil {
+		t.Errorf("Expected a definition without supported aggregations to be valid but got %v", err)
+	}
+}
+
+func TestAzMonitorValidateMetricDefinitionListError(t *testing.T) {
+	azureMonitorMetricDefinitions = newAzureMonitorMetricDefinitionCache(defaultAzureMonitorMetricDefinitionsTTL)
+	lister := &testAzMonitorDefinitionsLister{err: errors.New("forbidden")}
+
+	for i := 0; i < 2; i++ {
+		if err := validateMetricDefinition(context.Background(), lister, newTestAzMonitorRequest()); err == nil {
+			t.Error("Expected the list error to be returned")
+		}
+	}
+	if lister.calls != 2 {
+		t.Errorf("Expected failed lists not to be cached but got %d calls", lister.calls)
+	}
+}
+
+func TestAzMonitorNewAzureMonitorMetadata(t *testing.T) {
+	authParams := map[string]string{"activeDirectoryClientId": "id", "activeDirectoryClientPassword": "password"}
+
+	full := map[string]string{
+		"resourceURI": "Microsoft.Web/sites/mysite", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456",
+		"resourceGroupName": "test", "metricName": "Requests", "metricNamespace": "microsoft.web/sites", "metricFilter": "Instance eq '*'",
+		"metricAggregationType": "Total", "metricAggregationInterval": "00:10:00", "metricAggregationDelay": "00:01:00",
+		"aggregationGranularity": "PT1M", "cloud": "AzurePublicCloud", "maxRetries": "1", "maxMetricRetention": "720h", "targetValue": "5",
+	}
+	meta, err := NewAzureMonitorMetadata(full, authParams)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if meta.aggregationInterval != "00:10:00" || meta.maxMetricRetention != 720*time.Hour || meta.maxRetries != 1 {
+		t.Errorf("Expected the configured settings to be kept but got interval %s, retention %s and %d retries", meta.aggregationInterval, meta.maxMetricRetention, meta.maxRetries)
+	}
+
+	minimal := map[string]string{"resourceURI": "Microsoft.Web/sites/mysite", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "Requests", "metricAggregationType": "Average", "targetValue": "5"}
+	meta, err = NewAzureMonitorMetadata(minimal, authParams)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if meta.aggregationInterval != "00:05:00" {
+		t.Errorf("Expected the default window of 00:05:00 but got %q", meta.aggregationInterval)
+	}
+	if meta.maxMetricRetention != defaultAzureMonitorMaxRetention || meta.maxRetries != defaultAzureMonitorMaxRetries || meta.cloud != defaultAzureMonitorCloud {
+		t.Errorf("Expected the default retention, retries and cloud but got %s, %d and %s", meta.maxMetricRetention, meta.maxRetries, meta.cloud)
+	}
+
+	invalid := []struct {
+		name     string
+		metadata map[string]string
+		expected string
+	}{
+		{"unknown aggregation", map[string]string{"metricAggregationType": "Median"}, "metricAggregationType Median not supported"},
+		{"missing tenant", map[string]string{"tenantId": ""}, "no tenantId given"},
+		{"window beyond the retention", map[string]string{"metricAggregationInterval": "02:00:00", "maxMetricRetention": "1h"}, "reaches back further"},
+		{"short resourceURI", map[string]string{"resourceURI": "Microsoft.Web/sites"}, "resourceURI must be in the form"},
+	}
+	for _, data := range invalid {
+		metadata := map[string]string{}
+		for key, value := range minimal {
+			metadata[key] = value
+		}
+		for key, value := range data.metadata {
+			metadata[key] = value
+		}
+		if _, err := NewAzureMonitorMetadata(metadata, authParams); err == nil || !strings.Contains(err.Error(), data.expected) {
+			t.Errorf("%s: expected an error containing %q but got %v", data.name, data.expected, err)
+		}
+	}
+}
+
+func TestAzMonitorNewAzureMonitorMetadataJoinsErrors(t *testing.T) {
+	authParams := map[string]string{"activeDirectoryClientId": "id", "activeDirectoryClientPassword": "password"}
+	metadata := map[string]string{"resourceURI": "Microsoft.Compute/virtualMachines", "resourceNames": "vm-0,vm-1", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "metricAggregationInterval": "02:00:00", "maxMetricRetention": "1h", "targetValue": "5"}
+
+	_, err := NewAzureMonitorMetadata(metadata, authParams)
+	if err == nil {
+		t.Fatal("Expected error but got success")
+	}
+	if !strings.HasPrefix(err.Error(), "invalid azure monitor metadata: ") {
+		t.Errorf("Expected an invalid metadata error but got %v", err)
+	}
+	// both resources have the same window, the error is reported once
+	if count := strings.Count(err.Error(), "reaches back further"); count != 1 {
+		t.Errorf("Expected the error once but got it %d times in %v", count, err)
+	}
+}
+
+func TestAzMonitorMetadataString(t *testing.T) {
+	metadata := map[string]string{"resourceURI": "Microsoft.Web/sites/mysite", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "Requests", "metricAggregationType": "Total", "metricAggregationInterval": "00:10:00", "metricFilter": "Instance eq 'a'", "targetValue": "5"}
+	authParams := map[string]string{"activeDirectoryClientId": "client-id", "activeDirectoryClientPassword": "super-secret-password"}
+	meta, err := parseAzureMonitorMetadata(metadata, map[string]string{}, authParams, "")
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+
+	printed := meta.String()
+	if strings.Contains(printed, "super-secret-password") {
+		t.Errorf("Expected the client password to be redacted but got %s", printed)
+	}
+	for _, expected := range []string{"metricName=Requests", "resourceURI=Microsoft.Web/sites/mysite", "aggregation=Total", "aggregationInterval=00:10:00", "filter=Instance eq 'a'", "clientId=client-id", "clientPassword=<redacted>"} {
+		if !strings.Contains(printed, expected) {
+			t.Errorf("Expected %q in %s", expected, printed)
+		}
+	}
+
+	request, err := createMetricsRequest(meta)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	printed = request.String()
+	for _, expected := range []string{"metricName=Requests", "resourceURI=/subscriptions/00000000-0000-0000-0000-000000000456/resourceGroups/test/providers/Microsoft.Web/sites/mysite", "aggregation=Total", "timespan=" + request.Timespan, "filter=Instance eq 'a'"} {
+		if !strings.Contains(printed, expected) {
+			t.Errorf("Expected %q in %s", expected, printed)
+		}
+	}
+}
+
+func TestAzMonitorTestAzureMonitorTriggerParseError(t *testing.T) {
+	_, err := TestAzureMonitorTrigger(context.Background(), map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "targetValue": "5"})
+	if err == nil || !strings.Contains(err.Error(), "error parsing azure monitor metadata") {
+		t.Errorf("Expected a parse error but got %v", err)
+	}
+}
+
+func TestAzMonitorTestAzureMonitorTrigger(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(newTestAzMonitorResponse([]insights.MetricValue{{Average: float64Ptr(12.5)}}))
+	}))
+	defer server.Close()
+
+	// the test server does not need a token
+	seedTestAzMonitorAuthorizer("trigger-tenant", "trigger-id", "trigger-password", autorest.NullAuthorizer{})
+
+	value, err := TestAzureMonitorTrigger(context.Background(), map[string]string{
+		"resourceURI":                   "Microsoft.ServiceBus/namespaces/test",
+		"tenantId":                      "trigger-tenant",
+		"subscriptionId":                "00000000-0000-0000-0000-000000000456",
+		"resourceGroupName":             "test",
+		"metricName":                    "ActiveMessages",
+		"metricAggregationType":         "Average",
+		"activeDirectoryClientId":       "trigger-id",
+		"activeDirectoryClientPassword": "trigger-password",
+		"endpointOverride":              server.URL,
+		"targetValue":                   "5",
+	})
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if value != 13 {
+		t.Errorf("Expected 12.5 rounded by the default roundingMode but got %v", value)
+	}
+}
+
+func TestAzMonitorCheckPollingInterval(t *testing.T) {
+	entries := []testAzMonitorLogEntry{}
+	logger := testAzMonitorLogger{entries: &entries}
+	scaler := &azureMonitorScaler{metadata: &azureMonitorMetadata{}}
+
+	if scaler.MinRecommendedInterval() != 30*time.Second {
+		t.Errorf("Expected a minimum recommended interval of half the default granularity but got %s", scaler.MinRecommendedInterval())
+	}
+
+	// the default pollingInterval of a ScaledObject
+	if !CheckPollingInterval(logger, scaler, 30*time.Second) || len(entries) != 0 {
+		t.Errorf("Expected no warning for the default polling interval but got %v", entries)
+	}
+
+	if CheckPollingInterval(logger, scaler, 10*time.Second) {
+		t.Error("Expected a polling interval below half the granularity to be reported")
+	}
+	if len(entries) != 1 || !strings.Contains(entries[0].msg, "pollingInterval is shorter") {
+		t.Errorf("Expected a warning log for a polling interval below half the granularity but got %v", entries)
+	}
+}
+
+type azMonitorISO8601DurationTestData struct {
+	value            string
+	expectedDuration time.Duration
+	isError          bool
+}
+
+var testAzMonitorISO8601Durations = []azMonitorISO8601DurationTestData{
+	{"PT1M", time.Minute, false},
+	{"PT5M", 5 * time.Minute, false},
+	{"pt1h", time.Hour, false},
+	{"PT1H30M", 90 * time.Minute, false},
+	{"PT30S", 30 * time.Second, false},
+	{"P1D", 24 * time.Hour, false},
+	{"P1DT12H", 36 * time.Hour, false},
+	{"", 0, true},
+	{"P", 0, true},
+	{"PT", 0, true},
+	{"P1DT", 0, true},
+	{"PT0M", 0, true},
+	{"1M", 0, true},
+	{"PT1.5M", 0, true},
+	{"00:01:00", 0, true},
+}
+
+func TestAzMonitorParseISO8601Duration(t *testing.T) {
+	for _, testData := range testAzMonitorISO8601Durations {
+		duration, err := parseISO8601Duration("aggregationGranularity", testData.value)
+		if err != nil && !testData.isError {
+			t.Errorf("%q: expected success but got error %v", testData.value, err)
+		}
+		if testData.isError {
+			if err == nil {
+				t.Errorf("%q: expected error but got success", testData.value)
+			}
+			continue
+		}
+		if duration != testData.expectedDuration {
+			t.Errorf("%q: expected %s but got %s", testData.value, testData.expectedDuration, duration)
+		}
+	}
+}
+
+func TestAzMonitorGetAzureMetricGranularity(t *testing.T) {
+	for _, granularity := range []string{"", "PT1M"} {
+		sender := &testAzMonitorSender{responses: []testAzMonitorSenderResponse{
+			{statusCode: http.StatusOK, body: newTestAzMonitorResponse([]insights.MetricValue{{Average: float64Ptr(1)}})},
+		}}
+		request := newTestAzMonitorRequest()
+		request.Granularity = granularity
+
+		if _, err := getAzureMetric(context.Background(), newTestAzMonitorClient(sender), request); err != nil {
+			t.Fatal("Expected success but got error", err)
+		}
+		if interval := sender.requests[0].URL.Query().Get("interval"); interval != granularity {
+			t.Errorf("Expected interval %q to be forwarded but got %q", granularity, interval)
+		}
+	}
+}
+
+func TestAzMonitorMinRecommendedIntervalGranularity(t *testing.T) {
+	scaler := &azureMonitorScaler{metadata: &azureMonitorMetadata{granularity: 5 * time.Minute}}
+	if interval := scaler.MinRecommendedInterval(); interval != 150*time.Second {
+		t.Errorf("Expected half the aggregation granularity as minimum recommended interval but got %s", interval)
+	}
+}
+
+func newTestAzMonitorDefinitionsClient(sender *testAzMonitorSender) insights.MetricDefinitionsClient {
+	client := insights.NewMetricDefinitionsClient("456")
+	client.Sender = sender
+	client.RetryAttempts = 1
+	client.RetryDuration = 0
+	return client
+}
+
+func TestAzMonitorCheckMetricDefinitionsAccess(t *testing.T) {
+	sender := &testAzMonitorSender{responses: []testAzMonitorSenderResponse{
+		{statusCode: http.StatusOK, body: insights.MetricDefinitionCollection{Value: &[]insights.MetricDefinition{newTestAzMonitorDefinition("metric")}}},
+	}}
+	client := newTestAzMonitorDefinitionsClient(sender)
+
+	for i := 0; i < 2; i++ {
+		if err := checkMetricDefinitionsAccess(context.Background(), client, newTestAzMonitorRequest()); err != nil {
+			t.Fatal("Expected success but got error", err)
+		}
+	}
+	if len(sender.requests) != 2 {
+		t.Errorf("Expected every validation to list the metric definitions but got %d requests", len(sender.requests))
+	}
+	if path := sender.requests[0].URL.Path; !strings.HasSuffix(path, "/providers/microsoft.insights/metricDefinitions") {
+		t.Errorf("Expected a metric definitions request but got %s", path)
+	}
+}
+
+func TestAzMonitorCheckMetricDefinitionsAccessForbidden(t *testing.T) {
+	sender := &testAzMonitorSender{responses: []testAzMonitorSenderResponse{
+		{statusCode: http.StatusForbidden, body: map[string]interface{}{"error": map[string]string{"code": "AuthorizationFailed", "message": "does not have authorization to perform action 'Microsoft.Insights/metricDefinitions/read'"}}},
+	}}
+
+	err := checkMetricDefinitionsAccess(context.Background(), newTestAzMonitorDefinitionsClient(sender), newTestAzMonitorRequest())
+	if !errors.Is(err, ErrAzureMonitorPermissionDenied) {
+		t.Fatalf("Expected ErrAzureMonitorPermissionDenied but got %v", err)
+	}
+	if !strings.Contains(err.Error(), "AuthorizationFailed") {
+		t.Errorf("Expected the Azure error code in the error but got %v", err)
+	}
+}
+
+func TestAzMonitorCheckMetricDefinitionsAccessError(t *testing.T) {
+	sender := &testAzMonitorSender{responses: []testAzMonitorSenderResponse{
+		{statusCode: http.StatusNotFound, body: map[string]interface{}{"error": map[string]string{"code": "ResourceNotFound", "message": "resource not found"}}},
+	}}
+
+	err := checkMetricDefinitionsAccess(context.Background(), newTestAzMonitorDefinitionsClient(sender), newTestAzMonitorRequest())
+	if err == nil {
+		t.Fatal("Expected error but got success")
+	}
+	if errors.Is(err, ErrAzureMonitorPermissionDenied) {
+		t.Errorf("Expected a missing resource not to be reported as a permission error but got %v", err)
+	}
+}
+
+// newTestAzMonitorSeededMetadata returns a trigger whose authorizer is seeded, so that no token is requested from AAD
+func newTestAzMonitorSeededMetadata(name string, endpointOverride string) *azureMonitorMetadata {
+	metadata := &azureMonitorMetadata{
+		resourceURI:       "test/resource/uri",
+		subscriptionID:    "456",
+		resourceGroupName: "test",
+		name:              "metric",
+		aggregationType:   insights.Average,
+		tenantID:          name + "-tenant",
+		clientID:          name + "-id",
+		clientPassword:    name + "-password",
+		endpointOverride:  endpointOverride,
+	}
+	seedTestAzMonitorAuthorizer(metadata.tenantID, metadata.clientID, metadata.clientPassword, autorest.NullAuthorizer{})
+	return metadata
+}
+
+func TestAzMonitorCheckConnectivity(t *testing.T) {
+	sender := &testAzMonitorSender{responses: []testAzMonitorSenderResponse{
+		{statusCode: http.StatusOK, body: insights.MetricDefinitionCollection{Value: &[]insights.MetricDefinition{newTestAzMonitorDefinition("metric")}}},
+	}}
+
+	if err := checkAzureMonitorConnectivity(context.Background(), newTestAzMonitorSeededMetadata("connectivity", ""), sender); err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if len(sender.requests) != 1 || !strings.HasSuffix(sender.requests[0].URL.Path, "/providers/microsoft.insights/metricDefinitions") {
+		t.Errorf("Expected a single metric definitions request but got %d requests", len(sender.requests))
+	}
+}
+
+func TestAzMonitorCheckConnectivityAuthFailure(t *testing.T) {
+	sender := &testAzMonitorSender{responses: []testAzMonitorSenderResponse{
+		{statusCode: http.StatusUnauthorized, body: map[string]interface{}{"error": map[string]string{"code": "InvalidAuthenticationToken", "message": "the access token is invalid"}}},
+	}}
+
+	err := checkAzureMonitorConnectivity(context.Background(), newTestAzMonitorSeededMetadata("connectivity-auth", ""), sender)
+	if !errors.Is(err, ErrAzureMonitorAuthFailed) {
+		t.Fatalf("Expected ErrAzureMonitorAuthFailed but got %v", err)
+	}
+	if errors.Is(err, ErrAzureMonitorUnreachable) {
+		t.Errorf("Expected an auth failure not to be reported as a network failure but got %v", err)
+	}
+}
+
+func TestAzMonitorCheckConnectivityTimeout(t *testing.T) {
+	server := newSlowAzMonitorServer()
+	defer server.Close()
+
+	previousTimeout := azureMonitorConnectivityTimeout
+	azureMonitorConnectivityTimeout = 50 * time.Millisecond
+	defer func() { azureMonitorConnectivityTimeout = previousTimeout }()
+
+	start := time.Now()
+	err := checkAzureMonitorConnectivity(context.Background(), newTestAzMonitorSeededMetadata("connectivity-timeout", server.URL), server.Client())
+	if !errors.Is(err, ErrAzureMonitorUnreachable) {
+		t.Fatalf("Expected ErrAzureMonitorUnreachable but got %v", err)
+	}
+	if errors.Is(err, ErrAzureMonitorAuthFailed) {
+		t.Errorf("Expected a timeout not to be reported as an auth failure but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the check to return within its timeout but it took %s", elapsed)
+	}
+}
+
+func TestAzMonitorExecuteRequestIgnoreNullValues(t *testing.T) {
+	var nilData []insights.MetricValue
+	emptyResponses := map[string]insights.Response{
+		"empty data":       newTestAzMonitorResponse(nilData),
+		"empty timeseries": {Value: &[]insights.Metric{{Timeseries: &[]insights.TimeSeriesElement{}}}},
+	}
+
+	for name, response := range emptyResponses {
+		for _, ignoreNullValues := range []bool{false, true} {
+			sender := &testAzMonitorSender{responses: []testAzMonitorSenderResponse{
+				{statusCode: http.StatusOK, body: response},
+			}}
+			request := newTestAzMonitorRequest()
+			request.IgnoreNullValues = ignoreNullValues
+
+			value, err := executeRequest(context.Background(), newTestAzMonitorClient(sender), &request)
+			if !ignoreNullValues {
+				if !errors.Is(err, ErrNoMetricData) {
+					t.Errorf("%s: expected ErrNoMetricData without ignoreNullValues but got %v", name, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s: expected success with ignoreNullValues but got error %v", name, err)
+			}
+			if value != 0 {
+				t.Errorf("%s: expected 0 with ignoreNullValues but got %v", name, value)
+			}
+		}
+	}
+}
+
+func TestAzMonitorExtractValueNilPointers(t *testing.T) {
+	var nilData []insights.MetricValue
+	responses := map[string]insights.Response{
+		"nil value":      {},
+		"nil timeseries": {Value: &[]insights.Metric{{}}},
+		"nil data":       {Value: &[]insights.Metric{{Timeseries: &[]insights.TimeSeriesElement{{}}}}},
+		"nil data slice": newTestAzMonitorResponse(nilData),
+	}
+
+	for name, response := range responses {
+		_, err := extractValue(newTestAzMonitorRequest(), response)
+		if err == nil {
+			t.Errorf("%s: expected error but got success", name)
+		}
+	}
+
+	if _, err := extractValue(newTestAzMonitorRequest(), insights.Response{}); errors.Is(err, ErrNoMetricData) || !strings.Contains(err.Error(), "without a metric list") {
+		t.Errorf("Expected a response without a metric list to be reported as such but got %v", err)
+	}
+	if _, err := extractValue(newTestAzMonitorRequest(), insights.Response{Value: &[]insights.Metric{{}}}); !errors.Is(err, ErrNoMetricData) || !strings.Contains(err.Error(), "without a timeseries list") {
+		t.Errorf("Expected a metric without a timeseries list to be reported as such but got %v", err)
+	}
+	if _, err := extractValue(newTestAzMonitorRequest(), insights.Response{Value: &[]insights.Metric{{Timeseries: &[]insights.TimeSeriesElement{{}}}}}); !errors.Is(err, ErrNoMetricData) {
+		t.Errorf("Expected a timeseries without data to be reported as ErrNoMetricData but got %v", err)
+	}
+}
+
+func TestAzMonitorExtractValueEmptyTimeseries(t *testing.T) {
+	response := insights.Response{Value: &[]insights.Metric{{Timeseries: &[]insights.TimeSeriesElement{}}}}
+
+	if _, err := extractValue(newTestAzMonitorRequest(), response); !errors.Is(err, ErrNoMetricData) || !strings.Contains(err.Error(), "without timeseries") {
+		t.Errorf("Expected an empty timeseries list to be reported as without timeseries but got %v", err)
+	}
+
+	request := newTestAzMonitorRequest()
+	request.DimensionGroupBy = "Instance"
+	if _, err := extractValuesByDimension(request, response); !errors.Is(err, ErrNoMetricData) {
+		t.Errorf("Expected an empty timeseries list split by dimension to be reported as ErrNoMetricData but got %v", err)
+	}
+}
+
+type testAzMonitorTaggedResourceLister struct {
+	resourceGroup string
+	filter        string
+	resourceIDs   []string
+	err           error
+}
+
+func (l *testAzMonitorTaggedResourceLister) listResourceIDs(ctx context.Context, resourceGroup string, filter string) ([]string, error) {
+	l.resourceGroup = resourceGroup
+	l.filter = filter
+	return l.resourceIDs, l.err
+}
+
+func TestAzMonitorGetResourceTagFilter(t *testing.T) {
+	filters := map[string]string{
+		"role=worker":   "tagName eq 'role' and tagValue eq 'worker'",
+		"role":          "tagName eq 'role'",
+		"team=o'brien":  "tagName eq 'team' and tagValue eq 'o''brien'",
+		"env = staging": "tagName eq 'env' and tagValue eq 'staging'",
+	}
+	for tagFilter, expected := range filters {
+		if filter := getResourceTagFilter(tagFilter); filter != expected {
+			t.Errorf("%s: expected filter %q but got %q", tagFilter, expected, filter)
+		}
+	}
+}
+
+func TestAzMonitorGetAzureMetricValueByTag(t *testing.T) {
+	resourceValues := map[string]float64{"vm1": 2, "vm2": 5, "vm3": 11}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range resourceValues {
+			if strings.Contains(r.URL.Path, "/virtualMachines/"+name+"/") {
+				_ = json.NewEncoder(w).Encode(newTestAzMonitorResponse([]insights.MetricValue{{Total: float64Ptr(value), Maximum: float64Ptr(value)}}))
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	client := insights.NewMetricsClientWithBaseURI(server.URL, "00000000-0000-0000-0000-000000000456")
+	client.RetryAttempts = 1
+	resourceID := func(group, resourceType, name string) string {
+		return fmt.Sprintf("/subscriptions/00000000-0000-0000-0000-000000000456/resourceGroups/%s/providers/Microsoft.Compute/%s/%s", group, resourceType, name)
+	}
+
+	type tagTestData struct {
+		name          string
+		aggregation   insights.AggregationType
+		resourceType  string
+		resourceIDs   []string
+		expectedValue float64
+		isError       bool
+	}
+	testData := []tagTestData{
+		{"one match", "Total", "", []string{resourceID("group1", "virtualMachines", "vm1")}, 2, false},
+		{"multiple matches summed", "Total", "", []string{resourceID("group1", "virtualMachines", "vm1"), resourceID("group2", "virtualMachines", "vm2"), resourceID("group2", "virtualMachines", "vm3")}, 18, false},
+		{"multiple matches maximum", "Maximum", "", []string{resourceID("group1", "virtualMachines", "vm1"), resourceID("group2", "virtualMachines", "vm3")}, 11, false},
+		{"matches filtered by type", "Total", "Microsoft.Compute/virtualMachines", []string{resourceID("group1", "virtualMachines", "vm1"), resourceID("group1", "disks", "vm2")}, 2, false},
+		{"no matches", "Total", "", []string{}, 0, true},
+		{"no matches of the type", "Total", "Microsoft.Compute/virtualMachineScaleSets", []string{resourceID("group1", "virtualMachines", "vm1")}, 0, true},
+		{"metric error", "Total", "", []string{resourceID("group1", "virtualMachines", "vm1"), resourceID("group1", "virtualMachines", "unknown")}, 0, true},
+	}
+
+	for _, data := range testData {
+		lister := &testAzMonitorTaggedResourceLister{resourceIDs: data.resourceIDs}
+		metadata := &azureMonitorMetadata{
+			subscriptionID:    "00000000-0000-0000-0000-000000000456",
+			resourceGroupName: "group1",
+			resourceTagFilter: "role=worker",
+			resourceType:      data.resourceType,
+			name:              "metric",
+			aggregationType:   data.aggregation,
+		}
+
+		value, err := getAzureMetricValueByTag(context.Background(), metadata, client, lister)
+		if lister.filter != "tagName eq 'role' and tagValue eq 'worker'" || lister.resourceGroup != "group1" {
+			t.Errorf("%s: expected the tag filter within group1 but got %q in %q", data.name, lister.filter, lister.resourceGroup)
+		}
+		if data.isError {
+			if err == nil {
+				t.Errorf("%s: expected error but got success", data.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected success but got error %v", data.name, err)
+			continue
+		}
+		if value != data.expectedValue {
+			t.Errorf("%s: expected %v but got %v", data.name, data.expectedValue, value)
+		}
+	}
+}
+
+func TestAzMonitorGetAzureMetricValueByTagListError(t *testing.T) {
+	lister := &testAzMonitorTaggedResourceLister{err: errors.New("boom")}
+	metadata := &azureMonitorMetadata{subscriptionID: "00000000-0000-0000-0000-000000000456", resourceTagFilter: "role=worker", name: "metric", aggregationType: "Total"}
+	if _, err := getAzureMetricValueByTag(context.Background(), metadata, insights.MetricsClient{}, lister); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("Expected the resources API error but got %v", err)
+	}
+}
+
+func TestAzMonitorDebugLogRawResponse(t *testing.T) {
+	for _, debugLogRawResponse := range []bool{false, true} {
+		entries := []testAzMonitorLogEntry{}
+		previousLog := azureMonitorLog
+		azureMonitorLog = testAzMonitorLogger{entries: &entries}
+
+		response := newTestAzMonitorResponse([]insights.MetricValue{{Average: float64Ptr(3)}})
+		metricID := "/subscriptions/00000000-0000-0000-0000-000000000456/resourceGroups/secret-group/providers/test/resource/uri/providers/Microsoft.Insights/metrics/metric"
+		(*response.Value)[0].ID = &metricID
+		sender := &testAzMonitorSender{responses: []testAzMonitorSenderResponse{{statusCode: http.StatusOK, body: response}}}
+		request := newTestAzMonitorRequest()
+		request.DebugLogRawResponse = debugLogRawResponse
+
+		_, err := getAzureMetric(context.Background(), newTestAzMonitorClient(sender), request)
+		azureMonitorLog = previousLog
+		if err != nil {
+			t.Fatal("Expected success but got error", err)
+		}
+
+		var raw *testAzMonitorLogEntry
+		for i := range entries {
+			if entries[i].msg == "raw azure monitor response" {
+				raw = &entries[i]
+			}
+		}
+		if !debugLogRawResponse {
+			if raw != nil {
+				t.Errorf("Expected the raw response not to be logged without debugLogRawResponse but got %v", raw.keysAndValues)
+			}
+			continue
+		}
+		if raw == nil {
+			t.Fatal("Expected the raw response to be logged with debugLogRawResponse")
+		}
+		if raw.level != 4 {
+			t.Errorf("Expected the raw response to be logged at V(4) but got V(%d)", raw.level)
+		}
+		logged := raw.keysAndValues[1].(string)
+		if !strings.Contains(logged, `"average":3`) {
+			t.Errorf("Expected the logged response to contain the metric value but got %s", logged)
+		}
+		if strings.Contains(logged, "00000000-0000-0000-0000-000000000456") || strings.Contains(logged, "secret-group") {
+			t.Errorf("Expected the subscription and resource group to be redacted but got %s", logged)
+		}
+	}
+}
+
+func TestAzMonitorListAvailableMetrics(t *testing.T) {
+	azureMonitorMetricDefinitions = newAzureMonitorMetricDefinitionCache(defaultAzureMonitorMetricDefinitionsTTL)
+	lister := &testAzMonitorDefinitionsLister{definitions: []insights.MetricDefinition{
+		newTestAzMonitorDefinition("IncomingMessages"),
+		newTestAzMonitorDefinition("ActiveMessages", "EntityName"),
+		newTestAzMonitorDefinition("DeadletteredMessages", "EntityName"),
+	}}
+
+	names, err := listAvailableMetrics(context.Background(), lister, newTestAzMonitorRequest())
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	expected := []string{"ActiveMessages", "DeadletteredMessages", "IncomingMessages"}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected metric names %v but got %v", expected, names)
+	}
+
+	request := newTestAzMonitorRequest()
+	request.MetricName = "ActveMessages"
+	err = validateMetricDefinition(context.Background(), lister, request)
+	if err == nil || !strings.Contains(err.Error(), "Did you mean: ActiveMessages, ") {
+		t.Errorf("Expected the closest metric name to be suggested first but got %v", err)
+	}
+}
+
+func TestAzMonitorSuggestMetricNames(t *testing.T) {
+	available := []string{"CPU Credits Remaining", "Percentage CPU", "Network In", "Network Out", "Disk Read Bytes"}
+	suggestions := suggestMetricNames("percentage cpu ", available, 3)
+	if len(suggestions) != 3 || suggestions[0] != "Percentage CPU" {
+		t.Errorf("Expected 3 suggestions starting with Percentage CPU but got %v", suggestions)
+	}
+	if suggestions := suggestMetricNames("Network", available, 10); len(suggestions) != len(available) || suggestions[0] != "Network In" {
+		t.Errorf("Expected every metric ordered by distance but got %v", suggestions)
+	}
+	if suggestions := suggestMetricNames("anything", nil, 3); len(suggestions) != 0 {
+		t.Errorf("Expected no suggestions without metrics but got %v", suggestions)
+	}
+}
+
+func TestAzMonitorListAvailableMetricsAppInsights(t *testing.T) {
+	scaler := &azureMonitorScaler{metadata: &azureMonitorMetadata{metricSource: appInsightsMetricSource, appInsightsAppID: "app-id"}}
+	if _, err := scaler.ListAvailableMetrics(context.Background()); err == nil {
+		t.Error("Expected listing the metrics of an App Insights trigger to be rejected")
+	}
+}
+
+func TestAzMonitorParseAggregationTypeNormalized(t *testing.T) {
+	metadata := map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}
+	for _, aggregationType := range []string{"total", "TOTAL", "Total"} {
+		metadata["metricAggregationType"] = aggregationType
+		meta, err := parseAzureMonitorMetadata(metadata, testAzMonitorResolvedEnv, map[string]string{}, "")
+		if err != nil {
+			t.Errorf("%s: expected success but got error %v", aggregationType, err)
+			continue
+		}
+		if meta.aggregationType != insights.Total {
+			t.Errorf("%s: expected the aggregation type to be normalized to %s but got %s", aggregationType, insights.Total, meta.aggregationType)
+		}
+	}
+
+	for value, expected := range map[string]insights.AggregationType{"average": insights.Average, "LAST": azureMonitorLastAggregation, "datapointcount": azureMonitorDataPointCountAggregation} {
+		if aggregationType, err := normalizeAggregationType(value); err != nil || aggregationType != expected {
+			t.Errorf("%s: expected %s but got %s (%v)", value, expected, aggregationType, err)
+		}
+	}
+
+	if _, err := normalizeAggregationType("p95"); err == nil {
+		t.Error("Expected an unsupported aggregation type to be rejected")
+	}
+}
+
+func TestAzMonitorExecuteCombinedRequest(t *testing.T) {
+	testData := []struct {
+		combine       string
+		expectedValue float64
+	}{
+		{"max", 8},
+		{"min", 3},
+		{"sum", 11},
+		{"avg", 5.5},
+	}
+
+	for _, data := range testData {
+		sender := &testAzMonitorSender{responses: []testAzMonitorSenderResponse{
+			{statusCode: http.StatusOK, body: newTestAzMonitorResponse([]insights.MetricValue{{Average: float64Ptr(3)}})},
+			{statusCode: http.StatusOK, body: newTestAzMonitorResponse([]insights.MetricValue{{Average: float64Ptr(8)}})},
+		}}
+		request := newTestAzMonitorRequest()
+
+		value, err := executeCombinedRequest(context.Background(), newTestAzMonitorClient(sender), &request, []string{"cpu_percent", "memory_percent"}, data.combine)
+		if err != nil {
+			t.Errorf("%s: expected success but got error %v", data.combine, err)
+			continue
+		}
+		if value != data.expectedValue {
+			t.Errorf("%s: expected %v but got %v", data.combine, data.expectedValue, value)
+		}
+		if len(sender.requests) != 2 {
+			t.Fatalf("%s: expected one query per metric but got %d", data.combine, len(sender.requests))
+		}
+		for i, name := range []string{"cpu_percent", "memory_percent"} {
+			if metricName := sender.requests[i].URL.Query().Get("metricnames"); metricName != name {
+				t.Errorf("%s: expected query %d for metric %s but got %s", data.combine, i, name, metricName)
+			}
+		}
+	}
+}
+
+func TestAzMonitorExecuteCombinedRequestError(t *testing.T) {
+	sender := &testAzMonitorSender{responses: []testAzMonitorSenderResponse{
+		{statusCode: http.StatusOK, body: newTestAzMonitorResponse([]insights.MetricValue{{Average: float64Ptr(3)}})},
+		{statusCode: http.StatusOK, body: newTestAzMonitorResponse([]insights.MetricValue{{}})},
+	}}
+	request := newTestAzMonitorRequest()
+
+	if _, err := executeCombinedRequest(context.Background(), newTestAzMonitorClient(sender), &request, []string{"cpu_percent", "memory_percent"}, "max"); err == nil {
+		t.Error("Expected a metric without a value to fail the combined query")
+	}
+}
+
+func TestAzMonitorParseMetricNames(t *testing.T) {
+	metadata := map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricNames": "cpu_percent, memory_percent", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}
+	meta, err := parseAzureMonitorMetadata(metadata, testAzMonitorResolvedEnv, map[string]string{}, "")
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if len(meta.metricNames) != 2 || meta.metricNames[0] != "cpu_percent" || meta.metricNames[1] != "memory_percent" {
+		t.Errorf("Expected the trimmed metric names but got %v", meta.metricNames)
+	}
+	if meta.combine != defaultAzureMonitorCombineMode {
+		t.Errorf("Expected the default combine %s but got %s", defaultAzureMonitorCombineMode, meta.combine)
+	}
+}
+
+func TestAzMonitorHTTPClientProxyFromEnvironment(t *testing.T) {
+	for _, name := range []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy", "NO_PROXY", "no_proxy"} {
+		if val, ok := os.LookupEnv(name); ok {
+			defer os.Setenv(name, val)
+		} else {
+			defer os.Unsetenv(name)
+		}
+		os.Unsetenv(name)
+	}
+	os.Setenv("HTTPS_PROXY", "proxy.corp.example:3128")
+	os.Setenv("NO_PROXY", "internal.example, 10.0.0.0/8")
+
+	transport := newAzureMonitorHTTPClient("applicationinsights.io").Transport.(*azureMonitorTransport).pool
+	testData := []struct {
+		url           string
+		expectedProxy string
+	}{
+		{"https://management.azure.com/subscriptions", "http://proxy.corp.example:3128"},
+		{"https://vault.internal.example/secret", ""},
+		{"https://10.1.2.3/metrics", ""},
+		{"https://api.applicationinsights.io/v1/apps", ""},
+		{"https://localhost:8443/metrics", ""},
+		{"http://management.azure.com/subscriptions", ""},
+	}
+
+	for _, data := range testData {
+		request, _ := http.NewRequest(http.MethodGet, data.url, nil)
+		proxyURL, err := transport.Proxy(request)
+		if err != nil {
+			t.Errorf("%s: expected success but got error %v", data.url, err)
+			continue
+		}
+		proxy := ""
+		if proxyURL != nil {
+			proxy = proxyURL.String()
+		}
+		if proxy != data.expectedProxy {
+			t.Errorf("%s: expected proxy %q but got %q", data.url, data.expectedProxy, proxy)
+		}
+	}
+}
+
+func TestAzMonitorJitterState(t *testing.T) {
+	first := newAzureMonitorJitterState(42)
+	second := newAzureMonitorJitterState(42)
+
+	for i := 0; i < 100; i++ {
+		max := 5 * time.Second
+		if i == 0 {
+			max = 30 * time.Second
+		}
+		delay := first.next(30*time.Second, 5*time.Second)
+		if delay < 0 || delay > max {
+			t.Fatalf("poll %d: expected a jitter of at most %s but got %s", i, max, delay)
+		}
+		if other := second.next(30*time.Second, 5*time.Second); other != delay {
+			t.Fatalf("poll %d: expected the same jitter with the same seed but got %s and %s", i, delay, other)
+		}
+	}
+
+	if delay := newAzureMonitorJitterState(42).next(0, 5*time.Second); delay != 0 {
+		t.Errorf("Expected no jitter before the first query without startupJitter but got %s", delay)
+	}
+}
+
+func TestAzMonitorWaitJitterCanceledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	if err := waitAzureMonitorJitter(ctx, time.Minute); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the context error but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected a canceled context to stop the jitter but waited %s", elapsed)
+	}
+}
+
+func TestAzMonitorGetCapacityPercentage(t *testing.T) {
+	testData := []struct {
+		value         float64
+		capacity      float64
+		expectedValue float64
+		isError       bool
+	}{
+		{25, 100, 25, false},
+		{30, 40, 75, false},
+		{0, 50, 0, false},
+		{120, 100, 120, false},
+		{5, 0, 0, true},
+		{0, 0, 0, true},
+	}
+
+	for _, data := range testData {
+		percentage, err := getCapacityPercentage(data.value, data.capacity)
+		if data.isError {
+			if err == nil {
+				t.Errorf("%v/%v: expected error but got %v", data.value, data.capacity, percentage)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v/%v: expected success but got error %v", data.value, data.capacity, err)
+			continue
+		}
+		if percentage != data.expectedValue {
+			t.Errorf("%v/%v: expected %v but got %v", data.value, data.capacity, data.expectedValue, percentage)
+		}
+	}
+}
+
+func TestAzMonitorExecuteCapacityRequest(t *testing.T) {
+	sender := &testAzMonitorSender{responses: []testAzMonitorSenderResponse{
+		{statusCode: http.StatusOK, body: newTestAzMonitorResponse([]insights.MetricValue{{Average: float64Ptr(200)}})},
+	}}
+	request := newTestAzMonitorRequest()
+
+	percentage, err := executeCapacityRequest(context.Background(), newTestAzMonitorClient(sender), &request, "max_connections", 50)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if percentage != 25 {
+		t.Errorf("Expected 25 percent of the capacity but got %v", percentage)
+	}
+	if metricName := sender.requests[0].URL.Query().Get("metricnames"); metricName != "max_connections" {
+		t.Errorf("Expected the capacity metric to be queried but got %s", metricName)
+	}
+
+	sender = &testAzMonitorSender{responses: []testAzMonitorSenderResponse{
+		{statusCode: http.StatusOK, body: newTestAzMonitorResponse([]insights.MetricValue{{Average: float64Ptr(0)}})},
+	}}
+	if _, err := executeCapacityRequest(context.Background(), newTestAzMonitorClient(sender), &request, "max_connections", 50); err == nil {
+		t.Error("Expected a capacity of 0 to be rejected")
+	}
+}
+
+func TestAzMonitorMetricResourceURIScope(t *testing.T) {
+	testData := []struct {
+		scope         string
+		resourceGroup string
+		expectedURI   string
+	}{
+		{"", "test", "/subscriptions/456/resourceGroups/test/providers/test/resource/uri"},
+		{azureMonitorResourceGroupScope, "test", "/subscriptions/456/resourceGroups/test/providers/test/resource/uri"},
+		{azureMonitorSubscriptionScope, "", "/subscriptions/456/providers/test/resource/uri"},
+	}
+
+	for _, data := range testData {
+		request := newTestAzMonitorRequest()
+		request.Scope = data.scope
+		request.ResourceGroup = data.resourceGroup
+
+		if uri := request.metricResourceURI(); uri != data.expectedURI {
+			t.Errorf("%q: expected %s but got %s", data.scope, data.expectedURI, uri)
+		}
+		if err := request.validate(); err != nil {
+			t.Errorf("%q: expected a valid request but got error %v", data.scope, err)
+		}
+	}
+
+	request := newTestAzMonitorRequest()
+	request.ResourceGroup = ""
+	if err := request.validate(); err == nil {
+		t.Error("Expected a resource group scoped request without a resource group to be rejected")
+	}
+}
+
+func TestAzMonitorGetAzureMetricValueInvalidRequestCreatesNoClient(t *testing.T) {
+	metadata := &azureMonitorMetadata{
+		resourceURI:       "test/resource/uri",
+		subscriptionID:    "00000000-0000-0000-0000-000000000456",
+		resourceGroupName: "test",
+		aggregationType:   insights.Average,
+		tenantID:          "invalid-request-tenant",
+		clientID:          "invalid-request-id",
+		clientPassword:    "invalid-request-password",
+	}
+	key := azureMonitorAuthorizerKey{tenantID: metadata.tenantID, clientID: metadata.clientID, cloud: azure.PublicCloud.Name, resource: azure.PublicCloud.ResourceManagerEndpoint}
+	sender := &testAzMonitorSender{}
+
+	if _, err := getAzureMetricValue(context.Background(), metadata, sender); err == nil || !strings.Contains(err.Error(), "metricName is required") {
+		t.Errorf("Expected the missing metricName to be reported but got %v", err)
+	}
+	if err := validateAzureMonitorAccess(context.Background(), metadata, sender); err == nil || !strings.Contains(err.Error(), "metricName is required") {
+		t.Errorf("Expected the missing metricName to be reported when validating access but got %v", err)
+	}
+
+	if len(sender.requests) != 0 {
+		t.Errorf("Expected no call to Azure but got %d", len(sender.requests))
+	}
+	azureMonitorAuthorizers.lock.Lock()
+	_, ok := azureMonitorAuthorizers.entries[key]
+	azureMonitorAuthorizers.lock.Unlock()
+	if ok {
+		t.Error("Expected no authorizer to be created for an invalid request")
+	}
+}
+
+func TestAzMonitorConvertMetricUnit(t *testing.T) {
+	testData := []struct {
+		value         float64
+		unit          insights.Unit
+		targetUnit    string
+		expectedValue float64
+		isError       bool
+	}{
+		{3 << 30, insights.UnitBytes, "GB", 3, false},
+		{512 << 20, insights.UnitBytes, "gb", 0.5, false},
+		{3 << 20, insights.UnitBytes, "MB", 3, false},
+		{2, insights.UnitSeconds, "MilliSeconds", 2000, false},
+		{250, insights.UnitMilliSeconds, "Seconds", 0.25, false},
+		{600, insights.UnitCount, "CountPerSecond", 2, false},
+		{2, insights.UnitCountPerSecond, "Count", 600, false},
+		{42, insights.UnitPercent, "", 42, false},
+		{42, insights.UnitBytes, "Seconds", 0, true},
+		{42, insights.UnitPercent, "Count", 0, true},
+		{42, insights.UnitBytesPerSecond, "MB", 0, true},
+	}
+
+	for _, data := range testData {
+		value, err := convertMetricUnit(data.value, data.unit, data.targetUnit, 5*time.Minute)
+		if data.isError {
+			if err == nil {
+				t.Errorf("%s to %s: expected error but got %v", data.unit, data.targetUnit, value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s to %s: expected success but got error %v", data.unit, data.targetUnit, err)
+			continue
+		}
+		if value != data.expectedValue {
+			t.Errorf("%s to %s: expected %v but got %v", data.unit, data.targetUnit, data.expectedValue, value)
+		}
+	}
+}
+
+func TestAzMonitorExecuteRequestTargetUnit(t *testing.T) {
+	data := []insights.MetricValue{{Average: float64Ptr(2 << 30)}}
+	response := insights.Response{Value: &[]insights.Metric{{Unit: insights.UnitBytes, Timeseries: &[]insights.TimeSeriesElement{{Data: &data}}}}}
+	sender := &testAzMonitorSender{responses: []testAzMonitorSenderResponse{{statusCode: http.StatusOK, body: response}}}
+	request := newTestAzMonitorRequest()
+	request.TargetUnit = "GB"
+
+	value, err := executeRequest(context.Background(), newTestAzMonitorClient(sender), &request)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if value != 2 {
+		t.Errorf("Expected 2 GB but got %v", value)
+	}
+}
+
+// newSlowAzMonitorServer starts a server that only answers once the client gives up on the request
+func newSlowAzMonitorServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+}
+
+func TestAzMonitorGetAzureMetricValueDeadline(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+	server := newSlowAzMonitorServer()
+	httpClient := newAzureMonitorHTTPClient("")
+
+	metadata := &azureMonitorMetadata{
+		resourceURI:       "test/resource/uri",
+		subscriptionID:    "456",
+		resourceGroupName: "test",
+		name:              "metric",
+		aggregationType:   insights.Average,
+		tenantID:          "deadline-tenant",
+		clientID:          "deadline-id",
+		clientPassword:    "deadline-password",
+		endpointOverride:  server.URL,
+	}
+	// the test server does not need a token
+	seedTestAzMonitorAuthorizer("deadline-tenant", "deadline-id", "deadline-password", autorest.NullAuthorizer{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := getAzureMetricValue(ctx, metadata, httpClient)
+	elapsed := time.Since(start)
+
+	if err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Errorf("Expected the deadline to abort the query but got %v", err)
+	}
+	if elapsed > time.Second {
+		t.Errorf("Expected the query to return promptly after the deadline but it took %s", elapsed)
+	}
+
+	httpClient.CloseIdleConnections()
+	server.Close()
+}
+
+func TestAzMonitorParseMetricOrderBy(t *testing.T) {
+	testData := []struct {
+		orderBy  string
+		expected string
+		isError  bool
+	}{
+		{"Total desc", "Total desc", false},
+		{"average ASC", "Average asc", false},
+		{"  Maximum   desc ", "Maximum desc", false},
+		{"Total", "", true},
+		{"Total sideways", "", true},
+		{"Last desc", "", true},
+		{"Total desc, Average asc", "", true},
+	}
+
+	for _, data := range testData {
+		orderBy, err := parseMetricOrderBy(data.orderBy)
+		if data.isError {
+			if err == nil {
+				t.Errorf("%q: expected error but got %q", data.orderBy, orderBy)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: expected success but got error %v", data.orderBy, err)
+		} else if orderBy != data.expected {
+			t.Errorf("%q: expected %q but got %q", data.orderBy, data.expected, orderBy)
+		}
+	}
+}
+
+func TestAzMonitorValidateStrictTimeSpan(t *testing.T) {
+	if err := validateStrictTimeSpan("metricAggregationInterval", "00:00:90"); err == nil {
+		t.Error("Expected 90 seconds to be rejected")
+	}
+	if err := validateStrictTimeSpan("metricAggregationInterval", "00:60:00"); err == nil {
+		t.Error("Expected 60 minutes to be rejected")
+	}
+	// hours are not bounded, windows longer than a day are written as e.g. 48:00:00
+	for _, timeSpan := range []string{"00:59:59", "48:00:00", "PT90S"} {
+		if err := validateStrictTimeSpan("metricAggregationInterval", timeSpan); err != nil {
+			t.Errorf("%s: expected success but got error %v", timeSpan, err)
+		}
+	}
+
+	// without strictInterval the components are added up
+	duration, err := parseAggregationInterval("metricAggregationInterval", "00:00:90")
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if duration != 90*time.Second {
+		t.Errorf("Expected 90s but got %s", duration)
+	}
+}
+
+func TestAzMonitorExpandMetricFilterTemplate(t *testing.T) {
+	vars := azureMonitorTemplateVars{Name: "orders-processor", Namespace: "team-a"}
+	testData := []struct {
+		filter   string
+		vars     azureMonitorTemplateVars
+		expected string
+		isError  bool
+	}{
+		{"Environment eq '{{.Namespace}}'", vars, "Environment eq 'team-a'", false},
+		{"Environment eq '{{.Namespace}}' and Service eq '{{.Name}}'", vars, "Environment eq 'team-a' and Service eq 'orders-processor'", false},
+		{"Environment eq 'production'", azureMonitorTemplateVars{}, "Environment eq 'production'", false},
+		{"Environment eq '{{.Namespace}}'", azureMonitorTemplateVars{Namespace: "o'brien"}, "Environment eq 'o''brien'", false},
+		{"Environment eq '{{.Labels}}'", vars, "", true},
+		{"Environment eq '{{.Namespace}}'", azureMonitorTemplateVars{}, "", true},
+		{"Environment eq '{{.Namespace'", vars, "", true},
+	}
+
+	for _, data := range testData {
+		filter, err := expandMetricFilterTemplate(data.filter, data.vars)
+		if data.isError {
+			if err == nil {
+				t.Errorf("%q: expected error but got %q", data.filter, filter)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: expected success but got error %v", data.filter, err)
+		} else if filter != data.expected {
+			t.Errorf("%q: expected %q but got %q", data.filter, data.expected, filter)
+		}
+	}
+}
+
+func TestAzMonitorParseMetricFilterTemplate(t *testing.T) {
+	metadata := map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5", "metricFilter": "Environment eq '{{.Namespace}}'"}
+	meta, err := parseAzureMonitorTriggerMetadata(metadata, testAzMonitorResolvedEnv, map[string]string{}, "", azureMonitorTemplateVars{Name: "so", Namespace: "team-a"})
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if meta.filter != "Environment eq 'team-a'" {
+		t.Errorf("Expected the namespace in the filter but got %q", meta.filter)
+	}
+
+	metadata["metricFilter"] = "Environment eq '{{.Cluster}}'"
+	if _, err := parseAzureMonitorTriggerMetadata(metadata, testAzMonitorResolvedEnv, map[string]string{}, "", azureMonitorTemplateVars{Name: "so", Namespace: "team-a"}); err == nil {
+		t.Error("Expected a filter referencing an unknown variable to be rejected")
+	}
+}
+
+func TestAzMonitorBuildMetricFilter(t *testing.T) {
+	testData := []struct {
+		values         []string
+		op             string
+		expectedFilter string
+	}{
+		{[]string{"orders"}, "or", "EntityName eq 'orders'"},
+		{[]string{"orders", "invoices"}, "or", "EntityName eq 'orders' or EntityName eq 'invoices'"},
+		{[]string{"orders", "invoices"}, "and", "EntityName eq 'orders' and EntityName eq 'invoices'"},
+		{[]string{"o'brien", "it''s"}, "or", "EntityName eq 'o''brien' or EntityName eq 'it''''s'"},
+	}
+
+	for _, data := range testData {
+		filter := buildMetricFilter("EntityName", data.values, data.op)
+		if filter != data.expectedFilter {
+			t.Errorf("%v: expected %s but got %s", data.values, data.expectedFilter, filter)
+		}
+		if err := validateMetricFilter(filter); err != nil {
+			t.Errorf("%v: expected the built filter to be valid but got error %v", data.values, err)
+		}
+	}
+}
+
+func TestAzMonitorParseFilterDimension(t *testing.T) {
+	metadata := map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "filterDimension": "EntityName", "filterValues": "orders, o'brien", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5"}
+	meta, err := parseAzureMonitorMetadata(metadata, testAzMonitorResolvedEnv, map[string]string{}, "")
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if meta.filter != "EntityName eq 'orders' or EntityName eq 'o''brien'" {
+		t.Errorf("Expected the filter built from filterDimension and filterValues but got %s", meta.filter)
+	}
+}
+
+func newTestAzMonitorMetricsPage(nextLink string, data ...[]insights.MetricValue) azureMonitorMetricsPage {
+	name := "metric"
+	page := azureMonitorMetricsPage{Response: newTestAzMonitorResponse(data...)}
+	for i := range *page.Value {
+		(*page.Value)[i].Name = &insights.LocalizableString{Value: &name}
+	}
+	if nextLink != "" {
+		page.NextLink = &nextLink
+	}
+	return page
+}
+
+func TestAzMonitorGetAzureMetricFollowsNextLink(t *testing.T) {
+	nextLink := insights.DefaultBaseURI + "/test/resource/uri/providers/microsoft.insights/metrics?$skiptoken=page2"
+	sender := &testAzMonitorSender{responses: []testAzMonitorSenderResponse{
+		{statusCode: http.StatusOK, body: newTestAzMonitorMetricsPage(nextLink, []insights.MetricValue{{Total: float64Ptr(3)}})},
+		{statusCode: http.StatusOK, body: newTestAzMonitorMetricsPage("", []insights.MetricValue{{Total: float64Ptr(4)}}, []insights.MetricValue{{Total: float64Ptr(5)}})},
+	}}
+	request := newTestAzMonitorRequest()
+	request.Aggregation = insights.Total
+
+	value, err := getAzureMetric(context.TODO(), newTestAzMonitorClient(sender), request)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if value.Value != 12 {
+		t.Errorf("Expected the timeseries of both pages to be aggregated to 12 but got %v", value.Value)
+	}
+	if value.Partial {
+		t.Error("Expected the value not to be flagged as partial after reading every page")
+	}
+	if len(sender.requests) != 2 {
+		t.Fatalf("Expected 2 requests but got %d", len(sender.requests))
+	}
+	if sender.requests[1].URL.String() != nextLink {
+		t.Errorf("Expected the second request to follow the next link %s but got %s", nextLink, sender.requests[1].URL.String())
+	}
+}
+
+func TestAzMonitorGetAzureMetricPartialResponse(t *testing.T) {
+	testData := []struct {
+		name             string
+		nextLink         string
+		expectedRequests int
+	}{
+		{"more pages than followed", insights.DefaultBaseURI + "/test/resource/uri/providers/microsoft.insights/metrics?$skiptoken=next", azureMonitorMaxMetricPages},
+		{"next link to another host", "https://example.com/metrics?$skiptoken=next", 1},
+	}
+
+	for _, data := range testData {
+		// the sender repeats its last response, so every page links to another one
+		sender := &testAzMonitorSender{responses: []testAzMonitorSenderResponse{
+			{statusCode: http.StatusOK, body: newTestAzMonitorMetricsPage(data.nextLink, []insights.MetricValue{{Total: float64Ptr(1)}})},
+		}}
+		request := newTestAzMonitorRequest()
+		request.Aggregation = insights.Total
+
+		value, err := getAzureMetric(context.TODO(), newTestAzMonitorClient(sender), request)
+		if err != nil {
+			t.Fatalf("%s: expected success but got error %v", data.name, err)
+		}
+		if !value.Partial {
+			t.Errorf("%s: expected the value to be flagged as partial", data.name)
+		}
+		if value.Value != float64(data.expectedRequests) {
+			t.Errorf("%s: expected the fetched pages to be aggregated to %d but got %v", data.name, data.expectedRequests, value.Value)
+		}
+		if len(sender.requests) != data.expectedRequests {
+			t.Errorf("%s: expected %d requests but got %d", data.name, data.expectedRequests, len(sender.requests))
+		}
+	}
+}
+
+func TestAzMonitorGetMetricDerivative(t *testing.T) {
+	testData := []struct {
+		value    float64
+		previous float64
+		interval time.Duration
+		expected float64
+	}{
+		{70, 10, time.Minute, 1},
+		{10, 70, time.Minute, -1},
+		{50, 50, time.Minute, 0},
+		{50, 20, 0, 0},
+	}
+
+	for _, data := range testData {
+		derivative := getMetricDerivative(data.value, data.previous, data.interval)
+		if derivative != data.expected {
+			t.Errorf("%v to %v over %s: expected %v but got %v", data.previous, data.value, data.interval, data.expected, derivative)
+		}
+	}
+}
+
+// newWindowAzMonitorServer reports the previous value for windows that ended more than 30 seconds ago and the
+// current value for the others, counting the queries it answered
+func newWindowAzMonitorServer(previous float64, current float64, queries *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(queries, 1)
+		value := current
+		timespan := strings.Split(r.URL.Query().Get("timespan"), "/")
+		if end, err := time.Parse(time.RFC3339, timespan[len(timespan)-1]); err == nil && end.Before(time.Now().Add(-30*time.Second)) {
+			value = previous
+		}
+		_ = json.NewEncoder(w).Encode(newTestAzMonitorResponse([]insights.MetricValue{{Total: &value}}))
+	}))
+}
+
+func TestAzMonitorDerivativeFromTwoWindows(t *testing.T) {
+	var queries int32
+	server := newWindowAzMonitorServer(10, 70, &queries)
+	defer server.Close()
+
+	metadata := &azureMonitorMetadata{
+		resourceURI:         "test/resource/uri",
+		subscriptionID:      "456",
+		resourceGroupName:   "test",
+		name:                "metric",
+		aggregationType:     insights.Total,
+		aggregationInterval: "00:01:00",
+		metricDerivative:    true,
+		tenantID:            "derivative-tenant",
+		clientID:            "derivative-id",
+		clientPassword:      "derivative-password",
+		endpointOverride:    server.URL,
+	}
+	// the test server does not need a token
+	seedTestAzMonitorAuthorizer("derivative-tenant", "derivative-id", "derivative-password", autorest.NullAuthorizer{})
+
+	scaler := &azureMonitorScaler{metadata: metadata, httpClient: newAzureMonitorHTTPClient(""), derivative: &azureMonitorDerivativeState{}}
+
+	// without a previous sample the window before the current one is queried
+	value, err := scaler.queryMetricValue(context.TODO())
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if value != 1 {
+		t.Errorf("Expected the metric to grow by 60 over the minute between the windows, 1 per second, but got %v", value)
+	}
+	if atomic.LoadInt32(&queries) != 2 {
+		t.Errorf("Expected the current and the previous window to be queried but got %d queries", queries)
+	}
+
+	// with a recent sample only the current window is queried
+	scaler.derivative.store(40, time.Now().Add(-30*time.Second))
+	value, err = scaler.queryMetricValue(context.TODO())
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if math.Abs(value-1) > 0.01 {
+		t.Errorf("Expected the metric to grow by 30 over the 30 seconds since the last sample, 1 per second, but got %v", value)
+	}
+	if atomic.LoadInt32(&queries) != 3 {
+		t.Errorf("Expected only the current window to be queried but got %d queries in total", queries)
+	}
+}
+
+func TestAzMonitorCreateMetricsRequestShortResourceURI(t *testing.T) {
+	for _, resourceURI := range []string{"", "Microsoft.Web", "Microsoft.Web/sites"} {
+		metadata := &azureMonitorMetadata{resourceURI: resourceURI, subscriptionID: "456", resourceGroupName: "test", name: "metric", aggregationType: insights.Average}
+		_, err := createMetricsRequest(metadata)
+		expected := fmt.Sprintf("resourceURI must be in the form <provider>/<type>/<name>, got %q", resourceURI)
+		if err == nil || err.Error() != expected {
+			t.Errorf("%q: expected error %s but got %v", resourceURI, expected, err)
+		}
+	}
+}
+
+func TestAzMonitorResolveAuthPrecedence(t *testing.T) {
+	testData := []struct {
+		name        string
+		resolvedEnv map[string]string
+		authParams  map[string]string
+		metadata    map[string]string
+		expected    string
+		isError     bool
+	}{
+		{"inline", map[string]string{"inline": "inline"}, map[string]string{}, map[string]string{"%s": "inline"}, "inline", false},
+		{"metadata names env", map[string]string{"VALUE": "env"}, map[string]string{}, map[string]string{"%s": "VALUE"}, "env", false},
+		{"fromEnv over inline", map[string]string{"VALUE": "env"}, map[string]string{}, map[string]string{"%s": "inline", "%sFromEnv": "VALUE"}, "env", false},
+		{"authParams over inline", map[string]string{}, map[string]string{"%s": "auth"}, map[string]string{"%s": "inline"}, "auth", false},
+		{"authParams over env", map[string]string{"VALUE": "env"}, map[string]string{"%s": "auth"}, map[string]string{"%s": "VALUE"}, "auth", false},
+		{"authParams over fromEnv", map[string]string{"VALUE": "env"}, map[string]string{"%s": "auth"}, map[string]string{"%sFromEnv": "VALUE"}, "auth", false},
+		{"fromEnv missing", map[string]string{}, map[string]string{}, map[string]string{"%s": "inline", "%sFromEnv": "VALUE"}, "", true},
+		{"not set", map[string]string{}, map[string]string{}, map[string]string{}, "", false},
+	}
+
+	fields := map[string]func(azureMonitorAuth) string{
+		"tenantId":                      func(auth azureMonitorAuth) string { return auth.tenantID },
+		"subscriptionId":                func(auth azureMonitorAuth) string { return auth.subscriptionID },
+		"activeDirectoryClientId":       func(auth azureMonitorAuth) string { return auth.clientID },
+		"activeDirectoryClientPassword": func(auth azureMonitorAuth) string { return auth.clientPassword },
+	}
+
+	// the keys of the test data are templates filled in with the name of each auth field
+	expand := func(values map[string]string, field string) map[string]string {
+		expanded := map[string]string{}
+		for key, value := range values {
+			expanded[strings.Replace(key, "%s", field, 1)] = value
+		}
+		return expanded
+	}
+
+	for field, get := range fields {
+		for _, data := range testData {
+			auth, err := resolveAzureMonitorAuth(data.resolvedEnv, expand(data.authParams, field), expand(data.metadata, field))
+			if data.isError {
+				if err == nil {
+					t.Errorf("%s %s: expected error but got success", field, data.name)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s %s: expected success but got error %v", field, data.name, err)
+				continue
+			}
+			if get(auth) != data.expected {
+				t.Errorf("%s %s: expected %q but got %q", field, data.name, data.expected, get(auth))
+			}
+		}
+	}
+}
+
+func TestAzMonitorResolveAuthMissingEnv(t *testing.T) {
+	// the inline client ID and password name an environment variable, a typo in its name is a parse error
+	for _, key := range []string{"activeDirectoryClientId", "activeDirectoryClientPassword", "backupActiveDirectoryClientId", "backupActiveDirectoryClientPassword"} {
+		metadata := map[string]string{key: "CLIENT_PASSWROD"}
+		if _, err := resolveAzureMonitorAuth(testAzMonitorResolvedEnv, map[string]string{}, metadata); err == nil || !strings.Contains(err.Error(), "CLIENT_PASSWROD") {
+			t.Errorf("%s: expected an error naming the missing environment variable but got %v", key, err)
+		}
+	}
+
+	// the tenant and subscription are given inline
+	auth, err := resolveAzureMonitorAuth(map[string]string{}, map[string]string{}, map[string]string{"tenantId": "tenant", "subscriptionId": "subscription"})
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if auth.tenantID != "tenant" || auth.subscriptionID != "subscription" {
+		t.Errorf("Expected the inline tenant and subscription but got %q and %q", auth.tenantID, auth.subscriptionID)
+	}
+}
+
+func TestAzMonitorLastGoodFallback(t *testing.T) {
+	state := &azureMonitorLastGoodState{}
+	queryErr := errors.New("azure monitor is unavailable")
+	now := time.Now()
+
+	if _, err := state.fallback(-1, queryErr, time.Minute, now); err != queryErr {
+		t.Errorf("Expected the error before the first successful query but got %v", err)
+	}
+
+	value, err := state.fallback(7, nil, time.Minute, now)
+	if err != nil || value != 7 {
+		t.Errorf("Expected the value of the successful query but got %v, %v", value, err)
+	}
+
+	value, err = state.fallback(-1, queryErr, time.Minute, now.Add(30*time.Second))
+	if err != nil || value != 7 {
+		t.Errorf("Expected the last good value within fallbackMaxAge but got %v, %v", value, err)
+	}
+
+	if _, err = state.fallback(-1, queryErr, time.Minute, now.Add(2*time.Minute)); err != queryErr {
+		t.Errorf("Expected the error once the last good value is older than fallbackMaxAge but got %v", err)
+	}
+}
+
+func TestAzMonitorGetMetricValueFallbackOnError(t *testing.T) {
+	// without a resourceURI the query fails before any client is created
+	metadata := &azureMonitorMetadata{subscriptionID: "456", resourceGroupName: "test", name: "metric", aggregationType: insights.Average, fallbackOnError: true, fallbackMaxAge: time.Minute}
+	scaler := &azureMonitorScaler{metadata: metadata, httpClient: newAzureMonitorHTTPClient(""), lastGood: &azureMonitorLastGoodState{}}
+
+	if _, err := scaler.getMetricValue(context.TODO()); err == nil {
+		t.Error("Expected error without a last good value but got success")
+	}
+
+	_, _ = scaler.lastGood.fallback(12, nil, time.Minute, time.Now())
+	value, err := scaler.getMetricValue(context.TODO())
+	if err != nil {
+		t.Fatal("Expected the last good value but got error", err)
+	}
+	if value != 12 {
+		t.Errorf("Expected the last good value 12 but got %v", value)
+	}
+}
+
+func TestAzMonitorGetAggregationWindowFormats(t *testing.T) {
+	testData := []struct {
+		interval string
+		expected time.Duration
+		isError  bool
+	}{
+		{"PT5M", 5 * time.Minute, false},
+		{"00:05:00", 5 * time.Minute, false},
+		{"PT1H30M", 90 * time.Minute, false},
+		{"pt1h30m", 90 * time.Minute, false},
+		{"01:30:00", 90 * time.Minute, false},
+		{"P1D", 24 * time.Hour, false},
+		{"PT01:30:00", 0, true},
+		{"P1M", 0, true},
+		{"PT", 0, true},
+		{"5M", 0, true},
+	}
+
+	for _, data := range testData {
+		window, err := getAggregationWindow(data.interval)
+		if data.isError {
+			if err == nil {
+				t.Errorf("%s: expected error but got window %s", data.interval, window)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected success but got error %v", data.interval, err)
+			continue
+		}
+		if window != data.expected {
+			t.Errorf("%s: expected window %s but got %s", data.interval, data.expected, window)
+		}
+	}
+}
+
+func TestAzMonitorExtractValueListsPresentAggregations(t *testing.T) {
+	testData := []struct {
+		name     string
+		data     [][]insights.MetricValue
+		expected string
+	}{
+		{"only total", [][]insights.MetricValue{{{Total: float64Ptr(3)}, {Total: float64Ptr(4)}}}, "the returned data has values for Total"},
+		{"total and count across timeseries", [][]insights.MetricValue{{{Total: float64Ptr(3)}}, {{Count: int64Ptr(2)}}}, "the returned data has values for Total, Count"},
+		{"no values", [][]insights.MetricValue{{{}}}, "No value returned by Azure Monitor for any aggregation"},
+	}
+
+	for _, data := range testData {
+		request := newTestAzMonitorRequest()
+		request.Aggregation = insights.Average
+		_, err := extractValue(request, newTestAzMonitorResponse(data.data...))
+		if err == nil {
+			t.Errorf("%s: expected error but got success", data.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), data.expected) {
+			t.Errorf("%s: expected the error to contain %q but got %v", data.name, data.expected, err)
+		}
+	}
+}
+
+func TestAzMonitorRoundMetricValue(t *testing.T) {
+	testData := []struct {
+		value        float64
+		roundingMode string
+		expected     float64
+	}{
+		{1.4, "floor", 1},
+		{1.4, "ceil", 2},
+		{1.4, "round", 1},
+		{1.4, "none", 1.4},
+		{1.4, "", 1.4},
+		{1.5, "round", 2},
+	}
+
+	for _, data := range testData {
+		value := roundMetricValue(data.value, data.roundingMode)
+		if value != data.expected {
+			t.Errorf("%v with %q: expected %v but got %v", data.value, data.roundingMode, data.expected, value)
+		}
+	}
+}
+
+func TestAzMonitorQueryMetricValueRoundsFinalValue(t *testing.T) {
+	// every resource reports 1.4 and a capacity of 2.4, rounding each of them before they are combined would report
+	// 4 for the sum of two resources and 67 percent of the capacity
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/resources") {
+			_, _ = fmt.Fprint(w, `{"value": [{"id": "/subscriptions/456/resourceGroups/test/providers/Microsoft.Compute/virtualMachines/vm-0"}, {"id": "/subscriptions/456/resourceGroups/test/providers/Microsoft.Compute/virtualMachines/vm-1"}]}`)
+			return
+		}
+		value := 1.4
+		if r.URL.Query().Get("metricnames") == "capacity" {
+			value = 2.4
+		}
+		_ = json.NewEncoder(w).Encode(newTestAzMonitorResponse([]insights.MetricValue{{Average: &value, Total: &value}}))
+	}))
+	defer server.Close()
+
+	resourceNames := newTestAzMonitorSeededMetadata("rounding-names", server.URL)
+	resourceNames.resourceURI = "Microsoft.Compute/virtualMachines"
+	resourceNames.resourceNames = []string{"vm-0", "vm-1"}
+	resourceNames.combine = "sum"
+
+	tagFilter := newTestAzMonitorSeededMetadata("rounding-tags", server.URL)
+	tagFilter.resourceURI = ""
+	tagFilter.resourceTagFilter = "role=worker"
+	tagFilter.aggregationType = insights.Total
+
+	capacity := newTestAzMonitorSeededMetadata("rounding-capacity", server.URL)
+	capacity.capacityMetricName = "capacity"
+
+	for _, data := range []struct {
+		name     string
+		metadata *azureMonitorMetadata
+		values   map[string]float64
+	}{
+		{"resourceNames", resourceNames, map[string]float64{"floor": 2, "ceil": 3, "round": 3, "none": 2.8}},
+		{"resourceTagFilter", tagFilter, map[string]float64{"floor": 2, "ceil": 3, "round": 3, "none": 2.8}},
+		{"capacityMetricName", capacity, map[string]float64{"floor": 58, "ceil": 59, "round": 58, "none": 1.4 / 2.4 * 100}},
+	} {
+		for roundingMode, expected := range data.values {
+			metadata := *data.metadata
+			metadata.roundingMode = roundingMode
+			scaler := &azureMonitorScaler{metadata: &metadata, httpClient: newAzureMonitorHTTPClient("")}
+
+			value, err := scaler.queryMetricValue(context.TODO())
+			if err != nil {
+				t.Errorf("%s with %s: expected success but got error %v", data.name, roundingMode, err)
+				continue
+			}
+			if math.Abs(value-expected) > 1e-9 {
+				t.Errorf("%s with %s: expected %v but got %v", data.name, roundingMode, expected, value)
+			}
+		}
+	}
+}
+
+func TestAzMonitorExecuteRequestTop(t *testing.T) {
+	// Azure Monitor sorts the timeseries by orderBy, the response holds more of them than top
+	sender := &testAzMonitorSender{responses: []testAzMonitorSenderResponse{
+		{statusCode: http.StatusOK, body: newTestAzMonitorResponse(
+			[]insights.MetricValue{{Total: float64Ptr(9)}},
+			[]insights.MetricValue{{Total: float64Ptr(7)}},
+			[]insights.MetricValue{{Total: float64Ptr(5)}},
+			[]insights.MetricValue{{Total: float64Ptr(3)}},
+			[]insights.MetricValue{{Total: float64Ptr(1)}},
+		)},
+	}}
+	request := newTestAzMonitorRequest()
+	request.Aggregation = insights.Total
+	request.Filter = "Partition eq '*'"
+	request.Top = 3
+	request.OrderBy = "Total desc"
+
+	value, err := executeRequest(context.TODO(), newTestAzMonitorClient(sender), &request)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if value != 21 {
+		t.Errorf("Expected the total of the top 3 timeseries, 21, but got %v", value)
+	}
+
+	query := sender.requests[0].URL.Query()
+	if query.Get("top") != "3" {
+		t.Errorf("Expected top 3 to be sent but got %q", query.Get("top"))
+	}
+	if query.Get("orderby") != "Total desc" {
+		t.Errorf("Expected orderby Total desc to be sent but got %q", query.Get("orderby"))
+	}
+}
+
+func TestAzMonitorGetPercentile(t *testing.T) {
+	// 1 to 100 out of order
+	values := make([]float64, 0, 100)
+	for i := 0; i < 100; i++ {
+		values = append(values, float64((i*37)%100+1))
+	}
+
+	for _, data := range []struct {
+		percentile float64
+		expected   float64
+	}{{0, 1}, {50, 50.5}, {95, 95.05}, {100, 100}} {
+		if value := getPercentile(values, data.percentile); math.Abs(value-data.expected) > 1e-9 {
+			t.Errorf("p%v: expected %v but got %v", data.percentile, data.expected, value)
+		}
+	}
+	if values[0] != 1 || values[1] != 38 {
+		t.Error("Expected the values not to be sorted in place")
+	}
+}
+
+func TestAzMonitorParsePercentileGranularity(t *testing.T) {
+	metadata := map[string]string{"resourceURI": "test/resource/uri", "tenantId": "123", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "metric", "metricAggregationType": "Average", "activeDirectoryClientId": "CLIENT_ID", "activeDirectoryClientPassword": "CLIENT_PASSWORD", "targetValue": "5", "percentile": "95"}
+	meta, err := parseAzureMonitorMetadata(metadata, testAzMonitorResolvedEnv, map[string]string{}, "")
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if meta.aggregationGranularity != "PT1M" {
+		t.Errorf("Expected the per minute data points to be queried for a percentile but got %q", meta.aggregationGranularity)
+	}
+
+	metadata["aggregationGranularity"] = "PT5M"
+	metadata["metricAggregationInterval"] = "01:00:00"
+	meta, err = parseAzureMonitorMetadata(metadata, testAzMonitorResolvedEnv, map[string]string{}, "")
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if meta.aggregationGranularity != "PT5M" {
+		t.Errorf("Expected aggregationGranularity to take precedence but got %q", meta.aggregationGranularity)
+	}
+}
+
+func TestAzMonitorExecuteRequestPercentile(t *testing.T) {
+	// the data points of both timeseries make up the sample, the unfinished last bucket has no value
+	sender := &testAzMonitorSender{responses: []testAzMonitorSenderResponse{
+		{statusCode: http.StatusOK, body: newTestAzMonitorResponse(
+			[]insights.MetricValue{{Maximum: float64Ptr(10)}, {Maximum: float64Ptr(30)}, {Maximum: float64Ptr(20)}, {}},
+			[]insights.MetricValue{{Maximum: float64Ptr(50)}, {Maximum: float64Ptr(40)}},
+		)},
+	}}
+	request := newTestAzMonitorRequest()
+	request.Aggregation = insights.Maximum
+
+	for _, data := range []struct {
+		percentile float64
+		expected   float64
+	}{{50, 30}, {95, 48}} {
+		percentile := data.percentile
+		request.Percentile = &percentile
+		value, err := executeRequest(context.TODO(), newTestAzMonitorClient(sender), &request)
+		if err != nil {
+			t.Fatalf("p%v: expected success but got error %v", data.percentile, err)
+		}
+		if math.Abs(value-data.expected) > 1e-9 {
+			t.Errorf("p%v: expected %v but got %v", data.percentile, data.expected, value)
+		}
+	}
+}
+
+func TestAzMonitorClampMetricValue(t *testing.T) {
+	maxMetricValue := 100.0
+	meta := &azureMonitorMetadata{resourceURI: "test/resource/uri", name: "metric", maxMetricValue: &maxMetricValue}
+
+	for _, data := range []struct {
+		value    float64
+		expected float64
+	}{{5000, 100}, {100.5, 100}, {100, 100}, {42, 42}, {-3, -3}} {
+		if value := clampMetricValue(meta, data.value); value != data.expected {
+			t.Errorf("%v: expected %v but got %v", data.value, data.expected, value)
+		}
+	}
+
+	if value := clampMetricValue(&azureMonitorMetadata{}, 5000); value != 5000 {
+		t.Errorf("Expected the value to be left alone without maxMetricValue but got %v", value)
+	}
+}
+
+func TestAzMonitorGetMetricValueMaxMetricValue(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(newTestAzMonitorResponse([]insights.MetricValue{{Average: float64Ptr(5000)}}))
+	}))
+	defer server.Close()
+
+	maxMetricValue := 20.0
+	meta := newTestAzMonitorSeededMetadata("max-value", server.URL)
+	meta.maxMetricValue = &maxMetricValue
+	scaler := &azureMonitorScaler{metadata: meta, httpClient: server.Client()}
+
+	value, err := scaler.getMetricValue(context.Background())
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if value != 20 {
+		t.Errorf("Expected the value to be capped at 20 but got %v", value)
+	}
+}
+
+func TestAzMonitorGetHealthMetricValue(t *testing.T) {
+	unhealthyBelow := 1.0
+	meta := &azureMonitorMetadata{resourceURI: "test/resource/uri", name: "availability", unhealthyBelow: &unhealthyBelow, unhealthyMetricValue: 50}
+
+	for _, data := range []struct {
+		value    float64
+		expected float64
+	}{{1, 1}, {0.99, 50}, {0, 50}, {3, 3}} {
+		if value := getHealthMetricValue(meta, data.value); value != data.expected {
+			t.Errorf("%v: expected %v but got %v", data.value, data.expected, value)
+		}
+	}
+
+	if value := getHealthMetricValue(&azureMonitorMetadata{}, 0); value != 0 {
+		t.Errorf("Expected the value to be left alone without unhealthyBelow but got %v", value)
+	}
+}
+
+func TestAzMonitorGetMetricValueUnhealthyBelow(t *testing.T) {
+	availability := 100.0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(newTestAzMonitorResponse([]insights.MetricValue{{Average: float64Ptr(availability)}}))
+	}))
+	defer server.Close()
+
+	unhealthyBelow := 99.5
+	meta := newTestAzMonitorSeededMetadata("unhealthy-below", server.URL)
+	meta.unhealthyBelow = &unhealthyBelow
+	meta.unhealthyMetricValue = 50
+	scaler := &azureMonitorScaler{metadata: meta, httpClient: server.Client()}
+
+	value, err := scaler.getMetricValue(context.Background())
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if value != 100 {
+		t.Errorf("Expected the availability to be reported while healthy but got %v", value)
+	}
+
+	availability = 97
+	value, err = scaler.getMetricValue(context.Background())
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if value != 50 {
+		t.Errorf("Expected the unhealthyMetricValue 50 to be reported once the availability dropped but got %v", value)
+	}
+}
+
+type testAzMonitorFailingTransport struct {
+	t *testing.T
+}
+
+func (f testAzMonitorFailingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	f.t.Errorf("Expected the metrics client of the scaler to be reused but a new client requested %s", r.URL)
+	return nil, fmt.Errorf("unexpected request")
+}
+
+func TestAzMonitorGetMetricsReusesMetricsClient(t *testing.T) {
+	sender := &testAzMonitorSender{responses: []testAzMonitorSenderResponse{
+		{statusCode: http.StatusOK, body: newTestAzMonitorResponse([]insights.MetricValue{{Average: float64Ptr(1)}})},
+		{statusCode: http.StatusOK, body: newTestAzMonitorResponse([]insights.MetricValue{{Average: float64Ptr(2)}})},
+		{statusCode: http.StatusOK, body: newTestAzMonitorResponse([]insights.MetricValue{{Average: float64Ptr(3)}})},
+	}}
+	client := newTestAzMonitorClient(sender)
+	// a client created on a poll would send through the failing transport instead of the sender of the scaler's client
+	scaler := &azureMonitorScaler{
+		metadata:      newTestAzMonitorSeededMetadata("reused-client", ""),
+		httpClient:    &http.Client{Transport: testAzMonitorFailingTransport{t: t}},
+		metricsClient: &client,
+	}
+
+	for i := 1; i <= 3; i++ {
+		metrics, err := scaler.GetMetrics(context.Background(), getAzureMonitorMetricName(scaler.metadata), nil)
+		if err != nil {
+			t.Fatal("Expected success but got error", err)
+		}
+		if value := metrics[0].Value.Value(); value != int64(i) {
+			t.Errorf("poll %d: expected value %d but got %d", i, i, value)
+		}
+	}
+	if len(sender.requests) != 3 {
+		t.Errorf("Expected the three polls to go through the client of the scaler but got %d requests", len(sender.requests))
+	}
+}
+
+func TestAzMonitorNewAzureMonitorScalerMetricsClient(t *testing.T) {
+	meta := newTestAzMonitorSeededMetadata("scaler-client", "")
+	if client := newAzureMonitorScalerMetricsClient(meta); client == nil {
+		t.Error("Expected the scaler to get a shared metrics client")
+	}
+
+	other := *meta
+	other.clientSecretFile = "/tmp/secret"
+	if client := newAzureMonitorScalerMetricsClient(&other); client != nil {
+		t.Error("Expected no reused client with a clientSecretFile that can be rotated")
+	}
+
+	if client := newAzureMonitorScalerMetricsClient(&azureMonitorMetadata{metricSource: appInsightsMetricSource}); client != nil {
+		t.Error("Expected no metrics client for app insights")
+	}
+}
+
+func TestAzMonitorNewAzureMonitorScalerSharesMetricsClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(newTestAzMonitorResponse([]insights.MetricValue{{Average: float64Ptr(4)}}))
+	}))
+	defer server.Close()
+
+	seedTestAzMonitorAuthorizer("shared-client-tenant", "shared-client-id", "shared-client-password", autorest.NullAuthorizer{})
+	metadata := map[string]string{"resourceURI": "Microsoft.Web/sites/mysite", "tenantId": "shared-client-tenant", "subscriptionId": "00000000-0000-0000-0000-000000000456", "resourceGroupName": "test", "metricName": "Requests", "metricAggregationType": "Average", "targetValue": "5", "endpointOverride": server.URL}
+	authParams := map[string]string{"activeDirectoryClientId": "shared-client-id", "activeDirectoryClientPassword": "shared-client-password"}
+
+	// KEDA creates the scaler again for every poll, the polls share the client of the first one
+	var client *insights.MetricsClient
+	for i := 0; i < 3; i++ {
+		scaler, err := NewAzureMonitorScaler("test", "default", map[string]string{}, metadata, authParams, "")
+		if err != nil {
+			t.Fatal("Expected success but got error", err)
+		}
+		monitorScaler := scaler.(*azureMonitorScaler)
+		if monitorScaler.metricsClient == nil || (client != nil && monitorScaler.metricsClient != client) {
+			t.Errorf("poll %d: expected the metrics client of the first scaler but got %p", i, monitorScaler.metricsClient)
+		}
+		client = monitorScaler.metricsClient
+
+		metrics, err := scaler.GetMetrics(context.Background(), getAzureMonitorMetricName(monitorScaler.metadata), nil)
+		if err != nil {
+			t.Fatal("Expected success but got error", err)
+		}
+		if value := metrics[0].Value.Value(); value != 4 {
+			t.Errorf("poll %d: expected value 4 but got %d", i, value)
+		}
+	}
+
+	// a rotated secret builds a new authorizer and so a new client
+	seedTestAzMonitorAuthorizer("shared-client-tenant", "shared-client-id", "rotated-password", autorest.NullAuthorizer{})
+	authParams["activeDirectoryClientPassword"] = "rotated-password"
+	scaler, err := NewAzureMonitorScaler("test", "default", map[string]string{}, metadata, authParams, "")
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if rotated := scaler.(*azureMonitorScaler).metricsClient; rotated == nil || rotated == client {
+		t.Errorf("Expected a new metrics client for the rotated secret but got %p", rotated)
+	}
+}
+
+func TestAzMonitorGetMetricsOtherMetricName(t *testing.T) {
+	sender := &testAzMonitorSender{responses: []testAzMonitorSenderResponse{
+		{statusCode: http.StatusOK, body: newTestAzMonitorResponse([]insights.MetricValue{{Average: float64Ptr(1)}})},
+	}}
+	client := newTestAzMonitorClient(sender)
+	scaler := &azureMonitorScaler{
+		metadata:      newTestAzMonitorSeededMetadata("other-metric", ""),
+		httpClient:    &http.Client{Transport: testAzMonitorFailingTransport{t: t}},
+		metricsClient: &client,
+	}
+
+	if _, err := scaler.GetMetrics(context.Background(), "azure-monitor-other-trigger", nil); err == nil {
+		t.Error("Expected an error for the metric of another trigger")
+	}
+	if len(sender.requests) != 0 {
+		t.Errorf("Expected no query for the metric of another trigger but got %d", len(sender.requests))
+	}
+
+	// the metrics adapter passes the metric name in lower case
+	if _, err := scaler.GetMetrics(context.Background(), strings.ToUpper(getAzureMonitorMetricName(scaler.metadata)), nil); err != nil {
+		t.Error("Expected the metric name to match regardless of its case but got error", err)
+	}
+}
+
+func TestAzMonitorNewQuantity(t *testing.T) {
+	testData := []struct {
+		value         float64
+		expectedMilli int64
+	}{
+		{1.5, 1500},
+		{-2.25, -2250},
+		{0.0004, 0},
+		{1e18, math.MaxInt64},
+		{math.Inf(1), math.MaxInt64},
+		{-1e18, math.MinInt64},
+		{math.NaN(), 0},
+	}
+	for _, data := range testData {
+		quantity := newAzureMonitorQuantity(data.value)
+		if milli := quantity.MilliValue(); milli != data.expectedMilli {
+			t.Errorf("%v: expected %d thousandths but got %d", data.value, data.expectedMilli, milli)
+		}
+	}
+}
+
+// testAzMonitorCredentialAuthorizer marks the requests with the credential set that authorized them
+type testAzMonitorCredentialAuthorizer struct {
+	credential string
+}
+
+func (a testAzMonitorCredentialAuthorizer) WithAuthorization() autorest.PrepareDecorator {
+	return autorest.WithHeader("X-Test-Credential", a.credential)
+}
+
+func seedTestAzMonitorAuthorizer(tenantID string, clientID string, clientPassword string, authorizer autorest.Authorizer) {
+	credential := getAzureMonitorCredentialFingerprint(&azureMonitorMetadata{clientPassword: clientPassword})
+	azureMonitorAuthorizers.lock.Lock()
+	defer azureMonitorAuthorizers.lock.Unlock()
+	azureMonitorAuthorizers.entries[azureMonitorAuthorizerKey{tenantID: tenantID, clientID: clientID, cloud: azure.PublicCloud.Name, resource: azure.PublicCloud.ResourceManagerEndpoint}] = azureMonitorAuthorizerEntry{authorizer: authorizer, credential: credential, lastUsed: time.Now()}
+}
+
+func TestAzMonitorQueryBackupCredentials(t *testing.T) {
+	var credentials []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		credentials = append(credentials, r.Header.Get("X-Test-Credential"))
+		w.Header().Set("Content-Type", "application/json")
+		if r.Header.Get("X-Test-Credential") != "backup" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]string{"code": "InvalidAuthenticationToken", "message": "the client secret expired"}})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(newTestAzMonitorResponse([]insights.MetricValue{{Average: float64Ptr(12)}}))
+	}))
+	defer server.Close()
+
+	meta := newTestAzMonitorSeededMetadata("backup-credentials", server.URL)
+	meta.backupClientID = "backup-credentials-backup-id"
+	meta.backupClientPassword = "backup-credentials-backup-password"
+	seedTestAzMonitorAuthorizer(meta.tenantID, meta.clientID, meta.clientPassword, testAzMonitorCredentialAuthorizer{credential: "primary"})
+	seedTestAzMonitorAuthorizer(meta.tenantID, meta.backupClientID, meta.backupClientPassword, testAzMonitorCredentialAuthorizer{credential: "backup"})
+	scaler := &azureMonitorScaler{metadata: meta, httpClient: server.Client()}
+
+	value, err := scaler.getMetricValue(context.Background())
+	if err != nil {
+		t.Fatal("Expected the backup credentials to succeed but got error", err)
+	}
+	if value != 12 {
+		t.Errorf("Expected value 12 but got %v", value)
+	}
+	if len(credentials) != 2 || credentials[0] != "primary" || credentials[1] != "backup" {
+		t.Errorf("Expected a single retry with the backup credentials after the primary ones failed but got %v", credentials)
+	}
+
+	// without backup credentials the rejection is returned
+	meta.backupClientID = ""
+	if _, err := scaler.getMetricValue(context.Background()); !isAzureMonitorAuthError(err) {
+		t.Errorf("Expected the auth failure of the primary credentials but got %v", err)
+	}
+}
+
+func TestAzMonitorQueryBackupCredentialsOnlyOnAuthErrors(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	meta := newTestAzMonitorSeededMetadata("backup-credentials-bad-request", server.URL)
+	meta.backupClientID = "backup-credentials-bad-request-backup-id"
+	meta.backupClientPassword = "backup-credentials-bad-request-backup-password"
+	seedTestAzMonitorAuthorizer(meta.tenantID, meta.backupClientID, meta.backupClientPassword, autorest.NullAuthorizer{})
+	scaler := &azureMonitorScaler{metadata: meta, httpClient: server.Client()}
+
+	if _, err := scaler.getMetricValue(context.Background()); err == nil {
+		t.Fatal("Expected the bad request to fail")
+	}
+	if requests != 1 {
+		t.Errorf("Expected no retry with the backup credentials for an error other than 401/403 but got %d requests", requests)
+	}
+}
+
+func TestAzMonitorSmoothingState(t *testing.T) {
+	state := &azureMonitorSmoothingState{}
+	// the first value starts the average, every later one is blended in as 0.5*x + 0.5*previous
+	for i, data := range []struct {
+		value    float64
+		expected float64
+	}{{10, 10}, {20, 15}, {20, 17.5}, {0, 8.75}, {8.75, 8.75}} {
+		if smoothed := state.smooth(data.value, 0.5); smoothed != data.expected {
+			t.Errorf("poll %d: expected %v but got %v", i, data.expected, smoothed)
+		}
+	}
+
+	// an alpha of 1 returns the raw value
+	state = &azureMonitorSmoothingState{}
+	for _, value := range []float64{3, 9, 1} {
+		if smoothed := state.smooth(value, 1); smoothed != value {
+			t.Errorf("Expected %v without smoothing but got %v", value, smoothed)
+		}
+	}
+}
+
+func TestAzMonitorGetMetricValueEMA(t *testing.T) {
+	var value int64 = 100
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(newTestAzMonitorResponse([]insights.MetricValue{{Average: float64Ptr(float64(atomic.LoadInt64(&value)))}}))
+	}))
+	defer server.Close()
+
+	meta := newTestAzMonitorSeededMetadata("ema", server.URL)
+	meta.emaAlpha = 0.25
+
+	expected := []float64{100, 75, 56.25}
+	for i := range expected {
+		// the scale loop builds a new scaler for every poll
+		scaler := &azureMonitorScaler{metadata: meta, httpClient: server.Client(), smoothing: getAzureMonitorSmoothingState(meta)}
+		smoothed, err := scaler.getMetricValue(context.Background())
+		if err != nil {
+			t.Fatal("Expected success but got error", err)
+		}
+		if smoothed != expected[i] {
+			t.Errorf("poll %d: expected %v but got %v", i, expected[i], smoothed)
+		}
+		atomic.StoreInt64(&value, 0)
+	}
+}
+
+// testAzMonitorConcurrentSender answers with the value of the resource named in the request path and records how many
+// requests were in flight at the same time
+type testAzMonitorConcurrentSender struct {
+	values      map[string]float64
+	inFlight    int32
+	maxInFlight int32
+}
+
+func (s *testAzMonitorConcurrentSender) Do(r *http.Request) (*http.Response, error) {
+	inFlight := atomic.AddInt32(&s.inFlight, 1)
+	defer atomic.AddInt32(&s.inFlight, -1)
+	for {
+		max := atomic.LoadInt32(&s.maxInFlight)
+		if inFlight <= max || atomic.CompareAndSwapInt32(&s.maxInFlight, max, inFlight) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	value := float64(0)
+	for name, resourceValue := range s.values {
+		if strings.Contains(r.URL.Path, "/"+name+"/") {
+			value = resourceValue
+		}
+	}
+	body, err := json.Marshal(newTestAzMonitorResponse([]insights.MetricValue{{Total: &value}}))
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": []string{"application/json"}}, Body: ioutil.NopCloser(bytes.NewReader(body)), Request: r}, nil
+}
+
+func TestAzMonitorExecuteResourceRequestsBoundedConcurrency(t *testing.T) {
+	sender := &testAzMonitorConcurrentSender{values: map[string]float64{"vm-0": 1, "vm-1": 2, "vm-2": 3, "vm-3": 4, "vm-4": 5}}
+	requests := []*azureExternalMetricRequest{}
+	for _, name := range []string{"vm-0", "vm-1", "vm-2", "vm-3", "vm-4"} {
+		request := newTestAzMonitorRequest()
+		request.Aggregation = insights.Total
+		request.ResourceName = name
+		requests = append(requests, &request)
+	}
+
+	values, err := executeResourceRequests(context.TODO(), insights.MetricsClient{BaseClient: insights.BaseClient{Client: autorest.Client{Sender: sender}, BaseURI: insights.DefaultBaseURI}}, requests, 2)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	for i, expected := range []float64{1, 2, 3, 4, 5} {
+		if values[i] != expected {
+			t.Errorf("Expected value %v for %s but got %v", expected, requests[i].ResourceName, values[i])
+		}
+	}
+	if max := atomic.LoadInt32(&sender.maxInFlight); max > 2 {
+		t.Errorf("Expected at most 2 requests in flight but got %d", max)
+	}
+}
+
+func TestAzMonitorGetAzureMetricValueResourceNames(t *testing.T) {
+	sender := &testAzMonitorConcurrentSender{values: map[string]float64{"vm-0": 1, "vm-1": 2, "vm-2": 3}}
+	metadata := &azureMonitorMetadata{
+		resourceURI:       "Microsoft.Compute/virtualMachines",
+		resourceNames:     []string{"vm-0", "vm-1", "vm-2"},
+		combine:           defaultAzureMonitorResourceCombineMode,
+		subscriptionID:    "456",
+		resourceGroupName: "test",
+		name:              "metric",
+		aggregationType:   insights.Total,
+		tenantID:          "resource-names-tenant",
+		clientID:          "resource-names-id",
+		clientPassword:    "resource-names-password",
+	}
+	// the test sender does not need a token
+	seedTestAzMonitorAuthorizer("resource-names-tenant", "resource-names-id", "resource-names-password", autorest.NullAuthorizer{})
+
+	value, err := getAzureMetricValue(context.TODO(), metadata, sender)
+	if err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if value != 6 {
+		t.Errorf("Expected the values of the three resources to be summed to 6 but got %v", value)
+	}
+}
+
+func TestAzMonitorExecuteRequestNegativeValue(t *testing.T) {
+	sender := &testAzMonitorSender{responses: []testAzMonitorSenderResponse{
+		{statusCode: http.StatusOK, body: newTestAzMonitorResponse([]insights.MetricValue{{Average: float64Ptr(-5)}})},
+	}}
+	request := newTestAzMonitorRequest()
+
+	value, err := executeRequest(context.TODO(), newTestAzMonitorClient(sender), &request)
+	if err != nil {
+		t.Fatal("Expected a negative value to be returned without error but got", err)
+	}
+	if value != -5 {
+		t.Errorf("Expected -5 but got %v", value)
+	}
+
+	sender = &testAzMonitorSender{responses: []testAzMonitorSenderResponse{{statusCode: http.StatusBadRequest, body: map[string]interface{}{}}}}
+	value, err = executeRequest(context.TODO(), newTestAzMonitorClient(sender), &request)
+	if err == nil {
+		t.Fatal("Expected error but got success")
+	}
+	if value != 0 {
+		t.Errorf("Expected 0 alongside the error instead of a sentinel value but got %v", value)
+	}
+}
+
+func TestAzMonitorMetricDefinitionCacheTTL(t *testing.T) {
+	cache := newAzureMonitorMetricDefinitionCache(50 * time.Millisecond)
+	lister := &testAzMonitorDefinitionsLister{definitions: []insights.MetricDefinition{newTestAzMonitorDefinition("IncomingMessages")}}
+
+	for i := 0; i < 3; i++ {
+		definitions, err := cache.get(context.TODO(), lister, "/test/resource/uri", "")
+		if err != nil {
+			t.Fatal("Expected success but got error", err)
+		}
+		if len(definitions) != 1 {
+			t.Fatalf("Expected the listed definition but got %d definitions", len(definitions))
+		}
+	}
+	if lister.calls != 1 {
+		t.Errorf("Expected the definitions to be listed once within the ttl but got %d calls", lister.calls)
+	}
+
+	// another metric namespace of the same resource has its own entry
+	if _, err := cache.get(context.TODO(), lister, "/test/resource/uri", "custom"); err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if lister.calls != 2 {
+		t.Errorf("Expected another metric namespace to be listed separately but got %d calls", lister.calls)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, err := cache.get(context.TODO(), lister, "/test/resource/uri", ""); err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if lister.calls != 3 {
+		t.Errorf("Expected the definitions to be listed again after the ttl but got %d calls", lister.calls)
+	}
+}
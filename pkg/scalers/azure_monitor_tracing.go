@@ -0,0 +1,61 @@
+package scalers
+
+import (
+	"context"
+	"net/http"
+
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/trace"
+)
+
+// azureMonitorQuerySpanName names the span around each Azure Monitor and App Insights metric query. The spans go to
+// the OpenCensus exporters the process registers, without one they are dropped.
+const azureMonitorQuerySpanName = "azure_monitor.query"
+
+// the attributes of the query span, the resource is the resource ID or the App Insights application and holds no secrets
+const (
+	azureMonitorSpanMetricName  = "azure_monitor.metric_name"
+	azureMonitorSpanResource    = "azure_monitor.resource"
+	azureMonitorSpanAggregation = "azure_monitor.aggregation"
+	azureMonitorSpanRetries     = "azure_monitor.retries"
+)
+
+// startAzureMonitorQuerySpan starts the span of a query with the metric, resource and aggregation it asks for
+func startAzureMonitorQuerySpan(ctx context.Context, resource string, request azureExternalMetricRequest) (context.Context, *trace.Span) {
+	ctx, span := trace.StartSpan(ctx, azureMonitorQuerySpanName)
+	span.AddAttributes(
+		trace.StringAttribute(azureMonitorSpanMetricName, request.MetricName),
+		trace.StringAttribute(azureMonitorSpanResource, resource),
+		trace.StringAttribute(azureMonitorSpanAggregation, string(request.Aggregation)),
+	)
+	return ctx, span
+}
+
+// endAzureMonitorQuerySpan records the error the query failed with on its span and ends it
+func endAzureMonitorQuerySpan(span *trace.Span, err error) {
+	if err != nil {
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+	}
+	span.End()
+}
+
+// addAzureMonitorRetriesAttribute records how often the call of the query span in ctx was retried
+func addAzureMonitorRetriesAttribute(ctx context.Context, retries int) {
+	trace.FromContext(ctx).AddAttributes(trace.Int64Attribute(azureMonitorSpanRetries, int64(retries)))
+}
+
+// azureMonitorTransport traces every request as a child of the query span and keeps the connection pool of the
+// client closable, which ochttp.Transport does not pass on
+type azureMonitorTransport struct {
+	ochttp.Transport
+	pool *http.Transport
+}
+
+func newAzureMonitorTransport(pool *http.Transport) *azureMonitorTransport {
+	return &azureMonitorTransport{Transport: ochttp.Transport{Base: pool}, pool: pool}
+}
+
+// CloseIdleConnections closes the idle connections of the pool, it is called by http.Client.CloseIdleConnections
+func (t *azureMonitorTransport) CloseIdleConnections() {
+	t.pool.CloseIdleConnections()
+}
@@ -0,0 +1,75 @@
+package scalers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2018-03-01/insights"
+	"github.com/Azure/go-autorest/autorest"
+	"go.opencensus.io/trace"
+)
+
+// testAzMonitorSpanExporter keeps the spans it is given in memory
+type testAzMonitorSpanExporter struct {
+	lock  sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (e *testAzMonitorSpanExporter) ExportSpan(span *trace.SpanData) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if span.Name == azureMonitorQuerySpanName {
+		e.spans = append(e.spans, span)
+	}
+}
+
+func TestAzMonitorQuerySpan(t *testing.T) {
+	exporter := &testAzMonitorSpanExporter{}
+	trace.RegisterExporter(exporter)
+	defer trace.UnregisterExporter(exporter)
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
+	defer trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(1e-4)})
+	azureMonitorRetryBaseDelay = time.Millisecond
+	defer func() { azureMonitorRetryBaseDelay = time.Second }()
+
+	request := newTestAzMonitorRequest()
+	request.MaxRetries = 2
+	lister := &fakeMetricsLister{results: []fakeMetricsListerResult{
+		{err: autorest.DetailedError{StatusCode: http.StatusServiceUnavailable, Original: fmt.Errorf("unavailable")}},
+		{response: newTestAzMonitorResponse([]insights.MetricValue{{Average: float64Ptr(7)}})},
+		{err: fmt.Errorf("connection reset")},
+	}}
+	if _, err := getAzureMetric(context.Background(), lister, request); err != nil {
+		t.Fatal("Expected success but got error", err)
+	}
+	if _, err := getAzureMetric(context.Background(), lister, request); err == nil {
+		t.Fatal("Expected the second query to fail")
+	}
+
+	if len(exporter.spans) != 2 {
+		t.Fatalf("Expected a span per query but got %d", len(exporter.spans))
+	}
+	for i, expectedRetries := range []int64{1, 0} {
+		span := exporter.spans[i]
+		for key, expected := range map[string]interface{}{
+			azureMonitorSpanMetricName:  "metric",
+			azureMonitorSpanResource:    request.metricResourceURI(),
+			azureMonitorSpanAggregation: "Average",
+			azureMonitorSpanRetries:     expectedRetries,
+		} {
+			if value := span.Attributes[key]; value != expected {
+				t.Errorf("span %d: expected attribute %s to be %v but got %v", i, key, expected, value)
+			}
+		}
+	}
+	if code := exporter.spans[0].Status.Code; code != trace.StatusCodeOK {
+		t.Errorf("Expected the successful query to have an OK status but got %d", code)
+	}
+	if status := exporter.spans[1].Status; status.Code != trace.StatusCodeUnknown || status.Message != "connection reset" {
+		t.Errorf("Expected the error on the span of the failed query but got %+v", status)
+	}
+}
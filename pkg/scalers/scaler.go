@@ -2,7 +2,9 @@ package scalers
 
 import (
 	"context"
+	"time"
 
+	"github.com/go-logr/logr"
 	v2beta1 "k8s.io/api/autoscaling/v2beta1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/metrics/pkg/apis/external_metrics"
@@ -22,3 +24,26 @@ type Scaler interface {
 	// Close any resources that need disposing when scaler is no longer used or destroyed
 	Close() error
 }
+
+// PollingIntervalRecommender is implemented by scalers whose data source only updates at a known granularity
+type PollingIntervalRecommender interface {
+	// MinRecommendedInterval is the shortest polling interval at which the scaler can see new data
+	MinRecommendedInterval() time.Duration
+}
+
+// CheckPollingInterval logs a warning and returns false when the scaler is polled more often than its data source updates
+func CheckPollingInterval(logger logr.Logger, scaler Scaler, pollingInterval time.Duration) bool {
+	recommender, ok := scaler.(PollingIntervalRecommender)
+	if !ok {
+		return true
+	}
+
+	minInterval := recommender.MinRecommendedInterval()
+	if pollingInterval >= minInterval {
+		return true
+	}
+
+	logger.Info("pollingInterval is shorter than the interval the trigger's data is updated at, polls in between return the same value",
+		"pollingInterval", pollingInterval.String(), "minRecommendedInterval", minInterval.String())
+	return false
+}